@@ -0,0 +1,344 @@
+package ai_provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	error_types "maas/error-types"
+	meme_maker "maas/meme-maker"
+	meme_service "maas/meme-service"
+	"maas/models"
+)
+
+/*
+  The Memes AI provider. Sends the query, the place it came from and the templates to pick from
+  to an OpenAI compatible chat/completions endpoint, and asks for a template and captions back as
+  JSON. The meme maker it wraps still does the geocoding and rendering, so AI memes look like
+  every other meme.
+
+  Models don't always do as they're told, so the answer is checked before it is used: captions
+  are cleaned up and cut to length, a template that doesn't exist is swapped for the best tag
+  match, and anything that can't be read at all is a ProviderError.
+*/
+
+const (
+	DefaultBaseURL = "https://api.openai.com/v1"
+	DefaultModel   = "gpt-4o-mini"
+	DefaultTimeout = 30 * time.Second
+	// Longest caption kept from the model, in characters
+	MaxCaptionLength = 100
+
+	chatCompletionsPath = "/chat/completions"
+	maxErrorLength      = 200
+)
+
+// Everything the prompt template has to work with
+type PromptData struct {
+	Query string
+	// Nil when the request had no coordinates or nothing is near them
+	Place *models.Place
+	// The templates the model may choose from. Just the one when the request named a template
+	Templates []models.Template
+	// The language to write the captions in, as a language tag. Empty means English
+	Lang string
+}
+
+const DefaultPrompt = `Write a funny meme about "{{.Query}}".
+{{- with .Place}}
+The person asking is in {{.City}}, {{.Region}}, {{.Country}}{{with .Feature}}, near {{.}}{{end}}.
+{{- end}}
+{{- if .Templates}}
+Pick the template that suits the joke best:
+{{- range .Templates}}
+- {{.ID}}: {{.Name}} ({{join .Tags ", "}})
+{{- end}}
+{{- end}}
+{{- with .Lang}}
+Write both captions in the language with the tag "{{.}}".
+{{- end}}
+Keep each caption under 80 characters and keep it safe for work.
+Answer with only a JSON object: {"template": "<template id>", "top_text": "<top caption>", "bottom_text": "<bottom caption>"}`
+
+var promptFuncs = template.FuncMap{"join": strings.Join}
+
+var _ meme_service.MemeProvider = &AIProvider{}
+var _ meme_service.NamedProvider = &AIProvider{}
+
+type AIProvider struct {
+	BaseURL string
+	APIKey  string
+	Model   string
+	Prompt  *template.Template
+	// Does the geocoding, template lookups and rendering
+	Maker *meme_maker.MemeMaker
+
+	Client *http.Client
+}
+
+// What the model is asked to answer with
+type Suggestion struct {
+	Template   string `json:"template"`
+	TopText    string `json:"top_text"`
+	BottomText string `json:"bottom_text"`
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatRequest struct {
+	Model       string        `json:"model"`
+	Messages    []chatMessage `json:"messages"`
+	Temperature float64       `json:"temperature"`
+}
+
+type chatResponse struct {
+	Choices []struct {
+		Message chatMessage `json:"message"`
+	} `json:"choices"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func NewAIProvider(baseURL string, apiKey string, maker *meme_maker.MemeMaker) *AIProvider {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return &AIProvider{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		APIKey:  apiKey,
+		Model:   DefaultModel,
+		Prompt:  template.Must(ParsePrompt(DefaultPrompt)),
+		Maker:   maker,
+		Client:  &http.Client{Timeout: DefaultTimeout},
+	}
+}
+
+// Parses a prompt template. Prompts are text/templates over PromptData and can use join
+func ParsePrompt(text string) (*template.Template, error) {
+	return template.New("prompt").Funcs(promptFuncs).Parse(text)
+}
+
+func LoadPrompt(path string) (*template.Template, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrompt(string(text))
+}
+
+func (p *AIProvider) WithModel(model string) *AIProvider {
+	p.Model = model
+	return p
+}
+
+func (p *AIProvider) WithPrompt(prompt *template.Template) *AIProvider {
+	p.Prompt = prompt
+	return p
+}
+
+func (p *AIProvider) WithTimeout(timeout time.Duration) *AIProvider {
+	p.Client.Timeout = timeout
+	return p
+}
+
+func (p *AIProvider) Name() string {
+	return "ai"
+}
+
+func (p *AIProvider) BuildMeme(params *meme_service.QueryParams) (*models.Meme, error) {
+	meme := p.Maker.NewLocalizedMeme(params.Lang)
+	if params.Query != "" {
+		meme = meme.WithTopText(params.Query)
+	}
+	if params.Lat != 0 && params.Lon != 0 {
+		meme = meme.WithImageLocation(fmt.Sprintf("%.6f x %.6f", params.Lat, params.Lon))
+		place, err := p.Maker.Place(params)
+		if err != nil {
+			return nil, err
+		}
+		meme = meme.WithPlace(place)
+	}
+	candidates, err := p.candidates(params)
+	if err != nil {
+		return nil, err
+	}
+
+	prompt, err := p.prompt(&PromptData{Query: params.Query, Place: meme.Place, Templates: candidates, Lang: params.Lang})
+	if err != nil {
+		return nil, err
+	}
+	content, err := p.complete(prompt)
+	if err != nil {
+		return nil, err
+	}
+	suggestion, err := p.parseSuggestion(content)
+	if err != nil {
+		return nil, err
+	}
+
+	// The model picks the template and writes the captions in one go, but they're reported in the
+	// order every provider uses
+	template := p.chooseTemplate(suggestion.Template, params, candidates)
+	if template != nil {
+		meme = meme.WithTemplateId(template.ID)
+	}
+	params.Report(meme_service.StageTemplateSelected, meme)
+	if suggestion.TopText != "" {
+		meme = meme.WithTopText(suggestion.TopText)
+	}
+	meme = meme.WithBottomText(suggestion.BottomText)
+	params.Report(meme_service.StageCaptionGenerated, meme)
+	if p.Maker.Renderer != nil {
+		meme, err = p.Maker.Render(meme, template)
+		if err != nil {
+			return nil, err
+		}
+		params.Report(meme_service.StageRendered, meme)
+	}
+	return meme, nil
+}
+
+// The templates the model can choose from: the requested one, otherwise all of them
+func (p *AIProvider) candidates(params *meme_service.QueryParams) ([]models.Template, error) {
+	if params.Template != "" {
+		if p.Maker.Templates == nil {
+			return nil, &error_types.TemplateNotFoundError{ID: params.Template}
+		}
+		template, err := p.Maker.Templates.Template(params.Template)
+		if err != nil {
+			return nil, err
+		}
+		return []models.Template{*template}, nil
+	}
+	if p.Maker.Templates == nil {
+		return []models.Template{}, nil
+	}
+	return p.Maker.Templates.AllTemplates(), nil
+}
+
+// The model's pick when it is one of the candidates, otherwise the best tag match for the query
+func (p *AIProvider) chooseTemplate(id string, params *meme_service.QueryParams, candidates []models.Template) *models.Template {
+	for i := range candidates {
+		if candidates[i].ID == strings.TrimSpace(id) {
+			return &candidates[i]
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return meme_maker.SelectTemplate(params.Query, candidates, p.Maker.SynonymsFor(params.Lang))
+}
+
+func (p *AIProvider) prompt(data *PromptData) (string, error) {
+	var prompt bytes.Buffer
+	if err := p.Prompt.Execute(&prompt, data); err != nil {
+		return "", err
+	}
+	return prompt.String(), nil
+}
+
+// Sends the prompt and returns the content of the first choice
+func (p *AIProvider) complete(prompt string) (string, error) {
+	body, err := json.Marshal(&chatRequest{
+		Model:       p.Model,
+		Messages:    []chatMessage{{Role: "user", Content: prompt}},
+		Temperature: 0.9,
+	})
+	if err != nil {
+		return "", err
+	}
+	request, err := http.NewRequest(http.MethodPost, p.BaseURL+chatCompletionsPath, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if p.APIKey != "" {
+		request.Header.Set("Authorization", "Bearer "+p.APIKey)
+	}
+
+	response, err := p.Client.Do(request)
+	if err != nil {
+		return "", p.providerError(err.Error())
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return "", p.providerError(err.Error())
+	}
+
+	var result chatResponse
+	jsonErr := json.Unmarshal(responseBody, &result)
+	if response.StatusCode != http.StatusOK {
+		if jsonErr == nil && result.Error != nil {
+			return "", p.providerError(fmt.Sprintf("returned %d: %s", response.StatusCode, truncate(result.Error.Message)))
+		}
+		return "", p.providerError(fmt.Sprintf("returned %d: %s", response.StatusCode, truncate(string(responseBody))))
+	}
+	if jsonErr != nil {
+		return "", p.providerError(fmt.Sprintf("returned an unreadable response: %s", jsonErr))
+	}
+	if len(result.Choices) == 0 {
+		return "", p.providerError("returned no choices")
+	}
+	return result.Choices[0].Message.Content, nil
+}
+
+// Pulls the JSON object out of the model's answer, which may be wrapped in a code fence or
+// chatter, and cleans up its captions
+func (p *AIProvider) parseSuggestion(content string) (*Suggestion, error) {
+	start, end := strings.Index(content, "{"), strings.LastIndex(content, "}")
+	if start < 0 || end < start {
+		return nil, p.providerError("answered without a JSON object")
+	}
+	var suggestion Suggestion
+	if err := json.Unmarshal([]byte(content[start:end+1]), &suggestion); err != nil {
+		return nil, p.providerError(fmt.Sprintf("answered with unreadable JSON: %s", err))
+	}
+	suggestion.TopText = cleanCaption(suggestion.TopText)
+	suggestion.BottomText = cleanCaption(suggestion.BottomText)
+	if suggestion.BottomText == "" {
+		return nil, p.providerError("answered without a bottom caption")
+	}
+	return &suggestion, nil
+}
+
+// Drops control characters, collapses whitespace and cuts the caption to MaxCaptionLength
+func cleanCaption(caption string) string {
+	caption = strings.Map(func(char rune) rune {
+		if unicode.IsSpace(char) {
+			return ' '
+		}
+		if unicode.IsControl(char) || unicode.Is(unicode.Cf, char) {
+			return -1
+		}
+		return char
+	}, caption)
+	caption = strings.Join(strings.Fields(caption), " ")
+	if chars := []rune(caption); len(chars) > MaxCaptionLength {
+		caption = strings.TrimSpace(string(chars[:MaxCaptionLength]))
+	}
+	return caption
+}
+
+func (p *AIProvider) providerError(message string) error {
+	return &error_types.ProviderError{Provider: p.Name(), Message: message}
+}
+
+func truncate(message string) string {
+	message = strings.TrimSpace(message)
+	if len(message) > maxErrorLength {
+		return message[:maxErrorLength] + "..."
+	}
+	return message
+}
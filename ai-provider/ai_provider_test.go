@@ -0,0 +1,297 @@
+package ai_provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	error_types "maas/error-types"
+	meme_maker "maas/meme-maker"
+	meme_renderer "maas/meme-renderer"
+	meme_service "maas/meme-service"
+	"maas/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A stand-in for an OpenAI compatible server. Answers every request with content, and remembers
+// the last request it was sent
+type fakeCompletions struct {
+	mutex   sync.Mutex
+	request *chatRequest
+	auth    string
+	status  int
+	body    string
+	content string
+	delay   time.Duration
+}
+
+func (f *fakeCompletions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, chatCompletionsPath) || r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	request := &chatRequest{}
+	json.NewDecoder(r.Body).Decode(request)
+	f.mutex.Lock()
+	f.request, f.auth = request, r.Header.Get("Authorization")
+	status, body, content, delay := f.status, f.body, f.content, f.delay
+	f.mutex.Unlock()
+
+	time.Sleep(delay)
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if body != "" {
+		io.WriteString(w, body)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": content}}},
+	})
+}
+
+func (f *fakeCompletions) lastRequest() (*chatRequest, string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.request, f.auth
+}
+
+func (f *fakeCompletions) prompt() string {
+	request, _ := f.lastRequest()
+	return request.Messages[0].Content
+}
+
+type MockTemplateRepository struct {
+	templates []models.Template
+}
+
+func (m *MockTemplateRepository) AllTemplates() []models.Template {
+	return m.templates
+}
+
+func (m *MockTemplateRepository) Template(id string) (*models.Template, error) {
+	for _, template := range m.templates {
+		if template.ID == id {
+			return &template, nil
+		}
+	}
+	return nil, &error_types.TemplateNotFoundError{ID: id}
+}
+
+var fixtureTemplates = &MockTemplateRepository{templates: []models.Template{
+	{
+		ID:        "lunch",
+		Name:      "Lunch",
+		Tags:      []string{"food", "lunch"},
+		TopBox:    models.CaptionBox{X: 0, Y: 0, Width: 300, Height: 40},
+		BottomBox: models.CaptionBox{X: 0, Y: 60, Width: 300, Height: 40},
+		Image:     meme_renderer.Canvas(300, 100, meme_renderer.DefaultBackground),
+	},
+	{
+		ID:        "office",
+		Name:      "Office",
+		Tags:      []string{"work", "boss"},
+		TopBox:    models.CaptionBox{X: 0, Y: 0, Width: 200, Height: 40},
+		BottomBox: models.CaptionBox{X: 0, Y: 60, Width: 200, Height: 40},
+		Image:     meme_renderer.Canvas(200, 100, meme_renderer.DefaultBackground),
+	},
+}}
+
+type MockGeocoder struct{}
+
+func (m *MockGeocoder) ReverseGeocode(lat float64, lon float64) (*models.Place, error) {
+	return &models.Place{City: "Testville", Region: "Testshire", Country: "Exampleland"}, nil
+}
+
+func testProvider(fake *fakeCompletions) (*AIProvider, func()) {
+	server := httptest.NewServer(fake)
+	maker := meme_maker.NewMemeMaker().WithTemplates(fixtureTemplates).WithGeocoder(&MockGeocoder{})
+	return NewAIProvider(server.URL+"/v1/", "test-key", maker), server.Close
+}
+
+func TestBuildMeme_WhenModelAnswers_UsesItsTemplateAndCaptions(t *testing.T) {
+	fake := &fakeCompletions{content: `{"template": "office", "top_text": "when the boss", "bottom_text": "asks for a meme"}`}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	maker := meme_maker.NewMemeMaker().WithTemplates(fixtureTemplates).WithGeocoder(&MockGeocoder{})
+	provider := NewAIProvider(server.URL, "test-key", maker).WithModel("local-model")
+
+	meme, err := provider.BuildMeme(&meme_service.QueryParams{Query: "work"})
+	assert.Nil(t, err)
+	assert.Equal(t, "when the boss", meme.TopText)
+	assert.Equal(t, "asks for a meme", meme.BottomText)
+	assert.Equal(t, "office", meme.TemplateId)
+
+	request, auth := fake.lastRequest()
+	assert.Equal(t, "Bearer test-key", auth)
+	assert.Equal(t, "local-model", request.Model)
+	assert.Contains(t, request.Messages[0].Content, `"work"`)
+	assert.Contains(t, request.Messages[0].Content, "- lunch: Lunch (food, lunch)")
+	assert.Contains(t, request.Messages[0].Content, "- office: Office (work, boss)")
+}
+
+func TestBuildMeme_WhenCoordinatesAreGiven_PutsPlaceInPrompt(t *testing.T) {
+	fake := &fakeCompletions{content: `{"template": "lunch", "top_text": "a", "bottom_text": "b"}`}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	meme, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food", Lat: 1, Lon: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, "Testville", meme.Place.City)
+	assert.Equal(t, "1.000000 x 1.000000", meme.ImageLocation)
+	assert.Contains(t, fake.prompt(), "Testville, Testshire, Exampleland")
+}
+
+func TestBuildMeme_WhenTemplateIsRequested_OnlyOffersThatTemplate(t *testing.T) {
+	fake := &fakeCompletions{content: `{"template": "office", "top_text": "a", "bottom_text": "b"}`}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	meme, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food", Template: "lunch"})
+	assert.Nil(t, err)
+	assert.Equal(t, "lunch", meme.TemplateId)
+	assert.NotContains(t, fake.prompt(), "office")
+}
+
+func TestBuildMeme_WhenTemplateIsUnknown_RaisesTemplateNotFoundWithoutCallingModel(t *testing.T) {
+	fake := &fakeCompletions{}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Template: "missing"})
+	assert.IsType(t, &error_types.TemplateNotFoundError{}, err)
+	request, _ := fake.lastRequest()
+	assert.Nil(t, request)
+}
+
+func TestBuildMeme_WhenModelMakesUpATemplate_FallsBackToBestMatch(t *testing.T) {
+	fake := &fakeCompletions{content: `{"template": "galaxy-brain", "top_text": "a", "bottom_text": "b"}`}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	meme, err := provider.BuildMeme(&meme_service.QueryParams{Query: "boss"})
+	assert.Nil(t, err)
+	assert.Equal(t, "office", meme.TemplateId)
+}
+
+func TestBuildMeme_WhenAnswerIsWrappedInChatter_StillReadsIt(t *testing.T) {
+	fake := &fakeCompletions{content: "Sure! Here you go:\n```json\n{\"template\": \"lunch\", \"top_text\": \"a\", \"bottom_text\": \"b\"}\n```"}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	meme, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.Nil(t, err)
+	assert.Equal(t, "b", meme.BottomText)
+}
+
+func TestBuildMeme_WhenCaptionsAreMessy_CleansThemUp(t *testing.T) {
+	long := strings.Repeat("ha", MaxCaptionLength)
+	fake := &fakeCompletions{content: `{"template": "lunch", "top_text": "", "bottom_text": "  too\n\tmuch\u0007 ` + long + `"}`}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	meme, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.Nil(t, err)
+	assert.Equal(t, "food", meme.TopText)
+	assert.True(t, strings.HasPrefix(meme.BottomText, "too much ha"))
+	assert.Equal(t, MaxCaptionLength, len([]rune(meme.BottomText)))
+}
+
+func TestBuildMeme_WhenAnswerIsNotJSON_RaisesProviderError(t *testing.T) {
+	fake := &fakeCompletions{content: "I'd rather not."}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.IsType(t, &error_types.ProviderError{}, err)
+}
+
+func TestBuildMeme_WhenAnswerHasWrongTypes_RaisesProviderError(t *testing.T) {
+	fake := &fakeCompletions{content: `{"template": 7, "top_text": ["a"], "bottom_text": {}}`}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.IsType(t, &error_types.ProviderError{}, err)
+}
+
+func TestBuildMeme_WhenBottomTextIsMissing_RaisesProviderError(t *testing.T) {
+	fake := &fakeCompletions{content: `{"template": "lunch", "top_text": "a", "bottom_text": "  "}`}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.IsType(t, &error_types.ProviderError{}, err)
+}
+
+func TestBuildMeme_WhenServerReturnsAnError_RaisesProviderError(t *testing.T) {
+	fake := &fakeCompletions{status: http.StatusUnauthorized, body: `{"error": {"message": "Incorrect API key provided"}}`}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.IsType(t, &error_types.ProviderError{}, err)
+	assert.Contains(t, err.Error(), "Incorrect API key provided")
+}
+
+func TestBuildMeme_WhenThereAreNoChoices_RaisesProviderError(t *testing.T) {
+	fake := &fakeCompletions{body: `{"choices": []}`}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.IsType(t, &error_types.ProviderError{}, err)
+}
+
+func TestBuildMeme_WhenServerIsSlow_TimesOut(t *testing.T) {
+	fake := &fakeCompletions{content: `{"template": "lunch", "top_text": "a", "bottom_text": "b"}`, delay: 200 * time.Millisecond}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+	provider.WithTimeout(20 * time.Millisecond)
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.IsType(t, &error_types.ProviderError{}, err)
+}
+
+func TestBuildMeme_WithCustomPrompt_SendsIt(t *testing.T) {
+	fake := &fakeCompletions{content: `{"template": "lunch", "top_text": "a", "bottom_text": "b"}`}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+	prompt, err := ParsePrompt(`Make a meme about {{.Query}} using one of {{len .Templates}} templates`)
+	assert.Nil(t, err)
+	provider.WithPrompt(prompt)
+
+	_, err = provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.Nil(t, err)
+	assert.Equal(t, "Make a meme about food using one of 2 templates", fake.prompt())
+}
+
+func TestBuildMeme_WithRenderer_RendersOnChosenTemplate(t *testing.T) {
+	fake := &fakeCompletions{content: `{"template": "office", "top_text": "a", "bottom_text": "b"}`}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+	renderer, err := meme_renderer.NewRenderer()
+	assert.Nil(t, err)
+	provider.Maker.WithRenderer(renderer)
+
+	meme, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.Nil(t, err)
+	img, err := png.Decode(bytes.NewReader(meme.Image))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, img.Bounds().Dx())
+}
+
+func TestParsePrompt_WhenTemplateIsBroken_ReturnsError(t *testing.T) {
+	_, err := ParsePrompt("{{.Query")
+	assert.NotNil(t, err)
+}
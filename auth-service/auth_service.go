@@ -1,6 +1,7 @@
 package auth_service
 
 import (
+	"crypto/subtle"
 	error_types "maas/error-types"
 	"maas/models"
 )
@@ -11,6 +12,9 @@ type AuthRepository interface {
 
 type AuthService struct {
 	Repo AuthRepository
+	// Optional. The keys other services call us with, by the name of the service. They aren't users,
+	// so they only work on the endpoints that ask for a service
+	ServiceKeys map[string]string
 }
 
 func NewAuthService(repo AuthRepository) *AuthService {
@@ -19,6 +23,26 @@ func NewAuthService(repo AuthRepository) *AuthService {
 	}
 }
 
+func (s *AuthService) WithServiceKeys(keys map[string]string) *AuthService {
+	s.ServiceKeys = keys
+	return s
+}
+
+// The name of the service auth belongs to. Every key is compared in constant time, so the
+// comparison doesn't give away how much of a key was right
+func (s AuthService) Service(auth string) (string, bool) {
+	if auth == "" {
+		return "", false
+	}
+	found := ""
+	for name, key := range s.ServiceKeys {
+		if subtle.ConstantTimeCompare([]byte(auth), []byte(key)) == 1 {
+			found = name
+		}
+	}
+	return found, found != ""
+}
+
 func (s AuthService) IsAdmin(auth string) (bool, error) {
 	if auth == "" {
 		return false, &error_types.NoAuthHeaderError{}
@@ -142,3 +142,18 @@ func TestIsAuthenticated_WhenAuthHeaderIsEmpty_ReturnsFalseUserNotFoundError(t *
 	assert.ErrorIs(t, err, &error_types.NoAuthHeaderError{})
 	assert.False(t, result)
 }
+
+func TestService_WhenKeyBelongsToAService_ReturnsItsName(t *testing.T) {
+	service := *NewAuthService(&MockUserRepository{}).WithServiceKeys(map[string]string{"purchasing": "PURCHASING-KEY"})
+	name, ok := service.Service("PURCHASING-KEY")
+	assert.True(t, ok)
+	assert.Equal(t, "purchasing", name)
+}
+
+func TestService_WhenKeyIsAUsersOrUnknown_ReturnsFalse(t *testing.T) {
+	service := *NewAuthService(&MockUserRepository{}).WithServiceKeys(map[string]string{"purchasing": "PURCHASING-KEY"})
+	for _, auth := range []string{"ADMIN", "PURCHASING", ""} {
+		_, ok := service.Service(auth)
+		assert.False(t, ok, auth)
+	}
+}
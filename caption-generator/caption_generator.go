@@ -0,0 +1,286 @@
+package caption_generator
+
+import (
+	"bufio"
+	"embed"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"math/rand"
+	"strings"
+	"unicode"
+
+	meme_maker "maas/meme-maker"
+)
+
+/*
+  Writes bottom text with a word level Markov chain trained on a corpus of meme captions. Each
+  word is picked based on the two words before it. Captions from the corpus that mention the
+  query, the template's tags or the place are used as starting points, so a lunch meme tends to
+  get a food punchline.
+
+  Captions are deterministic for a given seed and context: the same request always gets the same
+  bottom text, which keeps renders reproducible. A different seed gives different captions.
+
+  LocalizedGenerator keeps a chain per language, each trained on its own corpus
+  (captions.<lang>.txt), and writes in the language the request asked for.
+*/
+
+const (
+	corpusFile   = "captions.txt"
+	placeToken   = "{place}"
+	defaultPlace = "here"
+	defaultLang  = "en"
+	endOfCaption = ""
+
+	MaxWords = 14
+	MinWords = 3
+	// How many times to regenerate a caption that comes out shorter than MinWords
+	attempts = 10
+)
+
+//go:embed corpus
+var corpus embed.FS
+
+var _ meme_maker.CaptionGenerator = &MarkovGenerator{}
+var _ meme_maker.CaptionGenerator = &LocalizedGenerator{}
+
+// What "here" is in each bundled language, for captions about a place that isn't known
+var defaultPlaces = map[string]string{
+	"de": "hier",
+	"es": "aquí",
+	"fr": "ici",
+	"pt": "aqui",
+}
+
+// The two words before the next one. Empty strings stand in for the start of a caption
+type state [2]string
+
+type MarkovGenerator struct {
+	// Every word seen after a state, repeats included so common words are picked more often
+	chain map[state][]string
+	// Each corpus caption split into words, used to find starting points
+	captions [][]string
+
+	Seed int64
+	// Stands in for the place when it isn't known. Empty means "here"
+	Place string
+}
+
+// A Markov generator per language. Captions in a language without a corpus are in English
+type LocalizedGenerator struct {
+	Generators map[string]*MarkovGenerator
+	// The seed all of the generators share
+	Seed int64
+}
+
+// Trains a generator on the corpus bundled with the binary
+func Default(seed int64) (*MarkovGenerator, error) {
+	corpusFS, err := fs.Sub(corpus, "corpus")
+	if err != nil {
+		return nil, err
+	}
+	return LoadFS(corpusFS, seed)
+}
+
+// Trains a generator per language on the corpora bundled with the binary
+func DefaultLocalized(seed int64) (*LocalizedGenerator, error) {
+	corpusFS, err := fs.Sub(corpus, "corpus")
+	if err != nil {
+		return nil, err
+	}
+	return LoadLocalizedFS(corpusFS, seed)
+}
+
+// Trains the English generator on captions.txt and one for each captions.<lang>.txt next to it
+func LoadLocalizedFS(fsys fs.FS, seed int64) (*LocalizedGenerator, error) {
+	english, err := LoadFS(fsys, seed)
+	if err != nil {
+		return nil, err
+	}
+	localized := &LocalizedGenerator{Generators: map[string]*MarkovGenerator{defaultLang: english}, Seed: seed}
+
+	files, err := fs.Glob(fsys, "captions.*.txt")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		lang := strings.TrimSuffix(strings.TrimPrefix(file, "captions."), ".txt")
+		generator, err := loadFile(fsys, file, seed)
+		if err != nil {
+			return nil, fmt.Errorf("%s corpus: %w", lang, err)
+		}
+		generator.Place = defaultPlaces[lang]
+		localized.Generators[lang] = generator
+	}
+	return localized, nil
+}
+
+// Trains a generator on a captions.txt file: one caption per line, # for comments
+func LoadFS(fsys fs.FS, seed int64) (*MarkovGenerator, error) {
+	return loadFile(fsys, corpusFile, seed)
+}
+
+func loadFile(fsys fs.FS, name string, seed int64) (*MarkovGenerator, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	captions := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		captions = append(captions, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewMarkovGenerator(captions, seed)
+}
+
+func NewMarkovGenerator(captions []string, seed int64) (*MarkovGenerator, error) {
+	generator := &MarkovGenerator{chain: map[state][]string{}, Seed: seed}
+	for _, caption := range captions {
+		words := strings.Fields(strings.ToLower(caption))
+		if len(words) == 0 {
+			continue
+		}
+		generator.captions = append(generator.captions, words)
+
+		current := state{}
+		for _, word := range append(words, endOfCaption) {
+			generator.chain[current] = append(generator.chain[current], word)
+			current = state{current[1], word}
+		}
+	}
+	if len(generator.captions) == 0 {
+		return nil, fmt.Errorf("caption corpus is empty")
+	}
+	return generator, nil
+}
+
+func (g *MarkovGenerator) Caption(context *meme_maker.CaptionContext) (string, error) {
+	random := rand.New(rand.NewSource(g.Seed ^ contextHash(context)))
+	keywords := contextKeywords(context)
+
+	var words []string
+	for attempt := 0; attempt < attempts; attempt++ {
+		words = g.generate(random, g.start(random, keywords))
+		if len(words) >= MinWords {
+			break
+		}
+	}
+
+	place := defaultPlace
+	if g.Place != "" {
+		place = g.Place
+	}
+	if context.Place != nil && context.Place.City != "" {
+		place = strings.ToLower(context.Place.City)
+	}
+	return strings.ReplaceAll(strings.Join(words, " "), placeToken, place), nil
+}
+
+func (g *LocalizedGenerator) Caption(context *meme_maker.CaptionContext) (string, error) {
+	generator, ok := g.Generators[context.Lang]
+	if !ok {
+		generator = g.Generators[defaultLang]
+	}
+	return generator.Caption(context)
+}
+
+// The first couple of words of a random corpus caption that mentions one of the keywords.
+// Returns nil, meaning start from scratch, when none of them do.
+func (g *MarkovGenerator) start(random *rand.Rand, keywords map[string]bool) []string {
+	matches := [][]string{}
+	for _, caption := range g.captions {
+		for _, word := range caption {
+			if keywords[normalizeWord(word)] {
+				matches = append(matches, caption)
+				break
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	caption := matches[random.Intn(len(matches))]
+	if len(caption) > 2 {
+		caption = caption[:2]
+	}
+	return append([]string{}, caption...)
+}
+
+// Walks the chain from the end of prefix until it reaches the end of a caption or MaxWords
+func (g *MarkovGenerator) generate(random *rand.Rand, prefix []string) []string {
+	words := prefix
+	current := state{}
+	for _, word := range words {
+		current = state{current[1], word}
+	}
+	for len(words) < MaxWords {
+		next := g.chain[current]
+		if len(next) == 0 {
+			break
+		}
+		word := next[random.Intn(len(next))]
+		if word == endOfCaption {
+			break
+		}
+		words = append(words, word)
+		current = state{current[1], word}
+	}
+	return words
+}
+
+func contextHash(context *meme_maker.CaptionContext) int64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(strings.ToLower(context.Query)))
+	if context.Template != nil {
+		hash.Write([]byte("\x00" + context.Template.ID))
+	}
+	if context.Place != nil {
+		hash.Write([]byte("\x00" + context.Place.City))
+	}
+	return int64(hash.Sum64())
+}
+
+// Words from the query and their synonyms, plus the template's tags.
+// A known place makes captions about places fair game.
+func contextKeywords(context *meme_maker.CaptionContext) map[string]bool {
+	keywords := map[string]bool{}
+	for _, word := range strings.Fields(strings.ToLower(context.Query)) {
+		for _, synonym := range meme_maker.DefaultSynonyms[word] {
+			keywords[synonym] = true
+		}
+		if word = normalizeWord(word); word != "" {
+			keywords[word] = true
+		}
+	}
+	if context.Template != nil {
+		for _, tag := range context.Template.Tags {
+			keywords[normalizeWord(tag)] = true
+		}
+	}
+	if context.Place != nil && context.Place.City != "" {
+		keywords[placeToken] = true
+	}
+	return keywords
+}
+
+// Lower case letters only, with a trailing plural s dropped so "tacos" matches "taco"
+func normalizeWord(word string) string {
+	if word == placeToken {
+		return word
+	}
+	word = strings.ToLower(strings.TrimFunc(word, func(r rune) bool { return !unicode.IsLetter(r) }))
+	if len(word) > 3 && strings.HasSuffix(word, "s") && unicode.IsLetter(rune(word[len(word)-2])) && !strings.HasSuffix(word, "ss") {
+		word = strings.TrimSuffix(word, "s")
+	}
+	return word
+}
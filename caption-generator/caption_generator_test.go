@@ -0,0 +1,142 @@
+package caption_generator
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	meme_maker "maas/meme-maker"
+	"maas/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var fixtureCaptions = []string{
+	"nobody expects the monday meeting",
+	"i'll just have one more taco",
+	"the taco was worth it",
+	"only in {place}",
+}
+
+func TestDefault_TrainsOnBundledCorpus(t *testing.T) {
+	generator, err := Default(0)
+	assert.Nil(t, err)
+	assert.Greater(t, len(generator.captions), 100)
+}
+
+func TestLoadFS_SkipsBlankLinesAndComments(t *testing.T) {
+	fsys := fstest.MapFS{corpusFile: {Data: []byte("# comment\n\nfirst caption here\n  second caption here  \n")}}
+	generator, err := LoadFS(fsys, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"first", "caption", "here"}, {"second", "caption", "here"}}, generator.captions)
+}
+
+func TestLoadFS_WhenCorpusIsMissing_RaisesAnError(t *testing.T) {
+	_, err := LoadFS(fstest.MapFS{}, 0)
+	assert.Error(t, err)
+}
+
+func TestNewMarkovGenerator_WhenCorpusIsEmpty_RaisesAnError(t *testing.T) {
+	_, err := NewMarkovGenerator([]string{"", "   "}, 0)
+	assert.Error(t, err)
+}
+
+func TestCaption_WithSameSeedAndContext_IsReproducible(t *testing.T) {
+	first, _ := Default(7)
+	second, _ := Default(7)
+	context := &meme_maker.CaptionContext{Query: "monday meeting"}
+	caption, err := first.Caption(context)
+	assert.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		again, _ := second.Caption(context)
+		assert.Equal(t, caption, again)
+	}
+}
+
+func TestCaption_WithDifferentSeeds_Varies(t *testing.T) {
+	captions := map[string]bool{}
+	for seed := int64(0); seed < 20; seed++ {
+		generator, _ := Default(seed)
+		caption, _ := generator.Caption(&meme_maker.CaptionContext{Query: "something"})
+		captions[caption] = true
+	}
+	assert.Greater(t, len(captions), 1)
+}
+
+func TestCaption_StartsFromCaptionsMatchingTheQuery(t *testing.T) {
+	generator, _ := NewMarkovGenerator(fixtureCaptions, 0)
+	for seed := int64(0); seed < 10; seed++ {
+		generator.Seed = seed
+		caption, _ := generator.Caption(&meme_maker.CaptionContext{Query: "Tacos!"})
+		assert.True(t, strings.HasPrefix(caption, "i'll just") || strings.HasPrefix(caption, "the taco"), caption)
+	}
+}
+
+func TestCaption_UsesTemplateTagsAndSynonyms(t *testing.T) {
+	generator, _ := NewMarkovGenerator(fixtureCaptions, 0)
+	template := &models.Template{ID: "office", Tags: []string{"monday"}}
+	caption, _ := generator.Caption(&meme_maker.CaptionContext{Template: template})
+	assert.Equal(t, "nobody expects the monday meeting", caption)
+
+	// "boss" isn't in the corpus but its synonym "work" is
+	generator, _ = NewMarkovGenerator([]string{"back to work already", "pass the salt"}, 0)
+	for seed := int64(0); seed < 10; seed++ {
+		generator.Seed = seed
+		caption, _ = generator.Caption(&meme_maker.CaptionContext{Query: "boss"})
+		assert.Equal(t, "back to work already", caption)
+	}
+}
+
+func TestCaption_FillsInThePlace(t *testing.T) {
+	generator, _ := NewMarkovGenerator([]string{"only in {place}"}, 0)
+	caption, _ := generator.Caption(&meme_maker.CaptionContext{Place: &models.Place{City: "Long Island City"}})
+	assert.Equal(t, "only in long island city", caption)
+	caption, _ = generator.Caption(&meme_maker.CaptionContext{})
+	assert.Equal(t, "only in here", caption)
+}
+
+func TestCaption_NeverRunsPastMaxWords(t *testing.T) {
+	// A caption that loops back on itself forever if nothing stops it
+	generator, _ := NewMarkovGenerator([]string{"go go go go go go go go go go go go go go go go go go go go"}, 0)
+	caption, _ := generator.Caption(&meme_maker.CaptionContext{})
+	assert.LessOrEqual(t, len(strings.Fields(caption)), MaxWords)
+}
+
+func TestNormalizeWord_TrimsPunctuationAndPlurals(t *testing.T) {
+	assert.Equal(t, "taco", normalizeWord("Tacos!"))
+	assert.Equal(t, "boss", normalizeWord("boss"))
+	assert.Equal(t, "it's", normalizeWord("it's"))
+	assert.Equal(t, placeToken, normalizeWord(placeToken))
+}
+
+func TestDefaultLocalized_TrainsEveryBundledLanguage(t *testing.T) {
+	generator, err := DefaultLocalized(0)
+	assert.Nil(t, err)
+	for _, lang := range []string{"en", "es", "fr", "de", "pt"} {
+		assert.Contains(t, generator.Generators, lang)
+	}
+}
+
+func TestLocalizedCaption_WritesInTheRequestedLanguage(t *testing.T) {
+	fsys := fstest.MapFS{
+		corpusFile:        {Data: []byte("only in {place}\n")},
+		"captions.es.txt": {Data: []byte("solo en {place}\n")},
+	}
+	generator, err := LoadLocalizedFS(fsys, 0)
+	assert.Nil(t, err)
+
+	caption, _ := generator.Caption(&meme_maker.CaptionContext{Lang: "es"})
+	assert.Equal(t, "solo en aquí", caption)
+	caption, _ = generator.Caption(&meme_maker.CaptionContext{Lang: "es", Place: &models.Place{City: "Madrid"}})
+	assert.Equal(t, "solo en madrid", caption)
+}
+
+func TestLocalizedCaption_WhenLanguageHasNoCorpus_WritesInEnglish(t *testing.T) {
+	fsys := fstest.MapFS{
+		corpusFile:        {Data: []byte("only in {place}\n")},
+		"captions.es.txt": {Data: []byte("solo en {place}\n")},
+	}
+	generator, _ := LoadLocalizedFS(fsys, 0)
+	caption, _ := generator.Caption(&meme_maker.CaptionContext{Lang: "ja"})
+	assert.Equal(t, "only in here", caption)
+}
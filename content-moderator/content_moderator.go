@@ -0,0 +1,133 @@
+package content_moderator
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	error_types "maas/error-types"
+	meme_service "maas/meme-service"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+/*
+  Checks meme text against a content policy: a list of rules, each a set of regular expressions
+  and whole words that the text can't contain. Some rules always apply, and the rest only apply to
+  users in safe mode.
+
+  Text is checked as written and again with common look-alike characters swapped back for letters
+  ("$h1t" reads as "shit"), so a rule doesn't have to list every spelling.
+*/
+
+//go:embed policy.json
+var defaultPolicy []byte
+
+var _ meme_service.Moderator = &Policy{}
+
+type Rule struct {
+	ID       string `json:"id"`
+	Category string `json:"category"`
+	// Shown to the user, so it should explain what isn't allowed
+	Reason   string   `json:"reason"`
+	Patterns []string `json:"patterns"`
+	// Matched as whole words, ignoring case
+	Words []string `json:"words"`
+	// Only applies to users in safe mode
+	SafeModeOnly bool `json:"safe_mode_only"`
+
+	compiled []*regexp.Regexp
+}
+
+type Policy struct {
+	Rules []*Rule `json:"rules"`
+}
+
+// Characters people use in place of letters to get words past a filter
+var lookAlikes = strings.NewReplacer(
+	"0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s", "!", "i",
+)
+
+// The policy bundled into the binary
+func Default() (*Policy, error) {
+	return Parse(defaultPolicy)
+}
+
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parses a JSON policy and compiles its rules. Every pattern is case insensitive
+func Parse(data []byte) (*Policy, error) {
+	policy := &Policy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+	for _, rule := range policy.Rules {
+		if rule.ID == "" {
+			return nil, fmt.Errorf("content policy rule without an id")
+		}
+		patterns := append([]string{}, rule.Patterns...)
+		if len(rule.Words) > 0 {
+			words := []string{}
+			for _, word := range rule.Words {
+				words = append(words, regexp.QuoteMeta(strings.ToLower(word)))
+			}
+			patterns = append(patterns, `\b(`+strings.Join(words, "|")+`)\b`)
+		}
+		for _, pattern := range patterns {
+			compiled, err := regexp.Compile("(?i)" + pattern)
+			if err != nil {
+				return nil, fmt.Errorf("content policy rule %s: %w", rule.ID, err)
+			}
+			rule.compiled = append(rule.compiled, compiled)
+		}
+	}
+	return policy, nil
+}
+
+// Returns a ContentPolicyError for the first rule the text breaks, or nil when it's fine
+func (p *Policy) Check(field string, text string, safeMode bool) error {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	variants := normalize(text)
+	for _, rule := range p.Rules {
+		if rule.SafeModeOnly && !safeMode {
+			continue
+		}
+		if rule.matches(variants) {
+			return &error_types.ContentPolicyError{Field: field, Rule: rule.ID, Category: rule.Category, Reason: rule.Reason}
+		}
+	}
+	return nil
+}
+
+func (r *Rule) matches(variants []string) bool {
+	for _, pattern := range r.compiled {
+		for _, variant := range variants {
+			if pattern.MatchString(variant) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The text folded to plain lower case letters, and the same again with look-alikes swapped out.
+// Compatibility folding turns full width and other fancy letters into their plain forms
+func normalize(text string) []string {
+	folded := strings.ToLower(norm.NFKC.String(text))
+	unmasked := lookAlikes.Replace(folded)
+	if unmasked == folded {
+		return []string{folded}
+	}
+	return []string{folded, unmasked}
+}
@@ -0,0 +1,75 @@
+package content_moderator
+
+import (
+	"testing"
+
+	error_types "maas/error-types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func defaultPolicyForTest(t *testing.T) *Policy {
+	policy, err := Default()
+	assert.Nil(t, err)
+	return policy
+}
+
+func TestDefault_Parses(t *testing.T) {
+	policy := defaultPolicyForTest(t)
+	assert.NotEmpty(t, policy.Rules)
+}
+
+func TestCheck_WhenTextIsFine_ReturnsNil(t *testing.T) {
+	policy := defaultPolicyForTest(t)
+	assert.Nil(t, policy.Check("query", "when the coffee kicks in", true))
+	assert.Nil(t, policy.Check("query", "", true))
+}
+
+func TestCheck_WhenTextBreaksAnAlwaysOnRule_ReturnsViolation(t *testing.T) {
+	policy := defaultPolicyForTest(t)
+	err := policy.Check("query", "call me at 555-123-4567", false)
+	assert.Equal(t, &error_types.ContentPolicyError{
+		Field:    "query",
+		Rule:     "personal-info",
+		Category: "privacy",
+		Reason:   "Memes can't include phone numbers, email addresses or other personal details",
+	}, err)
+}
+
+func TestCheck_WhenTextBreaksASafeModeRule_OnlyAppliesInSafeMode(t *testing.T) {
+	policy := defaultPolicyForTest(t)
+	assert.Nil(t, policy.Check("query", "this is some bullshit", false))
+
+	err := policy.Check("query", "this is some bullshit", true)
+	assert.IsType(t, &error_types.ContentPolicyError{}, err)
+	assert.Equal(t, "profanity", err.(*error_types.ContentPolicyError).Rule)
+}
+
+func TestCheck_MatchesWholeWordsOnly(t *testing.T) {
+	policy := defaultPolicyForTest(t)
+	assert.Nil(t, policy.Check("query", "first class assignment", true))
+}
+
+func TestCheck_WhenWordsAreDisguised_StillCatchesThem(t *testing.T) {
+	policy := defaultPolicyForTest(t)
+	assert.NotNil(t, policy.Check("query", "$H1T happens", true))
+	assert.NotNil(t, policy.Check("query", "ＳＨＩＴ happens", true))
+}
+
+func TestParse_WithCustomRules_UsesThem(t *testing.T) {
+	policy, err := Parse([]byte(`{"rules": [{"id": "no-mondays", "category": "morale", "reason": "Be nice to Mondays", "words": ["monday"]}]}`))
+	assert.Nil(t, err)
+
+	err = policy.Check("bottom_text", "I hate MONDAY", false)
+	assert.Equal(t, &error_types.ContentPolicyError{Field: "bottom_text", Rule: "no-mondays", Category: "morale", Reason: "Be nice to Mondays"}, err)
+}
+
+func TestParse_WhenPatternIsInvalid_ReturnsError(t *testing.T) {
+	_, err := Parse([]byte(`{"rules": [{"id": "broken", "patterns": ["(unclosed"]}]}`))
+	assert.NotNil(t, err)
+}
+
+func TestParse_WhenRuleHasNoId_ReturnsError(t *testing.T) {
+	_, err := Parse([]byte(`{"rules": [{"words": ["monday"]}]}`))
+	assert.NotNil(t, err)
+}
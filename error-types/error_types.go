@@ -61,3 +61,154 @@ type UnableToLocateDocumentError struct {
 func (e *UnableToLocateDocumentError) Error() string {
 	return fmt.Sprintf("Unable to locate document:\n%s", e.Err.Error())
 }
+
+type UnsupportedImageFormatError struct {
+	Format string
+}
+
+func (e *UnsupportedImageFormatError) Error() string {
+	return fmt.Sprintf("Unsupported image format: %s", e.Format)
+}
+
+type TemplateNotFoundError struct {
+	ID string
+}
+
+func (e *TemplateNotFoundError) Error() string {
+	return fmt.Sprintf("Template not found: %s", e.ID)
+}
+
+type PlaceNotFoundError struct {
+	Lat float64
+	Lon float64
+}
+
+func (e *PlaceNotFoundError) Error() string {
+	return fmt.Sprintf("No known place near %.6f x %.6f", e.Lat, e.Lon)
+}
+
+type ImageNotFoundError struct {
+	Key string
+}
+
+func (e *ImageNotFoundError) Error() string {
+	return fmt.Sprintf("Image not found: %s", e.Key)
+}
+
+type NotAcceptableError struct {
+	Accept string
+}
+
+func (e *NotAcceptableError) Error() string {
+	return fmt.Sprintf("None of the accepted types can be served: %s", e.Accept)
+}
+
+type CaptionTooLongError struct {
+	Text string
+}
+
+func (e *CaptionTooLongError) Error() string {
+	return fmt.Sprintf("Caption is too long to fit on the meme: %s", e.Text)
+}
+
+// A remote meme provider failed or couldn't be reached
+type ProviderError struct {
+	Provider string
+	Message  string
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("Meme provider %s failed: %s", e.Provider, e.Message)
+}
+
+// Text broke the content policy. Field is where it was found: the query, or the top or bottom text
+type ContentPolicyError struct {
+	Field    string
+	Rule     string
+	Category string
+	Reason   string
+}
+
+func (e *ContentPolicyError) Error() string {
+	return fmt.Sprintf("The %s breaks the content policy (%s): %s", e.Field, e.Rule, e.Reason)
+}
+
+// The user doesn't have enough tokens left to pay for what they asked for
+type InsufficientTokensError struct {
+	Needed int
+}
+
+func (e *InsufficientTokensError) Error() string {
+	return fmt.Sprintf("Not enough tokens remaining, %d needed", e.Needed)
+}
+
+type JobNotFoundError struct {
+	ID string
+}
+
+func (e *JobNotFoundError) Error() string {
+	return fmt.Sprintf("Could not find job: %s", e.ID)
+}
+
+// There are already as many jobs waiting as the queue will hold
+type QueueFullError struct{}
+
+func (e *QueueFullError) Error() string {
+	return "The job queue is full"
+}
+
+// The reservation has already been committed or released, or was released when it expired
+type ReservationNotFoundError struct {
+	ID string
+}
+
+func (e *ReservationNotFoundError) Error() string {
+	return fmt.Sprintf("Could not find reservation: %s", e.ID)
+}
+
+// The user's balance changed while it was being rebuilt from the ledger
+type BalanceChangedError struct {
+	UserId string
+}
+
+func (e *BalanceChangedError) Error() string {
+	return fmt.Sprintf("The balance of user %s changed while it was being rebuilt", e.UserId)
+}
+
+// The user's ledger is missing entries, so adding it up wouldn't give their balance
+type LedgerIncompleteError struct {
+	UserId   string
+	Expected int
+	Found    int
+}
+
+func (e *LedgerIncompleteError) Error() string {
+	return fmt.Sprintf("The ledger of user %s has %d of its %d entries", e.UserId, e.Found, e.Expected)
+}
+
+// Tokens have already been credited under this Idempotency-Key
+type DuplicateCreditError struct {
+	Key string
+}
+
+func (e *DuplicateCreditError) Error() string {
+	return fmt.Sprintf("Already credited under idempotency key: %s", e.Key)
+}
+
+// An Idempotency-Key was sent again with different parameters
+type IdempotencyKeyReusedError struct {
+	Key string
+}
+
+func (e *IdempotencyKeyReusedError) Error() string {
+	return fmt.Sprintf("Idempotency key reused with different parameters: %s", e.Key)
+}
+
+// A request with this Idempotency-Key is still being handled
+type IdempotencyKeyInUseError struct {
+	Key string
+}
+
+func (e *IdempotencyKeyInUseError) Error() string {
+	return fmt.Sprintf("Idempotency key is still in use: %s", e.Key)
+}
@@ -0,0 +1,67 @@
+package image_store
+
+import (
+	"errors"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+
+	error_types "maas/error-types"
+	meme_service "maas/meme-service"
+)
+
+var _ meme_service.ImageStore = &LocalImageStore{}
+
+// Keeps images in a directory on disk. The directory isn't served by itself, so images are only
+// reachable through GET /memes/:id/image and its auth checks
+type LocalImageStore struct {
+	Dir string
+}
+
+func NewLocalImageStore(dir string) (*LocalImageStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalImageStore{Dir: dir}, nil
+}
+
+// Returns no URL, since the image has none of its own
+func (s *LocalImageStore) SaveImage(key string, data []byte, contentType string) (string, error) {
+	filePath, err := s.filePath(key)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+func (s *LocalImageStore) Image(key string) ([]byte, string, error) {
+	filePath, err := s.filePath(key)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, "", &error_types.ImageNotFoundError{Key: key}
+		}
+		return nil, "", err
+	}
+	return data, mime.TypeByExtension(path.Ext(key)), nil
+}
+
+// Keeps keys from escaping the image directory
+func (s *LocalImageStore) filePath(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || cleaned != "/"+key {
+		return "", &error_types.ImageNotFoundError{Key: key}
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(cleaned)), nil
+}
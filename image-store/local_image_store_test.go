@@ -0,0 +1,53 @@
+package image_store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	error_types "maas/error-types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalSaveImage_WritesFileWithoutAURL(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLocalImageStore(dir)
+	assert.Nil(t, err)
+
+	url, err := store.SaveImage("memes/abc.png", []byte("png data"), "image/png")
+	assert.Nil(t, err)
+	assert.Empty(t, url)
+
+	written, err := os.ReadFile(filepath.Join(dir, "memes", "abc.png"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("png data"), written)
+}
+
+func TestLocalImage_ReturnsSavedImageAndContentType(t *testing.T) {
+	store, _ := NewLocalImageStore(t.TempDir())
+	store.SaveImage("memes/abc.jpeg", []byte("jpeg data"), "image/jpeg")
+
+	data, contentType, err := store.Image("memes/abc.jpeg")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("jpeg data"), data)
+	assert.Equal(t, "image/jpeg", contentType)
+}
+
+func TestLocalImage_WhenImageIsMissing_RaisesImageNotFound(t *testing.T) {
+	store, _ := NewLocalImageStore(t.TempDir())
+
+	data, _, err := store.Image("memes/missing.png")
+	assert.Nil(t, data)
+	assert.Equal(t, &error_types.ImageNotFoundError{Key: "memes/missing.png"}, err)
+}
+
+func TestLocalSaveImage_WhenKeyEscapesTheDirectory_RaisesAnError(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewLocalImageStore(filepath.Join(dir, "images"))
+
+	_, err := store.SaveImage("../escaped.png", []byte("png data"), "image/png")
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "escaped.png"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,225 @@
+package image_store
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	error_types "maas/error-types"
+	meme_service "maas/meme-service"
+)
+
+/*
+  Talks to any S3 compatible object store (AWS S3, MinIO, etc.) over plain HTTP with path style URLs.
+  Requests are signed with AWS Signature Version 4, so there is no need to pull in the whole AWS SDK
+  for two calls.
+*/
+
+const (
+	signingAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat    = "20060102T150405Z"
+	shortDateFormat  = "20060102"
+	defaultTimeout   = 10 * time.Second
+)
+
+var _ meme_service.ImageStore = &S3ImageStore{}
+
+type S3ImageStore struct {
+	// Something like https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// Optional. Where clients can fetch the images from (a CDN or public bucket URL).
+	// Defaults to the object's URL on Endpoint
+	PublicURL string
+
+	Client *http.Client
+	// Overridable for tests
+	now func() time.Time
+}
+
+func NewS3ImageStore(endpoint string, bucket string, region string, accessKey string, secretKey string) *S3ImageStore {
+	return &S3ImageStore{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Bucket:    bucket,
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Client:    &http.Client{Timeout: defaultTimeout},
+		now:       time.Now,
+	}
+}
+
+func (s *S3ImageStore) WithPublicURL(publicURL string) *S3ImageStore {
+	s.PublicURL = strings.TrimSuffix(publicURL, "/")
+	return s
+}
+
+func (s *S3ImageStore) SaveImage(key string, data []byte, contentType string) (string, error) {
+	request, err := http.NewRequest(http.MethodPut, s.objectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", contentType)
+	s.sign(request, data)
+
+	response, err := s.Client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", unexpectedResponse(response)
+	}
+
+	if s.PublicURL != "" {
+		return s.PublicURL + "/" + escapePath(key), nil
+	}
+	return s.objectURL(key), nil
+}
+
+func (s *S3ImageStore) Image(key string) ([]byte, string, error) {
+	request, err := http.NewRequest(http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	s.sign(request, nil)
+
+	response, err := s.Client.Do(request)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, "", &error_types.ImageNotFoundError{Key: key}
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, "", unexpectedResponse(response)
+	}
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, response.Header.Get("Content-Type"), nil
+}
+
+func (s *S3ImageStore) objectURL(key string) string {
+	return fmt.Sprintf("%s/%s/%s", s.Endpoint, escapePath(s.Bucket), escapePath(key))
+}
+
+func unexpectedResponse(response *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	return fmt.Errorf("object store returned %d: %s", response.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// Adds the SigV4 headers. Every header already on the request is signed along with the host.
+func (s *S3ImageStore) sign(request *http.Request, payload []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format(amzDateFormat)
+	payloadHash := sha256Hex(payload)
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonicalHeaders, signedHeaders := canonicalizeHeaders(request)
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		canonicalQuery(request.URL),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(shortDateFormat), s.Region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{signingAlgorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.SecretKey), now.Format(shortDateFormat))
+	signingKey = hmacSHA256(signingKey, s.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signingAlgorithm, s.AccessKey, scope, signedHeaders, signature))
+}
+
+func canonicalizeHeaders(request *http.Request) (string, string) {
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return canonical.String(), strings.Join(names, ";")
+}
+
+func canonicalQuery(u *url.URL) string {
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, escape(key)+"="+escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// S3's flavour of URI encoding: everything but unreserved characters is percent encoded
+func escape(value string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') || strings.IndexByte("-_.~", b) >= 0 {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func escapePath(value string) string {
+	segments := strings.Split(value, "/")
+	for i, segment := range segments {
+		segments[i] = escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
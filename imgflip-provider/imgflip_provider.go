@@ -0,0 +1,213 @@
+package imgflip_provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	error_types "maas/error-types"
+	meme_maker "maas/meme-maker"
+	meme_service "maas/meme-service"
+	"maas/models"
+)
+
+/*
+  Builds memes by calling an Imgflip style caption_image API instead of rendering them here.
+  Imgflip hosts the finished image, so the meme's image location is Imgflip's URL and nothing is
+  kept in the image store.
+
+  Our template IDs are mapped onto Imgflip's numeric ones through TemplateIds. A numeric template
+  param is passed through as is, so any Imgflip template can be asked for directly.
+*/
+
+const (
+	DefaultBaseURL = "https://api.imgflip.com"
+	DefaultTimeout = 10 * time.Second
+	// One Does Not Simply
+	DefaultTemplateId = "61579"
+
+	captionImagePath = "/caption_image"
+	// Imgflip's error messages can be long, only this much ends up in our errors
+	maxErrorLength = 200
+)
+
+// A few well known Imgflip templates under friendlier names
+var DefaultTemplateIds = map[string]string{
+	"one-does-not-simply":  "61579",
+	"drake":                "181913649",
+	"distracted-boyfriend": "112126428",
+	"two-buttons":          "87743020",
+	"change-my-mind":       "129242436",
+	"success-kid":          "61544",
+	"this-is-fine":         "55311130",
+}
+
+var numericTemplateId = regexp.MustCompile(`^[0-9]+$`)
+
+var _ meme_service.MemeProvider = &ImgflipProvider{}
+var _ meme_service.NamedProvider = &ImgflipProvider{}
+
+type ImgflipProvider struct {
+	BaseURL  string
+	Username string
+	Password string
+	// Our template IDs to Imgflip's. Defaults to DefaultTemplateIds
+	TemplateIds map[string]string
+	// Used when the request doesn't ask for a template
+	DefaultTemplateId string
+	// Optional. Without a caption generator the bottom text is always "Bottom Text"
+	Captions meme_maker.CaptionGenerator
+
+	Client *http.Client
+}
+
+// The caption_image response. Data is only there when Success is true
+type captionImageResponse struct {
+	Success      bool   `json:"success"`
+	ErrorMessage string `json:"error_message"`
+	Data         struct {
+		URL     string `json:"url"`
+		PageURL string `json:"page_url"`
+	} `json:"data"`
+}
+
+func NewImgflipProvider(baseURL string, username string, password string) *ImgflipProvider {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return &ImgflipProvider{
+		BaseURL:           strings.TrimSuffix(baseURL, "/"),
+		Username:          username,
+		Password:          password,
+		TemplateIds:       DefaultTemplateIds,
+		DefaultTemplateId: DefaultTemplateId,
+		Client:            &http.Client{Timeout: DefaultTimeout},
+	}
+}
+
+func (p *ImgflipProvider) WithTimeout(timeout time.Duration) *ImgflipProvider {
+	p.Client.Timeout = timeout
+	return p
+}
+
+func (p *ImgflipProvider) WithTemplateIds(templateIds map[string]string) *ImgflipProvider {
+	p.TemplateIds = templateIds
+	return p
+}
+
+func (p *ImgflipProvider) WithCaptions(captions meme_maker.CaptionGenerator) *ImgflipProvider {
+	p.Captions = captions
+	return p
+}
+
+func (p *ImgflipProvider) Name() string {
+	return "imgflip"
+}
+
+func (p *ImgflipProvider) BuildMeme(params *meme_service.QueryParams) (*models.Meme, error) {
+	templateId, err := p.templateId(params.Template)
+	if err != nil {
+		return nil, err
+	}
+	meme := &models.Meme{TopText: params.Query, BottomText: "Bottom Text", TemplateId: params.Template}
+	params.Report(meme_service.StageTemplateSelected, meme)
+	if p.Captions != nil {
+		meme.BottomText, err = p.Captions.Caption(&meme_maker.CaptionContext{Query: params.Query, Lang: params.Lang})
+		if err != nil {
+			return nil, err
+		}
+	}
+	params.Report(meme_service.StageCaptionGenerated, meme)
+
+	form := url.Values{}
+	form.Set("template_id", templateId)
+	form.Set("username", p.Username)
+	form.Set("password", p.Password)
+	form.Set("text0", meme.TopText)
+	form.Set("text1", meme.BottomText)
+
+	imageURL, err := p.captionImage(form)
+	if err != nil {
+		return nil, err
+	}
+	meme = meme.WithImageLocation(imageURL)
+	params.Report(meme_service.StageRendered, meme)
+	return meme, nil
+}
+
+func (p *ImgflipProvider) templateId(template string) (string, error) {
+	if template == "" {
+		return p.DefaultTemplateId, nil
+	}
+	if numericTemplateId.MatchString(template) {
+		return template, nil
+	}
+	templateId, ok := p.TemplateIds[template]
+	if !ok {
+		return "", &error_types.TemplateNotFoundError{ID: template}
+	}
+	return templateId, nil
+}
+
+// Posts the form and returns the finished image's URL
+func (p *ImgflipProvider) captionImage(form url.Values) (string, error) {
+	response, err := p.Client.PostForm(p.BaseURL+captionImagePath, form)
+	if err != nil {
+		return "", p.providerError(err.Error())
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return "", p.providerError(err.Error())
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", p.providerError(fmt.Sprintf("returned %d: %s", response.StatusCode, truncate(string(body))))
+	}
+
+	var result captionImageResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", p.providerError(fmt.Sprintf("returned an unreadable response: %s", err))
+	}
+	if !result.Success {
+		return "", p.providerError(truncate(result.ErrorMessage))
+	}
+	if result.Data.URL == "" {
+		return "", p.providerError("returned no image url")
+	}
+	return result.Data.URL, nil
+}
+
+func (p *ImgflipProvider) providerError(message string) error {
+	return &error_types.ProviderError{Provider: p.Name(), Message: message}
+}
+
+func truncate(message string) string {
+	message = strings.TrimSpace(message)
+	if len(message) > maxErrorLength {
+		return message[:maxErrorLength] + "..."
+	}
+	return message
+}
+
+// Parses "name=id,name=id" into a template ID map
+func ParseTemplateIds(value string) (map[string]string, error) {
+	templateIds := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, id, found := strings.Cut(pair, "=")
+		name, id = strings.TrimSpace(name), strings.TrimSpace(id)
+		if !found || name == "" || !numericTemplateId.MatchString(id) {
+			return nil, fmt.Errorf("bad template mapping: %s", pair)
+		}
+		templateIds[name] = id
+	}
+	return templateIds, nil
+}
@@ -0,0 +1,202 @@
+package imgflip_provider
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	error_types "maas/error-types"
+	meme_maker "maas/meme-maker"
+	meme_service "maas/meme-service"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A stand-in for Imgflip's caption_image endpoint that remembers the last form it was sent
+type fakeImgflip struct {
+	mutex    sync.Mutex
+	form     url.Values
+	status   int
+	response string
+	delay    time.Duration
+}
+
+func (f *fakeImgflip) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != captionImagePath || r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	r.ParseForm()
+	f.mutex.Lock()
+	f.form = r.PostForm
+	status, response, delay := f.status, f.response, f.delay
+	f.mutex.Unlock()
+
+	time.Sleep(delay)
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	io.WriteString(w, response)
+}
+
+func (f *fakeImgflip) lastForm() url.Values {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.form
+}
+
+const successResponse = `{"success":true,"data":{"url":"https://i.imgflip.com/123abc.jpg","page_url":"https://imgflip.com/i/123abc"}}`
+
+func testProvider(fake *fakeImgflip) (*ImgflipProvider, func()) {
+	server := httptest.NewServer(fake)
+	return NewImgflipProvider(server.URL, "test-user", "test-password"), server.Close
+}
+
+type MockCaptionGenerator struct{}
+
+func (m *MockCaptionGenerator) Caption(context *meme_maker.CaptionContext) (string, error) {
+	return "caption for " + context.Query, nil
+}
+
+func TestBuildMeme_WhenImgflipSucceeds_ReturnsHostedImage(t *testing.T) {
+	fake := &fakeImgflip{response: successResponse}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	meme, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food", Template: "drake"})
+	assert.Nil(t, err)
+	assert.Equal(t, "food", meme.TopText)
+	assert.Equal(t, "Bottom Text", meme.BottomText)
+	assert.Equal(t, "https://i.imgflip.com/123abc.jpg", meme.ImageLocation)
+	assert.Equal(t, "drake", meme.TemplateId)
+	assert.Nil(t, meme.Image)
+
+	form := fake.lastForm()
+	assert.Equal(t, "181913649", form.Get("template_id"))
+	assert.Equal(t, "test-user", form.Get("username"))
+	assert.Equal(t, "test-password", form.Get("password"))
+	assert.Equal(t, "food", form.Get("text0"))
+	assert.Equal(t, "Bottom Text", form.Get("text1"))
+}
+
+func TestBuildMeme_WhenNoTemplate_UsesDefaultTemplate(t *testing.T) {
+	fake := &fakeImgflip{response: successResponse}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultTemplateId, fake.lastForm().Get("template_id"))
+}
+
+func TestBuildMeme_WhenNumericTemplate_PassesItThrough(t *testing.T) {
+	fake := &fakeImgflip{response: successResponse}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food", Template: "438680"})
+	assert.Nil(t, err)
+	assert.Equal(t, "438680", fake.lastForm().Get("template_id"))
+}
+
+func TestBuildMeme_WhenUnknownTemplate_ReturnsTemplateNotFound(t *testing.T) {
+	fake := &fakeImgflip{response: successResponse}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food", Template: "lunch-break"})
+	assert.IsType(t, &error_types.TemplateNotFoundError{}, err)
+	assert.Nil(t, fake.lastForm())
+}
+
+func TestBuildMeme_WhenCaptionGenerator_SendsCaptionAsBottomText(t *testing.T) {
+	fake := &fakeImgflip{response: successResponse}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+	provider.WithCaptions(&MockCaptionGenerator{})
+
+	meme, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.Nil(t, err)
+	assert.Equal(t, "caption for food", meme.BottomText)
+	assert.Equal(t, "caption for food", fake.lastForm().Get("text1"))
+}
+
+func TestBuildMeme_WhenImgflipReportsFailure_ReturnsProviderError(t *testing.T) {
+	fake := &fakeImgflip{response: `{"success":false,"error_message":"Invalid username/password combination"}`}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.IsType(t, &error_types.ProviderError{}, err)
+	assert.Contains(t, err.Error(), "Invalid username/password combination")
+}
+
+func TestBuildMeme_WhenImgflipReturnsErrorStatus_ReturnsProviderError(t *testing.T) {
+	fake := &fakeImgflip{status: http.StatusServiceUnavailable, response: "down for maintenance"}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.IsType(t, &error_types.ProviderError{}, err)
+	assert.Contains(t, err.Error(), "503")
+}
+
+func TestBuildMeme_WhenResponseIsMalformed_ReturnsProviderError(t *testing.T) {
+	fake := &fakeImgflip{response: "<html>not json</html>"}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.IsType(t, &error_types.ProviderError{}, err)
+}
+
+func TestBuildMeme_WhenResponseHasNoURL_ReturnsProviderError(t *testing.T) {
+	fake := &fakeImgflip{response: `{"success":true,"data":{}}`}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.IsType(t, &error_types.ProviderError{}, err)
+}
+
+func TestBuildMeme_WhenImgflipIsSlow_TimesOut(t *testing.T) {
+	fake := &fakeImgflip{response: successResponse, delay: 200 * time.Millisecond}
+	provider, closeServer := testProvider(fake)
+	defer closeServer()
+	provider.WithTimeout(20 * time.Millisecond)
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.IsType(t, &error_types.ProviderError{}, err)
+}
+
+func TestBuildMeme_WhenServerIsUnreachable_ReturnsProviderError(t *testing.T) {
+	server := httptest.NewServer(&fakeImgflip{})
+	server.Close()
+	provider := NewImgflipProvider(server.URL, "test-user", "test-password")
+
+	_, err := provider.BuildMeme(&meme_service.QueryParams{Query: "food"})
+	assert.IsType(t, &error_types.ProviderError{}, err)
+}
+
+func TestNewImgflipProvider_WhenNoBaseURL_UsesImgflip(t *testing.T) {
+	provider := NewImgflipProvider("", "user", "password")
+	assert.Equal(t, DefaultBaseURL, provider.BaseURL)
+	assert.Equal(t, DefaultTimeout, provider.Client.Timeout)
+	assert.Equal(t, "imgflip", provider.Name())
+}
+
+func TestParseTemplateIds_WhenValid_ReturnsMap(t *testing.T) {
+	templateIds, err := ParseTemplateIds("drake=181913649, lunch-break = 438680,")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"drake": "181913649", "lunch-break": "438680"}, templateIds)
+}
+
+func TestParseTemplateIds_WhenIdIsNotNumeric_ReturnsError(t *testing.T) {
+	_, err := ParseTemplateIds("drake=hotline-bling")
+	assert.NotNil(t, err)
+}
@@ -5,11 +5,31 @@ import (
 	"fmt"
 
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	ai_provider "maas/ai-provider"
 	auth_service "maas/auth-service"
+	caption_generator "maas/caption-generator"
+	content_moderator "maas/content-moderator"
+	error_types "maas/error-types"
+	image_store "maas/image-store"
+	imgflip_provider "maas/imgflip-provider"
 	"maas/loggers"
+	meme_cache "maas/meme-cache"
+	meme_db "maas/meme-db"
+	meme_jobs "maas/meme-jobs"
+	meme_locales "maas/meme-locales"
 	meme_maker "maas/meme-maker"
+	meme_renderer "maas/meme-renderer"
 	meme_service "maas/meme-service"
+	meme_templates "maas/meme-templates"
+	"maas/models"
+	provider_chain "maas/provider-chain"
+	request_ids "maas/request-ids"
+	reverse_geocoder "maas/reverse-geocoder"
+	template_service "maas/template-service"
 	user_db "maas/user-db"
 	user_service "maas/user-service"
 
@@ -45,15 +65,392 @@ func connect(ctx context.Context) (*mongo.Client, error) {
 	return client, nil
 }
 
-func setupRouter(userService *user_service.UserService, memeService *meme_service.MemeService) *gin.Engine {
+// Uses the library bundled with the binary unless TEMPLATE_DIR points at another one
+func loadTemplates() (*meme_templates.Registry, error) {
+	templateDir := os.Getenv("TEMPLATE_DIR")
+	if templateDir == "" {
+		return meme_templates.Default()
+	}
+	return meme_templates.LoadDir(templateDir)
+}
+
+// CAPTION_SEED picks which captions the bottom text generator writes. The same seed always writes the
+// same caption for the same request. CAPTION_CORPUS_DIR can point at a different captions.txt, with
+// a captions.<lang>.txt next to it for each other language
+func loadCaptions() (*caption_generator.LocalizedGenerator, error) {
+	seed := int64(0)
+	if seedValue := os.Getenv("CAPTION_SEED"); seedValue != "" {
+		parsed, err := strconv.ParseInt(seedValue, 10, 64)
+		if err != nil {
+			return nil, &error_types.BadEnvironmentError{Err: err}
+		}
+		seed = parsed
+	}
+	if corpusDir := os.Getenv("CAPTION_CORPUS_DIR"); corpusDir != "" {
+		return caption_generator.LoadLocalizedFS(os.DirFS(corpusDir), seed)
+	}
+	return caption_generator.DefaultLocalized(seed)
+}
+
+// Rendered memes are cached in memory (MEME_CACHE_SIZE memes) and, when MEME_CACHE_DIR is set, on disk.
+// Everything that changes how a meme is rendered goes into the cache namespace. Bump MEME_CACHE_VERSION
+// when the templates change so stale renders on disk aren't served
+func loadMemeCache(provider meme_service.MemeProvider, renderer *meme_renderer.Renderer, captions *caption_generator.LocalizedGenerator) (*meme_cache.MemeCache, error) {
+	size := meme_cache.DefaultCapacity
+	if sizeValue := os.Getenv("MEME_CACHE_SIZE"); sizeValue != "" {
+		parsed, err := strconv.Atoi(sizeValue)
+		if err != nil {
+			return nil, &error_types.BadEnvironmentError{Err: err}
+		}
+		size = parsed
+	}
+	namespace := fmt.Sprintf("version=%s|templates=%s|seed=%d|format=%s|min_font=%g|overflow=%s|fonts=%s",
+		os.Getenv("MEME_CACHE_VERSION"), os.Getenv("TEMPLATE_DIR"), captions.Seed,
+		renderer.Format, renderer.MinFontSize, renderer.Overflow, os.Getenv("FALLBACK_FONTS"))
+	cache := meme_cache.NewMemeCache(provider, size).WithNamespace(namespace)
+	if cacheDir := os.Getenv("MEME_CACHE_DIR"); cacheDir != "" {
+		return cache.WithDisk(cacheDir)
+	}
+	return cache, nil
+}
+
+// Caption layout can be tuned with CAPTION_MIN_FONT_SIZE and CAPTION_OVERFLOW (truncate or reject).
+// FALLBACK_FONTS is a comma separated list of font files for characters Go Bold doesn't have, like CJK
+func loadRenderer() (*meme_renderer.Renderer, error) {
+	renderer, err := meme_renderer.NewRenderer()
+	if err != nil {
+		return nil, err
+	}
+	if minFontSize := os.Getenv("CAPTION_MIN_FONT_SIZE"); minFontSize != "" {
+		size, err := strconv.ParseFloat(minFontSize, 64)
+		if err != nil {
+			return nil, &error_types.BadEnvironmentError{Err: err}
+		}
+		renderer = renderer.WithMinFontSize(size)
+	}
+	if overflowName := os.Getenv("CAPTION_OVERFLOW"); overflowName != "" {
+		overflow, err := meme_renderer.ParseOverflow(overflowName)
+		if err != nil {
+			return nil, &error_types.BadEnvironmentError{Err: err}
+		}
+		renderer = renderer.WithOverflow(overflow)
+	}
+	for _, path := range strings.Split(os.Getenv("FALLBACK_FONTS"), ",") {
+		if strings.TrimSpace(path) == "" {
+			continue
+		}
+		fallback, err := meme_renderer.LoadFont(strings.TrimSpace(path))
+		if err != nil {
+			return nil, err
+		}
+		renderer = renderer.WithFallbackFonts(fallback)
+	}
+	return renderer, nil
+}
+
+// Builds the provider called name. The local meme maker is the default
+func loadProvider(name string, memeMaker *meme_maker.MemeMaker, captions *caption_generator.LocalizedGenerator) (meme_service.MemeProvider, error) {
+	switch name {
+	case "", "meme_maker":
+		return memeMaker, nil
+	case "defaults":
+		// Text only memes with none of the extras, the last resort when everything else is failing
+		return &renamedProvider{MemeProvider: meme_maker.NewMemeMaker(), name: "defaults"}, nil
+	case "imgflip":
+		provider := imgflip_provider.NewImgflipProvider(
+			os.Getenv("IMGFLIP_BASE_URL"),
+			os.Getenv("IMGFLIP_USERNAME"),
+			os.Getenv("IMGFLIP_PASSWORD")).
+			WithCaptions(captions)
+		if timeoutValue := os.Getenv("IMGFLIP_TIMEOUT"); timeoutValue != "" {
+			timeout, err := time.ParseDuration(timeoutValue)
+			if err != nil {
+				return nil, &error_types.BadEnvironmentError{Err: err}
+			}
+			provider = provider.WithTimeout(timeout)
+		}
+		if templatesValue := os.Getenv("IMGFLIP_TEMPLATES"); templatesValue != "" {
+			templateIds, err := imgflip_provider.ParseTemplateIds(templatesValue)
+			if err != nil {
+				return nil, &error_types.BadEnvironmentError{Err: err}
+			}
+			provider = provider.WithTemplateIds(templateIds)
+		}
+		return provider, nil
+	case "ai":
+		return loadAIProvider(memeMaker)
+	}
+	return nil, &error_types.BadEnvironmentError{Err: fmt.Errorf("unknown meme provider: %s", name)}
+}
+
+// Gives a provider a different name in responses and the meme history
+type renamedProvider struct {
+	meme_service.MemeProvider
+	name string
+}
+
+func (p *renamedProvider) Name() string {
+	return p.name
+}
+
+// Loads providers by name, each one once and behind its own render cache
+type providerSet struct {
+	memeMaker *meme_maker.MemeMaker
+	renderer  *meme_renderer.Renderer
+	captions  *caption_generator.LocalizedGenerator
+	loaded    map[string]meme_service.MemeProvider
+}
+
+func (p *providerSet) provider(name string) (meme_service.MemeProvider, error) {
+	if provider, ok := p.loaded[name]; ok {
+		return provider, nil
+	}
+	provider, err := loadProvider(name, p.memeMaker, p.captions)
+	if err != nil {
+		return nil, err
+	}
+	// The bare defaults are cheaper to make than to cache
+	if name != "defaults" {
+		provider, err = loadMemeCache(provider, p.renderer, p.captions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.loaded[name] = provider
+	return provider, nil
+}
+
+// The named provider followed by the PROVIDER_FALLBACKS, tried in order
+func (p *providerSet) chain(name string) (meme_service.MemeProvider, error) {
+	if name == "" {
+		name = "meme_maker"
+	}
+	providers := []meme_service.MemeProvider{}
+	seen := map[string]bool{}
+	for _, candidate := range append([]string{name}, strings.Split(os.Getenv("PROVIDER_FALLBACKS"), ",")...) {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "" || seen[candidate] {
+			continue
+		}
+		seen[candidate] = true
+		provider, err := p.provider(candidate)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+	if len(providers) == 1 {
+		return providers[0], nil
+	}
+
+	chain := provider_chain.NewChain(providers...)
+	if failuresValue := os.Getenv("BREAKER_FAILURES"); failuresValue != "" {
+		failures, err := strconv.Atoi(failuresValue)
+		if err != nil {
+			return nil, &error_types.BadEnvironmentError{Err: err}
+		}
+		chain.FailureThreshold = failures
+	}
+	if coolOffValue := os.Getenv("BREAKER_COOL_OFF"); coolOffValue != "" {
+		coolOff, err := time.ParseDuration(coolOffValue)
+		if err != nil {
+			return nil, &error_types.BadEnvironmentError{Err: err}
+		}
+		chain.CoolOff = coolOff
+	}
+	if timeoutValue := os.Getenv("PROVIDER_TIMEOUT"); timeoutValue != "" {
+		timeout, err := time.ParseDuration(timeoutValue)
+		if err != nil {
+			return nil, &error_types.BadEnvironmentError{Err: err}
+		}
+		chain = chain.WithTimeout(timeout)
+	}
+	return chain, nil
+}
+
+// PLAN_PROVIDERS maps plans onto providers, plan=provider comma separated
+func loadPlanProviders(memeService *meme_service.MemeService, providers *providerSet) error {
+	for _, pair := range strings.Split(os.Getenv("PLAN_PROVIDERS"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		planName, providerName, found := strings.Cut(pair, "=")
+		if !found {
+			return &error_types.BadEnvironmentError{Err: fmt.Errorf("bad plan provider: %s", pair)}
+		}
+		plan, err := models.ParsePlan(strings.TrimSpace(planName))
+		if err != nil {
+			return &error_types.BadEnvironmentError{Err: err}
+		}
+		provider, err := providers.chain(strings.TrimSpace(providerName))
+		if err != nil {
+			return err
+		}
+		memeService.WithPlanProvider(plan, provider)
+	}
+	return nil
+}
+
+func loadAIProvider(memeMaker *meme_maker.MemeMaker) (*ai_provider.AIProvider, error) {
+	provider := ai_provider.NewAIProvider(os.Getenv("AI_BASE_URL"), os.Getenv("AI_API_KEY"), memeMaker)
+	if model := os.Getenv("AI_MODEL"); model != "" {
+		provider = provider.WithModel(model)
+	}
+	if promptFile := os.Getenv("AI_PROMPT_FILE"); promptFile != "" {
+		prompt, err := ai_provider.LoadPrompt(promptFile)
+		if err != nil {
+			return nil, &error_types.BadEnvironmentError{Err: err}
+		}
+		provider = provider.WithPrompt(prompt)
+	}
+	if timeoutValue := os.Getenv("AI_TIMEOUT"); timeoutValue != "" {
+		timeout, err := time.ParseDuration(timeoutValue)
+		if err != nil {
+			return nil, &error_types.BadEnvironmentError{Err: err}
+		}
+		provider = provider.WithTimeout(timeout)
+	}
+	return provider, nil
+}
+
+// MODERATION_POLICY points at a JSON content policy to use instead of the bundled one
+func loadModerator() (*content_moderator.Policy, error) {
+	if policyFile := os.Getenv("MODERATION_POLICY"); policyFile != "" {
+		return content_moderator.Load(policyFile)
+	}
+	return content_moderator.Default()
+}
+
+// Background meme jobs run on JOB_WORKERS workers, with room for JOB_QUEUE_SIZE more waiting. Callback
+// URLs are only accepted when JOB_CALLBACK_SECRET is set, since that's what signs them
+func loadJobQueue() (*meme_jobs.Queue, error) {
+	workers := meme_jobs.DefaultWorkers
+	if workersValue := os.Getenv("JOB_WORKERS"); workersValue != "" {
+		parsed, err := strconv.Atoi(workersValue)
+		if err != nil {
+			return nil, &error_types.BadEnvironmentError{Err: err}
+		}
+		workers = parsed
+	}
+	capacity := meme_jobs.DefaultCapacity
+	if capacityValue := os.Getenv("JOB_QUEUE_SIZE"); capacityValue != "" {
+		parsed, err := strconv.Atoi(capacityValue)
+		if err != nil {
+			return nil, &error_types.BadEnvironmentError{Err: err}
+		}
+		capacity = parsed
+	}
+	queue := meme_jobs.NewQueue(workers, capacity)
+	if retentionValue := os.Getenv("JOB_RETENTION"); retentionValue != "" {
+		retention, err := time.ParseDuration(retentionValue)
+		if err != nil {
+			return nil, &error_types.BadEnvironmentError{Err: err}
+		}
+		queue = queue.WithRetention(retention)
+	}
+	if secret := os.Getenv("JOB_CALLBACK_SECRET"); secret != "" {
+		queue = queue.WithCallbacks(meme_jobs.NewCallbacks([]byte(secret)))
+	}
+	return queue, nil
+}
+
+// SERVICE_KEYS are the credentials other teams' services call us with, name=key comma separated
+func loadServiceKeys() (map[string]string, error) {
+	keys := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("SERVICE_KEYS"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, key, found := strings.Cut(pair, "=")
+		name, key = strings.TrimSpace(name), strings.TrimSpace(key)
+		if !found || name == "" || key == "" {
+			return nil, &error_types.BadEnvironmentError{Err: fmt.Errorf("bad service key for: %s", name)}
+		}
+		keys[name] = key
+	}
+	return keys, nil
+}
+
+// Responses to GET /memes sent with an Idempotency-Key are replayed to retries for IDEMPOTENCY_TTL. A
+// key whose first request never answered is freed when that request's reservation would have been
+func loadIdempotencyStore(client *mongo.Client, ctx *context.Context, reservationTimeout time.Duration) (*user_db.MongoDBIdempotencyStore, error) {
+	store := user_db.NewMongoDBIdempotencyStore(client, ctx).WithClaimTimeout(reservationTimeout)
+	if ttlValue := os.Getenv("IDEMPOTENCY_TTL"); ttlValue != "" {
+		ttl, err := time.ParseDuration(ttlValue)
+		if err != nil {
+			return nil, &error_types.BadEnvironmentError{Err: err}
+		}
+		store = store.WithTTL(ttl)
+	}
+	if err := store.EnsureIndexes(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Tokens are held for RESERVATION_TIMEOUT while a meme is made. Every RESERVATION_SWEEP_INTERVAL the
+// ones still held past that are given back
+func loadReservationTimings() (time.Duration, time.Duration, error) {
+	timeout := meme_service.DefaultReservationTimeout
+	if timeoutValue := os.Getenv("RESERVATION_TIMEOUT"); timeoutValue != "" {
+		parsed, err := time.ParseDuration(timeoutValue)
+		if err != nil {
+			return 0, 0, &error_types.BadEnvironmentError{Err: err}
+		}
+		timeout = parsed
+	}
+	interval := time.Minute
+	if intervalValue := os.Getenv("RESERVATION_SWEEP_INTERVAL"); intervalValue != "" {
+		parsed, err := time.ParseDuration(intervalValue)
+		if err != nil {
+			return 0, 0, &error_types.BadEnvironmentError{Err: err}
+		}
+		interval = parsed
+	}
+	return timeout, interval, nil
+}
+
+// Images go to local disk unless IMAGE_STORE is set to s3
+func loadImageStore() (meme_service.ImageStore, error) {
+	if os.Getenv("IMAGE_STORE") == "s3" {
+		store := image_store.NewS3ImageStore(
+			os.Getenv("S3_ENDPOINT"),
+			os.Getenv("S3_BUCKET"),
+			os.Getenv("S3_REGION"),
+			os.Getenv("S3_ACCESS_KEY"),
+			os.Getenv("S3_SECRET_KEY"))
+		return store.WithPublicURL(os.Getenv("S3_PUBLIC_URL")), nil
+	}
+
+	imageDir := os.Getenv("IMAGE_DIR")
+	if imageDir == "" {
+		imageDir = "meme-images"
+	}
+	return image_store.NewLocalImageStore(imageDir)
+}
+
+func setupRouter(userService *user_service.UserService, memeService *meme_service.MemeService, templateService *template_service.TemplateService) *gin.Engine {
 	router := gin.Default()
+	router.Use(request_ids.Middleware)
 	router.GET("/memes", memeService.GetMeme)
+	router.GET("/memes/cache", memeService.CacheStats)
+	router.GET("/memes/stream", memeService.StreamMeme)
+	router.POST("/memes/batch", memeService.BatchMemes)
+	router.POST("/memes/jobs", memeService.SubmitJob)
+	router.GET("/memes/jobs/:id", memeService.JobById)
+	router.GET("/memes/:id/image", memeService.MemeImage)
+	router.GET("/templates", templateService.AllTemplates)
+	router.GET("/templates/:id", templateService.TemplateById)
 	router.GET("/mongo", userService.Ping)
 	router.POST("/users/reset", userService.ResetDb)
 	router.GET("/users/debug", userService.AllUsersDebug)
 	router.GET("/users", userService.AllUsers)
 	router.POST("/users", userService.NewUser)
 	router.GET("/users/:id", userService.UserById)
+	router.GET("/users/:id/memes", userService.MemesByUser)
+	router.GET("/users/:id/ledger", userService.LedgerByUser)
+	router.POST("/users/:id/ledger/rebuild", userService.RebuildBalance)
+	router.POST("/users/:id/tokens/credit", userService.CreditTokens)
 	router.PATCH("/users/:id", userService.UpdateUser)
 	return router
 }
@@ -78,10 +475,103 @@ func main() {
 	}()
 
 	mongoUserDb := user_db.NewMongoDBUserRepository(client, &ctx)
-	authService := auth_service.NewAuthService(mongoUserDb)
-	userService := user_service.NewUserService(mongoUserDb, *authService)
-	memeService := meme_service.NewMemeService(mongoUserDb, *authService, &meme_maker.MemeMaker{})
-	router := setupRouter(userService, memeService)
+	if err := mongoUserDb.EnsureIndexes(); err != nil {
+		panic(err)
+	}
+	// Before the routes are up, so no balance is rebuilt from a ledger without its opening entry
+	backfilled, err := mongoUserDb.BackfillOpeningBalances()
+	if err != nil {
+		panic(err)
+	}
+	if backfilled > 0 {
+		loggers.InfoLog.Printf("Backfilled opening balances for %d users\n", backfilled)
+	}
+	serviceKeys, err := loadServiceKeys()
+	if err != nil {
+		panic(err)
+	}
+	authService := auth_service.NewAuthService(mongoUserDb).WithServiceKeys(serviceKeys)
+	mongoMemeDb := meme_db.NewMongoDBMemeRepository(client, &ctx)
+	if err := mongoMemeDb.EnsureIndexes(); err != nil {
+		panic(err)
+	}
+	userService := user_service.NewUserService(mongoUserDb, *authService).
+		WithMemeHistory(mongoMemeDb).
+		WithLedger(mongoUserDb)
+	renderer, err := loadRenderer()
+	if err != nil {
+		panic(err)
+	}
+	templates, err := loadTemplates()
+	if err != nil {
+		panic(err)
+	}
+	geocoder, err := reverse_geocoder.Default()
+	if err != nil {
+		panic(err)
+	}
+	captions, err := loadCaptions()
+	if err != nil {
+		panic(err)
+	}
+	locales, err := meme_locales.Default()
+	if err != nil {
+		panic(err)
+	}
+	memeMaker := meme_maker.NewMemeMaker().
+		WithRenderer(renderer).
+		WithTemplates(templates).
+		WithGeocoder(geocoder).
+		WithCaptions(captions).
+		WithLocalizer(locales)
+	providers := &providerSet{memeMaker: memeMaker, renderer: renderer, captions: captions, loaded: map[string]meme_service.MemeProvider{}}
+	provider, err := providers.chain(os.Getenv("MEME_PROVIDER"))
+	if err != nil {
+		panic(err)
+	}
+	images, err := loadImageStore()
+	if err != nil {
+		panic(err)
+	}
+	memeService := meme_service.NewMemeService(mongoUserDb, *authService, provider).
+		WithImageStore(images).
+		WithHistory(mongoMemeDb).
+		WithViolationLog(mongoMemeDb).
+		WithLanguages(locales)
+	reservationTimeout, sweepInterval, err := loadReservationTimings()
+	if err != nil {
+		panic(err)
+	}
+	memeService = memeService.WithReservationTimeout(reservationTimeout)
+	stopSweeping := make(chan struct{})
+	defer close(stopSweeping)
+	go meme_service.ReleaseStaleReservations(mongoUserDb, sweepInterval, stopSweeping)
+	jobs, err := loadJobQueue()
+	if err != nil {
+		panic(err)
+	}
+	defer jobs.Close()
+	memeService = memeService.WithJobs(jobs)
+	idempotency, err := loadIdempotencyStore(client, &ctx, reservationTimeout)
+	if err != nil {
+		panic(err)
+	}
+	memeService = memeService.WithIdempotency(idempotency)
+	if os.Getenv("MODERATION") != "off" {
+		moderator, err := loadModerator()
+		if err != nil {
+			panic(err)
+		}
+		memeService = memeService.WithModerator(moderator)
+	}
+	if err := loadPlanProviders(memeService, providers); err != nil {
+		panic(err)
+	}
+	if publicLinkSecret := os.Getenv("PUBLIC_LINK_SECRET"); publicLinkSecret != "" {
+		memeService = memeService.WithPublicLinks([]byte(publicLinkSecret))
+	}
+	templateService := template_service.NewTemplateService(templates, *authService)
+	router := setupRouter(userService, memeService, templateService)
 
 	rootURL := os.Getenv("ROOT_URL")
 	router.Run(rootURL)
@@ -0,0 +1,244 @@
+package meme_cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"maas/loggers"
+	meme_service "maas/meme-service"
+	"maas/models"
+
+	"golang.org/x/sync/singleflight"
+)
+
+/*
+  Caches built memes under a hash of everything that goes into them, so identical requests skip
+  the provider entirely. There are two tiers: an in-memory LRU, and optionally a directory on disk
+  that survives restarts. Memes found on disk are promoted back into memory.
+
+  Only successful builds are cached. The meme service charges tokens before it asks its provider
+  for a meme, so a cache hit costs the caller exactly what a miss does.
+*/
+
+const DefaultCapacity = 256
+
+var _ meme_service.MemeProvider = &MemeCache{}
+var _ meme_service.NamedProvider = &MemeCache{}
+var _ meme_service.CachingProvider = &MemeCache{}
+
+type entry struct {
+	key  string
+	meme *models.Meme
+}
+
+type MemeCache struct {
+	Provider meme_service.MemeProvider
+	// Mixed into every key. Needs to change whenever the provider would build something different
+	// for the same params (a new caption seed, different renderer settings, updated templates)
+	Namespace string
+	// Optional. Without a directory memes are only cached in memory
+	Dir string
+
+	mutex    sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	// Most recently used at the front
+	order  *list.List
+	stats  meme_service.CacheStats
+	builds singleflight.Group
+}
+
+// Keeps up to capacity memes in memory
+func NewMemeCache(provider meme_service.MemeProvider, capacity int) *MemeCache {
+	if capacity < 1 {
+		capacity = DefaultCapacity
+	}
+	return &MemeCache{
+		Provider: provider,
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+func (c *MemeCache) WithNamespace(namespace string) *MemeCache {
+	c.Namespace = namespace
+	return c
+}
+
+func (c *MemeCache) WithDisk(dir string) (*MemeCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c.Dir = dir
+	return c, nil
+}
+
+// The cache is invisible in the meme history, memes are credited to the provider that built them
+func (c *MemeCache) Name() string {
+	return meme_service.ProviderName(c.Provider)
+}
+
+func (c *MemeCache) BuildMeme(params *meme_service.QueryParams) (*models.Meme, error) {
+	key := c.Key(params)
+	if meme := c.fromMemory(key); meme != nil {
+		return meme, nil
+	}
+
+	// Identical requests that arrive together share a single build
+	result, err, _ := c.builds.Do(key, func() (interface{}, error) {
+		if meme := c.fromDisk(key); meme != nil {
+			c.remember(key, meme)
+			return meme, nil
+		}
+		c.mutex.Lock()
+		c.stats.Misses++
+		c.mutex.Unlock()
+
+		meme, err := c.Provider.BuildMeme(params)
+		if err != nil {
+			return nil, err
+		}
+		cached := copyMeme(meme)
+		c.remember(key, cached)
+		c.saveToDisk(key, cached)
+		return cached, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyMeme(result.(*models.Meme)), nil
+}
+
+// A content hash of the namespace, the provider and the params
+func (c *MemeCache) Key(params *meme_service.QueryParams) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%q\x00%q\x00%q\x00%.6f\x00%.6f\x00%q", c.Namespace, c.Name(), params.Query, params.Lat, params.Lon, params.Template)
+	// Only hashed in when set so English memes keep the keys they had before localization
+	if params.Lang != "" {
+		fmt.Fprintf(hash, "\x00%q", params.Lang)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (c *MemeCache) CacheStats() meme_service.CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Entries = c.order.Len()
+	stats.Capacity = c.capacity
+	return stats
+}
+
+func (c *MemeCache) fromMemory(key string) *models.Meme {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(element)
+	c.stats.Hits++
+	c.stats.MemoryHits++
+	return copyMeme(element.Value.(*entry).meme)
+}
+
+func (c *MemeCache) remember(key string, meme *models.Meme) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*entry).meme = meme
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&entry{key: key, meme: meme})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).key)
+	}
+}
+
+// Memes are spread over subdirectories named after the first two characters of their key
+func (c *MemeCache) diskPath(key string) string {
+	return filepath.Join(c.Dir, key[:2], key+".json")
+}
+
+// Anything unreadable on disk is treated as a miss and gets rebuilt
+func (c *MemeCache) fromDisk(key string) *models.Meme {
+	if c.Dir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.diskPath(key))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			loggers.ErrorLog.Printf("Encountered an error reading a cached meme: %s\n", err)
+		}
+		return nil
+	}
+	var meme models.Meme
+	if err := json.Unmarshal(data, &meme); err != nil {
+		loggers.ErrorLog.Printf("Encountered an error reading a cached meme: %s\n", err)
+		return nil
+	}
+
+	c.mutex.Lock()
+	c.stats.Hits++
+	c.stats.DiskHits++
+	c.mutex.Unlock()
+	return &meme
+}
+
+func (c *MemeCache) saveToDisk(key string, meme *models.Meme) {
+	if c.Dir == "" {
+		return
+	}
+	data, err := json.Marshal(meme)
+	if err == nil {
+		err = writeFileAtomically(c.diskPath(key), data)
+	}
+	if err != nil {
+		loggers.ErrorLog.Printf("Encountered an error caching a meme on disk: %s\n", err)
+	}
+}
+
+// Writes to a temporary file first so a half written meme is never read back
+func writeFileAtomically(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// The meme service fills in IDs and swaps images for links on the memes it gets back,
+// so callers always get their own copy
+func copyMeme(meme *models.Meme) *models.Meme {
+	copied := *meme
+	if meme.Place != nil {
+		place := *meme.Place
+		copied.Place = &place
+	}
+	return &copied
+}
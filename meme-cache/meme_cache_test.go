@@ -0,0 +1,207 @@
+package meme_cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"maas/loggers"
+	meme_service "maas/meme-service"
+	"maas/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	loggers.SilentInit()
+	m.Run()
+}
+
+// Counts how many memes it actually builds
+type CountingProvider struct {
+	mutex  sync.Mutex
+	builds int
+	// Optional. Builds wait on it when set
+	release chan struct{}
+}
+
+func (p *CountingProvider) BuildMeme(params *meme_service.QueryParams) (*models.Meme, error) {
+	if p.release != nil {
+		<-p.release
+	}
+	p.mutex.Lock()
+	p.builds++
+	p.mutex.Unlock()
+	if params.Query == "raiseError" {
+		return nil, errors.New("test")
+	}
+	return &models.Meme{
+		TopText:     params.Query,
+		BottomText:  "Bottom Text",
+		Image:       []byte("png data"),
+		ImageFormat: "png",
+		Place:       &models.Place{City: "Testville"},
+	}, nil
+}
+
+func (p *CountingProvider) Name() string {
+	return "counting"
+}
+
+func TestBuildMeme_WithSameParams_OnlyBuildsOnce(t *testing.T) {
+	provider := &CountingProvider{}
+	cache := NewMemeCache(provider, 10)
+	params := &meme_service.QueryParams{Query: "hello", Template: "classic"}
+
+	first, err := cache.BuildMeme(params)
+	assert.Nil(t, err)
+	second, err := cache.BuildMeme(&meme_service.QueryParams{Query: "hello", Template: "classic"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, provider.builds)
+	assert.Equal(t, first, second)
+	assert.Equal(t, meme_service.CacheStats{Hits: 1, MemoryHits: 1, Misses: 1, Entries: 1, Capacity: 10}, cache.CacheStats())
+}
+
+func TestBuildMeme_WithDifferentParams_BuildsEach(t *testing.T) {
+	provider := &CountingProvider{}
+	cache := NewMemeCache(provider, 10)
+	for _, params := range []*meme_service.QueryParams{
+		{Query: "hello"},
+		{Query: "hello", Template: "classic"},
+		{Query: "hello", Lat: 1, Lon: 2},
+		{Query: "hello", Lat: 2, Lon: 1},
+		{Query: "goodbye"},
+	} {
+		_, err := cache.BuildMeme(params)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 5, provider.builds)
+	assert.Equal(t, int64(5), cache.CacheStats().Misses)
+}
+
+func TestBuildMeme_ReturnsCopiesCallersCanChange(t *testing.T) {
+	cache := NewMemeCache(&CountingProvider{}, 10)
+	params := &meme_service.QueryParams{Query: "hello"}
+
+	first, _ := cache.BuildMeme(params)
+	first.ID = "changed"
+	first.Image = nil
+	first.Place.City = "Elsewhere"
+
+	second, _ := cache.BuildMeme(params)
+	assert.Equal(t, "", second.ID)
+	assert.Equal(t, []byte("png data"), second.Image)
+	assert.Equal(t, "Testville", second.Place.City)
+}
+
+func TestBuildMeme_WhenProviderErrors_DoesNotCacheIt(t *testing.T) {
+	provider := &CountingProvider{}
+	cache := NewMemeCache(provider, 10)
+	params := &meme_service.QueryParams{Query: "raiseError"}
+
+	_, err := cache.BuildMeme(params)
+	assert.Error(t, err)
+	_, err = cache.BuildMeme(params)
+	assert.Error(t, err)
+	assert.Equal(t, 2, provider.builds)
+	assert.Equal(t, 0, cache.CacheStats().Entries)
+}
+
+func TestBuildMeme_WhenFull_EvictsLeastRecentlyUsed(t *testing.T) {
+	provider := &CountingProvider{}
+	cache := NewMemeCache(provider, 2)
+	cache.BuildMeme(&meme_service.QueryParams{Query: "a"})
+	cache.BuildMeme(&meme_service.QueryParams{Query: "b"})
+	// Using a again makes b the oldest
+	cache.BuildMeme(&meme_service.QueryParams{Query: "a"})
+	cache.BuildMeme(&meme_service.QueryParams{Query: "c"})
+	assert.Equal(t, 3, provider.builds)
+
+	cache.BuildMeme(&meme_service.QueryParams{Query: "a"})
+	assert.Equal(t, 3, provider.builds)
+	cache.BuildMeme(&meme_service.QueryParams{Query: "b"})
+	assert.Equal(t, 4, provider.builds)
+	assert.Equal(t, 2, cache.CacheStats().Entries)
+}
+
+func TestKey_DependsOnNamespace(t *testing.T) {
+	params := &meme_service.QueryParams{Query: "hello"}
+	first := NewMemeCache(&CountingProvider{}, 10).WithNamespace("seed=1")
+	second := NewMemeCache(&CountingProvider{}, 10).WithNamespace("seed=2")
+	assert.NotEqual(t, first.Key(params), second.Key(params))
+	assert.Equal(t, first.Key(params), first.Key(&meme_service.QueryParams{Query: "hello"}))
+	assert.Len(t, first.Key(params), 64)
+}
+
+func TestKey_DependsOnLang(t *testing.T) {
+	cache := NewMemeCache(&CountingProvider{}, 10)
+	english := cache.Key(&meme_service.QueryParams{Query: "hello"})
+	assert.NotEqual(t, english, cache.Key(&meme_service.QueryParams{Query: "hello", Lang: "es"}))
+	assert.Equal(t, english, cache.Key(&meme_service.QueryParams{Query: "hello", Lang: ""}))
+}
+
+func TestBuildMeme_WithDisk_SurvivesARestart(t *testing.T) {
+	dir := t.TempDir()
+	provider := &CountingProvider{}
+	first, err := NewMemeCache(provider, 10).WithDisk(dir)
+	assert.Nil(t, err)
+	built, _ := first.BuildMeme(&meme_service.QueryParams{Query: "hello"})
+
+	second, _ := NewMemeCache(provider, 10).WithDisk(dir)
+	cached, err := second.BuildMeme(&meme_service.QueryParams{Query: "hello"})
+	assert.Nil(t, err)
+	assert.Equal(t, built, cached)
+	assert.Equal(t, 1, provider.builds)
+
+	// Promoted into memory, so the next one doesn't touch the disk
+	second.BuildMeme(&meme_service.QueryParams{Query: "hello"})
+	assert.Equal(t, meme_service.CacheStats{Hits: 2, MemoryHits: 1, DiskHits: 1, Entries: 1, Capacity: 10}, second.CacheStats())
+}
+
+func TestBuildMeme_WhenDiskEntryIsCorrupt_RebuildsIt(t *testing.T) {
+	dir := t.TempDir()
+	provider := &CountingProvider{}
+	cache, _ := NewMemeCache(provider, 10).WithDisk(dir)
+	params := &meme_service.QueryParams{Query: "hello"}
+	path := cache.diskPath(cache.Key(params))
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Nil(t, os.WriteFile(path, []byte("{not json"), 0644))
+
+	meme, err := cache.BuildMeme(params)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", meme.TopText)
+	assert.Equal(t, 1, provider.builds)
+}
+
+func TestBuildMeme_WhenIdenticalRequestsArriveTogether_BuildsOnce(t *testing.T) {
+	provider := &CountingProvider{release: make(chan struct{})}
+	cache := NewMemeCache(provider, 10)
+
+	var wait sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			meme, err := cache.BuildMeme(&meme_service.QueryParams{Query: "popular"})
+			assert.Nil(t, err)
+			assert.Equal(t, "popular", meme.TopText)
+		}()
+	}
+	// Give every request a chance to start waiting on the first build
+	time.Sleep(50 * time.Millisecond)
+	close(provider.release)
+	wait.Wait()
+	assert.Equal(t, 1, provider.builds)
+}
+
+func TestName_UsesTheProvidersName(t *testing.T) {
+	assert.Equal(t, "counting", NewMemeCache(&CountingProvider{}, 10).Name())
+}
+
+func TestNewMemeCache_WithoutCapacity_UsesDefault(t *testing.T) {
+	assert.Equal(t, DefaultCapacity, NewMemeCache(&CountingProvider{}, 0).CacheStats().Capacity)
+}
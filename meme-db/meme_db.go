@@ -0,0 +1,91 @@
+package meme_db
+
+import (
+	"context"
+
+	meme_service "maas/meme-service"
+	"maas/models"
+	user_service "maas/user-service"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Keeps the history of every meme made in the maas_memes collection, and the requests the content
+// policy turned away in maas_violations
+type MongoDBMemeRepository struct {
+	client *mongo.Client
+	ctx    *context.Context
+}
+
+var _ meme_service.MemeHistory = &MongoDBMemeRepository{}
+var _ meme_service.ViolationLog = &MongoDBMemeRepository{}
+var _ user_service.MemeHistoryRepository = &MongoDBMemeRepository{}
+
+func NewMongoDBMemeRepository(client *mongo.Client, ctx *context.Context) *MongoDBMemeRepository {
+	return &MongoDBMemeRepository{client: client, ctx: ctx}
+}
+
+func (m *MongoDBMemeRepository) SaveMeme(record *models.MemeRecord) error {
+	database := m.client.Database("maas")
+	maas_memes_collection := database.Collection("maas_memes")
+
+	_, err := maas_memes_collection.InsertOne(*m.ctx, record)
+	return err
+}
+
+func (m *MongoDBMemeRepository) SaveViolation(violation *models.Violation) error {
+	database := m.client.Database("maas")
+	maas_violations_collection := database.Collection("maas_violations")
+
+	_, err := maas_violations_collection.InsertOne(*m.ctx, violation)
+	return err
+}
+
+// Newest first, at most limit of them. When before is set the page starts with the meme after it
+func (m *MongoDBMemeRepository) MemesByUser(userId string, before string, limit int) ([]models.MemeRecord, error) {
+	database := m.client.Database("maas")
+	maas_memes_collection := database.Collection("maas_memes")
+
+	filter := bson.M{"user_id": userId}
+	if before != "" {
+		beforeId, err := primitive.ObjectIDFromHex(before)
+		if err != nil {
+			return nil, err
+		}
+		filter["_id"] = bson.M{"$lt": beforeId}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(limit))
+
+	cursor, err := maas_memes_collection.Find(*m.ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	memes := []models.MemeRecord{}
+	if err := cursor.All(*m.ctx, &memes); err != nil {
+		return nil, err
+	}
+	return memes, nil
+}
+
+// Lets the history for a user be paged through without scanning the whole collection
+func (m *MongoDBMemeRepository) EnsureIndexes() error {
+	database := m.client.Database("maas")
+	maas_memes_collection := database.Collection("maas_memes")
+
+	_, err := maas_memes_collection.Indexes().CreateOne(*m.ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "_id", Value: -1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	maas_violations_collection := database.Collection("maas_violations")
+	_, err = maas_violations_collection.Indexes().CreateOne(*m.ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "created_at", Value: -1}},
+	})
+	return err
+}
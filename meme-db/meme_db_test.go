@@ -0,0 +1,147 @@
+package meme_db_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"testing"
+	"time"
+
+	meme_db "maas/meme-db"
+	"maas/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/strikesecurity/strikememongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ctx        context.Context
+	database   *mongo.Database
+	repository *meme_db.MongoDBMemeRepository
+)
+
+// Same in-memory mongo as the user_db tests
+func TestMain(m *testing.M) {
+	mongoServer, err := strikememongo.Start("4.2.1")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer mongoServer.Stop()
+
+	ctx = context.Background()
+	uri := fmt.Sprintf("%s/maas?retryWrites=false", mongoServer.URI())
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		log.Fatal("error connecting to database", err)
+	}
+	database = client.Database("maas")
+	repository = meme_db.NewMongoDBMemeRepository(client, &ctx)
+	if err := repository.EnsureIndexes(); err != nil {
+		log.Fatal("error creating indexes", err)
+	}
+	m.Run()
+}
+
+func cleanup() {
+	database.Collection("maas_memes").DeleteMany(ctx, bson.M{})
+	database.Collection("maas_violations").DeleteMany(ctx, bson.M{})
+}
+
+// Saves count memes for userId, oldest first
+func saveMemes(t *testing.T, userId string, count int) []*models.MemeRecord {
+	saved := []*models.MemeRecord{}
+	for i := 0; i < count; i++ {
+		record := &models.MemeRecord{
+			ID:        primitive.NewObjectID(),
+			UserId:    userId,
+			Params:    models.MemeParams{Query: fmt.Sprintf("meme %d", i)},
+			Provider:  "meme_maker",
+			Cost:      1,
+			CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+		}
+		assert.Nil(t, repository.SaveMeme(record))
+		saved = append(saved, record)
+	}
+	return saved
+}
+
+func TestSaveMeme_RoundTripsTheRecord(t *testing.T) {
+	cleanup()
+	record := &models.MemeRecord{
+		ID:            primitive.NewObjectID(),
+		UserId:        "alice",
+		Params:        models.MemeParams{Query: "food", Lat: 40.7, Lon: -73.9, Template: "lunch-break", Lang: "es"},
+		TemplateId:    "lunch-break",
+		Provider:      "meme_maker",
+		Cost:          1,
+		ImageLocation: "/memes/1/image",
+		CreatedAt:     time.Now().UTC().Truncate(time.Millisecond),
+	}
+	assert.Nil(t, repository.SaveMeme(record))
+
+	memes, err := repository.MemesByUser("alice", "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, memes, 1)
+	assert.Equal(t, *record, memes[0])
+}
+
+func TestMemesByUser_IsNewestFirstAndOnlyTheUsers(t *testing.T) {
+	cleanup()
+	alices := saveMemes(t, "alice", 3)
+	saveMemes(t, "bob", 2)
+
+	memes, err := repository.MemesByUser("alice", "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, memes, 3)
+	for i, meme := range memes {
+		assert.Equal(t, alices[len(alices)-1-i].ID, meme.ID)
+	}
+
+	memes, err = repository.MemesByUser("nobody", "", 10)
+	assert.Nil(t, err)
+	assert.Empty(t, memes)
+}
+
+func TestMemesByUser_PagesFromBefore(t *testing.T) {
+	cleanup()
+	saved := saveMemes(t, "alice", 5)
+
+	page, err := repository.MemesByUser("alice", "", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []primitive.ObjectID{saved[4].ID, saved[3].ID}, ids(page))
+
+	page, err = repository.MemesByUser("alice", page[1].ID.Hex(), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []primitive.ObjectID{saved[2].ID, saved[1].ID}, ids(page))
+
+	page, err = repository.MemesByUser("alice", page[1].ID.Hex(), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []primitive.ObjectID{saved[0].ID}, ids(page))
+}
+
+func TestMemesByUser_WithABadBefore_RaisesAnError(t *testing.T) {
+	_, err := repository.MemesByUser("alice", "yesterday", 2)
+	assert.NotNil(t, err)
+}
+
+func TestSaveViolation_IsKept(t *testing.T) {
+	cleanup()
+	violation := &models.Violation{ID: primitive.NewObjectID(), UserId: "alice", Rule: "pii", CreatedAt: time.Now().UTC()}
+	assert.Nil(t, repository.SaveViolation(violation))
+
+	count, err := database.Collection("maas_violations").CountDocuments(ctx, bson.M{"user_id": "alice", "rule": "pii"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func ids(memes []models.MemeRecord) []primitive.ObjectID {
+	found := []primitive.ObjectID{}
+	for _, meme := range memes {
+		found = append(found, meme.ID)
+	}
+	return found
+}
@@ -0,0 +1,159 @@
+package meme_jobs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"maas/models"
+)
+
+const (
+	DefaultMaxAttempts = 5
+	DefaultBackoff     = time.Second
+	DefaultTimeout     = 10 * time.Second
+
+	SignatureHeader = "X-Maas-Signature"
+	TimestampHeader = "X-Maas-Timestamp"
+	JobHeader       = "X-Maas-Job"
+)
+
+// POSTs finished jobs to their callback URLs. Each POST is signed with an HMAC-SHA256 of
+// "<timestamp>.<body>" so receivers can check it came from us and isn't being replayed. Failed
+// deliveries are retried with a doubling backoff
+type Callbacks struct {
+	Secret []byte
+	// Only connects to public addresses, so a callback URL can't reach our own network
+	Client *http.Client
+	// Deliveries are given up on after this many tries
+	MaxAttempts int
+	// The wait before the first retry, doubled for each one after it
+	Backoff time.Duration
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func NewCallbacks(secret []byte) *Callbacks {
+	return &Callbacks{
+		Secret:      secret,
+		Client:      publicClient(),
+		MaxAttempts: DefaultMaxAttempts,
+		Backoff:     DefaultBackoff,
+		now:         time.Now,
+		sleep:       time.Sleep,
+	}
+}
+
+func (c *Callbacks) WithRetries(maxAttempts int, backoff time.Duration) *Callbacks {
+	c.MaxAttempts = maxAttempts
+	c.Backoff = backoff
+	return c
+}
+
+// Callback URLs come from users, so every connection is checked once the host has been resolved,
+// which also covers redirects and DNS that changes between the check and the POST. There's no proxy,
+// since its address would be the one checked
+func publicClient() *http.Client {
+	dialer := &net.Dialer{Timeout: DefaultTimeout, Control: refuseNonPublic}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: DefaultTimeout,
+	}
+	return &http.Client{Timeout: DefaultTimeout, Transport: transport}
+}
+
+// The callback resolved to an address inside our own network
+type blockedAddressError struct {
+	Address string
+}
+
+func (e *blockedAddressError) Error() string {
+	return fmt.Sprintf("callbacks can't be sent to %s", e.Address)
+}
+
+// 100.64.0.0/10, which carrier-grade NAT and some cloud metadata services use
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Loopback, link-local (where cloud metadata lives), private and other non-routable addresses aren't public
+func publicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+func refuseNonPublic(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return &blockedAddressError{Address: host}
+	}
+	return nil
+}
+
+// The hex signature for a callback body sent at timestamp
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sends the job to its callback URL until it's accepted or MaxAttempts run out. Server errors,
+// 429s and failed connections are retried, unless the connection was refused for not being public. Any other status means the receiver doesn't want it
+func (c *Callbacks) Deliver(job *models.MemeJob) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	backoff := c.Backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := c.post(job, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= c.MaxAttempts {
+			return fmt.Errorf("after %d attempts: %w", attempt, err)
+		}
+		c.sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Reports whether a failed POST is worth trying again
+func (c *Callbacks) post(job *models.MemeJob, body []byte) (bool, error) {
+	request, err := http.NewRequest(http.MethodPost, job.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	// Signed afresh each attempt so the timestamp says when it was actually sent
+	timestamp := strconv.FormatInt(c.now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(TimestampHeader, timestamp)
+	request.Header.Set(SignatureHeader, Sign(c.Secret, timestamp, body))
+	request.Header.Set(JobHeader, job.ID)
+
+	response, err := c.Client.Do(request)
+	if err != nil {
+		var blocked *blockedAddressError
+		return !errors.As(err, &blocked), err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("callback answered %s", response.Status)
+	return response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests, err
+}
@@ -0,0 +1,191 @@
+package meme_jobs
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	error_types "maas/error-types"
+	"maas/loggers"
+	meme_service "maas/meme-service"
+	"maas/models"
+)
+
+/*
+  An in-process version of the queue and worker setup from TheEssayPortion.md. Submitted jobs wait
+  in a bounded queue until one of a fixed pool of workers picks them up, so slow providers (AI,
+  animated renders) don't hold a request open and can't take on more work than there are workers.
+
+  Jobs are kept in memory so they can be polled, and dropped Retention after they finish. They
+  don't survive a restart. When a job has a callback URL, the finished job is also POSTed to it,
+  signed and retried by Callbacks.
+*/
+
+const (
+	DefaultWorkers   = 4
+	DefaultCapacity  = 100
+	DefaultRetention = time.Hour
+)
+
+var _ meme_service.JobQueue = &Queue{}
+
+type Queue struct {
+	// How long finished jobs can still be polled for
+	Retention time.Duration
+	// Optional. Without callbacks, jobs can only be polled
+	Callbacks *Callbacks
+
+	tasks      chan *task
+	mutex      sync.Mutex
+	jobs       map[string]*models.MemeJob
+	closed     bool
+	workers    sync.WaitGroup
+	deliveries sync.WaitGroup
+	now        func() time.Time
+}
+
+type task struct {
+	id   string
+	work meme_service.JobWork
+}
+
+// Starts workers goroutines working through a queue that holds up to capacity waiting jobs
+func NewQueue(workers int, capacity int) *Queue {
+	q := &Queue{
+		Retention: DefaultRetention,
+		tasks:     make(chan *task, capacity),
+		jobs:      map[string]*models.MemeJob{},
+		now:       time.Now,
+	}
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+func (q *Queue) WithCallbacks(callbacks *Callbacks) *Queue {
+	q.Callbacks = callbacks
+	return q
+}
+
+func (q *Queue) WithRetention(retention time.Duration) *Queue {
+	q.Retention = retention
+	return q
+}
+
+func (q *Queue) AcceptsCallbacks() bool {
+	return q.Callbacks != nil
+}
+
+func (q *Queue) Submit(job *models.MemeJob, work meme_service.JobWork) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return fmt.Errorf("the job queue is closed")
+	}
+	q.prune()
+
+	queued := *job
+	select {
+	case q.tasks <- &task{id: job.ID, work: work}:
+		q.jobs[job.ID] = &queued
+		return nil
+	default:
+		return &error_types.QueueFullError{}
+	}
+}
+
+func (q *Queue) Job(id string) (*models.MemeJob, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, &error_types.JobNotFoundError{ID: id}
+	}
+	snapshot := *job
+	return &snapshot, nil
+}
+
+// Stops taking jobs and waits for the ones already queued, and their callbacks, to finish
+func (q *Queue) Close() {
+	q.mutex.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.tasks)
+	}
+	q.mutex.Unlock()
+	q.workers.Wait()
+	q.deliveries.Wait()
+}
+
+func (q *Queue) work() {
+	defer q.workers.Done()
+	for task := range q.tasks {
+		q.run(task)
+	}
+}
+
+func (q *Queue) run(task *task) {
+	q.update(task.id, func(job *models.MemeJob) {
+		started := q.now().UTC()
+		job.Status = models.JobRunning
+		job.StartedAt = &started
+	})
+
+	meme, failure := q.perform(task)
+
+	finished := q.update(task.id, func(job *models.MemeJob) {
+		now := q.now().UTC()
+		job.FinishedAt = &now
+		if failure != nil {
+			job.Status = models.JobFailed
+			job.Error = failure.Error
+			job.ErrorStatus = failure.Status
+			job.Violation = failure.Violation
+			return
+		}
+		job.Status = models.JobSucceeded
+		job.Meme = meme
+	})
+	if finished.CallbackURL != "" && q.Callbacks != nil {
+		q.deliveries.Add(1)
+		go func() {
+			defer q.deliveries.Done()
+			if err := q.Callbacks.Deliver(&finished); err != nil {
+				loggers.ErrorLog.Printf("Giving up on the callback for job %s: %s\n", finished.ID, err)
+			}
+		}()
+	}
+}
+
+// Runs the job's work, turning a panic into a failed job so the worker lives on
+func (q *Queue) perform(task *task) (meme *models.Meme, failure *meme_service.MemeFailure) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			loggers.ErrorLog.Printf("Job %s panicked: %v\n", task.id, recovered)
+			meme, failure = nil, &meme_service.MemeFailure{Status: http.StatusInternalServerError, Error: "Unable to make meme"}
+		}
+	}()
+	return task.work()
+}
+
+// Changes the job under the lock and returns a copy of how it ended up
+func (q *Queue) update(id string, change func(job *models.MemeJob)) models.MemeJob {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	job := q.jobs[id]
+	change(job)
+	return *job
+}
+
+// Forgets jobs that finished more than Retention ago. Called with the lock held
+func (q *Queue) prune() {
+	cutoff := q.now().Add(-q.Retention)
+	for id, job := range q.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+			delete(q.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package meme_jobs
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	error_types "maas/error-types"
+	"maas/loggers"
+	meme_service "maas/meme-service"
+	"maas/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	loggers.SilentInit()
+	m.Run()
+}
+
+func succeed(meme *models.Meme) meme_service.JobWork {
+	return func() (*models.Meme, *meme_service.MemeFailure) { return meme, nil }
+}
+
+func TestSubmit_RunsTheJobAndKeepsTheMeme(t *testing.T) {
+	queue := NewQueue(2, 10)
+	job := &models.MemeJob{ID: "a", Status: models.JobQueued}
+	assert.Nil(t, queue.Submit(job, succeed(&models.Meme{TopText: "done"})))
+	queue.Close()
+
+	finished, err := queue.Job("a")
+	assert.Nil(t, err)
+	assert.Equal(t, models.JobSucceeded, finished.Status)
+	assert.Equal(t, "done", finished.Meme.TopText)
+	assert.NotNil(t, finished.StartedAt)
+	assert.NotNil(t, finished.FinishedAt)
+	assert.True(t, finished.Done())
+	assert.Equal(t, models.JobQueued, job.Status, "the submitted job isn't shared with the queue")
+}
+
+func TestSubmit_WhenWorkFails_RecordsTheFailure(t *testing.T) {
+	queue := NewQueue(1, 10)
+	failure := &meme_service.MemeFailure{Status: http.StatusBadGateway, Error: "provider down"}
+	queue.Submit(&models.MemeJob{ID: "a"}, func() (*models.Meme, *meme_service.MemeFailure) { return nil, failure })
+	queue.Submit(&models.MemeJob{ID: "b"}, func() (*models.Meme, *meme_service.MemeFailure) { panic("boom") })
+	queue.Close()
+
+	failed, _ := queue.Job("a")
+	assert.Equal(t, models.JobFailed, failed.Status)
+	assert.Equal(t, "provider down", failed.Error)
+	assert.Equal(t, http.StatusBadGateway, failed.ErrorStatus)
+	assert.Nil(t, failed.Meme)
+
+	panicked, _ := queue.Job("b")
+	assert.Equal(t, models.JobFailed, panicked.Status)
+	assert.Equal(t, http.StatusInternalServerError, panicked.ErrorStatus)
+}
+
+func TestSubmit_WhenQueueIsFull_RaisesQueueFull(t *testing.T) {
+	queue := NewQueue(1, 1)
+	release := make(chan bool)
+	started := make(chan bool)
+	blocking := func() (*models.Meme, *meme_service.MemeFailure) {
+		started <- true
+		<-release
+		return &models.Meme{}, nil
+	}
+	assert.Nil(t, queue.Submit(&models.MemeJob{ID: "running"}, blocking))
+	<-started
+	assert.Nil(t, queue.Submit(&models.MemeJob{ID: "waiting"}, succeed(&models.Meme{})))
+
+	err := queue.Submit(&models.MemeJob{ID: "rejected"}, succeed(&models.Meme{}))
+	assert.IsType(t, &error_types.QueueFullError{}, err)
+	_, err = queue.Job("rejected")
+	assert.IsType(t, &error_types.JobNotFoundError{}, err)
+
+	running, _ := queue.Job("running")
+	assert.Equal(t, models.JobRunning, running.Status)
+	close(release)
+	queue.Close()
+}
+
+func TestSubmit_WhenClosed_RaisesAnError(t *testing.T) {
+	queue := NewQueue(1, 1)
+	queue.Close()
+	assert.Error(t, queue.Submit(&models.MemeJob{ID: "a"}, succeed(&models.Meme{})))
+}
+
+func TestJob_IsForgottenAfterRetention(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var mutex sync.Mutex
+	queue := NewQueue(1, 10).WithRetention(time.Minute)
+	queue.now = func() time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return now
+	}
+	queue.Submit(&models.MemeJob{ID: "old"}, succeed(&models.Meme{}))
+	waitFor(t, queue, "old")
+
+	mutex.Lock()
+	now = now.Add(2 * time.Minute)
+	mutex.Unlock()
+	queue.Submit(&models.MemeJob{ID: "new"}, succeed(&models.Meme{}))
+	defer queue.Close()
+	_, err := queue.Job("old")
+	assert.IsType(t, &error_types.JobNotFoundError{}, err)
+	_, err = queue.Job("new")
+	assert.Nil(t, err)
+}
+
+func waitFor(t *testing.T, queue *Queue, id string) {
+	for i := 0; i < 1000; i++ {
+		if job, _ := queue.Job(id); job != nil && job.Done() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("job %s never finished", id)
+}
+
+// Records every callback and answers with the statuses it's given, then 200s
+type fakeReceiver struct {
+	mutex    sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (f *fakeReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	f.requests = append(f.requests, r)
+	f.bodies = append(f.bodies, body)
+	status := http.StatusOK
+	if len(f.statuses) > 0 {
+		status, f.statuses = f.statuses[0], f.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func testCallbacks() (*Callbacks, *[]time.Duration) {
+	waits := []time.Duration{}
+	callbacks := NewCallbacks([]byte("secret")).WithRetries(3, time.Second)
+	// The receivers are on loopback, which the real client won't connect to
+	callbacks.Client = &http.Client{Timeout: time.Second}
+	callbacks.sleep = func(wait time.Duration) { waits = append(waits, wait) }
+	return callbacks, &waits
+}
+
+func TestSubmit_WithCallbackURL_PostsTheSignedJob(t *testing.T) {
+	receiver := &fakeReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	callbacks, _ := testCallbacks()
+	queue := NewQueue(1, 10).WithCallbacks(callbacks)
+	assert.True(t, queue.AcceptsCallbacks())
+
+	queue.Submit(&models.MemeJob{ID: "a", CallbackURL: server.URL}, succeed(&models.Meme{TopText: "done"}))
+	queue.Close()
+
+	assert.Len(t, receiver.requests, 1)
+	request := receiver.requests[0]
+	assert.Equal(t, "a", request.Header.Get(JobHeader))
+	timestamp := request.Header.Get(TimestampHeader)
+	assert.Equal(t, Sign([]byte("secret"), timestamp, receiver.bodies[0]), request.Header.Get(SignatureHeader))
+	assert.Contains(t, string(receiver.bodies[0]), `"status":"succeeded"`)
+	assert.Contains(t, string(receiver.bodies[0]), `"top_text":"done"`)
+}
+
+func TestDeliver_RetriesServerErrorsWithBackoff(t *testing.T) {
+	receiver := &fakeReceiver{statuses: []int{http.StatusInternalServerError, http.StatusTooManyRequests}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	callbacks, waits := testCallbacks()
+
+	err := callbacks.Deliver(&models.MemeJob{ID: "a", CallbackURL: server.URL})
+	assert.Nil(t, err)
+	assert.Len(t, receiver.requests, 3)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, *waits)
+}
+
+func TestDeliver_GivesUpAfterMaxAttempts(t *testing.T) {
+	receiver := &fakeReceiver{statuses: []int{502, 502, 502, 502}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	callbacks, _ := testCallbacks()
+
+	err := callbacks.Deliver(&models.MemeJob{ID: "a", CallbackURL: server.URL})
+	assert.Error(t, err)
+	assert.Len(t, receiver.requests, 3)
+}
+
+func TestDeliver_DoesNotRetryClientErrors(t *testing.T) {
+	receiver := &fakeReceiver{statuses: []int{http.StatusNotFound}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	callbacks, waits := testCallbacks()
+
+	err := callbacks.Deliver(&models.MemeJob{ID: "a", CallbackURL: server.URL})
+	assert.Error(t, err)
+	assert.Len(t, receiver.requests, 1)
+	assert.Empty(t, *waits)
+}
+
+func TestSign_DependsOnSecretTimestampAndBody(t *testing.T) {
+	signature := Sign([]byte("secret"), "1", []byte("body"))
+	assert.NotEqual(t, signature, Sign([]byte("other"), "1", []byte("body")))
+	assert.NotEqual(t, signature, Sign([]byte("secret"), "2", []byte("body")))
+	assert.NotEqual(t, signature, Sign([]byte("secret"), "1", []byte("other")))
+	assert.Regexp(t, "^sha256=[0-9a-f]{64}$", signature)
+}
+
+func TestDeliver_WhenCallbackIsOnOurNetwork_RefusesWithoutRetrying(t *testing.T) {
+	receiver := &fakeReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	callbacks, waits := testCallbacks()
+	callbacks.Client = publicClient()
+
+	err := callbacks.Deliver(&models.MemeJob{ID: "a", CallbackURL: server.URL})
+	assert.Error(t, err)
+	assert.Empty(t, receiver.requests)
+	assert.Empty(t, *waits)
+}
+
+func TestPublicIP_RejectsInternalAddresses(t *testing.T) {
+	for _, address := range []string{"127.0.0.1", "::1", "169.254.169.254", "10.1.2.3", "172.16.0.1", "192.168.1.1", "100.100.100.200", "fd00::1", "0.0.0.0", "::ffff:127.0.0.1"} {
+		assert.False(t, publicIP(net.ParseIP(address)), address)
+	}
+	for _, address := range []string{"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"} {
+		assert.True(t, publicIP(net.ParseIP(address)), address)
+	}
+}
@@ -0,0 +1,148 @@
+package meme_locales
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	meme_maker "maas/meme-maker"
+	meme_service "maas/meme-service"
+
+	"golang.org/x/text/language"
+)
+
+/*
+  Message catalogs for memes in languages other than English, one JSON file per language. Each
+  catalog has the default captions the meme maker falls back on, and synonyms that map words in
+  that language onto the (English) tags in the template library so template selection still works.
+
+  Also picks the language for a request out of an Accept-Language header or lang param, using the
+  usual language matching rules: "es-MX" gets Spanish, "en-GB" gets English.
+*/
+
+const DefaultLanguage = "en"
+
+//go:embed catalogs
+var bundled embed.FS
+
+var _ meme_maker.Localizer = &Locales{}
+var _ meme_service.LanguageMatcher = &Locales{}
+
+type Catalog struct {
+	Lang     string              `json:"lang"`
+	Name     string              `json:"name"`
+	Messages map[string]string   `json:"messages"`
+	Synonyms map[string][]string `json:"synonyms"`
+}
+
+type Locales struct {
+	catalogs map[string]*Catalog
+	// Supported languages, the default first since the matcher falls back on it
+	tags    []language.Tag
+	matcher language.Matcher
+}
+
+// The catalogs bundled into the binary
+func Default() (*Locales, error) {
+	catalogs, err := fs.Sub(bundled, "catalogs")
+	if err != nil {
+		return nil, err
+	}
+	return LoadFS(catalogs)
+}
+
+// Loads every .json catalog in the directory. There has to be an English one
+func LoadFS(fsys fs.FS) (*Locales, error) {
+	files, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, err
+	}
+	catalogs := []*Catalog{}
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		catalog := &Catalog{}
+		if err := json.Unmarshal(data, catalog); err != nil {
+			return nil, fmt.Errorf("catalog %s: %w", file, err)
+		}
+		if catalog.Lang == "" {
+			catalog.Lang = strings.TrimSuffix(path.Base(file), ".json")
+		}
+		catalogs = append(catalogs, catalog)
+	}
+	return NewLocales(catalogs...)
+}
+
+func NewLocales(catalogs ...*Catalog) (*Locales, error) {
+	locales := &Locales{catalogs: map[string]*Catalog{}}
+	for _, catalog := range catalogs {
+		tag, err := language.Parse(catalog.Lang)
+		if err != nil {
+			return nil, fmt.Errorf("catalog %s: %w", catalog.Lang, err)
+		}
+		catalog.Lang = tag.String()
+		locales.catalogs[catalog.Lang] = catalog
+	}
+	if _, ok := locales.catalogs[DefaultLanguage]; !ok {
+		return nil, fmt.Errorf("there is no %s catalog", DefaultLanguage)
+	}
+
+	langs := []string{}
+	for lang := range locales.catalogs {
+		if lang != DefaultLanguage {
+			langs = append(langs, lang)
+		}
+	}
+	sort.Strings(langs)
+	for _, lang := range append([]string{DefaultLanguage}, langs...) {
+		locales.tags = append(locales.tags, language.MustParse(lang))
+	}
+	locales.matcher = language.NewMatcher(locales.tags)
+	return locales, nil
+}
+
+// The supported languages, default first
+func (l *Locales) Languages() []string {
+	langs := []string{}
+	for _, tag := range l.tags {
+		langs = append(langs, tag.String())
+	}
+	return langs
+}
+
+// Picks the best supported language for an Accept-Language header or a single language tag.
+// The second result is false when none of the preferences are supported at all
+func (l *Locales) Match(preferences string) (string, bool) {
+	tags, _, err := language.ParseAcceptLanguage(preferences)
+	if err != nil || len(tags) == 0 {
+		return DefaultLanguage, false
+	}
+	_, index, confidence := l.matcher.Match(tags...)
+	if confidence == language.No {
+		return DefaultLanguage, false
+	}
+	return l.tags[index].String(), true
+}
+
+func (l *Locales) Message(lang string, key string) (string, bool) {
+	catalog, ok := l.catalogs[lang]
+	if !ok {
+		return "", false
+	}
+	message, ok := catalog.Messages[key]
+	return message, ok
+}
+
+func (l *Locales) Synonyms(lang string) map[string][]string {
+	catalog, ok := l.catalogs[lang]
+	if !ok {
+		return nil
+	}
+	return catalog.Synonyms
+}
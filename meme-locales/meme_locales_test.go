@@ -0,0 +1,77 @@
+package meme_locales
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefault_LoadsTheBundledCatalogs(t *testing.T) {
+	locales, err := Default()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"en", "de", "es", "fr", "pt"}, locales.Languages())
+	for _, lang := range locales.Languages() {
+		for _, key := range []string{"top_text", "bottom_text", "image_location"} {
+			_, ok := locales.Message(lang, key)
+			assert.True(t, ok, "%s is missing %s", lang, key)
+		}
+	}
+}
+
+func TestLoadFS_WithoutAnEnglishCatalog_RaisesAnError(t *testing.T) {
+	fsys := fstest.MapFS{"es.json": {Data: []byte(`{"messages": {"top_text": "Arriba"}}`)}}
+	_, err := LoadFS(fsys)
+	assert.Error(t, err)
+}
+
+func TestLoadFS_WithBadJson_RaisesAnError(t *testing.T) {
+	fsys := fstest.MapFS{"en.json": {Data: []byte(`{`)}}
+	_, err := LoadFS(fsys)
+	assert.Error(t, err)
+}
+
+func TestLoadFS_TakesTheLanguageFromTheFileName(t *testing.T) {
+	fsys := fstest.MapFS{
+		"en.json": {Data: []byte(`{}`)},
+		"es.json": {Data: []byte(`{"messages": {"top_text": "Arriba"}}`)},
+	}
+	locales, err := LoadFS(fsys)
+	assert.Nil(t, err)
+	message, ok := locales.Message("es", "top_text")
+	assert.True(t, ok)
+	assert.Equal(t, "Arriba", message)
+}
+
+func TestMatch_PicksTheBestSupportedLanguage(t *testing.T) {
+	locales, _ := Default()
+	cases := map[string]string{
+		"es":                        "es",
+		"es-MX":                     "es",
+		"en-GB,en;q=0.8":            "en",
+		"ja, fr-CA;q=0.9, de;q=0.5": "fr",
+		"pt-BR":                     "pt",
+	}
+	for preferences, expected := range cases {
+		lang, ok := locales.Match(preferences)
+		assert.True(t, ok, preferences)
+		assert.Equal(t, expected, lang, preferences)
+	}
+}
+
+func TestMatch_WhenNothingIsSupported_ReturnsEnglish(t *testing.T) {
+	locales, _ := Default()
+	for _, preferences := range []string{"ja", "", "not a language!"} {
+		lang, ok := locales.Match(preferences)
+		assert.False(t, ok, preferences)
+		assert.Equal(t, DefaultLanguage, lang)
+	}
+}
+
+func TestSynonyms_MapOntoTemplateTags(t *testing.T) {
+	locales, _ := Default()
+	assert.Contains(t, locales.Synonyms("es")["almuerzo"], "lunch")
+	assert.Nil(t, locales.Synonyms("ja"))
+	_, ok := locales.Message("ja", "top_text")
+	assert.False(t, ok)
+}
@@ -2,23 +2,236 @@ package meme_maker
 
 import (
 	"fmt"
+	error_types "maas/error-types"
+	meme_renderer "maas/meme-renderer"
 	meme_service "maas/meme-service"
 	"maas/models"
 )
 
-type MemeMaker struct{}
+type TemplateRepository interface {
+	AllTemplates() []models.Template
+	Template(id string) (*models.Template, error)
+}
+
+type Geocoder interface {
+	ReverseGeocode(lat float64, lon float64) (*models.Place, error)
+}
+
+// What a caption generator has to go on when writing the bottom text
+type CaptionContext struct {
+	Query    string
+	Template *models.Template
+	Place    *models.Place
+	// The language to write in. Empty means English
+	Lang string
+}
+
+type CaptionGenerator interface {
+	Caption(context *CaptionContext) (string, error)
+}
+
+// Translations of the text the meme maker writes itself, and synonyms that map words in other
+// languages onto template tags
+type Localizer interface {
+	Message(lang string, key string) (string, bool)
+	Synonyms(lang string) map[string][]string
+}
+
+var _ meme_service.MemeProvider = &MemeMaker{}
+var _ meme_service.NamedProvider = &MemeMaker{}
+
+type MemeMaker struct {
+	// Optional. Without a renderer memes are text only
+	Renderer *meme_renderer.Renderer
+	// Optional. Without templates every meme uses a plain canvas
+	Templates TemplateRepository
+	// Used to match queries to template tags. Defaults to DefaultSynonyms
+	Synonyms map[string][]string
+	// Optional. Without a geocoder memes only get the raw coordinates
+	Geocoder Geocoder
+	// Optional. Without a caption generator the bottom text is always "Bottom Text"
+	Captions CaptionGenerator
+	// Optional. Without a localizer memes are always in English
+	Localizer Localizer
+}
+
+func NewMemeMaker() *MemeMaker {
+	return &MemeMaker{}
+}
+
+func (m *MemeMaker) WithRenderer(renderer *meme_renderer.Renderer) *MemeMaker {
+	m.Renderer = renderer
+	return m
+}
+
+func (m *MemeMaker) WithTemplates(templates TemplateRepository) *MemeMaker {
+	m.Templates = templates
+	return m
+}
+
+func (m *MemeMaker) WithSynonyms(synonyms map[string][]string) *MemeMaker {
+	m.Synonyms = synonyms
+	return m
+}
+
+func (m *MemeMaker) WithGeocoder(geocoder Geocoder) *MemeMaker {
+	m.Geocoder = geocoder
+	return m
+}
+
+func (m *MemeMaker) WithCaptions(captions CaptionGenerator) *MemeMaker {
+	m.Captions = captions
+	return m
+}
+
+func (m *MemeMaker) WithLocalizer(localizer Localizer) *MemeMaker {
+	m.Localizer = localizer
+	return m
+}
+
+func (m *MemeMaker) Name() string {
+	return "meme_maker"
+}
 
 func (m *MemeMaker) NewMeme() *models.Meme {
-	return &models.Meme{TopText: "Up Top", BottomText: "Bottom Text", ImageLocation: "Nowhere and everywhere"}
+	return m.NewLocalizedMeme("")
+}
+
+// A meme with the default captions in lang, or English when there's no translation
+func (m *MemeMaker) NewLocalizedMeme(lang string) *models.Meme {
+	return &models.Meme{
+		TopText:       m.message(lang, "top_text", "Up Top"),
+		BottomText:    m.message(lang, "bottom_text", "Bottom Text"),
+		ImageLocation: m.message(lang, "image_location", "Nowhere and everywhere"),
+	}
+}
+
+func (m *MemeMaker) message(lang string, key string, english string) string {
+	if m.Localizer == nil || lang == "" {
+		return english
+	}
+	if message, ok := m.Localizer.Message(lang, key); ok {
+		return message
+	}
+	return english
 }
 
 func (m *MemeMaker) BuildMeme(query *meme_service.QueryParams) (*models.Meme, error) {
-	meme := m.NewMeme()
+	meme := m.NewLocalizedMeme(query.Lang)
 	if query.Query != "" {
 		meme = meme.WithTopText(query.Query)
 	}
 	if query.Lat != 0 && query.Lon != 0 {
 		meme = meme.WithImageLocation(fmt.Sprintf("%.6f x %.6f", query.Lat, query.Lon))
+		place, err := m.Place(query)
+		if err != nil {
+			return nil, err
+		}
+		meme = meme.WithPlace(place)
+	}
+	template, err := m.template(query)
+	if err != nil {
+		return nil, err
+	}
+	if template != nil {
+		meme = meme.WithTemplateId(template.ID)
+	}
+	query.Report(meme_service.StageTemplateSelected, meme)
+	if m.Captions != nil {
+		caption, err := m.Captions.Caption(&CaptionContext{Query: query.Query, Template: template, Place: meme.Place, Lang: query.Lang})
+		if err != nil {
+			return nil, err
+		}
+		meme = meme.WithBottomText(caption)
+	}
+	query.Report(meme_service.StageCaptionGenerated, meme)
+	if m.Renderer != nil {
+		meme, err = m.Render(meme, template)
+		if err != nil {
+			return nil, err
+		}
+		query.Report(meme_service.StageRendered, meme)
 	}
 	return meme, nil
 }
+
+// Returns nil when there is no geocoder or nothing is near the coordinates
+func (m *MemeMaker) Place(query *meme_service.QueryParams) (*models.Place, error) {
+	if m.Geocoder == nil {
+		return nil, nil
+	}
+	place, err := m.Geocoder.ReverseGeocode(query.Lat, query.Lon)
+	if err != nil {
+		if _, ok := err.(*error_types.PlaceNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return place, nil
+}
+
+// Uses the requested template, otherwise picks one based on the query.
+// Returns nil when no template was asked for and none match the query.
+func (m *MemeMaker) template(query *meme_service.QueryParams) (*models.Template, error) {
+	if query.Template == "" {
+		if m.Templates == nil {
+			return nil, nil
+		}
+		return SelectTemplate(query.Query, m.Templates.AllTemplates(), m.SynonymsFor(query.Lang)), nil
+	}
+	if m.Templates == nil {
+		return nil, &error_types.TemplateNotFoundError{ID: query.Template}
+	}
+	return m.Templates.Template(query.Template)
+}
+
+func (m *MemeMaker) synonyms() map[string][]string {
+	if m.Synonyms == nil {
+		return DefaultSynonyms
+	}
+	return m.Synonyms
+}
+
+// The synonyms plus the localizer's ones for lang, so queries in other languages find templates too
+func (m *MemeMaker) SynonymsFor(lang string) map[string][]string {
+	if m.Localizer == nil || lang == "" {
+		return m.synonyms()
+	}
+	localized := m.Localizer.Synonyms(lang)
+	if len(localized) == 0 {
+		return m.synonyms()
+	}
+	merged := map[string][]string{}
+	for word, tags := range m.synonyms() {
+		merged[word] = tags
+	}
+	for word, tags := range localized {
+		merged[word] = append(append([]string{}, merged[word]...), tags...)
+	}
+	return merged
+}
+
+// Draws the meme's captions onto the template, or a plain canvas when template is nil.
+// Animated templates always come out as GIFs, everything else uses the renderer's format
+func (m *MemeMaker) Render(meme *models.Meme, template *models.Template) (*models.Meme, error) {
+	if template != nil && template.Animation != nil {
+		image, err := m.Renderer.RenderAnimatedTemplate(template, meme.TopText, meme.BottomText)
+		if err != nil {
+			return nil, err
+		}
+		return meme.WithImage(image, string(meme_renderer.GIF)), nil
+	}
+
+	var image []byte
+	var err error
+	if template != nil {
+		image, err = m.Renderer.RenderTemplate(template, meme.TopText, meme.BottomText)
+	} else {
+		base := meme_renderer.Canvas(meme_renderer.DefaultWidth, meme_renderer.DefaultHeight, meme_renderer.DefaultBackground)
+		image, err = m.Renderer.Render(base, meme.TopText, meme.BottomText)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return meme.WithImage(image, string(m.Renderer.Format)), nil
+}
@@ -1,9 +1,18 @@
 package meme_maker
 
 import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
 	"testing"
 
+	error_types "maas/error-types"
+	meme_renderer "maas/meme-renderer"
 	meme_service "maas/meme-service"
+	"maas/models"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,6 +25,40 @@ func TestNewMeme_ReturnsDefaultValues(t *testing.T) {
 	assert.Equal(t, meme.ImageLocation, "Nowhere and everywhere")
 }
 
+type MockLocalizer struct{}
+
+func (m *MockLocalizer) Message(lang string, key string) (string, bool) {
+	if lang == "es" && key == "top_text" {
+		return "Arriba", true
+	}
+	return "", false
+}
+
+func (m *MockLocalizer) Synonyms(lang string) map[string][]string {
+	if lang == "es" {
+		return map[string][]string{"comida": {"food"}, "lunch": {"siesta"}}
+	}
+	return nil
+}
+
+func TestNewLocalizedMeme_UsesTranslationsAndFallsBackToEnglish(t *testing.T) {
+	maker := (&MemeMaker{}).WithLocalizer(&MockLocalizer{})
+	meme := maker.NewLocalizedMeme("es")
+	assert.Equal(t, "Arriba", meme.TopText)
+	assert.Equal(t, "Bottom Text", meme.BottomText)
+	assert.Equal(t, "Up Top", maker.NewLocalizedMeme("fr").TopText)
+	assert.Equal(t, "Up Top", maker.NewMeme().TopText)
+}
+
+func TestSynonymsFor_MergesLocalizedSynonyms(t *testing.T) {
+	maker := (&MemeMaker{}).WithLocalizer(&MockLocalizer{})
+	synonyms := maker.SynonymsFor("es")
+	assert.Equal(t, []string{"food"}, synonyms["comida"])
+	assert.Equal(t, append(append([]string{}, DefaultSynonyms["lunch"]...), "siesta"), synonyms["lunch"])
+	assert.NotContains(t, DefaultSynonyms["lunch"], "siesta")
+	assert.NotContains(t, maker.SynonymsFor("en"), "comida")
+}
+
 func TestWithTopText_OnlyEditsTopText(t *testing.T) {
 	maker := &MemeMaker{}
 	meme := maker.NewMeme().WithTopText("Different Top Text")
@@ -111,3 +154,189 @@ func TestMakeMap_ReturnsMapOfMeme(t *testing.T) {
 	actual := maker.NewMeme().MakeMap()
 	assert.Equal(t, expected, actual)
 }
+
+func TestBuildMeme_WithRenderer_AttachesARenderedImage(t *testing.T) {
+	renderer, err := meme_renderer.NewRenderer()
+	assert.Nil(t, err)
+	maker := NewMemeMaker().WithRenderer(renderer)
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Query: "My Query"})
+	assert.Nil(t, err)
+	assert.Equal(t, meme.TopText, "My Query")
+	assert.Equal(t, meme.ImageFormat, "png")
+
+	img, err := png.Decode(bytes.NewReader(meme.Image))
+	assert.Nil(t, err)
+	assert.Equal(t, meme_renderer.DefaultWidth, img.Bounds().Dx())
+	assert.Equal(t, meme_renderer.DefaultHeight, img.Bounds().Dy())
+}
+
+func TestBuildMeme_WithoutRenderer_DoesNotAttachAnImage(t *testing.T) {
+	maker := &MemeMaker{}
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Query: "My Query"})
+	assert.Nil(t, err)
+	assert.Nil(t, meme.Image)
+	assert.Equal(t, meme.ImageFormat, "")
+}
+
+type MockTemplateRepository struct {
+	templates []models.Template
+}
+
+func (m *MockTemplateRepository) AllTemplates() []models.Template {
+	return m.templates
+}
+
+func (m *MockTemplateRepository) Template(id string) (*models.Template, error) {
+	for _, template := range m.templates {
+		if template.ID == id {
+			return &template, nil
+		}
+	}
+	return nil, &error_types.TemplateNotFoundError{ID: id}
+}
+
+var fixtureTemplates = &MockTemplateRepository{templates: []models.Template{
+	{
+		ID:        "wide",
+		Name:      "Wide",
+		Tags:      []string{"wide"},
+		TopBox:    models.CaptionBox{X: 0, Y: 0, Width: 300, Height: 40},
+		BottomBox: models.CaptionBox{X: 0, Y: 60, Width: 300, Height: 40},
+		Image:     meme_renderer.Canvas(300, 100, meme_renderer.DefaultBackground),
+	},
+}}
+
+func TestBuildMeme_WhenTemplateIsRequested_UsesTemplate(t *testing.T) {
+	maker := NewMemeMaker().WithTemplates(fixtureTemplates)
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Query: "My Query", Template: "wide"})
+	assert.Nil(t, err)
+	assert.Equal(t, meme.TopText, "My Query")
+	assert.Equal(t, meme.TemplateId, "wide")
+}
+
+func TestBuildMeme_WhenTemplateIsRequestedWithRenderer_RendersOnTemplateImage(t *testing.T) {
+	renderer, err := meme_renderer.NewRenderer()
+	assert.Nil(t, err)
+	maker := NewMemeMaker().WithRenderer(renderer).WithTemplates(fixtureTemplates)
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Template: "wide"})
+	assert.Nil(t, err)
+
+	img, err := png.Decode(bytes.NewReader(meme.Image))
+	assert.Nil(t, err)
+	assert.Equal(t, 300, img.Bounds().Dx())
+	assert.Equal(t, 100, img.Bounds().Dy())
+}
+
+func TestBuildMeme_WhenTemplateIsUnknown_RaisesTemplateNotFound(t *testing.T) {
+	maker := NewMemeMaker().WithTemplates(fixtureTemplates)
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Template: "missing"})
+	assert.Nil(t, meme)
+	assert.Equal(t, &error_types.TemplateNotFoundError{ID: "missing"}, err)
+}
+
+func TestBuildMeme_WhenTemplateIsRequestedWithoutTemplates_RaisesTemplateNotFound(t *testing.T) {
+	maker := NewMemeMaker()
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Template: "wide"})
+	assert.Nil(t, meme)
+	assert.IsType(t, &error_types.TemplateNotFoundError{}, err)
+}
+
+type MockGeocoder struct{}
+
+func (m *MockGeocoder) ReverseGeocode(lat float64, lon float64) (*models.Place, error) {
+	if lat == 1 {
+		return &models.Place{City: "Testville", Country: "Exampleland"}, nil
+	} else if lat == 2 {
+		return nil, &error_types.PlaceNotFoundError{Lat: lat, Lon: lon}
+	}
+	return nil, errors.New("test")
+}
+
+func TestBuildMeme_WithGeocoder_AttachesPlace(t *testing.T) {
+	maker := NewMemeMaker().WithGeocoder(&MockGeocoder{})
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Lat: 1, Lon: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, &models.Place{City: "Testville", Country: "Exampleland"}, meme.Place)
+	assert.Equal(t, "1.000000 x 1.000000", meme.ImageLocation)
+}
+
+func TestBuildMeme_WhenPlaceIsNotFound_LeavesPlaceEmpty(t *testing.T) {
+	maker := NewMemeMaker().WithGeocoder(&MockGeocoder{})
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Lat: 2, Lon: 1})
+	assert.Nil(t, err)
+	assert.Nil(t, meme.Place)
+}
+
+func TestBuildMeme_WhenGeocoderErrors_RaisesAnError(t *testing.T) {
+	maker := NewMemeMaker().WithGeocoder(&MockGeocoder{})
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Lat: 3, Lon: 1})
+	assert.Nil(t, meme)
+	assert.Error(t, err)
+}
+
+func TestBuildMeme_WithoutCoordinates_DoesNotGeocode(t *testing.T) {
+	maker := NewMemeMaker().WithGeocoder(&MockGeocoder{})
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Lat: 3})
+	assert.Nil(t, err)
+	assert.Nil(t, meme.Place)
+}
+
+// Records what it was asked about and captions with the query backwards
+type MockCaptionGenerator struct {
+	context *CaptionContext
+}
+
+func (m *MockCaptionGenerator) Caption(context *CaptionContext) (string, error) {
+	m.context = context
+	if context.Query == "raiseError" {
+		return "", errors.New("test")
+	}
+	reversed := []rune(context.Query)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	return string(reversed), nil
+}
+
+func TestBuildMeme_WithCaptionGenerator_SetsBottomText(t *testing.T) {
+	captions := &MockCaptionGenerator{}
+	maker := NewMemeMaker().WithCaptions(captions).WithTemplates(fixtureTemplates).WithGeocoder(&MockGeocoder{})
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Query: "wide query", Lat: 1, Lon: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, "wide query", meme.TopText)
+	assert.Equal(t, "yreuq ediw", meme.BottomText)
+	assert.Equal(t, "wide query", captions.context.Query)
+	assert.Equal(t, "wide", captions.context.Template.ID)
+	assert.Equal(t, "Testville", captions.context.Place.City)
+}
+
+func TestBuildMeme_WhenCaptionGeneratorErrors_RaisesAnError(t *testing.T) {
+	maker := NewMemeMaker().WithCaptions(&MockCaptionGenerator{})
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Query: "raiseError"})
+	assert.Nil(t, meme)
+	assert.Error(t, err)
+}
+
+func TestBuildMeme_WithAnimatedTemplate_RendersAnAnimatedGIF(t *testing.T) {
+	frames := []*image.Paletted{}
+	for i := 0; i < 4; i++ {
+		frames = append(frames, image.NewPaletted(image.Rect(0, 0, 60, 60), color.Palette{color.Black}))
+	}
+	animated := &MockTemplateRepository{templates: []models.Template{{
+		ID:        "dance",
+		TopBox:    models.CaptionBox{Width: 60, Height: 20},
+		BottomBox: models.CaptionBox{Y: 40, Width: 60, Height: 20},
+		Animated:  true,
+		Image:     frames[0],
+		Animation: &gif.GIF{Image: frames, Delay: []int{5, 5, 5, 5}, Config: image.Config{Width: 60, Height: 60}},
+	}}}
+	renderer, _ := meme_renderer.NewRenderer()
+	maker := NewMemeMaker().WithRenderer(renderer).WithTemplates(animated)
+
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Query: "dance", Template: "dance"})
+	assert.Nil(t, err)
+	assert.Equal(t, "gif", meme.ImageFormat)
+	animation, err := gif.DecodeAll(bytes.NewReader(meme.Image))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(animation.Image))
+}
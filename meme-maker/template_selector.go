@@ -0,0 +1,105 @@
+package meme_maker
+
+import (
+	"maas/models"
+	"strings"
+	"unicode"
+)
+
+const (
+	tagScore     = 2
+	synonymScore = 1
+)
+
+// Maps words people actually type to the tags used in the template library
+var DefaultSynonyms = map[string][]string{
+	"breakfast": {"food"},
+	"dinner":    {"food"},
+	"eat":       {"food", "hungry"},
+	"eating":    {"food", "hungry"},
+	"lunch":     {"food"},
+	"pizza":     {"food"},
+	"sandwich":  {"food", "lunch"},
+	"snack":     {"food", "hungry"},
+	"starving":  {"hungry"},
+	"taco":      {"food"},
+	"victory":   {"win", "success"},
+	"winning":   {"win", "success"},
+	"nailed":    {"success"},
+	"promotion": {"success", "work"},
+	"sunny":     {"sun", "happy"},
+	"bedtime":   {"sleep", "night"},
+	"exhausted": {"tired"},
+	"insomnia":  {"sleep", "night", "tired"},
+	"sleepy":    {"sleep", "tired"},
+	"boss":      {"work", "office"},
+	"deadline":  {"work"},
+	"email":     {"work", "computer"},
+	"job":       {"work"},
+	"meeting":   {"work", "office"},
+}
+
+// Picks the template whose tags best match the query. An exact tag match is worth more than a
+// synonym match. Ties go to the template with the alphabetically first ID so the same query always
+// gets the same template. Returns nil if nothing matches at all.
+func SelectTemplate(query string, templates []models.Template, synonyms map[string][]string) *models.Template {
+	words := queryWords(query)
+	if len(words) == 0 {
+		return nil
+	}
+
+	var best *models.Template
+	bestScore := 0
+	for i := range templates {
+		template := &templates[i]
+		score := scoreTemplate(words, template, synonyms)
+		if score == 0 {
+			continue
+		}
+		if score > bestScore || (score == bestScore && template.ID < best.ID) {
+			best = template
+			bestScore = score
+		}
+	}
+	return best
+}
+
+func scoreTemplate(words []string, template *models.Template, synonyms map[string][]string) int {
+	tags := map[string]bool{}
+	for _, tag := range template.Tags {
+		tags[strings.ToLower(tag)] = true
+	}
+
+	score := 0
+	for _, word := range words {
+		score += scoreWord(word, tags, synonyms)
+	}
+	return score
+}
+
+// Tries the word as typed and then with a simple plural trimmed, so "Tacos" matches "taco"
+func scoreWord(word string, tags map[string]bool, synonyms map[string][]string) int {
+	forms := []string{word}
+	if len(word) > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") {
+		forms = append(forms, strings.TrimSuffix(word, "s"))
+	}
+	for _, form := range forms {
+		if tags[form] {
+			return tagScore
+		}
+	}
+	for _, form := range forms {
+		for _, synonym := range synonyms[form] {
+			if tags[synonym] {
+				return synonymScore
+			}
+		}
+	}
+	return 0
+}
+
+func queryWords(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
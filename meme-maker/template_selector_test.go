@@ -0,0 +1,93 @@
+package meme_maker
+
+import (
+	"testing"
+
+	meme_service "maas/meme-service"
+	"maas/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var selectorFixtures = []models.Template{
+	{ID: "generic", Tags: []string{"classic", "default"}},
+	{ID: "pizza-party", Tags: []string{"food", "party"}},
+	{ID: "lunch-break", Tags: []string{"food", "lunch", "hungry"}},
+	{ID: "office", Tags: []string{"work", "office", "lunch"}},
+}
+
+var selectorSynonyms = map[string][]string{
+	"burrito": {"food"},
+	"boss":    {"work"},
+}
+
+func TestSelectTemplate_WhenQueryMatchesATag_PicksThatTemplate(t *testing.T) {
+	template := SelectTemplate("hungry", selectorFixtures, selectorSynonyms)
+	assert.Equal(t, "lunch-break", template.ID)
+}
+
+func TestSelectTemplate_WhenQueryMatchesMoreTags_PicksTheBestScore(t *testing.T) {
+	template := SelectTemplate("lunch at the office", selectorFixtures, selectorSynonyms)
+	assert.Equal(t, "office", template.ID)
+}
+
+func TestSelectTemplate_WhenQueryMatchesASynonym_PicksThatTemplate(t *testing.T) {
+	template := SelectTemplate("My boss is watching", selectorFixtures, selectorSynonyms)
+	assert.Equal(t, "office", template.ID)
+}
+
+func TestSelectTemplate_PrefersTagsOverSynonyms(t *testing.T) {
+	fixtures := []models.Template{
+		{ID: "a-synonym", Tags: []string{"food"}},
+		{ID: "b-tag", Tags: []string{"burrito"}},
+	}
+	template := SelectTemplate("burrito", fixtures, selectorSynonyms)
+	assert.Equal(t, "b-tag", template.ID)
+}
+
+func TestSelectTemplate_WhenScoresTie_PicksTheFirstIDAlphabetically(t *testing.T) {
+	// food matches both pizza-party and lunch-break once
+	for i := 0; i < 10; i++ {
+		template := SelectTemplate("food", selectorFixtures, selectorSynonyms)
+		assert.Equal(t, "lunch-break", template.ID)
+	}
+	reversed := []models.Template{selectorFixtures[2], selectorFixtures[1]}
+	template := SelectTemplate("food", reversed, selectorSynonyms)
+	assert.Equal(t, "lunch-break", template.ID)
+}
+
+func TestSelectTemplate_IgnoresCasePunctuationAndPlurals(t *testing.T) {
+	template := SelectTemplate("BURRITOS!!!", selectorFixtures, selectorSynonyms)
+	assert.Equal(t, "lunch-break", template.ID)
+}
+
+func TestSelectTemplate_WhenNothingMatches_ReturnsNil(t *testing.T) {
+	assert.Nil(t, SelectTemplate("quantum chromodynamics", selectorFixtures, selectorSynonyms))
+	assert.Nil(t, SelectTemplate("", selectorFixtures, selectorSynonyms))
+	assert.Nil(t, SelectTemplate("food", []models.Template{}, selectorSynonyms))
+}
+
+func TestBuildMeme_WhenNoTemplateIsRequested_SelectsTemplateFromQuery(t *testing.T) {
+	maker := NewMemeMaker().WithTemplates(&MockTemplateRepository{templates: selectorFixtures})
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Query: "pizza party"})
+	assert.Nil(t, err)
+	assert.Equal(t, "pizza-party", meme.TemplateId)
+}
+
+func TestBuildMeme_WhenTemplateIsRequested_IgnoresQueryForSelection(t *testing.T) {
+	maker := NewMemeMaker().WithTemplates(&MockTemplateRepository{templates: selectorFixtures})
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Query: "pizza party", Template: "office"})
+	assert.Nil(t, err)
+	assert.Equal(t, "office", meme.TemplateId)
+}
+
+func TestBuildMeme_UsesDefaultSynonymsUnlessOverridden(t *testing.T) {
+	maker := NewMemeMaker().WithTemplates(&MockTemplateRepository{templates: selectorFixtures})
+	meme, err := maker.BuildMeme(&meme_service.QueryParams{Query: "deadline"})
+	assert.Nil(t, err)
+	assert.Equal(t, "office", meme.TemplateId)
+
+	meme, err = maker.WithSynonyms(selectorSynonyms).BuildMeme(&meme_service.QueryParams{Query: "deadline"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", meme.TemplateId)
+}
@@ -0,0 +1,133 @@
+package meme_renderer
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"maas/models"
+)
+
+// Draws the captions onto every frame of an animated template and returns the encoded GIF.
+// Frame delays and the loop count are kept as they are in the template.
+func (r *Renderer) RenderAnimatedTemplate(template *models.Template, topText string, bottomText string) ([]byte, error) {
+	animation, err := r.DrawAnimatedTemplate(template, topText, bottomText)
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	if err := gif.EncodeAll(&buffer, animation); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (r *Renderer) DrawAnimatedTemplate(template *models.Template, topText string, bottomText string) (*gif.GIF, error) {
+	source := template.Animation
+	bounds := image.Rect(0, 0, source.Config.Width, source.Config.Height)
+
+	// The captions are the same on every frame, so draw them once and lay them over each frame
+	overlay, err := r.drawInBoxes(image.NewRGBA(bounds), topText, template.TopBox.Rect(), bottomText, template.BottomBox.Rect())
+	if err != nil {
+		return nil, err
+	}
+
+	animation := &gif.GIF{
+		Delay:     append([]int{}, source.Delay...),
+		LoopCount: source.LoopCount,
+		Config:    image.Config{Width: bounds.Dx(), Height: bounds.Dy()},
+	}
+	for i, frame := range coalesce(source, bounds) {
+		draw.Draw(frame, bounds, overlay, image.Point{}, draw.Over)
+		animation.Image = append(animation.Image, toPaletted(frame, source.Image[i].Palette))
+		animation.Disposal = append(animation.Disposal, gif.DisposalNone)
+	}
+	return animation, nil
+}
+
+// Flattens each frame onto everything shown before it, following the GIF disposal rules,
+// so every returned frame is a complete picture
+func coalesce(source *gif.GIF, bounds image.Rectangle) []*image.RGBA {
+	canvas := image.NewRGBA(bounds)
+	frames := make([]*image.RGBA, 0, len(source.Image))
+	for i, frame := range source.Image {
+		var previous *image.RGBA
+		disposal := byte(gif.DisposalNone)
+		if i < len(source.Disposal) {
+			disposal = source.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames = append(frames, cloneRGBA(canvas))
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	clone := image.NewRGBA(img.Bounds())
+	copy(clone.Pix, img.Pix)
+	return clone
+}
+
+// Coalesced frames can show colors from earlier frames, so the frame's own colors are used when
+// they fit in a palette. Otherwise the original palette is reused with room made for the caption
+// colors, falling back to a general purpose palette if the original is already full.
+func toPaletted(frame *image.RGBA, original color.Palette) *image.Paletted {
+	framePalette, ok := exactPalette(frame)
+	if !ok {
+		framePalette = append(color.Palette{}, original...)
+		for _, captionColor := range []color.Color{textColor, outlineColor} {
+			if !hasColor(framePalette, captionColor) {
+				framePalette = append(framePalette, captionColor)
+			}
+		}
+		if len(framePalette) > 256 {
+			framePalette = palette.Plan9
+		}
+	}
+
+	paletted := image.NewPaletted(frame.Bounds(), framePalette)
+	draw.Draw(paletted, frame.Bounds(), frame, image.Point{}, draw.Src)
+	return paletted
+}
+
+// Every color in the frame, as long as there are few enough for a GIF palette
+func exactPalette(frame *image.RGBA) (color.Palette, bool) {
+	seen := map[color.RGBA]bool{}
+	framePalette := color.Palette{}
+	for i := 0; i < len(frame.Pix); i += 4 {
+		c := color.RGBA{R: frame.Pix[i], G: frame.Pix[i+1], B: frame.Pix[i+2], A: frame.Pix[i+3]}
+		if seen[c] {
+			continue
+		}
+		if len(framePalette) == 256 {
+			return nil, false
+		}
+		seen[c] = true
+		framePalette = append(framePalette, c)
+	}
+	return framePalette, true
+}
+
+func hasColor(p color.Palette, c color.Color) bool {
+	r, g, b, a := c.RGBA()
+	for _, existing := range p {
+		er, eg, eb, ea := existing.RGBA()
+		if r == er && g == eg && b == eb && a == ea {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package meme_renderer
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"maas/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	red   = color.RGBA{R: 255, A: 255}
+	blue  = color.RGBA{B: 255, A: 255}
+	green = color.RGBA{G: 255, A: 255}
+)
+
+func solidFrame(bounds image.Rectangle, c color.Color) *image.Paletted {
+	return image.NewPaletted(bounds, color.Palette{c, color.Transparent})
+}
+
+// Three 40x40 frames. The last one only covers the top left corner
+func animatedTemplate(disposal byte) *models.Template {
+	full := image.Rect(0, 0, 40, 40)
+	animation := &gif.GIF{
+		Image:     []*image.Paletted{solidFrame(full, red), solidFrame(full, blue), solidFrame(image.Rect(0, 0, 10, 10), green)},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, disposal, gif.DisposalNone},
+		LoopCount: 3,
+		Config:    image.Config{Width: 40, Height: 40},
+	}
+	return &models.Template{
+		ID:        "animated",
+		TopBox:    models.CaptionBox{X: 0, Y: 0, Width: 40, Height: 16},
+		BottomBox: models.CaptionBox{X: 0, Y: 24, Width: 40, Height: 16},
+		Animated:  true,
+		Image:     animation.Image[0],
+		Animation: animation,
+	}
+}
+
+func TestDrawAnimatedTemplate_KeepsFramesAndTiming(t *testing.T) {
+	animation, err := renderer.DrawAnimatedTemplate(animatedTemplate(gif.DisposalNone), "top", "bottom")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(animation.Image))
+	assert.Equal(t, []int{10, 20, 30}, animation.Delay)
+	assert.Equal(t, 3, animation.LoopCount)
+	for _, frame := range animation.Image {
+		assert.Equal(t, image.Rect(0, 0, 40, 40), frame.Bounds())
+	}
+}
+
+func TestDrawAnimatedTemplate_DrawsCaptionsOnEveryFrame(t *testing.T) {
+	animation, err := renderer.DrawAnimatedTemplate(animatedTemplate(gif.DisposalNone), "top", "")
+	assert.Nil(t, err)
+	topBox := image.Rect(0, 0, 40, 16)
+	for _, frame := range animation.Image {
+		assert.Greater(t, countPixels(frame, topBox, color.White), 0)
+	}
+}
+
+func TestDrawAnimatedTemplate_FlattensPartialFrames(t *testing.T) {
+	animation, err := renderer.DrawAnimatedTemplate(animatedTemplate(gif.DisposalNone), "", "")
+	assert.Nil(t, err)
+	last := animation.Image[2]
+	assert.Equal(t, 100, countPixels(last, image.Rect(0, 0, 10, 10), green))
+	// Everything outside the partial frame still shows the frame before it
+	assert.Equal(t, 40*40-100, countPixels(last, last.Bounds(), blue))
+}
+
+func TestDrawAnimatedTemplate_FollowsBackgroundDisposal(t *testing.T) {
+	animation, err := renderer.DrawAnimatedTemplate(animatedTemplate(gif.DisposalBackground), "", "")
+	assert.Nil(t, err)
+	last := animation.Image[2]
+	assert.Equal(t, 0, countPixels(last, last.Bounds(), blue))
+	assert.Equal(t, 100, countPixels(last, image.Rect(0, 0, 10, 10), green))
+}
+
+func TestDrawAnimatedTemplate_FollowsPreviousDisposal(t *testing.T) {
+	animation, err := renderer.DrawAnimatedTemplate(animatedTemplate(gif.DisposalPrevious), "", "")
+	assert.Nil(t, err)
+	last := animation.Image[2]
+	assert.Equal(t, 40*40-100, countPixels(last, last.Bounds(), red))
+}
+
+func TestRenderAnimatedTemplate_ReturnsAnAnimatedGIF(t *testing.T) {
+	data, err := renderer.RenderAnimatedTemplate(animatedTemplate(gif.DisposalNone), "top", "bottom")
+	assert.Nil(t, err)
+	animation, err := gif.DecodeAll(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(animation.Image))
+	assert.Equal(t, []int{10, 20, 30}, animation.Delay)
+}
+
+func TestToPaletted_WithFewColors_KeepsThemExactly(t *testing.T) {
+	frame := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	frame.Set(0, 0, blue)
+	frame.Set(1, 0, green)
+	paletted := toPaletted(frame, color.Palette{red})
+	assert.Equal(t, 1, countPixels(paletted, paletted.Bounds(), blue))
+	assert.Equal(t, 1, countPixels(paletted, paletted.Bounds(), green))
+}
+
+func TestToPaletted_WithTooManyColors_UsesOriginalPalette(t *testing.T) {
+	frame := image.NewRGBA(image.Rect(0, 0, 300, 1))
+	for x := 0; x < 300; x++ {
+		frame.Set(x, 0, color.RGBA{R: uint8(x), G: uint8(x / 256), A: 255})
+	}
+	original := color.Palette{red, blue}
+	paletted := toPaletted(frame, original)
+	assert.Equal(t, 4, len(paletted.Palette))
+	assert.True(t, hasColor(paletted.Palette, color.White))
+	assert.True(t, hasColor(paletted.Palette, color.Black))
+}
+
+func TestToPaletted_WhenOriginalPaletteIsFull_FallsBackToGeneralPalette(t *testing.T) {
+	frame := image.NewRGBA(image.Rect(0, 0, 300, 1))
+	full := color.Palette{}
+	for x := 0; x < 300; x++ {
+		frame.Set(x, 0, color.RGBA{R: uint8(x), G: uint8(x / 256), A: 255})
+	}
+	for i := 0; i < 256; i++ {
+		full = append(full, color.RGBA{R: uint8(i), G: 1, B: 2, A: 255})
+	}
+	paletted := toPaletted(frame, full)
+	assert.Equal(t, 256, len(paletted.Palette))
+	assert.True(t, hasColor(paletted.Palette, color.White))
+	assert.True(t, hasColor(paletted.Palette, color.Black))
+}
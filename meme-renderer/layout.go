@@ -0,0 +1,377 @@
+package meme_renderer
+
+import (
+	"fmt"
+	"image"
+	error_types "maas/error-types"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/text/unicode/norm"
+)
+
+/*
+  Lays captions out inside their caption boxes. Text is wrapped on spaces (and between CJK
+  characters, which don't use them) and the font shrinks until every line fits. When the text
+  still doesn't fit at the minimum font size it is either cut short with an ellipsis or rejected,
+  depending on the renderer's Overflow setting.
+
+  Characters the main font doesn't have are drawn with the first fallback font that does. Anything
+  none of the fonts have, emoji mostly, is drawn as a box so the caption still reads.
+*/
+
+// What to do with a caption that doesn't fit in its box even at the minimum font size
+type Overflow string
+
+const (
+	Truncate Overflow = "truncate"
+	Reject   Overflow = "reject"
+)
+
+const (
+	DefaultMinFontSize = 14.0
+	ellipsis           = "…"
+	missingGlyph       = '□'
+	zeroWidthJoiner    = '\u200d'
+)
+
+// A caption laid out for a box: the font size it fits at and its lines from top to bottom
+type layout struct {
+	Size      float64
+	Lines     []string
+	Truncated bool
+}
+
+// A run of text that can't be broken across lines, and whether a space comes before it
+type segment struct {
+	Text  string
+	Space bool
+}
+
+func ParseOverflow(name string) (Overflow, error) {
+	switch Overflow(strings.ToLower(name)) {
+	case Truncate:
+		return Truncate, nil
+	case Reject:
+		return Reject, nil
+	}
+	return "", fmt.Errorf("unknown caption overflow: %s", name)
+}
+
+// Loads a TrueType or OpenType font (or the first font of a collection) to use as a fallback
+func LoadFont(path string) (*opentype.Font, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".ttc") || strings.EqualFold(filepath.Ext(path), ".otc") {
+		collection, err := opentype.ParseCollection(data)
+		if err != nil {
+			return nil, err
+		}
+		return collection.Font(0)
+	}
+	return opentype.Parse(data)
+}
+
+func (r *Renderer) WithFallbackFonts(fonts ...*opentype.Font) *Renderer {
+	r.Fallbacks = append(r.Fallbacks, fonts...)
+	return r
+}
+
+func (r *Renderer) WithMinFontSize(size float64) *Renderer {
+	r.MinFontSize = size
+	return r
+}
+
+func (r *Renderer) WithOverflow(overflow Overflow) *Renderer {
+	r.Overflow = overflow
+	return r
+}
+
+// Finds the biggest font size, up to half the box height, that fits the whole caption in the box
+func (r *Renderer) layout(text string, box image.Rectangle) (*layout, error) {
+	segments := splitSegments(r.prepareText(text))
+	if len(segments) == 0 {
+		return &layout{}, nil
+	}
+
+	maxSize := float64(box.Dy()) / 2
+	minSize := r.MinFontSize
+	if minSize <= 0 {
+		minSize = DefaultMinFontSize
+	}
+	if minSize > maxSize {
+		minSize = maxSize
+	}
+
+	for size := maxSize; size > minSize; size-- {
+		faces, err := r.faces(size)
+		if err != nil {
+			return nil, err
+		}
+		lines, broken := wrap(segments, fixed.I(box.Dx()), faces.measure)
+		fits := !broken && faces.linesThatFit(box.Dy()) >= len(lines)
+		faces.Close()
+		if fits {
+			return &layout{Size: size, Lines: lines}, nil
+		}
+	}
+
+	// At the smallest size words may be broken up if that's what it takes
+	faces, err := r.faces(minSize)
+	if err != nil {
+		return nil, err
+	}
+	defer faces.Close()
+	lines, _ := wrap(segments, fixed.I(box.Dx()), faces.measure)
+	maxLines := faces.linesThatFit(box.Dy())
+	if len(lines) <= maxLines {
+		return &layout{Size: minSize, Lines: lines}, nil
+	}
+	if r.Overflow == Reject {
+		return nil, &error_types.CaptionTooLongError{Text: text}
+	}
+	lines = lines[:maxLines]
+	lines[maxLines-1] = withEllipsis(lines[maxLines-1], fixed.I(box.Dx()), faces.measure)
+	return &layout{Size: minSize, Lines: lines, Truncated: true}, nil
+}
+
+// Captions are upper case with accents composed onto their letters and whitespace collapsed.
+// Emoji sequences are cut down to their first character since nothing here can shape them,
+// and characters no font has become a box.
+func (r *Renderer) prepareText(text string) string {
+	text = strings.ToUpper(norm.NFC.String(text))
+	var prepared strings.Builder
+	var previous rune
+	skipNext, openFlag := false, false
+	for _, char := range text {
+		startsFlag := isRegionalIndicator(char) && !openFlag
+		switch {
+		case skipNext:
+			skipNext = false
+			continue
+		case char == zeroWidthJoiner:
+			skipNext = true
+			continue
+		case unicode.IsSpace(char):
+			char = ' '
+			if previous == ' ' || previous == 0 {
+				continue
+			}
+		case isEmojiModifier(char), unicode.Is(unicode.Cc, char), unicode.Is(unicode.Cf, char):
+			continue
+		case unicode.Is(unicode.Mn, char) && r.fontFor(char) < 0:
+			// A leftover accent with nothing to draw it with is dropped rather than boxed
+			continue
+		case isRegionalIndicator(char) && openFlag:
+			// The second half of a flag
+			openFlag = false
+			continue
+		case r.fontFor(char) < 0:
+			char = missingGlyph
+		}
+		openFlag = startsFlag
+		prepared.WriteRune(char)
+		previous = char
+	}
+	return strings.TrimSpace(prepared.String())
+}
+
+func isEmojiModifier(char rune) bool {
+	return (char >= 0xfe00 && char <= 0xfe0f) || (char >= 0x1f3fb && char <= 0x1f3ff)
+}
+
+func isRegionalIndicator(char rune) bool {
+	return char >= 0x1f1e6 && char <= 0x1f1ff
+}
+
+// Index into the renderer's fonts (the main font then its fallbacks) of the first one with the
+// character, or -1 if none of them have it
+func (r *Renderer) fontFor(char rune) int {
+	var buffer sfnt.Buffer
+	for i, candidate := range r.fonts() {
+		index, err := candidate.GlyphIndex(&buffer, char)
+		if err == nil && index != 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *Renderer) fonts() []*opentype.Font {
+	return append([]*opentype.Font{r.Font}, r.Fallbacks...)
+}
+
+// Splits text at spaces and around CJK characters, where lines are allowed to break.
+// Closing punctuation stays with the character before it so it never starts a line.
+func splitSegments(text string) []segment {
+	segments := []segment{}
+	current := segment{}
+	flush := func() {
+		if current.Text != "" {
+			segments = append(segments, current)
+			current = segment{}
+		}
+	}
+	previousCJK := false
+	for _, char := range text {
+		switch {
+		case char == ' ':
+			flush()
+			current.Space = true
+			previousCJK = false
+		case isCJK(char):
+			flush()
+			current.Text = string(char)
+			flush()
+			previousCJK = true
+		case previousCJK && len(segments) > 0 && (unicode.Is(unicode.Pe, char) || unicode.Is(unicode.Po, char)):
+			segments[len(segments)-1].Text += string(char)
+		default:
+			current.Text += string(char)
+			previousCJK = false
+		}
+	}
+	flush()
+	return segments
+}
+
+func isCJK(char rune) bool {
+	return unicode.In(char, unicode.Han, unicode.Hiragana, unicode.Katakana) || char == missingGlyph
+}
+
+// Greedily fills each line with as many segments as fit. A segment wider than a whole line is
+// broken between characters, which is reported so the caller can try a smaller font first.
+func wrap(segments []segment, width fixed.Int26_6, measure func(string) fixed.Int26_6) ([]string, bool) {
+	lines := []string{}
+	current := ""
+	broken := false
+	for _, seg := range segments {
+		candidate := seg.Text
+		if current != "" && seg.Space {
+			candidate = current + " " + seg.Text
+		} else if current != "" {
+			candidate = current + seg.Text
+		}
+		if measure(candidate) <= width {
+			current = candidate
+			continue
+		}
+		if current != "" {
+			lines = append(lines, current)
+			current = ""
+		}
+		if measure(seg.Text) <= width {
+			current = seg.Text
+			continue
+		}
+		broken = true
+		for _, char := range seg.Text {
+			if current != "" && measure(current+string(char)) > width {
+				lines = append(lines, current)
+				current = ""
+			}
+			current += string(char)
+		}
+	}
+	if current != "" {
+		lines = append(lines, current)
+	}
+	return lines, broken
+}
+
+// Shortens the line until it fits with an ellipsis on the end
+func withEllipsis(line string, width fixed.Int26_6, measure func(string) fixed.Int26_6) string {
+	chars := []rune(line)
+	for len(chars) > 0 {
+		candidate := strings.TrimRight(string(chars), " ") + ellipsis
+		if measure(candidate) <= width {
+			return candidate
+		}
+		chars = chars[:len(chars)-1]
+	}
+	return ellipsis
+}
+
+// One face per font at a single size, the main font's first
+type faceSet []font.Face
+
+func (r *Renderer) faces(size float64) (faceSet, error) {
+	faces := faceSet{}
+	for _, candidate := range r.fonts() {
+		face, err := opentype.NewFace(candidate, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			faces.Close()
+			return nil, err
+		}
+		faces = append(faces, face)
+	}
+	return faces, nil
+}
+
+func (f faceSet) Close() {
+	for _, face := range f {
+		face.Close()
+	}
+}
+
+func (f faceSet) metrics() font.Metrics {
+	return f[0].Metrics()
+}
+
+// How many lines fit in a box this tall. Always at least one
+func (f faceSet) linesThatFit(height int) int {
+	metrics := f.metrics()
+	available := fixed.I(height) - metrics.Ascent - metrics.Descent
+	if available < 0 {
+		return 1
+	}
+	return 1 + int(available/metrics.Height)
+}
+
+func (f faceSet) measure(text string) fixed.Int26_6 {
+	width := fixed.Int26_6(0)
+	for _, run := range f.runs(text) {
+		width += font.MeasureString(f[run.face], run.text)
+	}
+	return width
+}
+
+func (f faceSet) draw(drawer *font.Drawer, text string) {
+	for _, run := range f.runs(text) {
+		drawer.Face = f[run.face]
+		drawer.DrawString(run.text)
+	}
+}
+
+type run struct {
+	face int
+	text string
+}
+
+// Splits text into runs that are each drawn with a single face
+func (f faceSet) runs(text string) []run {
+	runs := []run{}
+	for _, char := range text {
+		face := 0
+		for i := range f {
+			if _, ok := f[i].GlyphAdvance(char); ok {
+				face = i
+				break
+			}
+		}
+		if len(runs) > 0 && runs[len(runs)-1].face == face {
+			runs[len(runs)-1].text += string(char)
+		} else {
+			runs = append(runs, run{face: face, text: string(char)})
+		}
+	}
+	return runs
+}
@@ -0,0 +1,208 @@
+package meme_renderer
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	error_types "maas/error-types"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/math/fixed"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden images in testdata/golden")
+
+var captionBox = image.Rect(10, 10, 290, 90)
+
+func layoutRenderer(t *testing.T) *Renderer {
+	r, err := NewRenderer()
+	assert.Nil(t, err)
+	return r
+}
+
+func cjkRenderer(t *testing.T) *Renderer {
+	fallback, err := LoadFont(filepath.Join("testdata", "cmapTest.ttf"))
+	assert.Nil(t, err)
+	return layoutRenderer(t).WithFallbackFonts(fallback)
+}
+
+// Renders onto a 300x200 canvas and compares against testdata/golden/<name>.png.
+// Antialiased edges can differ by a few levels between platforms, so channels get some slack.
+func assertGolden(t *testing.T, r *Renderer, name string, top string, bottom string) {
+	topBox, bottomBox := image.Rect(10, 10, 290, 90), image.Rect(10, 110, 290, 190)
+	img, err := r.drawInBoxes(Canvas(300, 200, DefaultBackground), top, topBox, bottom, bottomBox)
+	assert.Nil(t, err)
+
+	path := filepath.Join("testdata", "golden", name+".png")
+	if *update {
+		file, err := os.Create(path)
+		assert.Nil(t, err)
+		defer file.Close()
+		assert.Nil(t, png.Encode(file, img))
+		return
+	}
+
+	file, err := os.Open(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer file.Close()
+	golden, err := png.Decode(file)
+	assert.Nil(t, err)
+	assert.Equal(t, golden.Bounds(), img.Bounds())
+
+	different := 0
+	for y := golden.Bounds().Min.Y; y < golden.Bounds().Max.Y; y++ {
+		for x := golden.Bounds().Min.X; x < golden.Bounds().Max.X; x++ {
+			gr, gg, gb, _ := golden.At(x, y).RGBA()
+			ir, ig, ib, _ := img.At(x, y).RGBA()
+			if channelDiff(gr, ir) > 16<<8 || channelDiff(gg, ig) > 16<<8 || channelDiff(gb, ib) > 16<<8 {
+				different++
+			}
+		}
+	}
+	assert.Equal(t, 0, different, fmt.Sprintf("%d pixels differ from %s", different, path))
+}
+
+func channelDiff(a uint32, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func TestGolden_ShortCaption(t *testing.T) {
+	assertGolden(t, layoutRenderer(t), "short", "one does not", "simply")
+}
+
+func TestGolden_WrapsLongCaption(t *testing.T) {
+	assertGolden(t, layoutRenderer(t), "wrapped", "when the build is green on the first try", "nobody believes you")
+}
+
+func TestGolden_TruncatesCaptionThatDoesNotFit(t *testing.T) {
+	long := strings.Repeat("this caption just keeps going ", 12)
+	assertGolden(t, layoutRenderer(t), "truncated", long, "")
+}
+
+func TestGolden_Accents(t *testing.T) {
+	// The top caption uses combining accents, the bottom one precomposed letters
+	assertGolden(t, layoutRenderer(t), "accents", "cafe\u0301 cre\u0300me bru\u0302le\u0301e", "déjà vu à São Paulo")
+}
+
+func TestGolden_CJKWithFallbackFont(t *testing.T) {
+	assertGolden(t, cjkRenderer(t), "cjk", strings.Repeat("中", 30), "AB中12")
+}
+
+func TestGolden_EmojiFallBackToBoxes(t *testing.T) {
+	assertGolden(t, layoutRenderer(t), "emoji", "party time 🎉", "thumbs up 👍🏽 family 👨‍👩‍👧")
+}
+
+func TestLayout_ShortCaption_UsesHalfTheBoxHeight(t *testing.T) {
+	captionLayout, err := layoutRenderer(t).layout("hi", captionBox)
+	assert.Nil(t, err)
+	assert.Equal(t, 40.0, captionLayout.Size)
+	assert.Equal(t, []string{"HI"}, captionLayout.Lines)
+}
+
+func TestLayout_LongCaption_WrapsAndShrinks(t *testing.T) {
+	r := layoutRenderer(t)
+	captionLayout, err := r.layout("when the build is green on the first try", captionBox)
+	assert.Nil(t, err)
+	assert.Greater(t, len(captionLayout.Lines), 1)
+	assert.Less(t, captionLayout.Size, 40.0)
+	assert.GreaterOrEqual(t, captionLayout.Size, DefaultMinFontSize)
+	assert.False(t, captionLayout.Truncated)
+	assert.Equal(t, "WHEN THE BUILD IS GREEN ON THE FIRST TRY", strings.Join(captionLayout.Lines, " "))
+
+	faces, _ := r.faces(captionLayout.Size)
+	defer faces.Close()
+	for _, line := range captionLayout.Lines {
+		assert.LessOrEqual(t, faces.measure(line), fixed.I(captionBox.Dx()))
+	}
+	assert.LessOrEqual(t, len(captionLayout.Lines), faces.linesThatFit(captionBox.Dy()))
+}
+
+func TestLayout_WhenCaptionDoesNotFit_TruncatesWithEllipsis(t *testing.T) {
+	captionLayout, err := layoutRenderer(t).layout(strings.Repeat("never ending caption ", 20), captionBox)
+	assert.Nil(t, err)
+	assert.True(t, captionLayout.Truncated)
+	assert.Equal(t, DefaultMinFontSize, captionLayout.Size)
+	assert.True(t, strings.HasSuffix(captionLayout.Lines[len(captionLayout.Lines)-1], ellipsis))
+}
+
+func TestLayout_WhenCaptionDoesNotFitAndOverflowIsReject_RaisesAnError(t *testing.T) {
+	r := layoutRenderer(t).WithOverflow(Reject)
+	captionLayout, err := r.layout(strings.Repeat("never ending caption ", 20), captionBox)
+	assert.Nil(t, captionLayout)
+	assert.IsType(t, &error_types.CaptionTooLongError{}, err)
+
+	_, err = r.Draw(Canvas(300, 100, DefaultBackground), strings.Repeat("never ending caption ", 20), "")
+	assert.IsType(t, &error_types.CaptionTooLongError{}, err)
+}
+
+func TestLayout_WithLargerMinFontSize_GivesUpSooner(t *testing.T) {
+	text := "when the build is green on the first try and the deploy works too"
+	small, _ := layoutRenderer(t).layout(text, captionBox)
+	large, _ := layoutRenderer(t).WithMinFontSize(30).layout(text, captionBox)
+	assert.False(t, small.Truncated)
+	assert.True(t, large.Truncated)
+	assert.Equal(t, 30.0, large.Size)
+}
+
+func TestLayout_WordTooLongForAnyLine_IsBrokenUp(t *testing.T) {
+	captionLayout, err := layoutRenderer(t).layout(strings.Repeat("A", 40), captionBox)
+	assert.Nil(t, err)
+	assert.Greater(t, len(captionLayout.Lines), 1)
+	assert.Equal(t, strings.Repeat("A", 40), strings.Join(captionLayout.Lines, ""))
+}
+
+func TestLayout_EmptyCaption_HasNoLines(t *testing.T) {
+	captionLayout, err := layoutRenderer(t).layout("  \n ", captionBox)
+	assert.Nil(t, err)
+	assert.Empty(t, captionLayout.Lines)
+}
+
+func TestPrepareText_ComposesAccentsAndCollapsesWhitespace(t *testing.T) {
+	assert.Equal(t, "CAFÉ AU LAIT", layoutRenderer(t).prepareText("  café\n\tau   lait "))
+}
+
+func TestPrepareText_ReplacesMissingGlyphsWithBoxes(t *testing.T) {
+	r := layoutRenderer(t)
+	assert.Equal(t, "HI □", r.prepareText("hi 🎉"))
+	assert.Equal(t, "□", r.prepareText("👍🏽"))
+	assert.Equal(t, "□", r.prepareText("👨‍👩‍👧"))
+	assert.Equal(t, "□", r.prepareText("🇯🇵"))
+	assert.Equal(t, "□", r.prepareText("❤️"))
+}
+
+func TestPrepareText_UsesFallbackFonts(t *testing.T) {
+	assert.Equal(t, "□", layoutRenderer(t).prepareText("中"))
+	assert.Equal(t, "中", cjkRenderer(t).prepareText("中"))
+}
+
+func TestSplitSegments_BreaksOnSpacesAndBetweenCJK(t *testing.T) {
+	assert.Equal(t, []segment{{Text: "HELLO"}, {Text: "WORLD", Space: true}}, splitSegments("HELLO WORLD"))
+	assert.Equal(t, []segment{{Text: "AB"}, {Text: "中"}, {Text: "中。"}, {Text: "CD", Space: true}}, splitSegments("AB中中。 CD"))
+	assert.Equal(t, []segment{{Text: "A"}, {Text: "中", Space: true}}, splitSegments("A 中"))
+}
+
+func TestParseOverflow_AcceptsKnownModes(t *testing.T) {
+	overflow, err := ParseOverflow("Reject")
+	assert.Nil(t, err)
+	assert.Equal(t, Reject, overflow)
+	overflow, err = ParseOverflow("truncate")
+	assert.Nil(t, err)
+	assert.Equal(t, Truncate, overflow)
+	_, err = ParseOverflow("shrink")
+	assert.Error(t, err)
+}
+
+func TestLoadFont_WhenFileIsMissing_RaisesAnError(t *testing.T) {
+	_, err := LoadFont(filepath.Join("testdata", "missing.ttf"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,223 @@
+package meme_renderer
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	error_types "maas/error-types"
+	"maas/models"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+/*
+  Draws meme captions onto a base image and encodes the result.
+  Captions are drawn in the classic meme style: upper case, bold, white text with a black outline.
+*/
+
+type Format string
+
+const (
+	PNG  Format = "png"
+	JPEG Format = "jpeg"
+	GIF  Format = "gif"
+)
+
+const (
+	DefaultWidth  = 600
+	DefaultHeight = 600
+)
+
+var (
+	DefaultBackground = color.RGBA{R: 40, G: 40, B: 40, A: 255}
+	textColor         = color.White
+	outlineColor      = color.Black
+)
+
+type Renderer struct {
+	Font   *opentype.Font
+	Format Format
+	// Used, in order, for characters Font doesn't have
+	Fallbacks []*opentype.Font
+	// The smallest size captions are shrunk to. Defaults to DefaultMinFontSize
+	MinFontSize float64
+	// What happens to captions that don't fit at MinFontSize. Defaults to Truncate
+	Overflow Overflow
+}
+
+// Builds a renderer using the bundled Go Bold font, producing PNGs
+func NewRenderer() (*Renderer, error) {
+	parsedFont, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		return nil, err
+	}
+	return &Renderer{Font: parsedFont, Format: PNG, MinFontSize: DefaultMinFontSize, Overflow: Truncate}, nil
+}
+
+func (r *Renderer) WithFormat(format Format) *Renderer {
+	r.Format = format
+	return r
+}
+
+// A plain single color image to draw on when there is no template to use
+func Canvas(width int, height int, background color.Color) image.Image {
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	return canvas
+}
+
+// Draws the captions onto a copy of base and returns the encoded image
+func (r *Renderer) Render(base image.Image, topText string, bottomText string) ([]byte, error) {
+	img, err := r.Draw(base, topText, bottomText)
+	if err != nil {
+		return nil, err
+	}
+	return Encode(img, r.Format)
+}
+
+// Draws the captions into the template's caption boxes and returns the encoded image
+func (r *Renderer) RenderTemplate(template *models.Template, topText string, bottomText string) ([]byte, error) {
+	img, err := r.DrawTemplate(template, topText, bottomText)
+	if err != nil {
+		return nil, err
+	}
+	return Encode(img, r.Format)
+}
+
+// Draws the captions onto a copy of base without encoding it
+func (r *Renderer) Draw(base image.Image, topText string, bottomText string) (*image.RGBA, error) {
+	topBox, bottomBox := DefaultBoxes(base.Bounds())
+	return r.drawInBoxes(base, topText, topBox, bottomText, bottomBox)
+}
+
+func (r *Renderer) DrawTemplate(template *models.Template, topText string, bottomText string) (*image.RGBA, error) {
+	return r.drawInBoxes(template.Image, topText, template.TopBox.Rect(), bottomText, template.BottomBox.Rect())
+}
+
+// Caption boxes covering the top and bottom fifths of an image, used when there is no template
+func DefaultBoxes(bounds image.Rectangle) (image.Rectangle, image.Rectangle) {
+	width, height := bounds.Dx(), bounds.Dy()
+	margin := height / 40
+	boxHeight := height / 5
+	topBox := image.Rect(margin, margin, width-margin, margin+boxHeight)
+	bottomBox := image.Rect(margin, height-margin-boxHeight, width-margin, height-margin)
+	return topBox, bottomBox
+}
+
+// Top text hangs from the top of its box and bottom text sits on the bottom of its box
+func (r *Renderer) drawInBoxes(base image.Image, topText string, topBox image.Rectangle, bottomText string, bottomBox image.Rectangle) (*image.RGBA, error) {
+	bounds := base.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(img, img.Bounds(), base, bounds.Min, draw.Src)
+
+	if err := r.drawCaption(img, topText, topBox, false); err != nil {
+		return nil, err
+	}
+	if err := r.drawCaption(img, bottomText, bottomBox, true); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// Lays the caption out in the box and draws each line centered horizontally
+func (r *Renderer) drawCaption(img *image.RGBA, text string, box image.Rectangle, alignBottom bool) error {
+	captionLayout, err := r.layout(text, box)
+	if err != nil {
+		return err
+	}
+	if len(captionLayout.Lines) == 0 {
+		return nil
+	}
+	faces, err := r.faces(captionLayout.Size)
+	if err != nil {
+		return err
+	}
+	defer faces.Close()
+
+	metrics := faces.metrics()
+	baseline := box.Min.Y + metrics.Ascent.Ceil()
+	if alignBottom {
+		baseline = box.Max.Y - metrics.Descent.Ceil() - (len(captionLayout.Lines)-1)*metrics.Height.Ceil()
+	}
+	for _, line := range captionLayout.Lines {
+		drawLine(img, faces, line, box, baseline)
+		baseline += metrics.Height.Ceil()
+	}
+	return nil
+}
+
+// Draws a single line of text centered horizontally in the box on the given baseline
+func drawLine(img *image.RGBA, faces faceSet, text string, box image.Rectangle, baseline int) {
+	drawer := &font.Drawer{Dst: img}
+	width := faces.measure(text)
+	x := fixed.I(box.Min.X) + (fixed.I(box.Dx())-width)/2
+	y := fixed.I(baseline)
+
+	// Outline first by stamping the text in black around the final position
+	outline := faces.metrics().Height.Ceil() / 16
+	if outline < 1 {
+		outline = 1
+	}
+	drawer.Src = image.NewUniform(outlineColor)
+	for dy := -outline; dy <= outline; dy++ {
+		for dx := -outline; dx <= outline; dx++ {
+			if dx*dx+dy*dy > outline*outline {
+				continue
+			}
+			drawer.Dot = fixed.Point26_6{X: x + fixed.I(dx), Y: y + fixed.I(dy)}
+			faces.draw(drawer, text)
+		}
+	}
+
+	drawer.Src = image.NewUniform(textColor)
+	drawer.Dot = fixed.Point26_6{X: x, Y: y}
+	faces.draw(drawer, text)
+}
+
+func Encode(img image.Image, format Format) ([]byte, error) {
+	var buffer bytes.Buffer
+	var err error
+	switch format {
+	case PNG:
+		err = png.Encode(&buffer, img)
+	case JPEG:
+		err = jpeg.Encode(&buffer, img, &jpeg.Options{Quality: 90})
+	case GIF:
+		err = gif.Encode(&buffer, img, nil)
+	default:
+		err = &error_types.UnsupportedImageFormatError{Format: string(format)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Re-encodes an image in another format. Only the first frame of an animation is kept
+func Transcode(data []byte, format Format) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return Encode(img, format)
+}
+
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "png":
+		return PNG, nil
+	case "jpeg", "jpg":
+		return JPEG, nil
+	case "gif":
+		return GIF, nil
+	}
+	return "", &error_types.UnsupportedImageFormatError{Format: name}
+}
@@ -0,0 +1,136 @@
+package meme_renderer
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	error_types "maas/error-types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var renderer *Renderer
+
+func TestMain(m *testing.M) {
+	var err error
+	renderer, err = NewRenderer()
+	if err != nil {
+		panic(err)
+	}
+	m.Run()
+}
+
+func countPixels(img image.Image, area image.Rectangle, c color.Color) int {
+	r, g, b, _ := c.RGBA()
+	count := 0
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			pr, pg, pb, _ := img.At(x, y).RGBA()
+			if pr == r && pg == g && pb == b {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func TestCanvas_FillsTheWholeImage(t *testing.T) {
+	canvas := Canvas(10, 20, DefaultBackground)
+	assert.Equal(t, image.Rect(0, 0, 10, 20), canvas.Bounds())
+	assert.Equal(t, 200, countPixels(canvas, canvas.Bounds(), DefaultBackground))
+}
+
+func TestDraw_KeepsBaseImageSize(t *testing.T) {
+	img, err := renderer.Draw(Canvas(300, 200, DefaultBackground), "top", "bottom")
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 300, 200), img.Bounds())
+}
+
+func TestDraw_DrawsTopTextInTopHalfOnly(t *testing.T) {
+	img, err := renderer.Draw(Canvas(400, 400, DefaultBackground), "top", "")
+	assert.Nil(t, err)
+	topHalf := image.Rect(0, 0, 400, 200)
+	bottomHalf := image.Rect(0, 200, 400, 400)
+	assert.Greater(t, countPixels(img, topHalf, color.White), 0)
+	assert.Greater(t, countPixels(img, topHalf, color.Black), 0)
+	assert.Equal(t, 0, countPixels(img, bottomHalf, color.White))
+}
+
+func TestDraw_DrawsBottomTextInBottomHalfOnly(t *testing.T) {
+	img, err := renderer.Draw(Canvas(400, 400, DefaultBackground), "", "bottom")
+	assert.Nil(t, err)
+	topHalf := image.Rect(0, 0, 400, 200)
+	bottomHalf := image.Rect(0, 200, 400, 400)
+	assert.Equal(t, 0, countPixels(img, topHalf, color.White))
+	assert.Greater(t, countPixels(img, bottomHalf, color.White), 0)
+}
+
+func TestDraw_DoesNotModifyBaseImage(t *testing.T) {
+	base := Canvas(100, 100, DefaultBackground)
+	_, err := renderer.Draw(base, "top", "bottom")
+	assert.Nil(t, err)
+	assert.Equal(t, 100*100, countPixels(base, base.Bounds(), DefaultBackground))
+}
+
+func TestRender_WithPNGFormat_ReturnsAPNG(t *testing.T) {
+	pngRenderer, _ := NewRenderer()
+	data, err := pngRenderer.WithFormat(PNG).Render(Canvas(100, 50, DefaultBackground), "top", "bottom")
+	assert.Nil(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 100, 50), img.Bounds())
+}
+
+func TestRender_WithJPEGFormat_ReturnsAJPEG(t *testing.T) {
+	jpegRenderer, _ := NewRenderer()
+	data, err := jpegRenderer.WithFormat(JPEG).Render(Canvas(100, 50, DefaultBackground), "top", "bottom")
+	assert.Nil(t, err)
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 100, 50), img.Bounds())
+}
+
+func TestEncode_WithUnknownFormat_RaisesAnError(t *testing.T) {
+	data, err := Encode(Canvas(10, 10, DefaultBackground), Format("bmp"))
+	assert.Nil(t, data)
+	assert.IsType(t, &error_types.UnsupportedImageFormatError{}, err)
+}
+
+func TestRender_WithGIFFormat_ReturnsAGIF(t *testing.T) {
+	gifRenderer, _ := NewRenderer()
+	data, err := gifRenderer.WithFormat(GIF).Render(Canvas(100, 50, DefaultBackground), "top", "bottom")
+	assert.Nil(t, err)
+	img, err := gif.Decode(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 100, 50), img.Bounds())
+}
+
+func TestTranscode_ConvertsBetweenFormats(t *testing.T) {
+	data, _ := Encode(Canvas(30, 20, DefaultBackground), PNG)
+	converted, err := Transcode(data, JPEG)
+	assert.Nil(t, err)
+	img, err := jpeg.Decode(bytes.NewReader(converted))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 30, 20), img.Bounds())
+}
+
+func TestTranscode_WhenDataIsNotAnImage_RaisesAnError(t *testing.T) {
+	converted, err := Transcode([]byte("not an image"), JPEG)
+	assert.Nil(t, converted)
+	assert.Error(t, err)
+}
+
+func TestParseFormat_AcceptsKnownFormats(t *testing.T) {
+	for name, expected := range map[string]Format{"png": PNG, "PNG": PNG, "jpeg": JPEG, "jpg": JPEG, "gif": GIF} {
+		format, err := ParseFormat(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, format)
+	}
+	_, err := ParseFormat("webp")
+	assert.IsType(t, &error_types.UnsupportedImageFormatError{}, err)
+}
@@ -0,0 +1,135 @@
+package meme_service
+
+import (
+	"fmt"
+	"net/http"
+
+	error_types "maas/error-types"
+	"maas/loggers"
+	"maas/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The most memes one batch can ask for
+const MaxBatchSize = 50
+
+type BatchRequest struct {
+	Memes []QueryParams `json:"memes"`
+}
+
+// How one meme in a batch went. Status is what GET /memes would have answered with
+type BatchItemResult struct {
+	Index     int               `json:"index"`
+	Status    int               `json:"status"`
+	Meme      *models.Meme      `json:"meme,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Violation map[string]string `json:"violation,omitempty"`
+}
+
+type BatchResponse struct {
+	// In the same order as the request
+	Results []*BatchItemResult `json:"results"`
+	// Tokens reserved up front, and how many of those were given back for memes that failed
+	Reserved int `json:"tokens_reserved"`
+	Refunded int `json:"tokens_refunded"`
+	// What the user has left once the batch is done
+	TokensRemaining int `json:"tokens_remaining"`
+}
+
+// POSTs a list of meme requests and makes each one. Requests that can be turned away before
+// anything is built (a bad lang or a query against the content policy) are, and aren't charged.
+// Tokens for the rest are reserved in one step, so either the whole batch is paid for or none of
+// it is. Once the memes are made the reservation is committed for the ones that worked and the
+// tokens for the rest are given back. Failures are reported per item, so the batch itself succeeds
+// as long as it could be paid for
+func (s *MemeService) BatchMemes(ginContext *gin.Context) {
+	err := s.requireAuthenticated(ginContext)
+	if err != nil {
+		return
+	}
+	var request BatchRequest
+	if err := ginContext.ShouldBindJSON(&request); err != nil {
+		loggers.ErrorLog.Printf("Encountered an error reading a batch%s\n", err)
+		ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": "bad request"})
+		return
+	}
+	if len(request.Memes) == 0 || len(request.Memes) > MaxBatchSize {
+		ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("A batch needs between 1 and %d memes", MaxBatchSize)})
+		return
+	}
+
+	user, err := s.UserRepo.UserByAuthHeader(ginContext.Request.Header.Get("auth"))
+	if err != nil {
+		loggers.ErrorLog.Printf("Encountered an error making a batch%s\n", err)
+		ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": "bad request"})
+		return
+	}
+
+	results := make([]*BatchItemResult, len(request.Memes))
+	billable := []int{}
+	for i := range request.Memes {
+		params := &request.Memes[i]
+		results[i] = &BatchItemResult{Index: i}
+		lang, err := s.resolveLanguage(params.Lang, ginContext.GetHeader("Accept-Language"))
+		if err != nil {
+			results[i].fail(http.StatusBadRequest, err.Error())
+			continue
+		}
+		params.Lang = lang
+		if err := s.moderateQuery(user, params); err != nil {
+			results[i].failModeration(err)
+			continue
+		}
+		billable = append(billable, i)
+	}
+
+	response := &BatchResponse{Results: results, TokensRemaining: user.TokensRemaining}
+	if len(billable) == 0 {
+		ginContext.IndentedJSON(http.StatusOK, response)
+		return
+	}
+	reservation := s.newReservation(len(billable)*MemeCost, fmt.Sprintf("batch of %d memes", len(billable)), ginContext)
+	reserved, err := s.UserRepo.ReserveTokens(user.ID.Hex(), reservation)
+	if err != nil {
+		switch err.(type) {
+		default:
+			loggers.ErrorLog.Printf("Encountered an error reserving tokens for a batch%s\n", err)
+			ginContext.IndentedJSON(http.StatusInternalServerError, map[string]string{"error": "Unable to reserve tokens"})
+		case *error_types.InsufficientTokensError:
+			ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": "Tokens needed to make more memes. Buy some!"})
+		}
+		return
+	}
+	// Routing and moderation go by the user as they were after reserving
+	user = reserved
+	response.Reserved = reservation.Amount
+	response.TokensRemaining = user.TokensRemaining
+
+	provider := s.providerFor(user)
+	for _, i := range billable {
+		meme, failure := s.fulfil(user, provider, &request.Memes[i])
+		if failure != nil {
+			results[i].fail(failure.Status, failure.Error)
+			results[i].Violation = failure.Violation
+			response.Refunded += MemeCost
+			continue
+		}
+		results[i].Status = http.StatusOK
+		results[i].Meme = meme
+	}
+	response.TokensRemaining += response.Refunded
+	ginContext.IndentedJSON(http.StatusOK, response)
+	s.commit(user, reservation, response.Reserved-response.Refunded)
+}
+
+func (r *BatchItemResult) fail(status int, message string) {
+	r.Status = status
+	r.Error = message
+}
+
+func (r *BatchItemResult) failModeration(err error) {
+	failure := moderationFailure(err)
+	r.fail(failure.Status, failure.Error)
+	r.Violation = failure.Violation
+}
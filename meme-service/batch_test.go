@@ -0,0 +1,166 @@
+package meme_service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"maas/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Holds the token balance for the "PLAN" user and keeps track of what was reserved and given back
+type TokenUserRepository struct {
+	PlanUserRepository
+	reserved []int
+	released int
+}
+
+func (m *TokenUserRepository) ReserveTokens(id string, reservation *models.TokenReservation) (*models.User, error) {
+	m.reserved = append(m.reserved, reservation.Amount)
+	return m.PlanUserRepository.ReserveTokens(id, reservation)
+}
+
+func (m *TokenUserRepository) ReserveTokensByAuth(auth string, reservation *models.TokenReservation) (*models.User, error) {
+	m.reserved = append(m.reserved, reservation.Amount)
+	return m.PlanUserRepository.ReserveTokensByAuth(auth, reservation)
+}
+
+func (m *TokenUserRepository) CommitReservation(userId string, reservation *models.TokenReservation, spent int) error {
+	err := m.PlanUserRepository.CommitReservation(userId, reservation, spent)
+	if err == nil {
+		m.released += reservation.Amount - spent
+	}
+	return err
+}
+
+func (m *TokenUserRepository) ReleaseReservation(userId string, reservation *models.TokenReservation) error {
+	return m.CommitReservation(userId, reservation, 0)
+}
+
+func batchService(tokens int) (*MemeService, *TokenUserRepository, *MockMemeHistory) {
+	users := &TokenUserRepository{PlanUserRepository: PlanUserRepository{
+		planUser: &models.User{ID: primitive.NewObjectID(), TokensRemaining: tokens},
+	}}
+	history := &MockMemeHistory{}
+	service := NewMemeService(users, authService, &MockMemeProvider{}).WithHistory(history)
+	return service, users, history
+}
+
+func performBatch(service *MemeService, body string, authHeader string) *httptest.ResponseRecorder {
+	router := gin.Default()
+	router.POST("/memes/batch", service.BatchMemes)
+	req, _ := http.NewRequest("POST", "/memes/batch", strings.NewReader(body))
+	req.Header.Set("auth", authHeader)
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestBatchMemes_WhenEverythingIsGood_ReturnsMemesInOrder(t *testing.T) {
+	service, users, history := batchService(5)
+	recorder := performBatch(service, `{"memes": [{"query": "someQuery"}, {}, {"query": "withImage"}]}`, "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response BatchResponse
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Len(t, response.Results, 3)
+	for i, result := range response.Results {
+		assert.Equal(t, i, result.Index)
+		assert.Equal(t, http.StatusOK, result.Status)
+		assert.Empty(t, result.Error)
+	}
+	assert.Equal(t, paramMeme.TopText, response.Results[0].Meme.TopText)
+	assert.Equal(t, defaultMeme.TopText, response.Results[1].Meme.TopText)
+	assert.Equal(t, "withImage", response.Results[2].Meme.TopText)
+	assert.Equal(t, 3, response.Reserved)
+	assert.Equal(t, 0, response.Refunded)
+	assert.Equal(t, 2, response.TokensRemaining)
+	assert.Equal(t, []int{3}, users.reserved)
+	assert.Len(t, history.records, 3)
+}
+
+func TestBatchMemes_WhenSomeItemsFail_RefundsThemAndReportsEach(t *testing.T) {
+	service, users, history := batchService(5)
+	body := `{"memes": [{"query": "raiseError"}, {"query": "someQuery"}, {"query": "providerDown"}, {"query": "tooLong"}]}`
+	recorder := performBatch(service, body, "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response BatchResponse
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, http.StatusInternalServerError, response.Results[0].Status)
+	assert.Nil(t, response.Results[0].Meme)
+	assert.Equal(t, http.StatusOK, response.Results[1].Status)
+	assert.Equal(t, http.StatusBadGateway, response.Results[2].Status)
+	assert.Equal(t, http.StatusBadRequest, response.Results[3].Status)
+	assert.Contains(t, response.Results[3].Error, "too long")
+	assert.Equal(t, 4, response.Reserved)
+	assert.Equal(t, 3, response.Refunded)
+	assert.Equal(t, 3, users.released)
+	assert.Equal(t, 4, response.TokensRemaining)
+	assert.Equal(t, 4, users.planUser.TokensRemaining)
+	assert.Len(t, history.records, 1)
+}
+
+func TestBatchMemes_WhenUserCantAffordTheWholeBatch_ChargesNothing(t *testing.T) {
+	service, users, history := batchService(2)
+	recorder := performBatch(service, `{"memes": [{}, {}, {}]}`, "PLAN")
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "Tokens needed")
+	assert.Equal(t, 2, users.planUser.TokensRemaining)
+	assert.Equal(t, 0, users.released)
+	assert.Empty(t, history.records)
+}
+
+func TestBatchMemes_WhenQueryBreaksPolicy_DoesNotChargeForIt(t *testing.T) {
+	service, users, _ := batchService(5)
+	violations := &MockViolationLog{}
+	service = service.WithModerator(&MockModerator{}).WithViolationLog(violations)
+	recorder := performBatch(service, `{"memes": [{"query": "blocked"}, {"query": "someQuery"}]}`, "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response BatchResponse
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Results[0].Status)
+	assert.Equal(t, "no-blocked", response.Results[0].Violation["rule"])
+	assert.Equal(t, http.StatusOK, response.Results[1].Status)
+	assert.Equal(t, []int{1}, users.reserved)
+	assert.Equal(t, 0, response.Refunded)
+	assert.Len(t, violations.violations, 1)
+}
+
+func TestBatchMemes_WhenNothingIsBillable_SpendsNothing(t *testing.T) {
+	service, users, _ := batchService(5)
+	service = service.WithLanguages(&MockLanguageMatcher{})
+	recorder := performBatch(service, `{"memes": [{"lang": "xx"}]}`, "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response BatchResponse
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, http.StatusBadRequest, response.Results[0].Status)
+	assert.Empty(t, users.reserved)
+	assert.Equal(t, 5, response.TokensRemaining)
+}
+
+func TestBatchMemes_WithBadBatches_RaisesBadRequest(t *testing.T) {
+	service, users, _ := batchService(100)
+	tooMany := `{"memes": [` + strings.Repeat(`{},`, MaxBatchSize) + `{}]}`
+	for _, body := range []string{`not json`, `{"memes": []}`, `{}`, tooMany} {
+		recorder := performBatch(service, body, "PLAN")
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, body)
+	}
+	assert.Empty(t, users.reserved)
+}
+
+func TestBatchMemes_WhenNotAuthenticated_RaisesUnauthorized(t *testing.T) {
+	service, _, _ := batchService(5)
+	recorder := performBatch(service, `{"memes": [{}]}`, "")
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
@@ -0,0 +1,137 @@
+package meme_service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	error_types "maas/error-types"
+	"maas/loggers"
+	"maas/models"
+	request_ids "maas/request-ids"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Set on responses that are a replay of the first one for their Idempotency-Key
+const ReplayedHeader = "Idempotent-Replayed"
+
+// Keeps the first response for each caller's Idempotency-Key
+type IdempotencyStore interface {
+	// Claims key for caller. Returns the stored response when the key has already been answered, an
+	// IdempotencyKeyReusedError when it was used with another fingerprint, and an
+	// IdempotencyKeyInUseError while the request that claimed it is still running
+	Begin(caller string, key string, fingerprint string) (*models.StoredResponse, error)
+	// Stores the claimed key's response, to be replayed until it expires
+	Complete(response *models.StoredResponse)
+	// Gives up a claim without storing anything, so the key can be tried again
+	Abandon(caller string, key string)
+}
+
+func (s *MemeService) WithIdempotency(store IdempotencyStore) *MemeService {
+	s.Idempotency = store
+	return s
+}
+
+// Runs handle once per caller and Idempotency-Key, replaying its response to retries. handle says what
+// the request was charged, and whether the response is worth keeping. Ones that aren't, like a caller
+// that couldn't be authenticated, and server errors are given up so a retry gets a fresh try
+func (s *MemeService) idempotently(ginContext *gin.Context, authHeader string, key string, params *QueryParams, handle func() (int, bool)) {
+	caller := fingerprint(authHeader)
+	paramsHash := paramsFingerprint(ginContext, params)
+	stored, err := s.Idempotency.Begin(caller, key, paramsHash)
+	if err != nil {
+		idempotencyResponse(err, ginContext)
+		return
+	}
+	if stored != nil {
+		loggers.InfoLog.Printf("Replaying the response for idempotency key %s, first charged %d\n", key, stored.Cost)
+		replay(stored, ginContext)
+		return
+	}
+
+	completed := false
+	defer func() {
+		if !completed {
+			s.Idempotency.Abandon(caller, key)
+		}
+	}()
+	recorder := &recordingWriter{ResponseWriter: ginContext.Writer}
+	ginContext.Writer = recorder
+	cost, keep := handle()
+	if !keep || recorder.Status() >= http.StatusInternalServerError {
+		return
+	}
+	s.Idempotency.Complete(&models.StoredResponse{
+		Key:             key,
+		Caller:          caller,
+		Fingerprint:     paramsHash,
+		Status:          recorder.Status(),
+		Body:            recorder.body.Bytes(),
+		ContentType:     recorder.Header().Get("Content-Type"),
+		ContentLanguage: recorder.Header().Get("Content-Language"),
+		Cost:            cost,
+	})
+	completed = true
+}
+
+// The request's Idempotency-Key, answering 400 for one that's too long
+func idempotencyKey(ginContext *gin.Context) (string, error) {
+	key, ok := request_ids.IdempotencyKey(ginContext)
+	if !ok {
+		message := fmt.Sprintf("Idempotency-Key can be at most %d characters", request_ids.MaxIdempotencyKeyLength)
+		ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": message})
+		return "", fmt.Errorf("idempotency key too long")
+	}
+	return key, nil
+}
+
+// What makes two requests the same: the route and the parameters the meme is made from
+func paramsFingerprint(ginContext *gin.Context, params *QueryParams) string {
+	encoded, _ := json.Marshal(params)
+	return fingerprint(ginContext.Request.Method + " " + ginContext.FullPath() + " " + string(encoded))
+}
+
+func fingerprint(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func replay(stored *models.StoredResponse, ginContext *gin.Context) {
+	if stored.ContentLanguage != "" {
+		ginContext.Header("Content-Language", stored.ContentLanguage)
+	}
+	ginContext.Header(ReplayedHeader, "true")
+	ginContext.Data(stored.Status, stored.ContentType, stored.Body)
+}
+
+func idempotencyResponse(err error, ginContext *gin.Context) {
+	switch err.(type) {
+	default:
+		loggers.ErrorLog.Printf("Encountered an error checking an idempotency key: %s\n", err)
+		ginContext.IndentedJSON(http.StatusInternalServerError, map[string]string{"error": "There was an error, please try again later"})
+	case *error_types.IdempotencyKeyReusedError:
+		ginContext.IndentedJSON(http.StatusConflict, map[string]string{"error": "This Idempotency-Key was already used with different parameters"})
+	case *error_types.IdempotencyKeyInUseError:
+		ginContext.IndentedJSON(http.StatusConflict, map[string]string{"error": "A request with this Idempotency-Key is still in progress"})
+	}
+}
+
+// Keeps a copy of everything written to the response
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(data string) (int, error) {
+	w.body.WriteString(data)
+	return w.ResponseWriter.WriteString(data)
+}
@@ -0,0 +1,132 @@
+package meme_service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	error_types "maas/error-types"
+	"maas/models"
+	request_ids "maas/request-ids"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Keeps claims and responses in a map, without expiring anything
+type MockIdempotencyStore struct {
+	claims    map[string]string
+	responses map[string]*models.StoredResponse
+}
+
+func newMockIdempotencyStore() *MockIdempotencyStore {
+	return &MockIdempotencyStore{claims: map[string]string{}, responses: map[string]*models.StoredResponse{}}
+}
+
+func (m *MockIdempotencyStore) Begin(caller string, key string, fingerprint string) (*models.StoredResponse, error) {
+	claimed, ok := m.claims[caller+key]
+	if !ok {
+		m.claims[caller+key] = fingerprint
+		return nil, nil
+	}
+	if claimed != fingerprint {
+		return nil, &error_types.IdempotencyKeyReusedError{Key: key}
+	}
+	if response, ok := m.responses[caller+key]; ok {
+		return response, nil
+	}
+	return nil, &error_types.IdempotencyKeyInUseError{Key: key}
+}
+
+func (m *MockIdempotencyStore) Complete(response *models.StoredResponse) {
+	m.responses[response.Caller+response.Key] = response
+}
+
+func (m *MockIdempotencyStore) Abandon(caller string, key string) {
+	if _, ok := m.responses[caller+key]; !ok {
+		delete(m.claims, caller+key)
+	}
+}
+
+func performIdempotentRequest(service *MemeService, path string, authHeader string, key string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Header.Set("auth", authHeader)
+	req.Header.Set(request_ids.IdempotencyKeyHeader, key)
+	recorder := httptest.NewRecorder()
+	testRouter(*service).ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestGetMeme_WhenRetriedWithTheSameKey_ReplaysWithoutCharging(t *testing.T) {
+	repo := &ChargingUserRepository{}
+	store := newMockIdempotencyStore()
+	service := NewMemeService(repo, authService, &MockMemeProvider{}).WithIdempotency(store)
+
+	first := performIdempotentRequest(service, "/meme?query=someQuery", "ADMIN", "retry-1")
+	retry := performIdempotentRequest(service, "/meme?query=someQuery", "ADMIN", "retry-1")
+
+	assert.Equal(t, http.StatusOK, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, first.Header().Get("Content-Type"), retry.Header().Get("Content-Type"))
+	assert.Equal(t, "true", retry.Header().Get(ReplayedHeader))
+	assert.Empty(t, first.Header().Get(ReplayedHeader))
+	assert.Equal(t, 1, repo.charges)
+	assert.Equal(t, MemeCost, store.responses[fingerprint("ADMIN")+"retry-1"].Cost)
+}
+
+func TestGetMeme_WhenKeyIsReusedWithOtherParams_RaisesConflict(t *testing.T) {
+	repo := &ChargingUserRepository{}
+	service := NewMemeService(repo, authService, &MockMemeProvider{}).WithIdempotency(newMockIdempotencyStore())
+
+	performIdempotentRequest(service, "/meme?query=someQuery", "ADMIN", "retry-1")
+	recorder := performIdempotentRequest(service, "/meme?query=otherQuery", "ADMIN", "retry-1")
+
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Equal(t, 1, repo.charges)
+}
+
+func TestGetMeme_WhenAnotherCallerUsesTheKey_MakesTheirOwnMeme(t *testing.T) {
+	repo := &ChargingUserRepository{}
+	service := NewMemeService(repo, authService, &MockMemeProvider{}).WithIdempotency(newMockIdempotencyStore())
+
+	performIdempotentRequest(service, "/meme?query=someQuery", "ADMIN", "retry-1")
+	recorder := performIdempotentRequest(service, "/meme?query=someQuery", "DEFAULT", "retry-1")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Empty(t, recorder.Header().Get(ReplayedHeader))
+	assert.Equal(t, 2, repo.charges)
+}
+
+func TestGetMeme_WhenTheFirstTryFailsOnOurSide_LetsTheRetryThrough(t *testing.T) {
+	repo := &ChargingUserRepository{}
+	store := newMockIdempotencyStore()
+	service := NewMemeService(repo, authService, &MockMemeProvider{}).WithIdempotency(store)
+
+	performIdempotentRequest(service, "/meme?query=raiseError", "ADMIN", "retry-1")
+	recorder := performIdempotentRequest(service, "/meme?query=raiseError", "ADMIN", "retry-1")
+
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Empty(t, recorder.Header().Get(ReplayedHeader))
+	assert.Equal(t, 2, repo.charges)
+	assert.Empty(t, store.responses)
+}
+
+func TestGetMeme_WhenTheCallerIsNotAUser_DoesNotKeepTheResponse(t *testing.T) {
+	store := newMockIdempotencyStore()
+	service := NewMemeService(&MockUserRepository{}, authService, &MockMemeProvider{}).WithIdempotency(store)
+
+	recorder := performIdempotentRequest(service, "/meme", "MISSING", "retry-1")
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Empty(t, store.claims)
+}
+
+func TestGetMeme_WhenIdempotencyKeyIsTooLong_RaisesBadRequest(t *testing.T) {
+	repo := &ChargingUserRepository{}
+	service := NewMemeService(repo, authService, &MockMemeProvider{}).WithIdempotency(newMockIdempotencyStore())
+
+	recorder := performIdempotentRequest(service, "/meme", "ADMIN", strings.Repeat("k", request_ids.MaxIdempotencyKeyLength+1))
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, 0, repo.charges)
+}
@@ -0,0 +1,167 @@
+package meme_service
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	error_types "maas/error-types"
+	"maas/loggers"
+	"maas/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Runs meme jobs in the background and keeps track of them so they can be polled
+type JobQueue interface {
+	// Queues work for the job, or returns a QueueFullError
+	Submit(job *models.MemeJob, work JobWork) error
+	// A copy of the job as it stands, or a JobNotFoundError
+	Job(id string) (*models.MemeJob, error)
+	// Whether jobs with a callback URL are told when they're done
+	AcceptsCallbacks() bool
+}
+
+// Makes the meme for a job. The queue records whichever of the two comes back
+type JobWork func() (*models.Meme, *MemeFailure)
+
+type JobRequest struct {
+	QueryParams
+	// Optional. Gets a signed POST of the job once it's done
+	CallbackURL string `json:"callback_url"`
+}
+
+func (s *MemeService) WithJobs(jobs JobQueue) *MemeService {
+	s.Jobs = jobs
+	return s
+}
+
+// POSTs a meme to be made in the background and returns the queued job straight away. The token is
+// reserved now, so a user without one finds out immediately, kept once the job succeeds and given
+// back if it fails
+func (s *MemeService) SubmitJob(ginContext *gin.Context) {
+	authHeader := ginContext.Request.Header.Get("auth")
+	if authHeader == "" {
+		authResponse(&error_types.NoAuthHeaderError{}, ginContext)
+		return
+	}
+	if s.Jobs == nil {
+		ginContext.IndentedJSON(http.StatusNotFound, map[string]string{"error": "meme jobs are not available"})
+		return
+	}
+	var request JobRequest
+	if err := ginContext.ShouldBindJSON(&request); err != nil {
+		loggers.ErrorLog.Printf("Encountered an error reading a job%s\n", err)
+		ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": "bad request"})
+		return
+	}
+	if request.CallbackURL != "" {
+		if !s.Jobs.AcceptsCallbacks() {
+			ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": "callback_url is not supported"})
+			return
+		}
+		if !validCallbackURL(request.CallbackURL) {
+			ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": "callback_url must be an http or https URL"})
+			return
+		}
+	}
+	params := &request.QueryParams
+	lang, err := s.resolveLanguage(params.Lang, ginContext.GetHeader("Accept-Language"))
+	if err != nil {
+		ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	params.Lang = lang
+
+	if err := s.screenQuery(authHeader, params, ginContext); err != nil {
+		return
+	}
+	user, reservation, err := s.reserveForCaller(authHeader, "meme job", ginContext)
+	if err != nil {
+		return
+	}
+	if err := s.moderateSafeModeQuery(user, params); err != nil {
+		s.release(user, reservation)
+		moderationResponse(err, ginContext)
+		return
+	}
+
+	job := &models.MemeJob{
+		ID:     primitive.NewObjectID().Hex(),
+		UserId: user.ID.Hex(),
+		Status: models.JobQueued,
+		Params: models.MemeParams{
+			Query:    params.Query,
+			Lat:      params.Lat,
+			Lon:      params.Lon,
+			Template: params.Template,
+			Lang:     params.Lang,
+		},
+		CallbackURL: request.CallbackURL,
+		CreatedAt:   time.Now().UTC(),
+	}
+	provider := s.providerFor(user)
+	work := func() (*models.Meme, *MemeFailure) {
+		if failure := s.renewReservation(user, reservation); failure != nil {
+			return nil, failure
+		}
+		meme, failure := s.fulfil(user, provider, params)
+		if failure != nil {
+			s.release(user, reservation)
+			return nil, failure
+		}
+		s.commit(user, reservation, MemeCost)
+		return meme, nil
+	}
+	if err := s.Jobs.Submit(job, work); err != nil {
+		loggers.ErrorLog.Printf("Encountered an error submitting a job%s\n", err)
+		s.release(user, reservation)
+		switch err.(type) {
+		default:
+			ginContext.IndentedJSON(http.StatusInternalServerError, map[string]string{"error": "Unable to queue meme"})
+		case *error_types.QueueFullError:
+			ginContext.IndentedJSON(http.StatusServiceUnavailable, map[string]string{"error": "Too many memes in the queue, try again later"})
+		}
+		return
+	}
+	ginContext.Header("Location", "/memes/jobs/"+job.ID)
+	ginContext.IndentedJSON(http.StatusAccepted, job)
+}
+
+// GETs a job's status, and its meme once it has one. Only the user who submitted it or an admin can see it
+func (s *MemeService) JobById(ginContext *gin.Context) {
+	err := s.requireAuthenticated(ginContext)
+	if err != nil {
+		return
+	}
+	if s.Jobs == nil {
+		ginContext.IndentedJSON(http.StatusNotFound, map[string]string{"error": "meme jobs are not available"})
+		return
+	}
+	job, err := s.Jobs.Job(ginContext.Param("id"))
+	if err != nil {
+		loggers.ErrorLog.Printf("Encountered an error getting a job%s\n", err)
+		ginContext.IndentedJSON(http.StatusNotFound, map[string]string{"error": "Unable to find that job"})
+		return
+	}
+	allowed, err := s.Auth.IsCallerOrAdmin(ginContext.Request.Header.Get("auth"), job.UserId)
+	if err != nil {
+		authResponse(err, ginContext)
+		return
+	}
+	if !allowed {
+		// The same answer as a job that doesn't exist, so job IDs can't be probed
+		ginContext.IndentedJSON(http.StatusNotFound, map[string]string{"error": "Unable to find that job"})
+		return
+	}
+	ginContext.IndentedJSON(http.StatusOK, job)
+}
+
+func validCallbackURL(callbackURL string) bool {
+	parsed, err := url.Parse(callbackURL)
+	if err != nil {
+		return false
+	}
+	return (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
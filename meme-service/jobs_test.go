@@ -0,0 +1,235 @@
+package meme_service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	error_types "maas/error-types"
+	"maas/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// Holds on to submitted work so tests can run it when they like
+type MockJobQueue struct {
+	jobs      map[string]*models.MemeJob
+	work      map[string]JobWork
+	full      bool
+	callbacks bool
+}
+
+func (m *MockJobQueue) Submit(job *models.MemeJob, work JobWork) error {
+	if m.full {
+		return &error_types.QueueFullError{}
+	}
+	m.jobs[job.ID] = job
+	m.work[job.ID] = work
+	return nil
+}
+
+func (m *MockJobQueue) Job(id string) (*models.MemeJob, error) {
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, &error_types.JobNotFoundError{ID: id}
+	}
+	return job, nil
+}
+
+func (m *MockJobQueue) AcceptsCallbacks() bool {
+	return m.callbacks
+}
+
+func jobService(tokens int) (*MemeService, *TokenUserRepository, *MockJobQueue) {
+	service, users, _ := batchService(tokens)
+	queue := &MockJobQueue{jobs: map[string]*models.MemeJob{}, work: map[string]JobWork{}}
+	return service.WithJobs(queue), users, queue
+}
+
+func jobRouter(service *MemeService) *gin.Engine {
+	router := gin.Default()
+	router.POST("/memes/jobs", service.SubmitJob)
+	router.GET("/memes/jobs/:id", service.JobById)
+	return router
+}
+
+func submitJob(service *MemeService, body string, authHeader string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/memes/jobs", strings.NewReader(body))
+	req.Header.Set("auth", authHeader)
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	jobRouter(service).ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestSubmitJob_WhenEverythingIsGood_QueuesAChargedJob(t *testing.T) {
+	service, users, queue := jobService(5)
+	recorder := submitJob(service, `{"query": "someQuery", "lat": 1, "lon": 2}`, "PLAN")
+
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	var job models.MemeJob
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &job))
+	assert.Equal(t, models.JobQueued, job.Status)
+	assert.Equal(t, models.MemeParams{Query: "someQuery", Lat: 1, Lon: 2}, job.Params)
+	assert.Equal(t, users.planUser.ID.Hex(), job.UserId)
+	assert.Equal(t, "/memes/jobs/"+job.ID, recorder.Header().Get("Location"))
+	assert.Equal(t, []int{1}, users.reserved)
+
+	meme, failure := queue.work[job.ID]()
+	assert.Nil(t, failure)
+	assert.Equal(t, paramMeme.TopText, meme.TopText)
+	assert.Equal(t, 0, users.released)
+}
+
+func TestSubmitJob_WhenWorkFails_RefundsTheToken(t *testing.T) {
+	service, users, queue := jobService(5)
+	recorder := submitJob(service, `{"query": "providerDown"}`, "PLAN")
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+
+	for _, work := range queue.work {
+		meme, failure := work()
+		assert.Nil(t, meme)
+		assert.Equal(t, http.StatusBadGateway, failure.Status)
+	}
+	assert.Equal(t, 1, users.released)
+	assert.Equal(t, 5, users.planUser.TokensRemaining)
+}
+
+func TestSubmitJob_WhenPickedUp_HoldsTheTokenForAFreshTimeout(t *testing.T) {
+	service, users, queue := jobService(5)
+	recorder := submitJob(service, `{}`, "PLAN")
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	// As if it had queued for most of the timeout
+	queued := time.Now().UTC().Add(time.Minute)
+	users.planUser.Reservations[0].ExpiresAt = queued
+	service.MemeProvider = &InspectingProvider{inspect: func() {
+		assert.Len(t, users.planUser.Reservations, 1)
+		assert.True(t, users.planUser.Reservations[0].ExpiresAt.After(queued))
+	}}
+
+	for _, work := range queue.work {
+		_, failure := work()
+		assert.Nil(t, failure)
+	}
+	assert.Equal(t, []int{1}, users.reserved)
+	assert.Equal(t, 4, users.planUser.TokensRemaining)
+}
+
+func TestSubmitJob_WhenReleasedWhileQueued_ReservesAgain(t *testing.T) {
+	service, users, queue := jobService(5)
+	recorder := submitJob(service, `{}`, "PLAN")
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	released, err := users.ReleaseExpiredReservations(time.Now().Add(2 * DefaultReservationTimeout))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, released)
+
+	for _, work := range queue.work {
+		_, failure := work()
+		assert.Nil(t, failure)
+	}
+	assert.Equal(t, []int{1, 1}, users.reserved)
+	assert.Equal(t, 4, users.planUser.TokensRemaining)
+	assert.Empty(t, users.planUser.Reservations)
+}
+
+func TestSubmitJob_WhenReleasedWhileQueuedAndOutOfTokens_FailsWithBadRequest(t *testing.T) {
+	service, users, queue := jobService(1)
+	recorder := submitJob(service, `{}`, "PLAN")
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	_, err := users.ReleaseExpiredReservations(time.Now().Add(2 * DefaultReservationTimeout))
+	assert.Nil(t, err)
+	users.planUser.TokensRemaining = 0
+
+	for _, work := range queue.work {
+		meme, failure := work()
+		assert.Nil(t, meme)
+		assert.Equal(t, http.StatusBadRequest, failure.Status)
+	}
+	assert.Equal(t, 0, users.planUser.TokensRemaining)
+	assert.Empty(t, users.planUser.Reservations)
+}
+
+func TestSubmitJob_WhenUserHasNoTokens_RaisesBadRequest(t *testing.T) {
+	service, _, queue := jobService(0)
+	recorder := submitJob(service, `{}`, "PLAN")
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "Tokens needed")
+	assert.Empty(t, queue.jobs)
+}
+
+func TestSubmitJob_WhenQueryBreaksPolicy_RaisesUnprocessable(t *testing.T) {
+	service, users, queue := jobService(5)
+	service = service.WithModerator(&MockModerator{})
+	recorder := submitJob(service, `{"query": "blocked"}`, "PLAN")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Empty(t, users.reserved)
+	assert.Equal(t, 0, users.released)
+	assert.Equal(t, 5, users.planUser.TokensRemaining)
+	assert.Empty(t, queue.jobs)
+}
+
+func TestSubmitJob_WhenQueueIsFull_RefundsAndRaisesUnavailable(t *testing.T) {
+	service, users, queue := jobService(5)
+	queue.full = true
+	recorder := submitJob(service, `{}`, "PLAN")
+
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, 1, users.released)
+	assert.Equal(t, 5, users.planUser.TokensRemaining)
+}
+
+func TestSubmitJob_WithCallbackURL_ChecksCallbacksAreSupported(t *testing.T) {
+	service, _, queue := jobService(5)
+	recorder := submitJob(service, `{"callback_url": "https://example.com/hook"}`, "PLAN")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	queue.callbacks = true
+	recorder = submitJob(service, `{"callback_url": "ftp://example.com/hook"}`, "PLAN")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	recorder = submitJob(service, `{"callback_url": "https://example.com/hook"}`, "PLAN")
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	for _, job := range queue.jobs {
+		assert.Equal(t, "https://example.com/hook", job.CallbackURL)
+	}
+}
+
+func TestSubmitJob_WithBadBody_RaisesBadRequest(t *testing.T) {
+	service, users, _ := jobService(5)
+	recorder := submitJob(service, `not json`, "PLAN")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Empty(t, users.reserved)
+}
+
+func TestSubmitJob_WithoutAQueue_RaisesNotFound(t *testing.T) {
+	service, _, _ := batchService(5)
+	recorder := submitJob(service, `{}`, "PLAN")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestJobById_OnlyShowsJobsToTheirOwnerOrAnAdmin(t *testing.T) {
+	service, _, queue := jobService(5)
+	queue.jobs["mine"] = &models.MemeJob{ID: "mine", UserId: defaultIDString, Status: models.JobSucceeded, Meme: paramMeme}
+	router := jobRouter(service)
+
+	recorder := performRequest(router, "GET", "/memes/jobs/mine", "DEFAULT")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var job models.MemeJob
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &job))
+	assert.Equal(t, models.JobSucceeded, job.Status)
+	assert.Equal(t, paramMeme.TopText, job.Meme.TopText)
+
+	recorder = performRequest(router, "GET", "/memes/jobs/mine", "ADMIN")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	recorder = performRequest(router, "GET", "/memes/jobs/mine", "OTHER")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	recorder = performRequest(router, "GET", "/memes/jobs/missing", "DEFAULT")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	recorder = performRequest(router, "GET", "/memes/jobs/mine", "")
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
@@ -0,0 +1,202 @@
+package meme_service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	error_types "maas/error-types"
+	"maas/loggers"
+	meme_renderer "maas/meme-renderer"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Memes never change once they are made, so clients can hold onto them
+const (
+	privateCacheControl = "private, max-age=31536000, immutable"
+	publicCacheControl  = "public, max-age=31536000, immutable"
+)
+
+// Formats a stored image is looked for in, and can be converted to
+var imageFormats = []meme_renderer.Format{meme_renderer.PNG, meme_renderer.JPEG, meme_renderer.GIF}
+
+func (s *MemeService) WithPublicLinks(secret []byte) *MemeService {
+	s.PublicLinkSecret = secret
+	return s
+}
+
+// Where GET /memes/:id/image serves the meme's image, to callers with an auth header
+func ImagePath(memeId string) string {
+	return fmt.Sprintf("/memes/%s/image", memeId)
+}
+
+// A link to the meme's image that works without an auth header
+func (s *MemeService) PublicImagePath(memeId string) string {
+	return fmt.Sprintf("%s?signature=%s", ImagePath(memeId), s.imageSignature(memeId))
+}
+
+func (s *MemeService) imageSignature(memeId string) string {
+	mac := hmac.New(sha256.New, s.PublicLinkSecret)
+	mac.Write([]byte(memeId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *MemeService) hasValidSignature(memeId string, signature string) bool {
+	if len(s.PublicLinkSecret) == 0 || signature == "" {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(s.imageSignature(memeId)))
+}
+
+// GETs the image for a meme that was made earlier. The format can be picked with the format query
+// param or the Accept header, otherwise the image is served as it was rendered. Needs an
+// authenticated caller unless the request carries a valid public link signature.
+func (s *MemeService) MemeImage(ginContext *gin.Context) {
+	id := ginContext.Param("id")
+	isPublic := s.hasValidSignature(id, ginContext.Query("signature"))
+	if !isPublic {
+		err := s.requireAuthenticated(ginContext)
+		if err != nil {
+			return
+		}
+	}
+
+	if s.Images == nil || !primitive.IsValidObjectID(id) {
+		ginContext.IndentedJSON(http.StatusNotFound, map[string]string{"error": "meme not found"})
+		return
+	}
+	data, storedFormat, err := s.findImage(id)
+	if err != nil {
+		switch err.(type) {
+		default:
+			loggers.ErrorLog.Printf("Encountered an error fetching a meme image: %s\n", err)
+			ginContext.IndentedJSON(http.StatusInternalServerError, map[string]string{"error": "Unable to fetch meme"})
+		case *error_types.ImageNotFoundError:
+			ginContext.IndentedJSON(http.StatusNotFound, map[string]string{"error": "meme not found"})
+		}
+		return
+	}
+
+	format, err := negotiateFormat(ginContext.Query("format"), ginContext.GetHeader("Accept"), storedFormat)
+	if err != nil {
+		switch err.(type) {
+		default:
+			ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		case *error_types.NotAcceptableError:
+			ginContext.IndentedJSON(http.StatusNotAcceptable, map[string]string{"error": err.Error()})
+		}
+		return
+	}
+	if format != storedFormat {
+		data, err = meme_renderer.Transcode(data, format)
+		if err != nil {
+			loggers.ErrorLog.Printf("Encountered an error converting a meme image: %s\n", err)
+			ginContext.IndentedJSON(http.StatusInternalServerError, map[string]string{"error": "Unable to convert meme"})
+			return
+		}
+	}
+
+	etag := imageETag(data)
+	ginContext.Header("ETag", etag)
+	ginContext.Header("Vary", "Accept")
+	if isPublic {
+		ginContext.Header("Cache-Control", publicCacheControl)
+	} else {
+		ginContext.Header("Cache-Control", privateCacheControl)
+	}
+	if matchesETag(ginContext.GetHeader("If-None-Match"), etag) {
+		ginContext.Status(http.StatusNotModified)
+		return
+	}
+	ginContext.Data(http.StatusOK, mime.TypeByExtension("."+string(format)), data)
+}
+
+// The meme's format isn't recorded anywhere, so check for each one it could have been stored as
+func (s *MemeService) findImage(memeId string) ([]byte, meme_renderer.Format, error) {
+	for _, format := range imageFormats {
+		data, _, err := s.Images.Image(ImageKey(memeId, string(format)))
+		if err == nil {
+			return data, format, nil
+		}
+		if _, ok := err.(*error_types.ImageNotFoundError); !ok {
+			return nil, "", err
+		}
+	}
+	return nil, "", &error_types.ImageNotFoundError{Key: memeId}
+}
+
+// An explicit format param wins. Otherwise the Accept header's highest quality image type is used,
+// preferring the stored format on ties so the image doesn't need converting.
+func negotiateFormat(formatParam string, accept string, stored meme_renderer.Format) (meme_renderer.Format, error) {
+	if formatParam != "" {
+		return meme_renderer.ParseFormat(formatParam)
+	}
+	if strings.TrimSpace(accept) == "" {
+		return stored, nil
+	}
+
+	var best meme_renderer.Format
+	bestQuality := 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		var candidate meme_renderer.Format
+		switch mediaType {
+		case "*/*", "image/*":
+			candidate = stored
+		default:
+			candidate = formatForMediaType(mediaType)
+		}
+		if candidate == "" || quality <= 0 {
+			continue
+		}
+		if quality > bestQuality || (quality == bestQuality && candidate == stored) {
+			best = candidate
+			bestQuality = quality
+		}
+	}
+	if best == "" {
+		return "", &error_types.NotAcceptableError{Accept: accept}
+	}
+	return best, nil
+}
+
+func formatForMediaType(mediaType string) meme_renderer.Format {
+	for _, format := range imageFormats {
+		if mime.TypeByExtension("."+string(format)) == mediaType {
+			return format
+		}
+	}
+	return ""
+}
+
+func imageETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(sum[:16]))
+}
+
+func matchesETag(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package meme_service
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	error_types "maas/error-types"
+	meme_renderer "maas/meme-renderer"
+	"maas/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const storedMemeId = "444444444444444444444444"
+
+func imageTestService() MemeService {
+	data, _ := meme_renderer.Encode(meme_renderer.Canvas(20, 10, meme_renderer.DefaultBackground), meme_renderer.PNG)
+	images := &MockImageStore{saved: map[string][]byte{ImageKey(storedMemeId, "png"): data}}
+	return *NewMemeService(&MockUserRepository{}, authService, &MockMemeProvider{}).
+		WithImageStore(images).
+		WithPublicLinks([]byte("test-secret"))
+}
+
+func imageTestRouter(memeService MemeService) *gin.Engine {
+	router := gin.Default()
+	router.GET("/meme", memeService.GetMeme)
+	router.GET("/memes/:id/image", memeService.MemeImage)
+	return router
+}
+
+func performImageRequest(r http.Handler, path string, authHeader string, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Header.Set("auth", authHeader)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestMemeImage_WhenAuthenticated_ReturnsStoredImage(t *testing.T) {
+	router := imageTestRouter(imageTestService())
+	recorder := performImageRequest(router, "/memes/"+storedMemeId+"/image", "ADMIN", nil)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "image/png", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, privateCacheControl, recorder.Header().Get("Cache-Control"))
+	assert.Equal(t, "Accept", recorder.Header().Get("Vary"))
+	assert.Equal(t, imageETag(recorder.Body.Bytes()), recorder.Header().Get("ETag"))
+	_, err := png.Decode(recorder.Body)
+	assert.Nil(t, err)
+}
+
+func TestMemeImage_WithFormatParam_ConvertsImage(t *testing.T) {
+	router := imageTestRouter(imageTestService())
+	recorder := performImageRequest(router, "/memes/"+storedMemeId+"/image?format=jpg", "ADMIN", nil)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "image/jpeg", recorder.Header().Get("Content-Type"))
+	_, err := jpeg.Decode(recorder.Body)
+	assert.Nil(t, err)
+}
+
+func TestMemeImage_WithAcceptHeader_ConvertsImage(t *testing.T) {
+	router := imageTestRouter(imageTestService())
+	recorder := performImageRequest(router, "/memes/"+storedMemeId+"/image", "ADMIN",
+		map[string]string{"Accept": "image/png;q=0.5, image/gif"})
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "image/gif", recorder.Header().Get("Content-Type"))
+	_, err := gif.Decode(recorder.Body)
+	assert.Nil(t, err)
+}
+
+func TestMemeImage_WithUnsupportedFormatParam_RaisesBadRequest(t *testing.T) {
+	router := imageTestRouter(imageTestService())
+	recorder := performImageRequest(router, "/memes/"+storedMemeId+"/image?format=bmp", "ADMIN", nil)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "Unsupported image format: bmp")
+}
+
+func TestMemeImage_WhenNoAcceptedTypeIsAvailable_RaisesNotAcceptable(t *testing.T) {
+	router := imageTestRouter(imageTestService())
+	recorder := performImageRequest(router, "/memes/"+storedMemeId+"/image", "ADMIN",
+		map[string]string{"Accept": "image/webp, text/html"})
+
+	assert.Equal(t, http.StatusNotAcceptable, recorder.Code)
+}
+
+func TestMemeImage_WhenETagMatches_ReturnsNotModified(t *testing.T) {
+	router := imageTestRouter(imageTestService())
+	first := performImageRequest(router, "/memes/"+storedMemeId+"/image", "ADMIN", nil)
+	recorder := performImageRequest(router, "/memes/"+storedMemeId+"/image", "ADMIN",
+		map[string]string{"If-None-Match": first.Header().Get("ETag")})
+
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	assert.Equal(t, 0, recorder.Body.Len())
+}
+
+func TestMemeImage_WhenMemeIsMissing_RaisesNotFound(t *testing.T) {
+	router := imageTestRouter(imageTestService())
+	recorder := performImageRequest(router, "/memes/555555555555555555555555/image", "ADMIN", nil)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	recorder = performImageRequest(router, "/memes/..%2Fsecret/image", "ADMIN", nil)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestMemeImage_WhenAuthHeaderIsNotProvided_RaisesUnauthorized(t *testing.T) {
+	router := imageTestRouter(imageTestService())
+	recorder := performImageRequest(router, "/memes/"+storedMemeId+"/image", "", nil)
+
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, "\"unauthorized\"", recorder.Body.String())
+}
+
+func TestMemeImage_WithPublicLink_SkipsAuth(t *testing.T) {
+	service := imageTestService()
+	router := imageTestRouter(service)
+	recorder := performImageRequest(router, service.PublicImagePath(storedMemeId), "", nil)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, publicCacheControl, recorder.Header().Get("Cache-Control"))
+}
+
+func TestMemeImage_WithBadSignature_RequiresAuth(t *testing.T) {
+	router := imageTestRouter(imageTestService())
+	recorder := performImageRequest(router, "/memes/"+storedMemeId+"/image?signature=abc123", "", nil)
+
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestMemeImage_WithoutPublicLinksConfigured_IgnoresSignatures(t *testing.T) {
+	service := imageTestService()
+	path := service.PublicImagePath(storedMemeId)
+	service.PublicLinkSecret = nil
+	router := imageTestRouter(service)
+	recorder := performImageRequest(router, path, "", nil)
+
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestGetMeme_WithPublicLinks_ReturnsPublicImagePath(t *testing.T) {
+	service := imageTestService()
+	router := imageTestRouter(service)
+	recorder := performRequest(router, "GET", "/meme?query=withImage", "ADMIN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response models.Meme
+	err := json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Nil(t, err)
+	assert.Equal(t, service.PublicImagePath(response.ID), response.PublicImagePath)
+
+	recorder = performImageRequest(router, response.PublicImagePath, "", nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, bytes.Equal([]byte("png data"), recorder.Body.Bytes()))
+}
+
+func TestNegotiateFormat_PicksTheBestFormat(t *testing.T) {
+	testCases := []struct {
+		formatParam string
+		accept      string
+		expected    meme_renderer.Format
+	}{
+		{"", "", meme_renderer.PNG},
+		{"GIF", "image/jpeg", meme_renderer.GIF},
+		{"", "*/*", meme_renderer.PNG},
+		{"", "image/*", meme_renderer.PNG},
+		{"", "image/jpeg", meme_renderer.JPEG},
+		{"", "image/jpeg;q=0.9, image/*;q=0.9", meme_renderer.PNG},
+		{"", "image/jpeg;q=0.8, image/gif;q=0.9", meme_renderer.GIF},
+		{"", "image/png;q=0, image/jpeg;q=0.1", meme_renderer.JPEG},
+		{"", "text/html, image/gif;q=0.2", meme_renderer.GIF},
+	}
+	for _, testCase := range testCases {
+		format, err := negotiateFormat(testCase.formatParam, testCase.accept, meme_renderer.PNG)
+		assert.Nil(t, err, testCase.accept)
+		assert.Equal(t, testCase.expected, format, testCase.accept)
+	}
+}
+
+func TestNegotiateFormat_WhenNothingIsAcceptable_RaisesNotAcceptable(t *testing.T) {
+	format, err := negotiateFormat("", "image/png;q=0, text/html", meme_renderer.PNG)
+	assert.Equal(t, meme_renderer.Format(""), format)
+	assert.IsType(t, &error_types.NotAcceptableError{}, err)
+}
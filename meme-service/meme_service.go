@@ -1,44 +1,171 @@
 package meme_service
 
 import (
+	"fmt"
 	auth_service "maas/auth-service"
 	error_types "maas/error-types"
 	"maas/loggers"
 	"maas/models"
+	"mime"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type QueryParams struct {
-	Lon   float64 `json:"lon"`
-	Lat   float64 `json:"lat"`
-	Query string  `json:"query"`
+	Lon      float64 `json:"lon"`
+	Lat      float64 `json:"lat"`
+	Query    string  `json:"query"`
+	Template string  `json:"template"`
+	// Empty means the provider's default, English
+	Lang string `json:"lang"`
+	// Optional. Told about each step the provider gets through, so progress can be streamed
+	Progress ProgressFunc `json:"-"`
+}
+
+// The steps of making a meme that GET /memes/stream reports
+const (
+	StageCharged          = "charged"
+	StageTemplateSelected = "template_selected"
+	StageCaptionGenerated = "caption_generated"
+	StageRendered         = "rendered"
+	StageDone             = "done"
+)
+
+// Called by providers as they finish each stage, with the meme as it stands
+type ProgressFunc func(stage string, meme *models.Meme)
+
+// Lets the caller know the provider has got through stage. Does nothing when nobody's listening
+func (p *QueryParams) Report(stage string, meme *models.Meme) {
+	if p.Progress != nil {
+		p.Progress(stage, meme)
+	}
 }
 
 type UserRepository interface {
 	User(id string) (*models.User, error)
 	UserByAuthHeader(auth string) (*models.User, error)
-	UpdateUser(id string, user *models.User) error
+	// Finds the user with this auth key and takes the reservation's tokens from them, recording the
+	// reservation, in one step. Returns an AuthUserNotFoundError for an unknown key, an
+	// InsufficientTokensError when they can't pay, and otherwise the user as they are afterwards
+	ReserveTokensByAuth(auth string, reservation *models.TokenReservation) (*models.User, error)
+	// The same for a user the caller has already found
+	ReserveTokens(id string, reservation *models.TokenReservation) (*models.User, error)
+	// Keeps spent of the reservation's tokens and gives the rest back. Returns a ReservationNotFoundError
+	// when it has already been committed or released
+	CommitReservation(userId string, reservation *models.TokenReservation, spent int) error
+	// Gives all of the reservation's tokens back, with the same errors as CommitReservation
+	ReleaseReservation(userId string, reservation *models.TokenReservation) error
+	// Holds the reservation until its ExpiresAt instead, with the same errors as CommitReservation
+	ExtendReservation(userId string, reservation *models.TokenReservation) error
 }
 
+// Every meme costs this many tokens
+const MemeCost = 1
+
 type MemeProvider interface {
 	BuildMeme(*QueryParams) (*models.Meme, error)
 }
 
+// Providers can give themselves a name for the meme history. Otherwise their type is used
+type NamedProvider interface {
+	Name() string
+}
+
+// Implemented by providers that cache the memes they build
+type CachingProvider interface {
+	CacheStats() CacheStats
+}
+
+type CacheStats struct {
+	Hits       int64 `json:"hits"`
+	MemoryHits int64 `json:"memory_hits"`
+	DiskHits   int64 `json:"disk_hits"`
+	Misses     int64 `json:"misses"`
+	// Memes currently held in memory, out of Capacity
+	Entries  int `json:"entries"`
+	Capacity int `json:"capacity"`
+}
+
+// Works out which supported language to use from an Accept-Language header or a single language tag.
+// Reports false when nothing in preferences is supported
+type LanguageMatcher interface {
+	Match(preferences string) (string, bool)
+}
+
+// Somewhere to keep a record of every meme made, so there's a history of what users were charged for
+type MemeHistory interface {
+	SaveMeme(record *models.MemeRecord) error
+}
+
+// Somewhere rendered memes can be kept and fetched from again
+type ImageStore interface {
+	// Returns a URL the image can be retrieved from, or nothing when it can only be fetched through
+	// GET /memes/:id/image
+	SaveImage(key string, data []byte, contentType string) (string, error)
+	Image(key string) ([]byte, string, error)
+}
+
 type MemeService struct {
 	UserRepo     UserRepository
 	Auth         auth_service.AuthService
 	MemeProvider MemeProvider
+	// Optional. Without a store rendered images are returned inline
+	Images ImageStore
+	// Optional. When set, memes come back with an image link that works without an auth header
+	PublicLinkSecret []byte
+	// Optional. Without a history memes aren't recorded anywhere
+	History MemeHistory
+	// Optional. Which provider each plan gets. Plans without one get MemeProvider
+	PlanProviders map[models.Plan]MemeProvider
+	// Optional. Without a moderator any query is allowed
+	Moderator Moderator
+	// Optional. Without a log violations only show up in the logs
+	Violations ViolationLog
+	// Optional. Without one every meme is in English
+	Languages LanguageMatcher
+	// Optional. Without a queue memes can't be made in the background
+	Jobs JobQueue
+	// Optional. Without a store Idempotency-Key is ignored
+	Idempotency IdempotencyStore
+	// How long tokens are held for a meme before they're given back regardless
+	ReservationTimeout time.Duration
 }
 
 func NewMemeService(userRepo UserRepository, auth auth_service.AuthService, memeProvider MemeProvider) *MemeService {
 	return &MemeService{
-		UserRepo:     userRepo,
-		Auth:         auth,
-		MemeProvider: memeProvider,
+		UserRepo:           userRepo,
+		Auth:               auth,
+		MemeProvider:       memeProvider,
+		ReservationTimeout: DefaultReservationTimeout,
+	}
+}
+
+func (s *MemeService) WithImageStore(images ImageStore) *MemeService {
+	s.Images = images
+	return s
+}
+
+func (s *MemeService) WithHistory(history MemeHistory) *MemeService {
+	s.History = history
+	return s
+}
+
+func (s *MemeService) WithLanguages(languages LanguageMatcher) *MemeService {
+	s.Languages = languages
+	return s
+}
+
+// Users on plan get their memes from provider instead of the default MemeProvider
+func (s *MemeService) WithPlanProvider(plan models.Plan, provider MemeProvider) *MemeService {
+	if s.PlanProviders == nil {
+		s.PlanProviders = map[models.Plan]MemeProvider{}
 	}
+	s.PlanProviders[plan] = provider
+	return s
 }
 
 func (s *MemeService) ExtractParams(c *gin.Context) (*QueryParams, error) {
@@ -58,17 +185,51 @@ func (s *MemeService) ExtractParams(c *gin.Context) (*QueryParams, error) {
 			return nil, err
 		}
 	}
+	lang, err := s.language(c)
+	if err != nil {
+		return nil, err
+	}
 	queryParams := &QueryParams{
-		Lat:   lat,
-		Lon:   lon,
-		Query: c.Query("query"),
+		Lat:      lat,
+		Lon:      lon,
+		Query:    c.Query("query"),
+		Template: c.Query("template"),
+		Lang:     lang,
 	}
 	return queryParams, nil
 }
 
+// The lang param has to be a supported language. Accept-Language is only a preference, so when
+// nothing in it is supported the meme is made in the default language
+func (s *MemeService) language(c *gin.Context) (string, error) {
+	return s.resolveLanguage(c.Query("lang"), c.GetHeader("Accept-Language"))
+}
+
+func (s *MemeService) resolveLanguage(lang string, accept string) (string, error) {
+	if s.Languages == nil {
+		return "", nil
+	}
+	if lang != "" {
+		matched, ok := s.Languages.Match(lang)
+		if !ok {
+			return "", fmt.Errorf("unsupported lang: %s", lang)
+		}
+		return matched, nil
+	}
+	if accept != "" {
+		matched, _ := s.Languages.Match(accept)
+		return matched, nil
+	}
+	return "", nil
+}
+
+// Authenticating the caller and reserving their token is a single conditional update, so two requests
+// can't spend the same token. The token is only kept once the meme has been delivered, and is given
+// back if it can't be made. Retries sent with the same Idempotency-Key get the first response again
 func (s *MemeService) GetMeme(ginContext *gin.Context) {
-	err := s.requireAuthenticated(ginContext)
-	if err != nil {
+	authHeader := ginContext.Request.Header.Get("auth")
+	if authHeader == "" {
+		authResponse(&error_types.NoAuthHeaderError{}, ginContext)
 		return
 	}
 	params, err := s.ExtractParams(ginContext)
@@ -77,36 +238,170 @@ func (s *MemeService) GetMeme(ginContext *gin.Context) {
 		ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": "bad request"})
 		return
 	}
-
-	user, err := s.UserRepo.UserByAuthHeader(ginContext.Request.Header.Get("auth"))
+	key, err := idempotencyKey(ginContext)
 	if err != nil {
-		loggers.ErrorLog.Printf("Encountered an error making a meme%s\n", err)
-		ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": "bad request"})
 		return
 	}
-
-	if user.TokensRemaining < 1 {
-		loggers.ErrorLog.Printf("Encountered an error making a meme%s\n", err)
-		ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": "Tokens needed to make more memes. Buy some!"})
+	if key == "" || s.Idempotency == nil {
+		s.makeMeme(authHeader, params, ginContext)
 		return
 	}
+	s.idempotently(ginContext, authHeader, key, params, func() (int, bool) {
+		return s.makeMeme(authHeader, params, ginContext)
+	})
+}
 
-	user.TokensRemaining -= 1
-	err = s.UserRepo.UpdateUser(user.ID.Hex(), user)
+// Makes and answers with a meme for whoever authHeader belongs to. Returns the tokens they were charged
+// and whether they got as far as being charged at all
+func (s *MemeService) makeMeme(authHeader string, params *QueryParams, ginContext *gin.Context) (int, bool) {
+	if err := s.screenQuery(authHeader, params, ginContext); err != nil {
+		return 0, false
+	}
+	user, reservation, err := s.reserveForCaller(authHeader, "meme", ginContext)
+	if err != nil {
+		return 0, false
+	}
+	// Safe mode's extra rules come with the user the reservation loaded. Turning the query away gives
+	// the token straight back
+	if err := s.moderateSafeModeQuery(user, params); err != nil {
+		s.release(user, reservation)
+		moderationResponse(err, ginContext)
+		return 0, true
+	}
+
+	meme, failure := s.fulfil(user, s.providerFor(user), params)
+	if failure != nil {
+		s.release(user, reservation)
+		failureResponse(failure, ginContext)
+		return 0, true
+	}
+
+	if params.Lang != "" {
+		ginContext.Header("Content-Language", params.Lang)
+	}
+	ginContext.IndentedJSON(http.StatusOK, meme)
+	s.commit(user, reservation, MemeCost)
+	return MemeCost, true
+}
+
+// GETs the hit and miss counts of the meme cache. Only admins can see these
+func (s *MemeService) CacheStats(ginContext *gin.Context) {
+	err := s.requireAdmin(ginContext)
 	if err != nil {
-		loggers.ErrorLog.Printf("Encountered an error making a meme%s\n", err)
-		ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": "bad request"})
 		return
 	}
+	cache, ok := s.MemeProvider.(CachingProvider)
+	if !ok {
+		ginContext.IndentedJSON(http.StatusNotFound, map[string]string{"error": "memes are not being cached"})
+		return
+	}
+	ginContext.IndentedJSON(http.StatusOK, cache.CacheStats())
+}
+
+// Why a meme that was already paid for couldn't be made. Status is what GET /memes would have answered with
+type MemeFailure struct {
+	Status    int               `json:"status"`
+	Error     string            `json:"error"`
+	Violation map[string]string `json:"violation,omitempty"`
+}
 
-	meme, err := s.MemeProvider.BuildMeme(params)
+// Makes, checks, stores and records a meme the user has already reserved tokens for, the same way
+// GetMeme does. Committing or releasing the reservation is up to the caller
+func (s *MemeService) fulfil(user *models.User, provider MemeProvider, params *QueryParams) (*models.Meme, *MemeFailure) {
+	meme, err := provider.BuildMeme(params)
 	if err != nil {
 		loggers.ErrorLog.Printf("Encountered an error making a meme%s\n", err)
-		ginContext.IndentedJSON(http.StatusInternalServerError, map[string]string{"error": "Unable to make meme"})
+		status, message := buildErrorStatus(err)
+		return nil, &MemeFailure{Status: status, Error: message}
+	}
+	if meme.Provider == "" {
+		meme.Provider = ProviderName(provider)
+	}
+	if err := s.moderateMeme(user, params, meme); err != nil {
+		return nil, moderationFailure(err)
+	}
+	if err := s.storeImage(meme); err != nil {
+		loggers.ErrorLog.Printf("Encountered an error storing a meme%s\n", err)
+		return nil, &MemeFailure{Status: http.StatusInternalServerError, Error: "Unable to store meme"}
+	}
+	s.recordMeme(user, params, meme)
+	return meme, nil
+}
+
+// Moves a rendered image into the image store and points the meme at it instead of returning it inline
+func (s *MemeService) storeImage(meme *models.Meme) error {
+	if s.Images == nil || meme.Image == nil {
+		return nil
+	}
+	if meme.ID == "" {
+		meme.ID = primitive.NewObjectID().Hex()
+	}
+	key := ImageKey(meme.ID, meme.ImageFormat)
+	location, err := s.Images.SaveImage(key, meme.Image, mime.TypeByExtension("."+meme.ImageFormat))
+	if err != nil {
+		return err
+	}
+	if location == "" {
+		location = ImagePath(meme.ID)
+	}
+	meme.ImageLocation = location
+	meme.Image = nil
+	if len(s.PublicLinkSecret) > 0 {
+		meme.PublicImagePath = s.PublicImagePath(meme.ID)
+	}
+	return nil
+}
+
+// Saves what the user was charged for. The meme has already been paid for by this point, so a
+// failure here is logged with everything needed to backfill the record rather than failing the request
+func (s *MemeService) recordMeme(user *models.User, params *QueryParams, meme *models.Meme) {
+	if s.History == nil {
 		return
 	}
+	if meme.ID == "" {
+		meme.ID = primitive.NewObjectID().Hex()
+	}
+	id, _ := primitive.ObjectIDFromHex(meme.ID)
+	record := &models.MemeRecord{
+		ID:     id,
+		UserId: user.ID.Hex(),
+		Params: models.MemeParams{
+			Query:    params.Query,
+			Lat:      params.Lat,
+			Lon:      params.Lon,
+			Template: params.Template,
+			Lang:     params.Lang,
+		},
+		TemplateId:    meme.TemplateId,
+		Provider:      meme.Provider,
+		Cost:          MemeCost,
+		ImageLocation: meme.ImageLocation,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if err := s.History.SaveMeme(record); err != nil {
+		loggers.ErrorLog.Printf("Encountered an error recording a meme: %s. Record: %+v\n", err, *record)
+	}
+}
 
-	ginContext.IndentedJSON(http.StatusOK, meme)
+// Picks the provider for the user's current plan. The plan comes along with the user document
+// GetMeme already has, so routing never costs another trip to the database
+func (s *MemeService) providerFor(user *models.User) MemeProvider {
+	if provider, ok := s.PlanProviders[user.ActivePlan(time.Now())]; ok {
+		return provider
+	}
+	return s.MemeProvider
+}
+
+// The provider's name, or its type when it doesn't have one
+func ProviderName(provider MemeProvider) string {
+	if named, ok := provider.(NamedProvider); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%T", provider)
+}
+
+func ImageKey(memeId string, format string) string {
+	return fmt.Sprintf("memes/%s.%s", memeId, format)
 }
 
 func (s *MemeService) requireAuthenticated(ginContext *gin.Context) error {
@@ -123,6 +418,43 @@ func (s *MemeService) requireAuthenticated(ginContext *gin.Context) error {
 	authResponse(err, ginContext)
 	return err
 }
+
+func (s *MemeService) requireAdmin(ginContext *gin.Context) error {
+	authHeader := ginContext.Request.Header.Get("auth")
+	isAdmin, err := s.Auth.IsAdmin(authHeader)
+	if err != nil {
+		authResponse(err, ginContext)
+		return err
+	}
+	if isAdmin {
+		return nil
+	}
+	err = &error_types.NotAdminError{}
+	authResponse(err, ginContext)
+	return err
+}
+
+// The response for a meme that was paid for but couldn't be made
+func failureResponse(failure *MemeFailure, ginContext *gin.Context) {
+	body := map[string]interface{}{"error": failure.Error}
+	if failure.Violation != nil {
+		body["violation"] = failure.Violation
+	}
+	ginContext.IndentedJSON(failure.Status, body)
+}
+
+// The status and message for a provider that couldn't make a meme
+func buildErrorStatus(err error) (int, string) {
+	switch err.(type) {
+	default:
+		return http.StatusInternalServerError, "Unable to make meme"
+	case *error_types.TemplateNotFoundError, *error_types.CaptionTooLongError:
+		return http.StatusBadRequest, err.Error()
+	case *error_types.ProviderError:
+		return http.StatusBadGateway, "Unable to make meme, the meme provider is unavailable"
+	}
+}
+
 func authResponse(err error, ginContext *gin.Context) {
 	switch err.(type) {
 	default:
@@ -9,7 +9,9 @@ import (
 	"maas/models"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -78,7 +80,41 @@ var (
 
 type MockUserRepository struct{}
 
-func (m *MockUserRepository) UpdateUser(id string, user *models.User) error {
+// Reserves from a copy so the shared test users keep their tokens
+func (m *MockUserRepository) ReserveTokens(id string, reservation *models.TokenReservation) (*models.User, error) {
+	user, err := m.User(id)
+	if err != nil {
+		return nil, err
+	}
+	return m.reserveFrom(*user, reservation)
+}
+
+func (m *MockUserRepository) ReserveTokensByAuth(auth string, reservation *models.TokenReservation) (*models.User, error) {
+	user, err := m.UserByAuthHeader(auth)
+	if err != nil {
+		return nil, err
+	}
+	return m.reserveFrom(*user, reservation)
+}
+
+func (m *MockUserRepository) reserveFrom(user models.User, reservation *models.TokenReservation) (*models.User, error) {
+	if user.TokensRemaining < reservation.Amount {
+		return nil, &error_types.InsufficientTokensError{Needed: reservation.Amount}
+	}
+	user.TokensRemaining -= reservation.Amount
+	user.Reservations = append(append([]models.TokenReservation{}, user.Reservations...), *reservation)
+	return &user, nil
+}
+
+func (m *MockUserRepository) CommitReservation(userId string, reservation *models.TokenReservation, spent int) error {
+	return nil
+}
+
+func (m *MockUserRepository) ReleaseReservation(userId string, reservation *models.TokenReservation) error {
+	return nil
+}
+
+func (m *MockUserRepository) ExtendReservation(userId string, reservation *models.TokenReservation) error {
 	return nil
 }
 
@@ -117,11 +153,45 @@ func (m *MockMemeProvider) BuildMeme(params *QueryParams) (*models.Meme, error)
 		return paramMeme, nil
 	} else if params.Query == "raiseError" {
 		return nil, errors.New("test")
+	} else if params.Query == "withImage" {
+		return &models.Meme{TopText: "withImage", ImageLocation: "1 x 1", Image: []byte("png data"), ImageFormat: "png"}, nil
+	} else if params.Query == "tooLong" {
+		return nil, &error_types.CaptionTooLongError{Text: params.Query}
+	} else if params.Query == "providerDown" {
+		return nil, &error_types.ProviderError{Provider: "mock", Message: "connection refused"}
+	} else if params.Template == "missing" {
+		return nil, &error_types.TemplateNotFoundError{ID: params.Template}
 	} else {
 		return defaultMeme, nil
 	}
 }
 
+type MockImageStore struct {
+	saved map[string][]byte
+	err   error
+	// Save without handing out a URL, like the local store
+	noURL bool
+}
+
+func (m *MockImageStore) SaveImage(key string, data []byte, contentType string) (string, error) {
+	if m.err != nil {
+		return "", m.err
+	}
+	m.saved[key] = data
+	if m.noURL {
+		return "", nil
+	}
+	return "https://images.example.com/" + key + "#" + contentType, nil
+}
+
+func (m *MockImageStore) Image(key string) ([]byte, string, error) {
+	data, ok := m.saved[key]
+	if !ok {
+		return nil, "", &error_types.ImageNotFoundError{Key: key}
+	}
+	return data, "image/png", nil
+}
+
 func TestMain(m *testing.M) {
 	loggers.SilentInit()
 	setIdHexes()
@@ -169,6 +239,7 @@ func performRequest(r http.Handler, method string, path string, authHeader strin
 
 func TestGetMeme_WhenEverythingIsGood_RendersAMeme(t *testing.T) {
 	expected_body := *defaultMeme
+	expected_body.Provider = "*meme_service.MockMemeProvider"
 	router := testRouter(memeService)
 	recorder := performRequest(router, "GET", "/meme", "ADMIN")
 
@@ -181,6 +252,7 @@ func TestGetMeme_WhenEverythingIsGood_RendersAMeme(t *testing.T) {
 
 func TestGetMeme_WhenParamsAreProvided_RendersACustomMeme(t *testing.T) {
 	expected_body := *paramMeme
+	expected_body.Provider = "*meme_service.MockMemeProvider"
 	router := testRouter(memeService)
 	recorder := performRequest(router, "GET", "/meme?query=someQuery", "ADMIN")
 
@@ -210,6 +282,84 @@ func TestGetMeme_WhenMemeProviderErrors_RaisesAnError(t *testing.T) {
 	assert.Contains(t, recorder.Body.String(), expected_body)
 }
 
+func TestGetMeme_WhenTemplateIsUnknown_RaisesBadRequest(t *testing.T) {
+	expected_body := "Template not found: missing"
+	router := testRouter(memeService)
+	recorder := performRequest(router, "GET", "/meme?template=missing", "ADMIN")
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), expected_body)
+}
+
+func TestGetMeme_WhenCaptionDoesNotFit_RaisesBadRequest(t *testing.T) {
+	router := testRouter(memeService)
+	recorder := performRequest(router, "GET", "/meme?query=tooLong", "ADMIN")
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "Caption is too long to fit on the meme")
+}
+
+func TestGetMeme_WhenRemoteProviderFails_RaisesBadGateway(t *testing.T) {
+	router := testRouter(memeService)
+	recorder := performRequest(router, "GET", "/meme?query=providerDown", "ADMIN")
+
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "the meme provider is unavailable")
+	assert.NotContains(t, recorder.Body.String(), "connection refused")
+}
+
+func TestGetMeme_WithImageStore_StoresImageAndReturnsItsLocation(t *testing.T) {
+	images := &MockImageStore{saved: map[string][]byte{}}
+	service := *NewMemeService(&MockUserRepository{}, authService, &MockMemeProvider{}).WithImageStore(images)
+	router := testRouter(service)
+	recorder := performRequest(router, "GET", "/meme?query=withImage", "ADMIN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response models.Meme
+	err := json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Nil(t, err)
+
+	key := ImageKey(response.ID, "png")
+	assert.Equal(t, "memes/"+response.ID+".png", key)
+	assert.Equal(t, []byte("png data"), images.saved[key])
+	assert.Equal(t, "https://images.example.com/"+key+"#image/png", response.ImageLocation)
+	assert.Nil(t, response.Image)
+	assert.Equal(t, "png", response.ImageFormat)
+}
+
+func TestGetMeme_WhenImageStoreHasNoURL_PointsAtTheImageRoute(t *testing.T) {
+	images := &MockImageStore{saved: map[string][]byte{}, noURL: true}
+	service := *NewMemeService(&MockUserRepository{}, authService, &MockMemeProvider{}).WithImageStore(images)
+	recorder := performRequest(testRouter(service), "GET", "/meme?query=withImage", "ADMIN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response models.Meme
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "/memes/"+response.ID+"/image", response.ImageLocation)
+}
+
+func TestGetMeme_WithoutImageStore_ReturnsImageInline(t *testing.T) {
+	router := testRouter(memeService)
+	recorder := performRequest(router, "GET", "/meme?query=withImage", "ADMIN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response models.Meme
+	err := json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("png data"), response.Image)
+	assert.Equal(t, "1 x 1", response.ImageLocation)
+}
+
+func TestGetMeme_WhenImageStoreErrors_RaisesAnError(t *testing.T) {
+	images := &MockImageStore{err: errors.New("test")}
+	service := *NewMemeService(&MockUserRepository{}, authService, &MockMemeProvider{}).WithImageStore(images)
+	router := testRouter(service)
+	recorder := performRequest(router, "GET", "/meme?query=withImage", "ADMIN")
+
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "Unable to store meme")
+}
+
 func TestGetMeme_WhenAuthHeaderIsNotProvided_RaisesAnError(t *testing.T) {
 	expected_body := "\"unauthorized\""
 	router := testRouter(memeService)
@@ -264,6 +414,15 @@ func TestExtractParams_WithParams_SetsParams(t *testing.T) {
 	assert.Equal(t, &QueryParams{Query: "test", Lat: 1, Lon: 2}, params)
 }
 
+func TestExtractParams_WithTemplate_SetsTemplate(t *testing.T) {
+	path := "/test?template=lunch-break"
+
+	context := buildTestContext(path)
+	params, err := memeService.ExtractParams(context)
+	assert.Nil(t, err)
+	assert.Equal(t, &QueryParams{Template: "lunch-break"}, params)
+}
+
 func TestExtractParams_WithPartialParams_SetsParams(t *testing.T) {
 	path := "/test?query=test"
 
@@ -290,3 +449,388 @@ func TestExtractParams_WithBadLat_ThrowsError(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, params)
 }
+
+// Supports English and Spanish, and only understands bare language tags
+type MockLanguageMatcher struct{}
+
+func (m *MockLanguageMatcher) Match(preferences string) (string, bool) {
+	for _, lang := range strings.Split(preferences, ",") {
+		if lang = strings.TrimSpace(lang); lang == "en" || lang == "es" {
+			return lang, true
+		}
+	}
+	return "en", false
+}
+
+func TestExtractParams_WithLang_SetsLang(t *testing.T) {
+	service := (&MemeService{}).WithLanguages(&MockLanguageMatcher{})
+	params, err := service.ExtractParams(buildTestContext("/test?lang=es"))
+	assert.Nil(t, err)
+	assert.Equal(t, &QueryParams{Lang: "es"}, params)
+}
+
+func TestExtractParams_WithUnsupportedLang_ThrowsError(t *testing.T) {
+	service := (&MemeService{}).WithLanguages(&MockLanguageMatcher{})
+	params, err := service.ExtractParams(buildTestContext("/test?lang=xx"))
+	assert.Error(t, err)
+	assert.Nil(t, params)
+}
+
+func TestExtractParams_WithAcceptLanguage_UsesTheBestMatch(t *testing.T) {
+	service := (&MemeService{}).WithLanguages(&MockLanguageMatcher{})
+	context := buildTestContext("/test")
+	context.Request.Header.Set("Accept-Language", "xx, es")
+	params, err := service.ExtractParams(context)
+	assert.Nil(t, err)
+	assert.Equal(t, "es", params.Lang)
+
+	context = buildTestContext("/test")
+	context.Request.Header.Set("Accept-Language", "xx")
+	params, err = service.ExtractParams(context)
+	assert.Nil(t, err)
+	assert.Equal(t, "en", params.Lang)
+}
+
+func TestExtractParams_WithoutALanguageMatcher_IgnoresLang(t *testing.T) {
+	params, err := memeService.ExtractParams(buildTestContext("/test?lang=es"))
+	assert.Nil(t, err)
+	assert.Equal(t, "", params.Lang)
+}
+
+func TestGetMeme_WithLang_SetsContentLanguage(t *testing.T) {
+	service := memeService
+	service.Languages = &MockLanguageMatcher{}
+	recorder := performRequest(testRouter(service), "GET", "/meme?lang=es", "ADMIN")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "es", recorder.Header().Get("Content-Language"))
+
+	recorder = performRequest(testRouter(service), "GET", "/meme?lang=xx", "ADMIN")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+type MockMemeHistory struct {
+	records []*models.MemeRecord
+	err     error
+}
+
+func (m *MockMemeHistory) SaveMeme(record *models.MemeRecord) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.records = append(m.records, record)
+	return nil
+}
+
+type NamedMockMemeProvider struct {
+	MockMemeProvider
+}
+
+func (m *NamedMockMemeProvider) Name() string {
+	return "named"
+}
+
+func TestGetMeme_WithHistory_RecordsWhatTheUserWasChargedFor(t *testing.T) {
+	history := &MockMemeHistory{}
+	images := &MockImageStore{saved: map[string][]byte{}}
+	service := *NewMemeService(&MockUserRepository{}, authService, &MockMemeProvider{}).WithImageStore(images).WithHistory(history)
+	router := testRouter(service)
+	recorder := performRequest(router, "GET", "/meme?query=withImage&lat=1.5&lon=2.5&template=classic", "DEFAULT")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response models.Meme
+	err := json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, len(history.records))
+	record := history.records[0]
+	assert.Equal(t, response.ID, record.ID.Hex())
+	assert.Equal(t, defaultIDString, record.UserId)
+	assert.Equal(t, models.MemeParams{Query: "withImage", Lat: 1.5, Lon: 2.5, Template: "classic"}, record.Params)
+	assert.Equal(t, "*meme_service.MockMemeProvider", record.Provider)
+	assert.Equal(t, MemeCost, record.Cost)
+	assert.Equal(t, response.ImageLocation, record.ImageLocation)
+	assert.WithinDuration(t, time.Now(), record.CreatedAt, time.Minute)
+}
+
+func TestGetMeme_WithHistoryAndNamedProvider_RecordsProviderName(t *testing.T) {
+	history := &MockMemeHistory{}
+	service := *NewMemeService(&MockUserRepository{}, authService, &NamedMockMemeProvider{}).WithHistory(history)
+	router := testRouter(service)
+	recorder := performRequest(router, "GET", "/meme?query=withImage", "ADMIN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "named", history.records[0].Provider)
+	assert.Equal(t, adminIDString, history.records[0].UserId)
+	assert.NotEmpty(t, history.records[0].ID.Hex())
+}
+
+func TestGetMeme_WhenHistoryErrors_StillReturnsTheMeme(t *testing.T) {
+	history := &MockMemeHistory{err: errors.New("test")}
+	service := *NewMemeService(&MockUserRepository{}, authService, &MockMemeProvider{}).WithHistory(history)
+	router := testRouter(service)
+	recorder := performRequest(router, "GET", "/meme?query=withImage", "ADMIN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestGetMeme_WhenMemeFails_DoesNotRecordIt(t *testing.T) {
+	history := &MockMemeHistory{}
+	service := *NewMemeService(&MockUserRepository{}, authService, &MockMemeProvider{}).WithHistory(history)
+	router := testRouter(service)
+	performRequest(router, "GET", "/meme?query=raiseError", "ADMIN")
+	performRequest(router, "GET", "/meme", "OTHER")
+
+	assert.Empty(t, history.records)
+}
+
+// Caches nothing but reports fixed stats
+type MockCachingProvider struct {
+	MockMemeProvider
+}
+
+func (m *MockCachingProvider) CacheStats() CacheStats {
+	return CacheStats{Hits: 3, MemoryHits: 2, DiskHits: 1, Misses: 4, Entries: 4, Capacity: 10}
+}
+
+// Counts how many times tokens have been reserved through it
+type ChargingUserRepository struct {
+	MockUserRepository
+	charges int
+}
+
+func (m *ChargingUserRepository) ReserveTokensByAuth(auth string, reservation *models.TokenReservation) (*models.User, error) {
+	m.charges++
+	return m.MockUserRepository.ReserveTokensByAuth(auth, reservation)
+}
+
+func cacheRouter(service *MemeService) *gin.Engine {
+	router := testRouter(*service)
+	router.GET("/memes/cache", service.CacheStats)
+	return router
+}
+
+func TestCacheStats_WhenAdmin_ReturnsStats(t *testing.T) {
+	service := NewMemeService(&MockUserRepository{}, authService, &MockCachingProvider{})
+	recorder := performRequest(cacheRouter(service), "GET", "/memes/cache", "ADMIN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response CacheStats
+	err := json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Nil(t, err)
+	assert.Equal(t, CacheStats{Hits: 3, MemoryHits: 2, DiskHits: 1, Misses: 4, Entries: 4, Capacity: 10}, response)
+}
+
+func TestCacheStats_WhenNotAdmin_RaisesForbidden(t *testing.T) {
+	service := NewMemeService(&MockUserRepository{}, authService, &MockCachingProvider{})
+	recorder := performRequest(cacheRouter(service), "GET", "/memes/cache", "DEFAULT")
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestCacheStats_WhenProviderDoesNotCache_RaisesNotFound(t *testing.T) {
+	service := NewMemeService(&MockUserRepository{}, authService, &MockMemeProvider{})
+	recorder := performRequest(cacheRouter(service), "GET", "/memes/cache", "ADMIN")
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestGetMeme_WithCachingProvider_ChargesEveryRequest(t *testing.T) {
+	users := &ChargingUserRepository{}
+	service := NewMemeService(users, authService, &MockCachingProvider{})
+	router := testRouter(*service)
+	for i := 0; i < 3; i++ {
+		recorder := performRequest(router, "GET", "/meme?query=someQuery", "DEFAULT")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	}
+	assert.Equal(t, 3, users.charges)
+}
+
+// Hands out planUser for the "PLAN" auth header, and counts every user lookup
+type PlanUserRepository struct {
+	MockUserRepository
+	planUser *models.User
+	lookups  int
+}
+
+func (m *PlanUserRepository) UserByAuthHeader(auth string) (*models.User, error) {
+	m.lookups++
+	if auth == "PLAN" {
+		return m.planUser, nil
+	}
+	return m.MockUserRepository.UserByAuthHeader(auth)
+}
+
+// Reserves from planUser itself, so tests can check its balance and reservations afterwards
+func (m *PlanUserRepository) ReserveTokensByAuth(auth string, reservation *models.TokenReservation) (*models.User, error) {
+	m.lookups++
+	if auth != "PLAN" {
+		return m.MockUserRepository.ReserveTokensByAuth(auth, reservation)
+	}
+	return m.reservePlanUser(reservation)
+}
+
+func (m *PlanUserRepository) ReserveTokens(id string, reservation *models.TokenReservation) (*models.User, error) {
+	if m.planUser == nil || id != m.planUser.ID.Hex() {
+		return m.MockUserRepository.ReserveTokens(id, reservation)
+	}
+	return m.reservePlanUser(reservation)
+}
+
+func (m *PlanUserRepository) reservePlanUser(reservation *models.TokenReservation) (*models.User, error) {
+	reserved, err := m.reserveFrom(*m.planUser, reservation)
+	if err != nil {
+		return nil, err
+	}
+	*m.planUser = *reserved
+	return reserved, nil
+}
+
+func (m *PlanUserRepository) CommitReservation(userId string, reservation *models.TokenReservation, spent int) error {
+	if m.planUser == nil || userId != m.planUser.ID.Hex() {
+		return m.MockUserRepository.CommitReservation(userId, reservation, spent)
+	}
+	for i, held := range m.planUser.Reservations {
+		if held.ID == reservation.ID {
+			m.planUser.Reservations = append(m.planUser.Reservations[:i:i], m.planUser.Reservations[i+1:]...)
+			m.planUser.TokensRemaining += held.Amount - spent
+			return nil
+		}
+	}
+	return &error_types.ReservationNotFoundError{ID: reservation.ID}
+}
+
+func (m *PlanUserRepository) ReleaseReservation(userId string, reservation *models.TokenReservation) error {
+	return m.CommitReservation(userId, reservation, 0)
+}
+
+func (m *PlanUserRepository) ExtendReservation(userId string, reservation *models.TokenReservation) error {
+	if m.planUser == nil || userId != m.planUser.ID.Hex() {
+		return m.MockUserRepository.ExtendReservation(userId, reservation)
+	}
+	for i, held := range m.planUser.Reservations {
+		if held.ID == reservation.ID {
+			m.planUser.Reservations[i].ExpiresAt = reservation.ExpiresAt
+			return nil
+		}
+	}
+	return &error_types.ReservationNotFoundError{ID: reservation.ID}
+}
+
+// Releases planUser's reservations that expired before now
+func (m *PlanUserRepository) ReleaseExpiredReservations(now time.Time) (int, error) {
+	released := 0
+	for _, held := range append([]models.TokenReservation{}, m.planUser.Reservations...) {
+		if held.Expired(now) {
+			if err := m.ReleaseReservation(m.planUser.ID.Hex(), &held); err != nil {
+				return released, err
+			}
+			released++
+		}
+	}
+	return released, nil
+}
+
+func (m *PlanUserRepository) User(id string) (*models.User, error) {
+	m.lookups++
+	return m.MockUserRepository.User(id)
+}
+
+// Always makes the same meme, so tests can tell which provider was used
+type FixedMemeProvider struct {
+	name string
+}
+
+func (m *FixedMemeProvider) BuildMeme(params *QueryParams) (*models.Meme, error) {
+	return &models.Meme{TopText: m.name}, nil
+}
+
+func (m *FixedMemeProvider) Name() string {
+	return m.name
+}
+
+func planService(user *models.User) (*MemeService, *PlanUserRepository, *MockMemeHistory) {
+	users := &PlanUserRepository{planUser: user}
+	history := &MockMemeHistory{}
+	service := NewMemeService(users, authService, &FixedMemeProvider{name: "free"}).
+		WithPlanProvider(models.PlanStandard, &FixedMemeProvider{name: "standard"}).
+		WithPlanProvider(models.PlanAIPremium, &FixedMemeProvider{name: "ai"}).
+		WithHistory(history)
+	return service, users, history
+}
+
+func TestGetMeme_WhenUserIsOnAPlan_UsesThatPlansProvider(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	user := &models.User{ID: primitive.NewObjectID(), TokensRemaining: 10, Plan: models.PlanAIPremium, PlanExpiresAt: &expires}
+	service, users, history := planService(user)
+	recorder := performRequest(testRouter(*service), "GET", "/meme", "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"top_text": "ai"`)
+	assert.Equal(t, "ai", history.records[0].Provider)
+	// The plan comes with the user GetMeme already looks up
+	assert.Equal(t, 1, users.lookups)
+}
+
+func TestGetMeme_ChargesInTheSameCallThatAuthenticates(t *testing.T) {
+	user := &models.User{ID: primitive.NewObjectID(), TokensRemaining: 1}
+	service, users, _ := planService(user)
+	router := testRouter(*service)
+
+	recorder := performRequest(router, "GET", "/meme", "PLAN")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, 0, user.TokensRemaining)
+	assert.Equal(t, 1, users.lookups)
+
+	recorder = performRequest(router, "GET", "/meme", "PLAN")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, 0, user.TokensRemaining)
+}
+
+func TestGetMeme_WhenPlanHasExpired_UsesDefaultProvider(t *testing.T) {
+	expired := time.Now().Add(-time.Hour)
+	user := &models.User{ID: primitive.NewObjectID(), TokensRemaining: 10, Plan: models.PlanAIPremium, PlanExpiresAt: &expired}
+	service, _, history := planService(user)
+	recorder := performRequest(testRouter(*service), "GET", "/meme", "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"top_text": "free"`)
+	assert.Equal(t, "free", history.records[0].Provider)
+}
+
+func TestGetMeme_WhenUserHasNoPlan_UsesDefaultProvider(t *testing.T) {
+	user := &models.User{ID: primitive.NewObjectID(), TokensRemaining: 10}
+	service, _, _ := planService(user)
+	recorder := performRequest(testRouter(*service), "GET", "/meme", "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"top_text": "free"`)
+}
+
+func TestGetMeme_WhenPlanHasNoProvider_UsesDefaultProvider(t *testing.T) {
+	user := &models.User{ID: primitive.NewObjectID(), TokensRemaining: 10, Plan: models.PlanStandard}
+	service := NewMemeService(&PlanUserRepository{planUser: user}, authService, &FixedMemeProvider{name: "free"}).
+		WithPlanProvider(models.PlanAIPremium, &FixedMemeProvider{name: "ai"})
+	recorder := performRequest(testRouter(*service), "GET", "/meme", "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"top_text": "free"`)
+}
+
+func TestGetMeme_WhenProviderFails_RefundsTheToken(t *testing.T) {
+	user := &models.User{ID: primitive.NewObjectID(), TokensRemaining: 5}
+	service := NewMemeService(&PlanUserRepository{planUser: user}, authService, &MockMemeProvider{})
+	recorder := performRequest(testRouter(*service), "GET", "/meme?query=providerDown", "PLAN")
+
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+	assert.Equal(t, 5, user.TokensRemaining)
+}
+
+func TestGetMeme_WhenProviderSucceeds_SaysWhichProviderMadeIt(t *testing.T) {
+	user := &models.User{ID: primitive.NewObjectID(), TokensRemaining: 5}
+	service := NewMemeService(&PlanUserRepository{planUser: user}, authService, &FixedMemeProvider{name: "fixed"})
+	recorder := performRequest(testRouter(*service), "GET", "/meme", "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"provider": "fixed"`)
+	assert.Equal(t, 4, user.TokensRemaining)
+}
@@ -0,0 +1,163 @@
+package meme_service
+
+import (
+	"net/http"
+	"time"
+
+	error_types "maas/error-types"
+	"maas/loggers"
+	"maas/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Decides whether text is allowed on a meme. Returns a ContentPolicyError when it isn't
+type Moderator interface {
+	Check(field string, text string, safeMode bool) error
+}
+
+// Somewhere to keep the requests the content policy turned away, for moderators to review
+type ViolationLog interface {
+	SaveViolation(violation *models.Violation) error
+}
+
+func (s *MemeService) WithModerator(moderator Moderator) *MemeService {
+	s.Moderator = moderator
+	return s
+}
+
+func (s *MemeService) WithViolationLog(violations ViolationLog) *MemeService {
+	s.Violations = violations
+	return s
+}
+
+// Turns away a query that breaks the policy for everyone before anything is reserved, so it isn't
+// charged and refunded. The caller is only looked up when the query is turned away, to record who
+// sent it, which keeps the usual path to the one update that authenticates and reserves
+func (s *MemeService) screenQuery(authHeader string, params *QueryParams, ginContext *gin.Context) error {
+	if s.Moderator == nil {
+		return nil
+	}
+	err := s.Moderator.Check("query", params.Query, false)
+	if err == nil {
+		return nil
+	}
+	user, lookupErr := s.UserRepo.UserByAuthHeader(authHeader)
+	if lookupErr != nil {
+		authResponse(lookupErr, ginContext)
+		return lookupErr
+	}
+	s.recordViolation(user, params, params.Query, err, false)
+	moderationResponse(err, ginContext)
+	return err
+}
+
+// Rules that only apply in safe mode need the user, so for callers found by the reservation these are
+// checked once it's made. Turning the query away then means giving the tokens back
+func (s *MemeService) moderateSafeModeQuery(user *models.User, params *QueryParams) error {
+	if !user.SafeMode {
+		return nil
+	}
+	return s.moderateQuery(user, params)
+}
+
+// Checks the query against every rule that applies to the user
+func (s *MemeService) moderateQuery(user *models.User, params *QueryParams) error {
+	if s.Moderator == nil {
+		return nil
+	}
+	err := s.Moderator.Check("query", params.Query, user.SafeMode)
+	if err != nil {
+		s.recordViolation(user, params, params.Query, err, false)
+	}
+	return err
+}
+
+// Checks the captions the provider wrote, which can break the policy even when the query didn't
+func (s *MemeService) moderateMeme(user *models.User, params *QueryParams, meme *models.Meme) error {
+	text, err := s.checkCaptions(user, meme)
+	if err != nil {
+		s.recordViolation(user, params, text, err, true)
+	}
+	return err
+}
+
+// The first caption that breaks the policy, and why. Doesn't record anything
+func (s *MemeService) checkCaptions(user *models.User, meme *models.Meme) (string, error) {
+	if s.Moderator == nil {
+		return "", nil
+	}
+	fields := []struct{ name, text string }{{"top_text", meme.TopText}, {"bottom_text", meme.BottomText}}
+	for _, field := range fields {
+		if err := s.Moderator.Check(field.name, field.text, user.SafeMode); err != nil {
+			return field.text, err
+		}
+	}
+	return "", nil
+}
+
+func (s *MemeService) recordViolation(user *models.User, params *QueryParams, text string, err error, afterBuild bool) {
+	policyErr, ok := err.(*error_types.ContentPolicyError)
+	if !ok {
+		loggers.ErrorLog.Printf("Encountered an error moderating a meme: %s\n", err)
+		return
+	}
+	violation := &models.Violation{
+		ID:     primitive.NewObjectID(),
+		UserId: user.ID.Hex(),
+		Params: models.MemeParams{
+			Query:    params.Query,
+			Lat:      params.Lat,
+			Lon:      params.Lon,
+			Template: params.Template,
+		},
+		Field:      policyErr.Field,
+		Text:       text,
+		Rule:       policyErr.Rule,
+		Category:   policyErr.Category,
+		SafeMode:   user.SafeMode,
+		AfterBuild: afterBuild,
+		CreatedAt:  time.Now().UTC(),
+	}
+	loggers.InfoLog.Printf("Content policy violation by user %s: rule %s on %s\n", violation.UserId, violation.Rule, violation.Field)
+	if s.Violations == nil {
+		return
+	}
+	if saveErr := s.Violations.SaveViolation(violation); saveErr != nil {
+		loggers.ErrorLog.Printf("Encountered an error recording a violation: %s. Violation: %+v\n", saveErr, *violation)
+	}
+}
+
+// A 422 that says which rule was broken and where, so the caller can fix their request
+func moderationResponse(err error, ginContext *gin.Context) {
+	policyErr, ok := err.(*error_types.ContentPolicyError)
+	if !ok {
+		ginContext.IndentedJSON(http.StatusInternalServerError, map[string]string{"error": "Unable to make meme"})
+		return
+	}
+	ginContext.IndentedJSON(http.StatusUnprocessableEntity, map[string]interface{}{
+		"error":     violationMessage,
+		"violation": violationDetails(policyErr),
+	})
+}
+
+// The same 422 for memes that aren't made while the caller waits
+func moderationFailure(err error) *MemeFailure {
+	policyErr, ok := err.(*error_types.ContentPolicyError)
+	if !ok {
+		return &MemeFailure{Status: http.StatusInternalServerError, Error: "Unable to make meme"}
+	}
+	return &MemeFailure{Status: http.StatusUnprocessableEntity, Error: violationMessage, Violation: violationDetails(policyErr)}
+}
+
+const violationMessage = "This meme breaks the content policy"
+
+func violationDetails(policyErr *error_types.ContentPolicyError) map[string]string {
+	return map[string]string{
+		"field":    policyErr.Field,
+		"rule":     policyErr.Rule,
+		"category": policyErr.Category,
+		"reason":   policyErr.Reason,
+	}
+}
@@ -0,0 +1,129 @@
+package meme_service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	error_types "maas/error-types"
+	"maas/models"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Blocks anything that says "blocked", and anything that says "rude" in safe mode
+type MockModerator struct{}
+
+func (m *MockModerator) Check(field string, text string, safeMode bool) error {
+	if strings.Contains(text, "blocked") {
+		return &error_types.ContentPolicyError{Field: field, Rule: "no-blocked", Category: "test", Reason: "blocked is blocked"}
+	}
+	if safeMode && strings.Contains(text, "rude") {
+		return &error_types.ContentPolicyError{Field: field, Rule: "no-rude", Category: "test", Reason: "be nice"}
+	}
+	return nil
+}
+
+type MockViolationLog struct {
+	violations []*models.Violation
+}
+
+func (m *MockViolationLog) SaveViolation(violation *models.Violation) error {
+	m.violations = append(m.violations, violation)
+	return nil
+}
+
+func moderatedService(user *models.User, provider MemeProvider) (*MemeService, *MockViolationLog, *MockMemeHistory) {
+	violations := &MockViolationLog{}
+	history := &MockMemeHistory{}
+	service := NewMemeService(&PlanUserRepository{planUser: user}, authService, provider).
+		WithModerator(&MockModerator{}).
+		WithViolationLog(violations).
+		WithHistory(history)
+	return service, violations, history
+}
+
+func TestGetMeme_WhenQueryBreaksPolicy_RaisesUnprocessableWithoutCharging(t *testing.T) {
+	user := &models.User{ID: primitive.NewObjectID(), TokensRemaining: 5}
+	provider := &FixedMemeProvider{name: "fixed"}
+	service, violations, history := moderatedService(user, provider)
+	recorder := performRequest(testRouter(*service), "GET", "/meme?query=blocked", "PLAN")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	var response struct {
+		Error     string            `json:"error"`
+		Violation map[string]string `json:"violation"`
+	}
+	err := json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Nil(t, err)
+	assert.Equal(t, "This meme breaks the content policy", response.Error)
+	assert.Equal(t, map[string]string{"field": "query", "rule": "no-blocked", "category": "test", "reason": "blocked is blocked"}, response.Violation)
+
+	assert.Equal(t, 5, user.TokensRemaining)
+	assert.Empty(t, history.records)
+	assert.Equal(t, 1, len(violations.violations))
+	violation := violations.violations[0]
+	assert.Equal(t, user.ID.Hex(), violation.UserId)
+	assert.Equal(t, "blocked", violation.Text)
+	assert.Equal(t, "no-blocked", violation.Rule)
+	assert.False(t, violation.AfterBuild)
+}
+
+func TestGetMeme_WhenUserIsInSafeMode_AppliesSafeModeRules(t *testing.T) {
+	user := &models.User{ID: primitive.NewObjectID(), TokensRemaining: 5, SafeMode: true}
+	service, violations, _ := moderatedService(user, &FixedMemeProvider{name: "fixed"})
+	recorder := performRequest(testRouter(*service), "GET", "/meme?query=rude", "PLAN")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, 5, user.TokensRemaining)
+	assert.True(t, violations.violations[0].SafeMode)
+}
+
+func TestGetMeme_WhenUserIsNotInSafeMode_AllowsSafeModeOnlyContent(t *testing.T) {
+	user := &models.User{ID: primitive.NewObjectID(), TokensRemaining: 5}
+	service, violations, _ := moderatedService(user, &FixedMemeProvider{name: "fixed"})
+	recorder := performRequest(testRouter(*service), "GET", "/meme?query=rude", "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, 4, user.TokensRemaining)
+	assert.Empty(t, violations.violations)
+}
+
+func TestGetMeme_WhenProviderWritesSomethingThatBreaksPolicy_RefundsAndRaisesUnprocessable(t *testing.T) {
+	user := &models.User{ID: primitive.NewObjectID(), TokensRemaining: 5}
+	// FixedMemeProvider puts its name in the top text
+	service, violations, history := moderatedService(user, &FixedMemeProvider{name: "blocked"})
+	recorder := performRequest(testRouter(*service), "GET", "/meme?query=fine", "PLAN")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"field": "top_text"`)
+	assert.Equal(t, 5, user.TokensRemaining)
+	assert.Empty(t, history.records)
+	assert.True(t, violations.violations[0].AfterBuild)
+}
+
+func TestGetMeme_WithoutModerator_AllowsAnything(t *testing.T) {
+	user := &models.User{ID: primitive.NewObjectID(), TokensRemaining: 5}
+	service := NewMemeService(&PlanUserRepository{planUser: user}, authService, &FixedMemeProvider{name: "fixed"})
+	recorder := performRequest(testRouter(*service), "GET", "/meme?query=blocked", "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestGetMeme_WhenQueryBreaksPolicy_NeverReservesTokens(t *testing.T) {
+	repo := &ChargingUserRepository{}
+	service := NewMemeService(repo, authService, &MockMemeProvider{}).WithModerator(&MockModerator{})
+	recorder := performRequest(testRouter(*service), "GET", "/meme?query=blocked", "ADMIN")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, 0, repo.charges)
+}
+
+func TestGetMeme_WhenQueryBreaksPolicyForAnUnknownCaller_RaisesForbidden(t *testing.T) {
+	service := NewMemeService(&MockUserRepository{}, authService, &MockMemeProvider{}).WithModerator(&MockModerator{})
+	recorder := performRequest(testRouter(*service), "GET", "/meme?query=blocked", "MISSING")
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
@@ -0,0 +1,130 @@
+package meme_service
+
+import (
+	"net/http"
+	"time"
+
+	error_types "maas/error-types"
+	"maas/loggers"
+	"maas/models"
+	request_ids "maas/request-ids"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How long tokens are held for a meme before they're given back regardless. It's well past anything
+// a provider should take, so only memes lost to a crash or a restart are ever released this way
+const DefaultReservationTimeout = 10 * time.Minute
+
+// Implemented by user repositories that can give back reservations nobody committed or released in time
+type ReservationReleaser interface {
+	// Releases every reservation that expired before now and returns how many there were
+	ReleaseExpiredReservations(now time.Time) (int, error)
+}
+
+func (s *MemeService) WithReservationTimeout(timeout time.Duration) *MemeService {
+	s.ReservationTimeout = timeout
+	return s
+}
+
+// The reason and request ID go on the ledger entries for the reservation. It's held for
+// ReservationTimeout for each meme it pays for, since a batch makes its memes one after another
+func (s *MemeService) newReservation(amount int, reason string, ginContext *gin.Context) *models.TokenReservation {
+	memes := amount / MemeCost
+	if memes < 1 {
+		memes = 1
+	}
+	now := time.Now().UTC()
+	return &models.TokenReservation{
+		ID:        primitive.NewObjectID().Hex(),
+		Amount:    amount,
+		Reason:    reason,
+		RequestId: request_ids.Of(ginContext),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ReservationTimeout * time.Duration(memes)),
+	}
+}
+
+// Reserves MemeCost tokens from whoever authHeader belongs to and returns them as they are afterwards.
+// Sets the error response when the caller is unknown or can't pay
+func (s *MemeService) reserveForCaller(authHeader string, reason string, ginContext *gin.Context) (*models.User, *models.TokenReservation, error) {
+	reservation := s.newReservation(MemeCost, reason, ginContext)
+	user, err := s.UserRepo.ReserveTokensByAuth(authHeader, reservation)
+	if err != nil {
+		switch err.(type) {
+		default:
+			authResponse(err, ginContext)
+		case *error_types.InsufficientTokensError:
+			loggers.ErrorLog.Printf("Encountered an error making a meme%s\n", err)
+			ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": "Tokens needed to make more memes. Buy some!"})
+		}
+		return nil, nil, err
+	}
+	return user, reservation, nil
+}
+
+// Starts a job's reservation timing out afresh once a worker picks it up, however long it queued.
+// When the sweep has already given the tokens back the job is reserved for again, and fails if the
+// user can't pay any more, so a long queue never means a free meme
+func (s *MemeService) renewReservation(user *models.User, reservation *models.TokenReservation) *MemeFailure {
+	now := time.Now().UTC()
+	reservation.ExpiresAt = now.Add(s.ReservationTimeout)
+	err := s.UserRepo.ExtendReservation(user.ID.Hex(), reservation)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*error_types.ReservationNotFoundError); !ok {
+		// Still held, just for the original timeout
+		loggers.ErrorLog.Printf("Encountered an error extending reservation %s for user %s: %s\n", reservation.ID, user.ID.Hex(), err)
+		return nil
+	}
+
+	reservation.ID = primitive.NewObjectID().Hex()
+	reservation.CreatedAt = now
+	if _, err := s.UserRepo.ReserveTokens(user.ID.Hex(), reservation); err != nil {
+		loggers.ErrorLog.Printf("Encountered an error reserving again for user %s: %s\n", user.ID.Hex(), err)
+		if _, ok := err.(*error_types.InsufficientTokensError); ok {
+			return &MemeFailure{Status: http.StatusBadRequest, Error: "Tokens needed to make more memes. Buy some!"}
+		}
+		return &MemeFailure{Status: http.StatusInternalServerError, Error: "Unable to make meme"}
+	}
+	return nil
+}
+
+// Keeps spent of the reservation's tokens once the memes they paid for have been delivered. When the
+// reservation has already expired the user got those memes for free, which is the side to err on
+func (s *MemeService) commit(user *models.User, reservation *models.TokenReservation, spent int) {
+	if err := s.UserRepo.CommitReservation(user.ID.Hex(), reservation, spent); err != nil {
+		loggers.ErrorLog.Printf("Encountered an error committing reservation %s for user %s: %s\n", reservation.ID, user.ID.Hex(), err)
+	}
+}
+
+// Gives back the tokens reserved for memes that couldn't be made
+func (s *MemeService) release(user *models.User, reservation *models.TokenReservation) {
+	if err := s.UserRepo.ReleaseReservation(user.ID.Hex(), reservation); err != nil {
+		loggers.ErrorLog.Printf("Encountered an error releasing reservation %s for user %s: %s\n", reservation.ID, user.ID.Hex(), err)
+	}
+}
+
+// Releases expired reservations every interval until stop is closed. These are memes that were
+// never delivered, usually because the server went down while making them
+func ReleaseStaleReservations(releaser ReservationReleaser, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			released, err := releaser.ReleaseExpiredReservations(now.UTC())
+			if err != nil {
+				loggers.ErrorLog.Printf("Encountered an error releasing stale reservations: %s\n", err)
+				continue
+			}
+			if released > 0 {
+				loggers.InfoLog.Printf("Released %d stale token reservations\n", released)
+			}
+		}
+	}
+}
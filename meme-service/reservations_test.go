@@ -0,0 +1,142 @@
+package meme_service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"maas/models"
+	request_ids "maas/request-ids"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs inspect partway through building, while the meme's tokens are still reserved
+type InspectingProvider struct {
+	MockMemeProvider
+	inspect func()
+}
+
+func (m *InspectingProvider) BuildMeme(params *QueryParams) (*models.Meme, error) {
+	m.inspect()
+	return m.MockMemeProvider.BuildMeme(params)
+}
+
+// Reports every sweep it's asked to do
+type MockReservationReleaser struct {
+	sweeps chan time.Time
+}
+
+func (m *MockReservationReleaser) ReleaseExpiredReservations(now time.Time) (int, error) {
+	select {
+	case m.sweeps <- now:
+	default:
+	}
+	return 1, nil
+}
+
+func TestGetMeme_WhileBuilding_HoldsTheTokenInAReservation(t *testing.T) {
+	service, users, _ := batchService(5)
+	service.MemeProvider = &InspectingProvider{inspect: func() {
+		assert.Equal(t, 4, users.planUser.TokensRemaining)
+		assert.Len(t, users.planUser.Reservations, 1)
+		reservation := users.planUser.Reservations[0]
+		assert.Equal(t, MemeCost, reservation.Amount)
+		assert.Equal(t, DefaultReservationTimeout, reservation.ExpiresAt.Sub(reservation.CreatedAt))
+	}}
+	recorder := performRequest(testRouter(*service), "GET", "/meme?query=someQuery", "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, 4, users.planUser.TokensRemaining)
+	assert.Empty(t, users.planUser.Reservations)
+	assert.Equal(t, 0, users.released)
+}
+
+func TestGetMeme_ReservesForTheLedgerWithTheRequestId(t *testing.T) {
+	service, users, _ := batchService(5)
+	service.MemeProvider = &InspectingProvider{inspect: func() {
+		reservation := users.planUser.Reservations[0]
+		assert.Equal(t, "meme", reservation.Reason)
+		assert.Equal(t, "retry-42", reservation.RequestId)
+	}}
+	req, _ := http.NewRequest("GET", "/meme", nil)
+	req.Header.Set("auth", "PLAN")
+	req.Header.Set(request_ids.Header, "retry-42")
+	recorder := httptest.NewRecorder()
+	testRouter(*service).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestGetMeme_WhenBuildFails_ReleasesTheReservation(t *testing.T) {
+	service, users, _ := batchService(5)
+	recorder := performRequest(testRouter(*service), "GET", "/meme?query=raiseError", "PLAN")
+
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Equal(t, 5, users.planUser.TokensRemaining)
+	assert.Empty(t, users.planUser.Reservations)
+	assert.Equal(t, 1, users.released)
+}
+
+func TestGetMeme_WhenReservationExpiresMidBuild_StillDeliversTheMeme(t *testing.T) {
+	service, users, _ := batchService(5)
+	service.MemeProvider = &InspectingProvider{inspect: func() {
+		released, err := users.ReleaseExpiredReservations(time.Now().Add(2 * DefaultReservationTimeout))
+		assert.Nil(t, err)
+		assert.Equal(t, 1, released)
+	}}
+	recorder := performRequest(testRouter(*service), "GET", "/meme?query=someQuery", "PLAN")
+
+	// The token was already given back, so this one's free
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, 5, users.planUser.TokensRemaining)
+	assert.Empty(t, users.planUser.Reservations)
+}
+
+func TestBatchMemes_CommitsOnlyTheMemesThatWereMade(t *testing.T) {
+	service, users, _ := batchService(5)
+	recorder := performBatch(service, `{"memes": [{"query": "raiseError"}, {}, {}]}`, "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, []int{3}, users.reserved)
+	assert.Equal(t, 1, users.released)
+	assert.Equal(t, 3, users.planUser.TokensRemaining)
+	assert.Empty(t, users.planUser.Reservations)
+}
+
+func TestBatchMemes_HoldsTheReservationForEveryMemeInTheBatch(t *testing.T) {
+	service, users, _ := batchService(5)
+	service.MemeProvider = &InspectingProvider{inspect: func() {
+		reservation := users.planUser.Reservations[0]
+		assert.Equal(t, 3*DefaultReservationTimeout, reservation.ExpiresAt.Sub(reservation.CreatedAt))
+	}}
+	recorder := performBatch(service, `{"memes": [{}, {}, {}]}`, "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, 2, users.planUser.TokensRemaining)
+}
+
+func TestReleaseStaleReservations_SweepsUntilStopped(t *testing.T) {
+	releaser := &MockReservationReleaser{sweeps: make(chan time.Time, 1)}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		ReleaseStaleReservations(releaser, time.Millisecond, stop)
+		close(stopped)
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-releaser.sweeps:
+		case <-time.After(time.Second):
+			t.Fatal("expected a sweep")
+		}
+	}
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected the sweeper to stop")
+	}
+}
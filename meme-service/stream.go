@@ -0,0 +1,162 @@
+package meme_service
+
+import (
+	"net/http"
+	"sync"
+
+	error_types "maas/error-types"
+	"maas/loggers"
+	"maas/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Stages in the order they're streamed. A stage reported early is held until the ones before it have
+// been sent. Any a provider doesn't report itself (a cached meme, say) are sent once the meme is
+// made, so clients always see every one of them
+var streamedStages = []string{StageTemplateSelected, StageCaptionGenerated, StageRendered}
+
+// The same as GET /memes, but answers with a stream of server-sent events as the meme is made:
+// charged, template_selected, caption_generated, rendered and finally done with the meme. Anything
+// that goes wrong before the token is reserved gets the usual JSON error. Anything after that is sent
+// as an error event, and the token is given back. It's only kept once done has been sent
+func (s *MemeService) StreamMeme(ginContext *gin.Context) {
+	authHeader := ginContext.Request.Header.Get("auth")
+	if authHeader == "" {
+		authResponse(&error_types.NoAuthHeaderError{}, ginContext)
+		return
+	}
+	params, err := s.ExtractParams(ginContext)
+	if err != nil {
+		loggers.ErrorLog.Printf("Encountered an error making a meme%s\n", err)
+		ginContext.IndentedJSON(http.StatusBadRequest, map[string]string{"error": "bad request"})
+		return
+	}
+	if err := s.screenQuery(authHeader, params, ginContext); err != nil {
+		return
+	}
+	user, reservation, err := s.reserveForCaller(authHeader, "streamed meme", ginContext)
+	if err != nil {
+		return
+	}
+	if err := s.moderateSafeModeQuery(user, params); err != nil {
+		s.release(user, reservation)
+		moderationResponse(err, ginContext)
+		return
+	}
+
+	if params.Lang != "" {
+		ginContext.Header("Content-Language", params.Lang)
+	}
+	stream := newProgressStream(ginContext)
+	defer stream.close()
+	stream.send(StageCharged, map[string]int{"cost": MemeCost, "tokens_remaining": user.TokensRemaining})
+
+	// Captions are checked as they're reported, so one that breaks the policy is never streamed.
+	// fulfil turns the meme away once it's built, and records the violation
+	params.Progress = func(stage string, meme *models.Meme) {
+		if stage == StageCaptionGenerated {
+			if _, err := s.checkCaptions(user, meme); err != nil {
+				return
+			}
+		}
+		stream.report(stage, meme)
+	}
+	meme, failure := s.fulfil(user, s.providerFor(user), params)
+	if failure != nil {
+		s.release(user, reservation)
+		stream.send("error", &streamFailure{MemeFailure: *failure, Refunded: MemeCost})
+		return
+	}
+	for _, stage := range streamedStages {
+		stream.report(stage, meme)
+	}
+	stream.send(StageDone, meme)
+	s.commit(user, reservation, MemeCost)
+}
+
+// An error event. The token the meme was charged is always given back
+type streamFailure struct {
+	MemeFailure
+	Refunded int `json:"tokens_refunded"`
+}
+
+// Writes events to the response as they happen. Providers can report from their own goroutines, so
+// sends are serialized, and each stage is only sent once
+type progressStream struct {
+	ginContext *gin.Context
+	mutex      sync.Mutex
+	sent       map[string]bool
+	// Stages reported ahead of one that hasn't been yet
+	held map[string]*models.Meme
+	// Set once the handler has returned. A provider abandoned after a timeout can still report
+	// progress, and the response mustn't be written to after that
+	closed bool
+}
+
+func newProgressStream(ginContext *gin.Context) *progressStream {
+	header := ginContext.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	// Stops proxies like nginx holding events back until the response is finished
+	header.Set("X-Accel-Buffering", "no")
+	ginContext.Status(http.StatusOK)
+	return &progressStream{ginContext: ginContext, sent: map[string]bool{}, held: map[string]*models.Meme{}}
+}
+
+func (p *progressStream) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+}
+
+// Sends stage once the stages before it have been, along with any later ones that were waiting on it.
+// The details are taken now, since the provider goes on changing the meme
+func (p *progressStream) report(stage string, meme *models.Meme) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.held[stage]; !ok {
+		snapshot := *meme
+		p.held[stage] = &snapshot
+	}
+	for _, next := range streamedStages {
+		if p.sent[next] {
+			continue
+		}
+		held, ok := p.held[next]
+		if !ok {
+			return
+		}
+		p.write(next, stageDetails(next, held))
+	}
+}
+
+func (p *progressStream) send(event string, data interface{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.write(event, data)
+}
+
+// Called with the lock held
+func (p *progressStream) write(event string, data interface{}) {
+	if p.closed || p.sent[event] {
+		return
+	}
+	p.sent[event] = true
+	p.ginContext.SSEvent(event, data)
+	p.ginContext.Writer.Flush()
+}
+
+// What's worth showing about the meme at each stage. The image itself only comes with done
+func stageDetails(stage string, meme *models.Meme) map[string]string {
+	switch stage {
+	case StageTemplateSelected:
+		return map[string]string{"template_id": meme.TemplateId}
+	case StageCaptionGenerated:
+		return map[string]string{"top_text": meme.TopText, "bottom_text": meme.BottomText}
+	case StageRendered:
+		return map[string]string{"image_format": meme.ImageFormat}
+	}
+	return map[string]string{}
+}
@@ -0,0 +1,174 @@
+package meme_service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"maas/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type streamEvent struct {
+	name string
+	data string
+}
+
+func parseEvents(body string) []streamEvent {
+	events := []streamEvent{}
+	for _, block := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		event := streamEvent{}
+		for _, line := range strings.Split(block, "\n") {
+			if name, ok := cutPrefix(line, "event:"); ok {
+				event.name = name
+			} else if data, ok := cutPrefix(line, "data:"); ok {
+				event.data = data
+			}
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func cutPrefix(line string, prefix string) (string, bool) {
+	if !strings.HasPrefix(line, prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, prefix)), true
+}
+
+func eventNames(events []streamEvent) []string {
+	names := []string{}
+	for _, event := range events {
+		names = append(names, event.name)
+	}
+	return names
+}
+
+// Reports the stages it gets through, the caption before the template, and fails after picking a
+// template when asked to
+type ReportingProvider struct{}
+
+func (m *ReportingProvider) BuildMeme(params *QueryParams) (*models.Meme, error) {
+	meme := &models.Meme{TopText: params.Query, TemplateId: "drake"}
+	if params.Query == "badCaption" {
+		meme.BottomText = "blocked words"
+	}
+	params.Report(StageCaptionGenerated, meme)
+	params.Report(StageTemplateSelected, meme)
+	if params.Query == "raiseError" {
+		return nil, errors.New("down")
+	}
+	meme.ImageFormat = "png"
+	params.Report(StageRendered, meme)
+	return meme, nil
+}
+
+func streamRouter(service *MemeService) *gin.Engine {
+	router := gin.Default()
+	router.GET("/memes/stream", service.StreamMeme)
+	return router
+}
+
+func TestStreamMeme_WhenEverythingIsGood_StreamsEveryStage(t *testing.T) {
+	service, users, history := batchService(5)
+	service.MemeProvider = &ReportingProvider{}
+	recorder := performRequest(streamRouter(service), "GET", "/memes/stream?query=hello", "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/event-stream", recorder.Header().Get("Content-Type"))
+	events := parseEvents(recorder.Body.String())
+	assert.Equal(t, []string{StageCharged, StageTemplateSelected, StageCaptionGenerated, StageRendered, StageDone}, eventNames(events))
+	assert.JSONEq(t, `{"cost": 1, "tokens_remaining": 4}`, events[0].data)
+	assert.JSONEq(t, `{"template_id": "drake"}`, events[1].data)
+	assert.JSONEq(t, `{"top_text": "hello", "bottom_text": ""}`, events[2].data)
+	assert.JSONEq(t, `{"image_format": "png"}`, events[3].data)
+
+	var meme models.Meme
+	assert.Nil(t, json.Unmarshal([]byte(events[4].data), &meme))
+	assert.Equal(t, "hello", meme.TopText)
+	assert.Equal(t, []int{1}, users.reserved)
+	assert.Equal(t, 0, users.released)
+	assert.Len(t, history.records, 1)
+}
+
+func TestStreamMeme_WhenProviderDoesNotReport_StillSendsEveryStage(t *testing.T) {
+	service, _, _ := batchService(5)
+	recorder := performRequest(streamRouter(service), "GET", "/memes/stream?query=someQuery", "PLAN")
+
+	events := parseEvents(recorder.Body.String())
+	assert.Equal(t, []string{StageCharged, StageTemplateSelected, StageCaptionGenerated, StageRendered, StageDone}, eventNames(events))
+}
+
+func TestStreamMeme_WhenProviderFailsMidStream_SendsAnErrorAndRefunds(t *testing.T) {
+	service, users, history := batchService(5)
+	service.MemeProvider = &ReportingProvider{}
+	recorder := performRequest(streamRouter(service), "GET", "/memes/stream?query=raiseError", "PLAN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	events := parseEvents(recorder.Body.String())
+	assert.Equal(t, []string{StageCharged, StageTemplateSelected, StageCaptionGenerated, "error"}, eventNames(events))
+	assert.JSONEq(t, `{"status": 500, "error": "Unable to make meme", "tokens_refunded": 1}`, events[3].data)
+	assert.Equal(t, 1, users.released)
+	assert.Equal(t, 5, users.planUser.TokensRemaining)
+	assert.Empty(t, history.records)
+}
+
+func TestStreamMeme_WhenCaptionBreaksPolicy_SendsTheViolation(t *testing.T) {
+	service, users, _ := batchService(5)
+	service = service.WithModerator(&MockModerator{})
+	service.MemeProvider = &FixedMemeProvider{name: "blocked"}
+	recorder := performRequest(streamRouter(service), "GET", "/memes/stream", "PLAN")
+
+	events := parseEvents(recorder.Body.String())
+	last := events[len(events)-1]
+	assert.Equal(t, "error", last.name)
+	assert.Contains(t, last.data, `"rule":"no-blocked"`)
+	assert.Equal(t, 1, users.released)
+}
+
+func TestStreamMeme_WhenReportedCaptionBreaksPolicy_NeverStreamsIt(t *testing.T) {
+	service, users, _ := batchService(5)
+	violations := &MockViolationLog{}
+	service = service.WithModerator(&MockModerator{}).WithViolationLog(violations)
+	service.MemeProvider = &ReportingProvider{}
+	recorder := performRequest(streamRouter(service), "GET", "/memes/stream?query=badCaption", "PLAN")
+
+	events := parseEvents(recorder.Body.String())
+	assert.Equal(t, []string{StageCharged, StageTemplateSelected, "error"}, eventNames(events))
+	assert.NotContains(t, recorder.Body.String(), "blocked words")
+	assert.Equal(t, 1, users.released)
+	assert.Len(t, violations.violations, 1)
+}
+
+func TestStreamMeme_BeforeCharging_AnswersWithPlainErrors(t *testing.T) {
+	service, users, _ := batchService(0)
+	recorder := performRequest(streamRouter(service), "GET", "/memes/stream", "PLAN")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "Tokens needed")
+
+	recorder = performRequest(streamRouter(service), "GET", "/memes/stream?lat=BAD", "PLAN")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	recorder = performRequest(streamRouter(service), "GET", "/memes/stream", "")
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, 0, users.released)
+}
+
+func TestProgressStream_IgnoresRepeatsAndReportsAfterClosing(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	context, _ := gin.CreateTestContext(recorder)
+	stream := newProgressStream(context)
+	stream.report(StageTemplateSelected, &models.Meme{TemplateId: "first"})
+	stream.report(StageTemplateSelected, &models.Meme{TemplateId: "again"})
+	stream.close()
+	stream.report(StageRendered, &models.Meme{})
+
+	events := parseEvents(recorder.Body.String())
+	assert.Equal(t, []string{StageTemplateSelected}, eventNames(events))
+	assert.JSONEq(t, `{"template_id": "first"}`, events[0].data)
+}
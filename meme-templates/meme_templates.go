@@ -0,0 +1,128 @@
+package meme_templates
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	error_types "maas/error-types"
+	meme_maker "maas/meme-maker"
+	"maas/models"
+	template_service "maas/template-service"
+)
+
+/*
+  Holds the meme templates that are available to the meme maker.
+  A template library is a directory with a templates.json manifest and the images it references.
+*/
+
+const manifestName = "templates.json"
+
+//go:embed library
+var library embed.FS
+
+var _ template_service.TemplateRepository = &Registry{}
+var _ meme_maker.TemplateRepository = &Registry{}
+
+type Registry struct {
+	templates map[string]*models.Template
+	// Keeps listings in the order the templates were loaded in
+	order []string
+}
+
+func NewRegistry(templates ...*models.Template) *Registry {
+	registry := &Registry{templates: map[string]*models.Template{}}
+	for _, template := range templates {
+		registry.Add(template)
+	}
+	return registry
+}
+
+// Loads the library bundled with the binary
+func Default() (*Registry, error) {
+	libraryFS, err := fs.Sub(library, "library")
+	if err != nil {
+		return nil, err
+	}
+	return LoadFS(libraryFS)
+}
+
+func LoadDir(dir string) (*Registry, error) {
+	return LoadFS(os.DirFS(dir))
+}
+
+func LoadFS(fsys fs.FS) (*Registry, error) {
+	manifest, err := fs.ReadFile(fsys, manifestName)
+	if err != nil {
+		return nil, err
+	}
+
+	var templates []*models.Template
+	if err := json.Unmarshal(manifest, &templates); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", manifestName, err)
+	}
+
+	for _, template := range templates {
+		if err := loadImage(fsys, template); err != nil {
+			return nil, fmt.Errorf("unable to load image for template %s: %w", template.ID, err)
+		}
+	}
+	return NewRegistry(templates...), nil
+}
+
+// GIFs with more than one frame are kept whole so every frame can be captioned
+func loadImage(fsys fs.FS, template *models.Template) error {
+	file, err := fsys.Open(template.ImageFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if strings.EqualFold(path.Ext(template.ImageFile), ".gif") {
+		animation, err := gif.DecodeAll(file)
+		if err != nil {
+			return err
+		}
+		template.Image = animation.Image[0]
+		if len(animation.Image) > 1 {
+			template.Animated = true
+			template.Animation = animation
+		}
+		return nil
+	}
+
+	template.Image, _, err = image.Decode(file)
+	return err
+}
+
+// Adds a template, replacing any existing template with the same ID
+func (r *Registry) Add(template *models.Template) {
+	if _, exists := r.templates[template.ID]; !exists {
+		r.order = append(r.order, template.ID)
+	}
+	r.templates[template.ID] = template
+}
+
+func (r *Registry) AllTemplates() []models.Template {
+	templates := make([]models.Template, 0, len(r.order))
+	for _, id := range r.order {
+		templates = append(templates, *r.templates[id])
+	}
+	return templates
+}
+
+func (r *Registry) Template(id string) (*models.Template, error) {
+	template, ok := r.templates[id]
+	if !ok {
+		return nil, &error_types.TemplateNotFoundError{ID: id}
+	}
+	return template, nil
+}
@@ -0,0 +1,126 @@
+package meme_templates
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/png"
+	"testing"
+	"testing/fstest"
+
+	error_types "maas/error-types"
+	meme_maker "maas/meme-maker"
+	"maas/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func pngBytes(width int, height int) []byte {
+	var buffer bytes.Buffer
+	png.Encode(&buffer, image.NewRGBA(image.Rect(0, 0, width, height)))
+	return buffer.Bytes()
+}
+
+func TestDefault_LoadsTheBundledLibrary(t *testing.T) {
+	registry, err := Default()
+	assert.Nil(t, err)
+	templates := registry.AllTemplates()
+	assert.Equal(t, 6, len(templates))
+	for _, template := range templates {
+		assert.NotNil(t, template.Image, template.ID)
+	}
+}
+
+func TestLoadFS_LoadsTemplatesAndImages(t *testing.T) {
+	fsys := fstest.MapFS{
+		"templates.json": {Data: []byte(`[{"id": "small", "name": "Small", "tags": ["tiny"], "image_file": "small.png",
+			"top_box": {"x": 1, "y": 2, "width": 3, "height": 4}, "bottom_box": {"x": 5, "y": 6, "width": 7, "height": 8}}]`)},
+		"small.png": {Data: pngBytes(20, 10)},
+	}
+	registry, err := LoadFS(fsys)
+	assert.Nil(t, err)
+
+	template, err := registry.Template("small")
+	assert.Nil(t, err)
+	assert.Equal(t, "Small", template.Name)
+	assert.Equal(t, []string{"tiny"}, template.Tags)
+	assert.Equal(t, models.CaptionBox{X: 1, Y: 2, Width: 3, Height: 4}, template.TopBox)
+	assert.Equal(t, models.CaptionBox{X: 5, Y: 6, Width: 7, Height: 8}, template.BottomBox)
+	assert.Equal(t, image.Rect(0, 0, 20, 10), template.Image.Bounds())
+}
+
+func TestLoadFS_WhenManifestIsMissing_RaisesAnError(t *testing.T) {
+	registry, err := LoadFS(fstest.MapFS{})
+	assert.Error(t, err)
+	assert.Nil(t, registry)
+}
+
+func TestLoadFS_WhenImageIsMissing_RaisesAnError(t *testing.T) {
+	fsys := fstest.MapFS{
+		"templates.json": {Data: []byte(`[{"id": "small", "image_file": "missing.png"}]`)},
+	}
+	registry, err := LoadFS(fsys)
+	assert.Error(t, err)
+	assert.Nil(t, registry)
+}
+
+func TestAllTemplates_KeepsLoadOrder(t *testing.T) {
+	registry := NewRegistry(&models.Template{ID: "b"}, &models.Template{ID: "a"}, &models.Template{ID: "c"})
+	templates := registry.AllTemplates()
+	assert.Equal(t, "b", templates[0].ID)
+	assert.Equal(t, "a", templates[1].ID)
+	assert.Equal(t, "c", templates[2].ID)
+}
+
+func TestAdd_ReplacesTemplatesWithTheSameID(t *testing.T) {
+	registry := NewRegistry(&models.Template{ID: "a", Name: "First"})
+	registry.Add(&models.Template{ID: "a", Name: "Second"})
+	templates := registry.AllTemplates()
+	assert.Equal(t, 1, len(templates))
+	assert.Equal(t, "Second", templates[0].Name)
+}
+
+func TestTemplate_WhenTemplateIsMissing_RaisesTemplateNotFound(t *testing.T) {
+	registry := NewRegistry()
+	template, err := registry.Template("missing")
+	assert.Nil(t, template)
+	assert.Equal(t, &error_types.TemplateNotFoundError{ID: "missing"}, err)
+}
+
+// The readme's example query should land on a food template rather than the plain default
+func TestDefault_SelectsFoodTemplateForReadmeExample(t *testing.T) {
+	registry, err := Default()
+	assert.Nil(t, err)
+	template := meme_maker.SelectTemplate("food", registry.AllTemplates(), meme_maker.DefaultSynonyms)
+	assert.Equal(t, "lunch-break", template.ID)
+}
+
+func TestDefault_LoadsAnimatedTemplatesWithEveryFrame(t *testing.T) {
+	registry, err := Default()
+	assert.Nil(t, err)
+	template, err := registry.Template("party-time")
+	assert.Nil(t, err)
+	assert.True(t, template.Animated)
+	assert.Equal(t, 8, len(template.Animation.Image))
+	assert.NotNil(t, template.Image)
+
+	static, err := registry.Template("classic")
+	assert.Nil(t, err)
+	assert.False(t, static.Animated)
+	assert.Nil(t, static.Animation)
+}
+
+func TestLoadFS_WithSingleFrameGIF_IsNotAnimated(t *testing.T) {
+	var buffer bytes.Buffer
+	gif.Encode(&buffer, image.NewRGBA(image.Rect(0, 0, 20, 10)), nil)
+	fsys := fstest.MapFS{
+		"templates.json": {Data: []byte(`[{"id": "still", "image_file": "still.GIF"}]`)},
+		"still.GIF":      {Data: buffer.Bytes()},
+	}
+	registry, err := LoadFS(fsys)
+	assert.Nil(t, err)
+	template, _ := registry.Template("still")
+	assert.False(t, template.Animated)
+	assert.Nil(t, template.Animation)
+	assert.Equal(t, image.Rect(0, 0, 20, 10), template.Image.Bounds())
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// The first response to a request sent with an Idempotency-Key, kept so retries get it again instead
+// of being charged again
+type StoredResponse struct {
+	Key string `json:"key" bson:"key"`
+	// A hash of the caller's auth header. Keys only replay for the caller who sent them
+	Caller string `json:"caller" bson:"caller"`
+	// A hash of the request's parameters. Reusing a key for different ones is refused
+	Fingerprint string `json:"fingerprint" bson:"fingerprint"`
+	// 0 while the request that claimed the key is still running
+	Status          int    `json:"status" bson:"status"`
+	Body            []byte `json:"body" bson:"body,omitempty"`
+	ContentType     string `json:"content_type" bson:"content_type,omitempty"`
+	ContentLanguage string `json:"content_language,omitempty" bson:"content_language,omitempty"`
+	// Tokens the first request was charged
+	Cost      int       `json:"cost" bson:"cost"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// A meme made in the background. The token is reserved when the job is submitted and given back
+// if it fails
+type MemeJob struct {
+	ID string `json:"id"`
+	// The object ID hex of the user who submitted the job
+	UserId string     `json:"user_id"`
+	Status JobStatus  `json:"status"`
+	Params MemeParams `json:"params"`
+	// Set once the job has succeeded
+	Meme *Meme `json:"meme,omitempty"`
+	// Set once the job has failed. ErrorStatus is what GET /memes would have answered with
+	Error       string            `json:"error,omitempty"`
+	ErrorStatus int               `json:"error_status,omitempty"`
+	Violation   map[string]string `json:"violation,omitempty"`
+	// Optional. Gets a signed POST of the job once it's done
+	CallbackURL string     `json:"callback_url,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+func (j *MemeJob) Done() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type LedgerKind string
+
+const (
+	// Tokens bought by the user
+	LedgerCredit LedgerKind = "credit"
+	// Tokens taken for memes
+	LedgerSpend LedgerKind = "spend"
+	// Tokens given back for memes that weren't made
+	LedgerRefund LedgerKind = "refund"
+	// Balances set by an admin, and the opening balance of a new user
+	LedgerAdjustment LedgerKind = "adjustment"
+)
+
+// The actor for changes nobody asked for, like a stale reservation being released
+const SystemActor = "system"
+
+// One change to a user's balance. The ledger is only ever appended to, so a user's entries add up to
+// their tokens_remaining. Entries from before seq was kept don't have one, and are left out of the sum
+// in favour of the opening balance backfilled after them
+type LedgerEntry struct {
+	ID primitive.ObjectID `json:"id" bson:"_id"`
+	// The object ID hex of the user whose balance changed
+	UserId string `json:"user_id" bson:"user_id"`
+	// Counts up from the user's opening balance at 0, so a missing entry shows up as a gap
+	Seq  int        `json:"seq" bson:"seq"`
+	Kind LedgerKind `json:"kind" bson:"kind"`
+	// Negative when tokens were taken
+	Amount int `json:"amount" bson:"amount"`
+	// The user's tokens_remaining straight after the change
+	Balance int `json:"balance" bson:"balance"`
+	// The object ID hex of whoever made the change, or SystemActor
+	Actor     string `json:"actor" bson:"actor"`
+	Reason    string `json:"reason" bson:"reason"`
+	RequestId string `json:"request_id,omitempty" bson:"request_id,omitempty"`
+	// For credits, the purchase they were for and the key the purchasing team sent with them
+	Reference      string    `json:"reference,omitempty" bson:"reference,omitempty"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty" bson:"idempotency_key,omitempty"`
+	CreatedAt      time.Time `json:"created_at" bson:"created_at"`
+}
+
+// Who is changing a user's balance and why, for the ledger
+type BalanceChange struct {
+	Actor     string
+	Reason    string
+	RequestId string
+	// Only for credits, the purchase they were for
+	Reference string
+}
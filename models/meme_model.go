@@ -1,9 +1,18 @@
 package models
 
 type Meme struct {
+	ID            string `json:"id,omitempty"`
 	TopText       string `json:"top_text"`
 	BottomText    string `json:"bottom_text"`
 	ImageLocation string `json:"image_location"`
+	Image         []byte `json:"image,omitempty"`
+	ImageFormat   string `json:"image_format,omitempty"`
+	TemplateId    string `json:"template_id,omitempty"`
+	Place         *Place `json:"place,omitempty"`
+	// The provider that made the meme, which isn't always the one asked first
+	Provider string `json:"provider,omitempty"`
+	// Only set when public links are turned on. Lets the image be fetched without an auth header
+	PublicImagePath string `json:"public_image_path,omitempty"`
 }
 
 func (m *Meme) MakeMap() map[string]string {
@@ -28,3 +37,19 @@ func (m *Meme) WithImageLocation(imageLocation string) *Meme {
 	m.ImageLocation = imageLocation
 	return m
 }
+
+func (m *Meme) WithImage(image []byte, format string) *Meme {
+	m.Image = image
+	m.ImageFormat = format
+	return m
+}
+
+func (m *Meme) WithTemplateId(templateId string) *Meme {
+	m.TemplateId = templateId
+	return m
+}
+
+func (m *Meme) WithPlace(place *Place) *Meme {
+	m.Place = place
+	return m
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A meme a user was charged for, kept so there's a history to look back on
+type MemeRecord struct {
+	ID primitive.ObjectID `json:"id" bson:"_id"`
+	// The object ID hex of the user who made the meme
+	UserId        string     `json:"user_id" bson:"user_id"`
+	Params        MemeParams `json:"params" bson:"params"`
+	TemplateId    string     `json:"template_id,omitempty" bson:"template_id,omitempty"`
+	Provider      string     `json:"provider" bson:"provider"`
+	Cost          int        `json:"cost" bson:"cost"`
+	ImageLocation string     `json:"image_location" bson:"image_location"`
+	CreatedAt     time.Time  `json:"created_at" bson:"created_at"`
+}
+
+// The query parameters the meme was made with
+type MemeParams struct {
+	Query    string  `json:"query,omitempty" bson:"query,omitempty"`
+	Lat      float64 `json:"lat,omitempty" bson:"lat,omitempty"`
+	Lon      float64 `json:"lon,omitempty" bson:"lon,omitempty"`
+	Template string  `json:"template,omitempty" bson:"template,omitempty"`
+	Lang     string  `json:"lang,omitempty" bson:"lang,omitempty"`
+}
@@ -0,0 +1,11 @@
+package models
+
+// Where a meme request came from, resolved from its lat and lon
+type Place struct {
+	City        string `json:"city"`
+	Region      string `json:"region"`
+	Country     string `json:"country"`
+	CountryCode string `json:"country_code"`
+	// The closest named park, landmark, body of water, etc. Empty if nothing is close by
+	Feature string `json:"feature,omitempty"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// Tokens taken from a user for a meme that hasn't been delivered yet. Reservations are kept on the
+// user document, so taking the tokens and recording why is one update. Committing one keeps the
+// tokens. Releasing it, or letting it expire, gives them back
+type TokenReservation struct {
+	ID     string `bson:"id"`
+	Amount int    `bson:"amount"`
+	// What the tokens are for and the request that reserved them, for the ledger
+	Reason    string    `bson:"reason"`
+	RequestId string    `bson:"request_id,omitempty"`
+	CreatedAt time.Time `bson:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+func (r *TokenReservation) Expired(now time.Time) bool {
+	return !now.Before(r.ExpiresAt)
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"image"
+	"image/gif"
+)
+
+// Pixel coordinates of the area a caption is drawn in, relative to the top left of the template image
+type CaptionBox struct {
+	X      int `json:"x" bson:"x"`
+	Y      int `json:"y" bson:"y"`
+	Width  int `json:"width" bson:"width"`
+	Height int `json:"height" bson:"height"`
+}
+
+func (b CaptionBox) Rect() image.Rectangle {
+	return image.Rect(b.X, b.Y, b.X+b.Width, b.Y+b.Height)
+}
+
+type Template struct {
+	ID        string     `json:"id" bson:"_id"`
+	Name      string     `json:"name" bson:"name"`
+	Tags      []string   `json:"tags" bson:"tags"`
+	ImageFile string     `json:"image_file" bson:"image_file"`
+	TopBox    CaptionBox `json:"top_box" bson:"top_box"`
+	BottomBox CaptionBox `json:"bottom_box" bson:"bottom_box"`
+	// Set when ImageFile is a GIF with more than one frame. Memes made from it are animated GIFs too
+	Animated bool `json:"animated" bson:"animated"`
+
+	// Decoded from ImageFile when the template is loaded. Image is the first frame for animated templates
+	Image     image.Image `json:"-" bson:"-"`
+	Animation *gif.GIF    `json:"-" bson:"-"`
+}
@@ -1,6 +1,20 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The subscription a user is on. It decides which meme provider makes their memes
+type Plan string
+
+const (
+	PlanFree      Plan = "free"
+	PlanStandard  Plan = "standard"
+	PlanAIPremium Plan = "ai-premium"
+)
 
 type User struct {
 	ID              primitive.ObjectID `bson:"_id,omitempty"`
@@ -8,4 +22,35 @@ type User struct {
 	TokensRemaining int                `bson:"tokens_remaining"`
 	AuthKey         string             `bson:"auth_key"`
 	IsAdmin         bool               `bson:"is_admin"`
+	// Empty means free
+	Plan Plan `bson:"plan,omitempty"`
+	// When the plan lapses back to free. Nil plans never expire
+	PlanExpiresAt *time.Time `bson:"plan_expires_at,omitempty"`
+	// Holds the user's memes to the stricter safe mode content rules
+	SafeMode bool `bson:"safe_mode"`
+	// Tokens held for memes that are still being made. They've already come out of TokensRemaining
+	Reservations []TokenReservation `bson:"reservations,omitempty"`
+	// The Idempotency-Keys of the most recent credits, so a retried credit isn't applied twice
+	CreditKeys []string `bson:"credit_keys,omitempty" json:"-"`
+	// The seq of the user's latest ledger entry. Goes up in the same update as every balance change
+	LedgerSeq int `bson:"ledger_seq" json:"-"`
+}
+
+func ParsePlan(name string) (Plan, error) {
+	switch Plan(name) {
+	case PlanFree, PlanStandard, PlanAIPremium:
+		return Plan(name), nil
+	}
+	return "", fmt.Errorf("unknown plan: %s", name)
+}
+
+// The plan the user is on right now, which is free once their plan has expired
+func (u *User) ActivePlan(now time.Time) Plan {
+	if u.Plan == "" {
+		return PlanFree
+	}
+	if u.PlanExpiresAt != nil && !now.Before(*u.PlanExpiresAt) {
+		return PlanFree
+	}
+	return u.Plan
 }
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActivePlan_WhenNoPlan_IsFree(t *testing.T) {
+	user := &User{}
+	assert.Equal(t, PlanFree, user.ActivePlan(time.Now()))
+}
+
+func TestActivePlan_WhenPlanHasNotExpired_IsThePlan(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(time.Hour)
+	user := &User{Plan: PlanAIPremium, PlanExpiresAt: &expires}
+	assert.Equal(t, PlanAIPremium, user.ActivePlan(now))
+}
+
+func TestActivePlan_WhenPlanHasExpired_IsFree(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(-time.Hour)
+	user := &User{Plan: PlanAIPremium, PlanExpiresAt: &expires}
+	assert.Equal(t, PlanFree, user.ActivePlan(now))
+}
+
+func TestActivePlan_WhenPlanNeverExpires_IsThePlan(t *testing.T) {
+	user := &User{Plan: PlanStandard}
+	assert.Equal(t, PlanStandard, user.ActivePlan(time.Now().AddDate(100, 0, 0)))
+}
+
+func TestParsePlan_WhenUnknown_ReturnsError(t *testing.T) {
+	_, err := ParsePlan("platinum")
+	assert.NotNil(t, err)
+	plan, err := ParsePlan("ai-premium")
+	assert.Nil(t, err)
+	assert.Equal(t, PlanAIPremium, plan)
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A request the content policy turned away, kept so moderators can review what is being blocked
+type Violation struct {
+	ID primitive.ObjectID `json:"id" bson:"_id"`
+	// The object ID hex of the user who made the request
+	UserId   string     `json:"user_id" bson:"user_id"`
+	Params   MemeParams `json:"params" bson:"params"`
+	Field    string     `json:"field" bson:"field"`
+	Text     string     `json:"text" bson:"text"`
+	Rule     string     `json:"rule" bson:"rule"`
+	Category string     `json:"category" bson:"category"`
+	SafeMode bool       `json:"safe_mode" bson:"safe_mode"`
+	// Whether a meme was built before it was caught, in which case the provider wrote the text
+	AfterBuild bool      `json:"after_build" bson:"after_build"`
+	CreatedAt  time.Time `json:"created_at" bson:"created_at"`
+}
@@ -0,0 +1,221 @@
+package provider_chain
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	error_types "maas/error-types"
+	"maas/loggers"
+	meme_service "maas/meme-service"
+	"maas/models"
+)
+
+/*
+  Tries a list of providers in order until one of them makes the meme, so a failing AI or remote
+  provider falls back to something that still works. The meme comes back with the name of the
+  provider that actually made it.
+
+  Each provider sits behind a circuit breaker. After FailureThreshold failures in a row the
+  provider is skipped for CoolOff, after which a single request is let through to see whether it
+  has recovered. Only the provider's own failures count: a template it doesn't have moves on to the
+  next provider without tripping anything, and a caption that's too long ends the chain since no
+  provider will fit it either.
+*/
+
+const (
+	DefaultFailureThreshold = 3
+	DefaultCoolOff          = 30 * time.Second
+)
+
+var _ meme_service.MemeProvider = &Chain{}
+var _ meme_service.NamedProvider = &Chain{}
+var _ meme_service.CachingProvider = &Chain{}
+
+type Chain struct {
+	Links []*Link
+	// Consecutive failures that open a provider's breaker
+	FailureThreshold int
+	// How long an open breaker skips its provider
+	CoolOff time.Duration
+	// Optional. How long to wait on each provider before moving on. Zero waits as long as it takes
+	Timeout time.Duration
+
+	now func() time.Time
+}
+
+// A provider in the chain and the state of its breaker
+type Link struct {
+	Provider meme_service.MemeProvider
+	Name     string
+
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+	// Set while the one request allowed through a cooled off breaker is out
+	probing bool
+}
+
+func NewChain(providers ...meme_service.MemeProvider) *Chain {
+	links := []*Link{}
+	for _, provider := range providers {
+		links = append(links, &Link{Provider: provider, Name: meme_service.ProviderName(provider)})
+	}
+	return &Chain{
+		Links:            links,
+		FailureThreshold: DefaultFailureThreshold,
+		CoolOff:          DefaultCoolOff,
+		now:              time.Now,
+	}
+}
+
+func (c *Chain) WithBreaker(failureThreshold int, coolOff time.Duration) *Chain {
+	c.FailureThreshold = failureThreshold
+	c.CoolOff = coolOff
+	return c
+}
+
+func (c *Chain) WithTimeout(timeout time.Duration) *Chain {
+	c.Timeout = timeout
+	return c
+}
+
+// Named after the first provider, which is the one the chain is standing in for
+func (c *Chain) Name() string {
+	if len(c.Links) == 0 {
+		return "chain"
+	}
+	return c.Links[0].Name
+}
+
+func (c *Chain) BuildMeme(params *meme_service.QueryParams) (*models.Meme, error) {
+	var lastErr error
+	for _, link := range c.Links {
+		if !link.allow(c.now()) {
+			continue
+		}
+		meme, err := c.build(link, params)
+		if err == nil {
+			link.succeeded()
+			if meme.Provider == "" {
+				meme.Provider = link.Name
+			}
+			return meme, nil
+		}
+
+		switch err.(type) {
+		case *error_types.CaptionTooLongError:
+			link.released()
+			return nil, err
+		case *error_types.TemplateNotFoundError:
+			link.released()
+		default:
+			loggers.ErrorLog.Printf("Meme provider %s failed, falling back: %s\n", link.Name, err)
+			if link.failed(c.now(), c.FailureThreshold, c.CoolOff) {
+				loggers.ErrorLog.Printf("Meme provider %s failed %d times in a row, skipping it for %s\n", link.Name, c.FailureThreshold, c.CoolOff)
+			}
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = &error_types.ProviderError{Provider: c.Name(), Message: "every provider is cooling off"}
+	}
+	return nil, lastErr
+}
+
+// Builds the meme, giving up after the chain's timeout
+func (c *Chain) build(link *Link, params *meme_service.QueryParams) (*models.Meme, error) {
+	if c.Timeout <= 0 {
+		return link.Provider.BuildMeme(params)
+	}
+	type result struct {
+		meme *models.Meme
+		err  error
+	}
+	// Buffered so a provider that answers after the timeout doesn't block forever
+	results := make(chan result, 1)
+	go func() {
+		meme, err := link.Provider.BuildMeme(params)
+		results <- result{meme, err}
+	}()
+	timer := time.NewTimer(c.Timeout)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.meme, r.err
+	case <-timer.C:
+		return nil, &error_types.ProviderError{Provider: link.Name, Message: fmt.Sprintf("timed out after %s", c.Timeout)}
+	}
+}
+
+// Adds up the stats of every provider in the chain that caches
+func (c *Chain) CacheStats() meme_service.CacheStats {
+	total := meme_service.CacheStats{}
+	for _, link := range c.Links {
+		cache, ok := link.Provider.(meme_service.CachingProvider)
+		if !ok {
+			continue
+		}
+		stats := cache.CacheStats()
+		total.Hits += stats.Hits
+		total.MemoryHits += stats.MemoryHits
+		total.DiskHits += stats.DiskHits
+		total.Misses += stats.Misses
+		total.Entries += stats.Entries
+		total.Capacity += stats.Capacity
+	}
+	return total
+}
+
+// Whether the provider should be tried. Once the breaker's cool off is over one request is let
+// through, and the rest keep skipping it until that request has an answer
+func (l *Link) allow(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if now.Before(l.openUntil) {
+		return false
+	}
+	if l.openUntil.IsZero() {
+		return true
+	}
+	if l.probing {
+		return false
+	}
+	l.probing = true
+	return true
+}
+
+func (l *Link) succeeded() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.openUntil.IsZero() {
+		loggers.InfoLog.Printf("Meme provider %s has recovered\n", l.Name)
+	}
+	l.failures, l.openUntil, l.probing = 0, time.Time{}, false
+}
+
+// The provider turned the request down without failing, which says nothing about its health
+func (l *Link) released() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.probing = false
+}
+
+// Counts a failure and reports whether it opened the breaker
+func (l *Link) failed(now time.Time, threshold int, coolOff time.Duration) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.failures++
+	if l.probing || l.failures >= threshold {
+		l.openUntil, l.probing = now.Add(coolOff), false
+		return true
+	}
+	return false
+}
+
+// Whether the provider's breaker is currently skipping it
+func (l *Link) Open(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return now.Before(l.openUntil)
+}
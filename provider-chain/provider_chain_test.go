@@ -0,0 +1,208 @@
+package provider_chain
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	error_types "maas/error-types"
+	"maas/loggers"
+	meme_service "maas/meme-service"
+	"maas/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	loggers.SilentInit()
+	m.Run()
+}
+
+// Fails with err whenever it is set, and counts how often it is asked for a meme
+type MockProvider struct {
+	mutex sync.Mutex
+	name  string
+	err   error
+	delay time.Duration
+	calls int
+}
+
+func (m *MockProvider) BuildMeme(params *meme_service.QueryParams) (*models.Meme, error) {
+	m.mutex.Lock()
+	m.calls++
+	err, delay := m.err, m.delay
+	m.mutex.Unlock()
+	time.Sleep(delay)
+	if err != nil {
+		return nil, err
+	}
+	return &models.Meme{TopText: params.Query, BottomText: m.name}, nil
+}
+
+func (m *MockProvider) Name() string {
+	return m.name
+}
+
+func (m *MockProvider) setErr(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.err = err
+}
+
+func (m *MockProvider) callCount() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.calls
+}
+
+type MockCachingProvider struct {
+	MockProvider
+}
+
+func (m *MockCachingProvider) CacheStats() meme_service.CacheStats {
+	return meme_service.CacheStats{Hits: 1, Misses: 2, Entries: 3, Capacity: 10}
+}
+
+// A clock tests can move forward by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func testChain(providers ...meme_service.MemeProvider) (*Chain, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	chain := NewChain(providers...).WithBreaker(2, time.Minute)
+	chain.now = clock.Now
+	return chain, clock
+}
+
+var params = &meme_service.QueryParams{Query: "food"}
+
+func TestBuildMeme_WhenFirstProviderWorks_UsesIt(t *testing.T) {
+	ai, maker := &MockProvider{name: "ai"}, &MockProvider{name: "meme_maker"}
+	chain, _ := testChain(ai, maker)
+
+	meme, err := chain.BuildMeme(params)
+	assert.Nil(t, err)
+	assert.Equal(t, "ai", meme.Provider)
+	assert.Equal(t, 0, maker.callCount())
+}
+
+func TestBuildMeme_WhenFirstProviderFails_FallsBack(t *testing.T) {
+	ai, maker := &MockProvider{name: "ai", err: &error_types.ProviderError{Provider: "ai", Message: "down"}}, &MockProvider{name: "meme_maker"}
+	chain, _ := testChain(ai, maker)
+
+	meme, err := chain.BuildMeme(params)
+	assert.Nil(t, err)
+	assert.Equal(t, "meme_maker", meme.Provider)
+	assert.Equal(t, "meme_maker", meme.BottomText)
+}
+
+func TestBuildMeme_WhenEveryProviderFails_ReturnsLastError(t *testing.T) {
+	last := errors.New("last")
+	chain, _ := testChain(&MockProvider{name: "ai", err: errors.New("first")}, &MockProvider{name: "meme_maker", err: last})
+
+	meme, err := chain.BuildMeme(params)
+	assert.Nil(t, meme)
+	assert.Equal(t, last, err)
+}
+
+func TestBuildMeme_WhenCaptionIsTooLong_DoesNotFallBack(t *testing.T) {
+	ai, maker := &MockProvider{name: "ai", err: &error_types.CaptionTooLongError{Text: "food"}}, &MockProvider{name: "meme_maker"}
+	chain, _ := testChain(ai, maker)
+
+	_, err := chain.BuildMeme(params)
+	assert.IsType(t, &error_types.CaptionTooLongError{}, err)
+	assert.Equal(t, 0, maker.callCount())
+}
+
+func TestBuildMeme_WhenTemplateIsMissing_FallsBackWithoutTrippingBreaker(t *testing.T) {
+	imgflip, maker := &MockProvider{name: "imgflip", err: &error_types.TemplateNotFoundError{ID: "lunch-break"}}, &MockProvider{name: "meme_maker"}
+	chain, clock := testChain(imgflip, maker)
+
+	for i := 0; i < 3; i++ {
+		meme, err := chain.BuildMeme(params)
+		assert.Nil(t, err)
+		assert.Equal(t, "meme_maker", meme.Provider)
+	}
+	assert.Equal(t, 3, imgflip.callCount())
+	assert.False(t, chain.Links[0].Open(clock.now))
+}
+
+func TestBuildMeme_WhenProviderKeepsFailing_StopsCallingItUntilCoolOffIsOver(t *testing.T) {
+	ai, maker := &MockProvider{name: "ai", err: errors.New("down")}, &MockProvider{name: "meme_maker"}
+	chain, clock := testChain(ai, maker)
+
+	chain.BuildMeme(params)
+	chain.BuildMeme(params)
+	assert.True(t, chain.Links[0].Open(clock.now))
+	chain.BuildMeme(params)
+	assert.Equal(t, 2, ai.callCount())
+
+	clock.now = clock.now.Add(time.Minute)
+	ai.setErr(nil)
+	meme, err := chain.BuildMeme(params)
+	assert.Nil(t, err)
+	assert.Equal(t, "ai", meme.Provider)
+	assert.Equal(t, 3, ai.callCount())
+	assert.False(t, chain.Links[0].Open(clock.now))
+}
+
+func TestBuildMeme_WhenProviderFailsAfterCoolOff_OpensAgainStraightAway(t *testing.T) {
+	ai, maker := &MockProvider{name: "ai", err: errors.New("down")}, &MockProvider{name: "meme_maker"}
+	chain, clock := testChain(ai, maker)
+
+	chain.BuildMeme(params)
+	chain.BuildMeme(params)
+	clock.now = clock.now.Add(time.Minute)
+	chain.BuildMeme(params)
+	assert.Equal(t, 3, ai.callCount())
+	assert.True(t, chain.Links[0].Open(clock.now))
+}
+
+func TestBuildMeme_WhenAFailureIsFollowedBySuccess_ResetsTheCount(t *testing.T) {
+	ai := &MockProvider{name: "ai", err: errors.New("down")}
+	chain, clock := testChain(ai, &MockProvider{name: "meme_maker"})
+
+	chain.BuildMeme(params)
+	ai.setErr(nil)
+	chain.BuildMeme(params)
+	ai.setErr(errors.New("down"))
+	chain.BuildMeme(params)
+	assert.False(t, chain.Links[0].Open(clock.now))
+}
+
+func TestBuildMeme_WhenEveryProviderIsCoolingOff_ReturnsProviderError(t *testing.T) {
+	ai := &MockProvider{name: "ai", err: errors.New("down")}
+	chain, _ := testChain(ai)
+
+	chain.BuildMeme(params)
+	chain.BuildMeme(params)
+	_, err := chain.BuildMeme(params)
+	assert.IsType(t, &error_types.ProviderError{}, err)
+	assert.Equal(t, 2, ai.callCount())
+}
+
+func TestBuildMeme_WhenProviderIsTooSlow_FallsBack(t *testing.T) {
+	ai, maker := &MockProvider{name: "ai", delay: 200 * time.Millisecond}, &MockProvider{name: "meme_maker"}
+	chain, _ := testChain(ai, maker)
+	chain.WithTimeout(20 * time.Millisecond)
+
+	meme, err := chain.BuildMeme(params)
+	assert.Nil(t, err)
+	assert.Equal(t, "meme_maker", meme.Provider)
+}
+
+func TestCacheStats_AddsUpCachingProviders(t *testing.T) {
+	chain, _ := testChain(&MockCachingProvider{}, &MockProvider{}, &MockCachingProvider{})
+	assert.Equal(t, meme_service.CacheStats{Hits: 2, Misses: 4, Entries: 6, Capacity: 20}, chain.CacheStats())
+}
+
+func TestName_IsTheFirstProvidersName(t *testing.T) {
+	chain, _ := testChain(&MockProvider{name: "ai"}, &MockProvider{name: "meme_maker"})
+	assert.Equal(t, "ai", chain.Name())
+}
@@ -0,0 +1,45 @@
+package request_ids
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+  Gives every request an ID, so things like ledger entries can be traced back to the request that
+  caused them. Callers can send their own X-Request-Id, and either way it comes back on the response.
+  Also reads the Idempotency-Key callers send so a retry isn't applied twice.
+*/
+
+const Header = "X-Request-Id"
+
+// Longer IDs from callers are replaced rather than stored
+const MaxLength = 128
+
+// Sent by callers that want a retried request to be applied only once
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Longer idempotency keys are turned away rather than stored
+const MaxIdempotencyKeyLength = 255
+
+// Keeps the caller's X-Request-Id when they sent one, or makes one up, and sends it back with the response
+func Middleware(ginContext *gin.Context) {
+	id := ginContext.GetHeader(Header)
+	if id == "" || len(id) > MaxLength {
+		id = primitive.NewObjectID().Hex()
+		ginContext.Request.Header.Set(Header, id)
+	}
+	ginContext.Header(Header, id)
+	ginContext.Next()
+}
+
+// The request's ID. Empty when the middleware isn't in use
+func Of(ginContext *gin.Context) string {
+	return ginContext.GetHeader(Header)
+}
+
+// The request's Idempotency-Key, and whether it's usable. Empty with ok set when there isn't one
+func IdempotencyKey(ginContext *gin.Context) (key string, ok bool) {
+	key = ginContext.GetHeader(IdempotencyKeyHeader)
+	return key, len(key) <= MaxIdempotencyKeyLength
+}
@@ -0,0 +1,56 @@
+package request_ids
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func performRequest(requestId string) (*httptest.ResponseRecorder, string) {
+	seen := ""
+	router := gin.New()
+	router.Use(Middleware)
+	router.GET("/", func(ginContext *gin.Context) {
+		seen = Of(ginContext)
+	})
+	req, _ := http.NewRequest("GET", "/", nil)
+	if requestId != "" {
+		req.Header.Set(Header, requestId)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder, seen
+}
+
+func TestMiddleware_WhenCallerSendsAnId_KeepsIt(t *testing.T) {
+	recorder, seen := performRequest("retry-42")
+	assert.Equal(t, "retry-42", seen)
+	assert.Equal(t, "retry-42", recorder.Header().Get(Header))
+}
+
+func TestMiddleware_WhenCallerSendsNoId_MakesOneUp(t *testing.T) {
+	recorder, seen := performRequest("")
+	assert.Len(t, seen, 24)
+	assert.Equal(t, seen, recorder.Header().Get(Header))
+}
+
+func TestMiddleware_WhenIdIsTooLong_ReplacesIt(t *testing.T) {
+	recorder, seen := performRequest(strings.Repeat("a", MaxLength+1))
+	assert.Len(t, seen, 24)
+	assert.Equal(t, seen, recorder.Header().Get(Header))
+}
+
+func TestIdempotencyKey_WhenTooLong_IsNotUsable(t *testing.T) {
+	ginContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ginContext.Request, _ = http.NewRequest("GET", "/", nil)
+	_, ok := IdempotencyKey(ginContext)
+	assert.True(t, ok, "no key at all is fine")
+
+	ginContext.Request.Header.Set(IdempotencyKeyHeader, strings.Repeat("k", MaxIdempotencyKeyLength+1))
+	_, ok = IdempotencyKey(ginContext)
+	assert.False(t, ok)
+}
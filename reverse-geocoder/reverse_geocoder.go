@@ -0,0 +1,181 @@
+package reverse_geocoder
+
+import (
+	"bufio"
+	"embed"
+	"fmt"
+	"io/fs"
+	"math"
+	"strconv"
+	"strings"
+
+	error_types "maas/error-types"
+	meme_maker "maas/meme-maker"
+	"maas/models"
+)
+
+/*
+  Turns coordinates into a place without calling out to anything over the network.
+  The bundled data is a trimmed down take on the GeoNames cities and features dumps:
+    places.tsv:    name, latitude, longitude, feature class, feature code, country code, region, population
+    countries.tsv: country code, country name
+  Feature class P (populated places) are treated as cities, everything else as nearby features.
+*/
+
+const (
+	placesFile    = "places.tsv"
+	countriesFile = "countries.tsv"
+
+	populatedPlaceClass = "P"
+	earthRadiusKm       = 6371.0
+
+	DefaultMaxCityDistanceKm    = 150
+	DefaultMaxFeatureDistanceKm = 5
+)
+
+//go:embed data
+var data embed.FS
+
+var _ meme_maker.Geocoder = &ReverseGeocoder{}
+
+type entry struct {
+	name        string
+	lat         float64
+	lon         float64
+	countryCode string
+	region      string
+}
+
+type ReverseGeocoder struct {
+	cities    []entry
+	features  []entry
+	countries map[string]string
+
+	// Coordinates further than this from every city don't resolve to a place
+	MaxCityDistanceKm float64
+	// Features further than this are left off the place
+	MaxFeatureDistanceKm float64
+}
+
+// Loads the dataset bundled with the binary
+func Default() (*ReverseGeocoder, error) {
+	dataFS, err := fs.Sub(data, "data")
+	if err != nil {
+		return nil, err
+	}
+	return LoadFS(dataFS)
+}
+
+func LoadFS(fsys fs.FS) (*ReverseGeocoder, error) {
+	countries, err := loadCountries(fsys)
+	if err != nil {
+		return nil, err
+	}
+	geocoder := &ReverseGeocoder{
+		countries:            countries,
+		MaxCityDistanceKm:    DefaultMaxCityDistanceKm,
+		MaxFeatureDistanceKm: DefaultMaxFeatureDistanceKm,
+	}
+
+	err = readRows(fsys, placesFile, 8, func(fields []string) error {
+		lat, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return err
+		}
+		lon, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return err
+		}
+		place := entry{name: fields[0], lat: lat, lon: lon, countryCode: fields[5], region: fields[6]}
+		if fields[3] == populatedPlaceClass {
+			geocoder.cities = append(geocoder.cities, place)
+		} else {
+			geocoder.features = append(geocoder.features, place)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return geocoder, nil
+}
+
+func loadCountries(fsys fs.FS) (map[string]string, error) {
+	countries := map[string]string{}
+	err := readRows(fsys, countriesFile, 2, func(fields []string) error {
+		countries[fields[0]] = fields[1]
+		return nil
+	})
+	return countries, err
+}
+
+// Calls handleRow for every tab separated row, skipping blank lines and # comments
+func readRows(fsys fs.FS, name string, columns int, handleRow func(fields []string) error) error {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != columns {
+			return fmt.Errorf("%s line %d: expected %d columns, found %d", name, lineNumber, columns, len(fields))
+		}
+		if err := handleRow(fields); err != nil {
+			return fmt.Errorf("%s line %d: %w", name, lineNumber, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Resolves the closest city and, if there is one close enough, the closest feature
+func (g *ReverseGeocoder) ReverseGeocode(lat float64, lon float64) (*models.Place, error) {
+	city, distance := nearest(g.cities, lat, lon)
+	if city == nil || distance > g.MaxCityDistanceKm {
+		return nil, &error_types.PlaceNotFoundError{Lat: lat, Lon: lon}
+	}
+
+	place := &models.Place{
+		City:        city.name,
+		Region:      city.region,
+		Country:     g.countries[city.countryCode],
+		CountryCode: city.countryCode,
+	}
+	feature, distance := nearest(g.features, lat, lon)
+	if feature != nil && distance <= g.MaxFeatureDistanceKm {
+		place.Feature = feature.name
+	}
+	return place, nil
+}
+
+// A linear scan is plenty fast for a few hundred entries
+func nearest(entries []entry, lat float64, lon float64) (*entry, float64) {
+	var closest *entry
+	closestDistance := math.Inf(1)
+	for i := range entries {
+		distance := haversineKm(lat, lon, entries[i].lat, entries[i].lon)
+		if distance < closestDistance {
+			closest = &entries[i]
+			closestDistance = distance
+		}
+	}
+	return closest, closestDistance
+}
+
+// Great circle distance between two points
+func haversineKm(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	toRadians := math.Pi / 180
+	dLat := (lat2 - lat1) * toRadians
+	dLon := (lon2 - lon1) * toRadians
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRadians)*math.Cos(lat2*toRadians)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
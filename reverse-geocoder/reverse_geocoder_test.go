@@ -0,0 +1,106 @@
+package reverse_geocoder
+
+import (
+	"testing"
+	"testing/fstest"
+
+	error_types "maas/error-types"
+	"maas/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var geocoder *ReverseGeocoder
+
+func TestMain(m *testing.M) {
+	var err error
+	geocoder, err = Default()
+	if err != nil {
+		panic(err)
+	}
+	m.Run()
+}
+
+// The example from the readme
+func TestReverseGeocode_WithReadmeExample_ResolvesLongIslandCity(t *testing.T) {
+	place, err := geocoder.ReverseGeocode(40.730610, -73.935242)
+	assert.Nil(t, err)
+	assert.Equal(t, &models.Place{
+		City:        "Long Island City",
+		Region:      "New York",
+		Country:     "United States",
+		CountryCode: "US",
+		Feature:     "Newtown Creek",
+	}, place)
+}
+
+func TestReverseGeocode_WhenNoFeatureIsClose_LeavesFeatureEmpty(t *testing.T) {
+	// Just outside Denver
+	place, err := geocoder.ReverseGeocode(39.7, -105.1)
+	assert.Nil(t, err)
+	assert.Equal(t, "Denver", place.City)
+	assert.Equal(t, "Colorado", place.Region)
+	assert.Equal(t, "", place.Feature)
+}
+
+func TestReverseGeocode_WorksAcrossHemispheres(t *testing.T) {
+	place, err := geocoder.ReverseGeocode(-33.857, 151.215)
+	assert.Nil(t, err)
+	assert.Equal(t, "Sydney", place.City)
+	assert.Equal(t, "Australia", place.Country)
+	assert.Equal(t, "Sydney Opera House", place.Feature)
+}
+
+func TestReverseGeocode_WhenNothingIsNearby_RaisesPlaceNotFound(t *testing.T) {
+	// Middle of the Pacific
+	place, err := geocoder.ReverseGeocode(0, -140)
+	assert.Nil(t, place)
+	assert.IsType(t, &error_types.PlaceNotFoundError{}, err)
+}
+
+func TestLoadFS_WithFixtureData_UsesFixtures(t *testing.T) {
+	fsys := fstest.MapFS{
+		"countries.tsv": {Data: []byte("# comment\nXX\tExampleland\n")},
+		"places.tsv": {Data: []byte("Testville\t10\t10\tP\tPPL\tXX\tTest Region\t100\n" +
+			"\n" +
+			"Test Pond\t10.01\t10.01\tH\tPND\tXX\tTest Region\t0\n")},
+	}
+	fixtureGeocoder, err := LoadFS(fsys)
+	assert.Nil(t, err)
+
+	place, err := fixtureGeocoder.ReverseGeocode(10.02, 10.02)
+	assert.Nil(t, err)
+	assert.Equal(t, &models.Place{
+		City:        "Testville",
+		Region:      "Test Region",
+		Country:     "Exampleland",
+		CountryCode: "XX",
+		Feature:     "Test Pond",
+	}, place)
+}
+
+func TestLoadFS_WithBadRow_RaisesAnError(t *testing.T) {
+	fsys := fstest.MapFS{
+		"countries.tsv": {Data: []byte("XX\tExampleland\n")},
+		"places.tsv":    {Data: []byte("Testville\tnorth\t10\tP\tPPL\tXX\tTest Region\t100\n")},
+	}
+	fixtureGeocoder, err := LoadFS(fsys)
+	assert.Nil(t, fixtureGeocoder)
+	assert.ErrorContains(t, err, "places.tsv line 1")
+}
+
+func TestLoadFS_WithMissingColumns_RaisesAnError(t *testing.T) {
+	fsys := fstest.MapFS{
+		"countries.tsv": {Data: []byte("XX\n")},
+		"places.tsv":    {Data: []byte("")},
+	}
+	fixtureGeocoder, err := LoadFS(fsys)
+	assert.Nil(t, fixtureGeocoder)
+	assert.ErrorContains(t, err, "expected 2 columns")
+}
+
+func TestHaversineKm_MatchesKnownDistance(t *testing.T) {
+	// New York to London is roughly 5570km
+	distance := haversineKm(40.71427, -74.00597, 51.50853, -0.12574)
+	assert.InDelta(t, 5570, distance, 10)
+}
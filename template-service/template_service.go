@@ -0,0 +1,82 @@
+package template_service
+
+import (
+	auth_service "maas/auth-service"
+	error_types "maas/error-types"
+	"maas/loggers"
+	"maas/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type TemplateRepository interface {
+	AllTemplates() []models.Template
+	Template(id string) (*models.Template, error)
+}
+
+type TemplateService struct {
+	Repo TemplateRepository
+	Auth auth_service.AuthService
+}
+
+func NewTemplateService(repo TemplateRepository, auth auth_service.AuthService) *TemplateService {
+	return &TemplateService{
+		Repo: repo,
+		Auth: auth,
+	}
+}
+
+// GETs every template a meme can be made from. Any authenticated user can browse them
+func (s *TemplateService) AllTemplates(ginContext *gin.Context) {
+	err := s.requireAuthenticated(ginContext)
+	if err != nil {
+		return
+	}
+	ginContext.IndentedJSON(http.StatusOK, s.Repo.AllTemplates())
+}
+
+// GETs a single template by ID
+func (s *TemplateService) TemplateById(ginContext *gin.Context) {
+	err := s.requireAuthenticated(ginContext)
+	if err != nil {
+		return
+	}
+
+	template, err := s.Repo.Template(ginContext.Param("id"))
+	if err != nil {
+		loggers.ErrorLog.Printf("Error getting template:\n%s", err.Error())
+		ginContext.IndentedJSON(http.StatusNotFound, "template not found")
+		return
+	}
+	ginContext.IndentedJSON(http.StatusOK, template)
+}
+
+func (s *TemplateService) requireAuthenticated(ginContext *gin.Context) error {
+	authHeader := ginContext.Request.Header.Get("auth")
+	isAuthenticated, err := s.Auth.IsAuthenticated(authHeader)
+	if err != nil {
+		authResponse(err, ginContext)
+		return err
+	}
+	if isAuthenticated {
+		return nil
+	}
+	err = &error_types.UserNotFoundError{}
+	authResponse(err, ginContext)
+	return err
+}
+
+func authResponse(err error, ginContext *gin.Context) {
+	switch err.(type) {
+	default:
+		loggers.ErrorLog.Printf("Encountered an error during authentication: %s", err.Error())
+		ginContext.IndentedJSON(http.StatusForbidden, "forbidden")
+	case *error_types.NoAuthHeaderError:
+		loggers.ErrorLog.Print(err.Error())
+		ginContext.IndentedJSON(http.StatusUnauthorized, "unauthorized")
+	case *error_types.AuthUserNotFoundError:
+		loggers.ErrorLog.Print(err.Error())
+		ginContext.IndentedJSON(http.StatusForbidden, "forbidden")
+	}
+}
@@ -0,0 +1,147 @@
+package template_service
+
+import (
+	"encoding/json"
+	"errors"
+	auth_service "maas/auth-service"
+	error_types "maas/error-types"
+	"maas/loggers"
+	"maas/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	authService     auth_service.AuthService
+	templateService TemplateService
+
+	defaultUser = &models.User{
+		UserId:          "Danny Default",
+		TokensRemaining: 1000,
+		IsAdmin:         false,
+		AuthKey:         "Danny-Password",
+	}
+
+	allTemplates = []models.Template{
+		{
+			ID:        "classic",
+			Name:      "Classic",
+			Tags:      []string{"classic"},
+			ImageFile: "classic.png",
+			TopBox:    models.CaptionBox{X: 1, Y: 1, Width: 10, Height: 10},
+			BottomBox: models.CaptionBox{X: 1, Y: 20, Width: 10, Height: 10},
+		}, {
+			ID:        "lunch-break",
+			Name:      "Lunch Break",
+			Tags:      []string{"food"},
+			ImageFile: "lunch-break.png",
+		},
+	}
+)
+
+type MockUserRepository struct{}
+
+func (m *MockUserRepository) UserByAuthHeader(auth string) (*models.User, error) {
+	if auth == "MISSING" {
+		return nil, &error_types.AuthUserNotFoundError{}
+	} else if auth == "THROW" {
+		return nil, errors.New("TEST")
+	}
+	return defaultUser, nil
+}
+
+type MockTemplateRepository struct{}
+
+func (m *MockTemplateRepository) AllTemplates() []models.Template {
+	return allTemplates
+}
+
+func (m *MockTemplateRepository) Template(id string) (*models.Template, error) {
+	for _, template := range allTemplates {
+		if template.ID == id {
+			return &template, nil
+		}
+	}
+	return nil, &error_types.TemplateNotFoundError{ID: id}
+}
+
+func TestMain(m *testing.M) {
+	loggers.SilentInit()
+	authService = *auth_service.NewAuthService(&MockUserRepository{})
+	templateService = *NewTemplateService(&MockTemplateRepository{}, authService)
+	m.Run()
+}
+
+func testRouter(templateService TemplateService) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.GET("/templates", templateService.AllTemplates)
+	router.GET("/templates/:id", templateService.TemplateById)
+	return router
+}
+
+func performRequest(r http.Handler, method string, path string, authHeader string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, nil)
+	req.Header.Set("auth", authHeader)
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestAllTemplates_WhenAuthenticated_ReturnsTemplates(t *testing.T) {
+	router := testRouter(templateService)
+	recorder := performRequest(router, "GET", "/templates", "DEFAULT")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response []models.Template
+	err := json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Nil(t, err)
+	assert.Equal(t, allTemplates, response)
+}
+
+func TestAllTemplates_WhenAuthHeaderIsNotProvided_RaisesUnauthorized(t *testing.T) {
+	router := testRouter(templateService)
+	recorder := performRequest(router, "GET", "/templates", "")
+
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, "\"unauthorized\"", recorder.Body.String())
+}
+
+func TestAllTemplates_WhenAuthHeaderDoesNotMatchAUser_RaisesForbidden(t *testing.T) {
+	router := testRouter(templateService)
+	recorder := performRequest(router, "GET", "/templates", "MISSING")
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, "\"forbidden\"", recorder.Body.String())
+}
+
+func TestTemplateById_WhenTemplateExists_ReturnsTemplate(t *testing.T) {
+	router := testRouter(templateService)
+	recorder := performRequest(router, "GET", "/templates/lunch-break", "DEFAULT")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response models.Template
+	err := json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Nil(t, err)
+	assert.Equal(t, allTemplates[1], response)
+}
+
+func TestTemplateById_WhenTemplateIsMissing_RaisesNotFound(t *testing.T) {
+	router := testRouter(templateService)
+	recorder := performRequest(router, "GET", "/templates/missing", "DEFAULT")
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "\"template not found\"", recorder.Body.String())
+}
+
+func TestTemplateById_WhenAuthThrowsUnknownError_RaisesForbidden(t *testing.T) {
+	router := testRouter(templateService)
+	recorder := performRequest(router, "GET", "/templates/classic", "THROW")
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, "\"forbidden\"", recorder.Body.String())
+}
@@ -0,0 +1,175 @@
+package user_db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	error_types "maas/error-types"
+	"maas/loggers"
+	meme_service "maas/meme-service"
+	"maas/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How long responses are replayed for by default
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// Keeps the first response to each caller's Idempotency-Key in the maas_idempotency collection, so a
+// client retrying a request that timed out gets the meme it already paid for instead of paying again,
+// whichever instance the retry lands on. A key is claimed when its first request starts, and retries
+// that arrive before it's answered are turned away rather than run alongside it. A TTL index on
+// expires_at clears out answered keys after TTL, and claims whose request never answered, say after a
+// crash, once ClaimTimeout is up
+type MongoDBIdempotencyStore struct {
+	client *mongo.Client
+	ctx    *context.Context
+	// How long responses are replayed for
+	TTL time.Duration
+	// How long a claim holds its key without an answer. Matches the reservation the request holds
+	ClaimTimeout time.Duration
+
+	now func() time.Time
+}
+
+var _ meme_service.IdempotencyStore = &MongoDBIdempotencyStore{}
+
+// A claim or stored response, under an _id made from the caller and the key
+type idempotencyRecord struct {
+	ID                    string `bson:"_id"`
+	models.StoredResponse `bson:",inline"`
+}
+
+func NewMongoDBIdempotencyStore(client *mongo.Client, ctx *context.Context) *MongoDBIdempotencyStore {
+	return &MongoDBIdempotencyStore{
+		client:       client,
+		ctx:          ctx,
+		TTL:          DefaultIdempotencyTTL,
+		ClaimTimeout: meme_service.DefaultReservationTimeout,
+		now:          time.Now,
+	}
+}
+
+func (m *MongoDBIdempotencyStore) WithTTL(ttl time.Duration) *MongoDBIdempotencyStore {
+	m.TTL = ttl
+	return m
+}
+
+func (m *MongoDBIdempotencyStore) WithClaimTimeout(timeout time.Duration) *MongoDBIdempotencyStore {
+	m.ClaimTimeout = timeout
+	return m
+}
+
+// Claims the key by inserting it, so of two requests racing for one only the first insert succeeds
+func (m *MongoDBIdempotencyStore) Begin(caller string, key string, fingerprint string) (*models.StoredResponse, error) {
+	database := m.client.Database("maas")
+	maas_idempotency_collection := database.Collection("maas_idempotency")
+
+	now := m.now().UTC()
+	claim := &idempotencyRecord{
+		ID: idempotencyId(caller, key),
+		StoredResponse: models.StoredResponse{
+			Key:         key,
+			Caller:      caller,
+			Fingerprint: fingerprint,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(m.ClaimTimeout),
+		},
+	}
+	claimed, err := m.claim(claim)
+	if err != nil || claimed {
+		return nil, err
+	}
+
+	var existing idempotencyRecord
+
+	err = maas_idempotency_collection.FindOne(*m.ctx, bson.M{"_id": claim.ID}).Decode(&existing)
+	if err != nil {
+		// Given up between the insert and the lookup, which a retry will find free
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, &error_types.IdempotencyKeyInUseError{Key: key}
+		}
+		return nil, err
+	}
+	if !now.Before(existing.ExpiresAt) {
+		// Expired, but the TTL monitor only runs every minute or so
+		filter := bson.M{"_id": claim.ID, "expires_at": existing.ExpiresAt}
+		if _, err := maas_idempotency_collection.DeleteOne(*m.ctx, filter); err != nil {
+			return nil, err
+		}
+		claimed, err := m.claim(claim)
+		if err != nil || claimed {
+			return nil, err
+		}
+		return nil, &error_types.IdempotencyKeyInUseError{Key: key}
+	}
+	if existing.Fingerprint != fingerprint {
+		return nil, &error_types.IdempotencyKeyReusedError{Key: key}
+	}
+	if existing.Status == 0 {
+		return nil, &error_types.IdempotencyKeyInUseError{Key: key}
+	}
+	return &existing.StoredResponse, nil
+}
+
+// Reports whether the claim went in, and false without an error when the key was already taken
+func (m *MongoDBIdempotencyStore) claim(claim *idempotencyRecord) (bool, error) {
+	database := m.client.Database("maas")
+	maas_idempotency_collection := database.Collection("maas_idempotency")
+
+	_, err := maas_idempotency_collection.InsertOne(*m.ctx, claim)
+	if err == nil {
+		return true, nil
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// Stores the response in place of the claim. Upserts, so the response is still kept when the claim
+// ran out first. A failure is only logged: the caller already has their response, and a retry is
+// charged again the same as if they'd sent no key
+func (m *MongoDBIdempotencyStore) Complete(response *models.StoredResponse) {
+	database := m.client.Database("maas")
+	maas_idempotency_collection := database.Collection("maas_idempotency")
+
+	stored := &idempotencyRecord{ID: idempotencyId(response.Caller, response.Key), StoredResponse: *response}
+	stored.CreatedAt = m.now().UTC()
+	stored.ExpiresAt = stored.CreatedAt.Add(m.TTL)
+	opts := options.Replace().SetUpsert(true)
+	if _, err := maas_idempotency_collection.ReplaceOne(*m.ctx, bson.M{"_id": stored.ID}, stored, opts); err != nil {
+		loggers.ErrorLog.Printf("Encountered an error storing the response for idempotency key %s: %s\n", response.Key, err)
+	}
+}
+
+// Only removes a claim that hasn't been answered. When this fails the key stays claimed until
+// ClaimTimeout is up
+func (m *MongoDBIdempotencyStore) Abandon(caller string, key string) {
+	database := m.client.Database("maas")
+	maas_idempotency_collection := database.Collection("maas_idempotency")
+
+	filter := bson.M{"_id": idempotencyId(caller, key), "status": 0}
+	if _, err := maas_idempotency_collection.DeleteOne(*m.ctx, filter); err != nil {
+		loggers.ErrorLog.Printf("Encountered an error giving up idempotency key %s: %s\n", key, err)
+	}
+}
+
+// Has Mongo delete keys once they expire
+func (m *MongoDBIdempotencyStore) EnsureIndexes() error {
+	database := m.client.Database("maas")
+	maas_idempotency_collection := database.Collection("maas_idempotency")
+
+	_, err := maas_idempotency_collection.Indexes().CreateOne(*m.ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+func idempotencyId(caller string, key string) string {
+	return caller + " " + key
+}
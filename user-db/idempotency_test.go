@@ -0,0 +1,118 @@
+package user_db_test
+
+import (
+	"net/http"
+	"testing"
+
+	error_types "maas/error-types"
+	"maas/models"
+	user_db "maas/user-db"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Starts each test with no keys
+func idempotencyStore(t *testing.T) *user_db.MongoDBIdempotencyStore {
+	_, err := database.Collection("maas_idempotency").DeleteMany(ctx, bson.M{})
+	assert.Nil(t, err)
+	store := user_db.NewMongoDBIdempotencyStore(usersClient, &ctx)
+	assert.Nil(t, store.EnsureIndexes())
+	return store
+}
+
+func answered(caller string, key string, fingerprint string) *models.StoredResponse {
+	return &models.StoredResponse{Key: key, Caller: caller, Fingerprint: fingerprint, Status: http.StatusOK, Body: []byte("meme"), Cost: 1}
+}
+
+func TestIdempotencyBegin_AfterComplete_ReturnsTheStoredResponse(t *testing.T) {
+	store := idempotencyStore(t)
+	stored, err := store.Begin("alice", "key", "params")
+	assert.Nil(t, stored)
+	assert.Nil(t, err)
+	store.Complete(answered("alice", "key", "params"))
+
+	stored, err = store.Begin("alice", "key", "params")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("meme"), stored.Body)
+	assert.Equal(t, 1, stored.Cost)
+	assert.Equal(t, user_db.DefaultIdempotencyTTL, stored.ExpiresAt.Sub(stored.CreatedAt))
+}
+
+func TestIdempotencyBegin_WithDifferentParams_RaisesReused(t *testing.T) {
+	store := idempotencyStore(t)
+	store.Begin("alice", "key", "params")
+	store.Complete(answered("alice", "key", "params"))
+
+	_, err := store.Begin("alice", "key", "other params")
+	assert.IsType(t, &error_types.IdempotencyKeyReusedError{}, err)
+}
+
+func TestIdempotencyBegin_WhileStillInProgress_RaisesInUse(t *testing.T) {
+	store := idempotencyStore(t)
+	store.Begin("alice", "key", "params")
+
+	_, err := store.Begin("alice", "key", "params")
+	assert.IsType(t, &error_types.IdempotencyKeyInUseError{}, err)
+}
+
+func TestIdempotencyBegin_FromAnotherInstance_SeesTheSameKeys(t *testing.T) {
+	store := idempotencyStore(t)
+	store.Begin("alice", "key", "params")
+	store.Complete(answered("alice", "key", "params"))
+
+	other := user_db.NewMongoDBIdempotencyStore(usersClient, &ctx)
+	stored, err := other.Begin("alice", "key", "params")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("meme"), stored.Body)
+}
+
+func TestIdempotencyBegin_ForAnotherCaller_ClaimsTheirOwnKey(t *testing.T) {
+	store := idempotencyStore(t)
+	store.Begin("alice", "key", "params")
+	store.Complete(answered("alice", "key", "params"))
+
+	stored, err := store.Begin("bob", "key", "other params")
+	assert.Nil(t, stored)
+	assert.Nil(t, err)
+}
+
+func TestIdempotencyAbandon_LetsTheKeyBeTriedAgain(t *testing.T) {
+	store := idempotencyStore(t)
+	store.Begin("alice", "key", "params")
+	store.Abandon("alice", "key")
+
+	stored, err := store.Begin("alice", "key", "other params")
+	assert.Nil(t, stored)
+	assert.Nil(t, err)
+}
+
+func TestIdempotencyAbandon_AfterComplete_KeepsTheResponse(t *testing.T) {
+	store := idempotencyStore(t)
+	store.Begin("alice", "key", "params")
+	store.Complete(answered("alice", "key", "params"))
+	store.Abandon("alice", "key")
+
+	stored, err := store.Begin("alice", "key", "params")
+	assert.Nil(t, err)
+	assert.NotNil(t, stored)
+}
+
+func TestIdempotencyBegin_AfterTTL_ForgetsTheResponse(t *testing.T) {
+	store := idempotencyStore(t).WithTTL(0)
+	store.Begin("alice", "key", "params")
+	store.Complete(answered("alice", "key", "params"))
+
+	stored, err := store.Begin("alice", "key", "params")
+	assert.Nil(t, stored)
+	assert.Nil(t, err)
+}
+
+func TestIdempotencyBegin_AfterAClaimTimesOut_ClaimsItAgain(t *testing.T) {
+	store := idempotencyStore(t).WithClaimTimeout(0)
+	store.Begin("alice", "key", "params")
+
+	stored, err := store.Begin("alice", "key", "params")
+	assert.Nil(t, stored)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,236 @@
+package user_db
+
+import (
+	"errors"
+	"time"
+
+	error_types "maas/error-types"
+	"maas/loggers"
+	"maas/models"
+	user_service "maas/user-service"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var _ user_service.LedgerRepository = &MongoDBUserRepository{}
+
+// Adds an entry to maas_ledger for a balance change that has already been made. The change can't be
+// undone by then, so a failure here is logged with everything needed to backfill the entry rather
+// than failing the request
+func (m *MongoDBUserRepository) appendLedger(entry *models.LedgerEntry) {
+	database := m.client.Database("maas")
+	maas_ledger_collection := database.Collection("maas_ledger")
+
+	if entry.ID.IsZero() {
+		entry.ID = primitive.NewObjectID()
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().UTC()
+	}
+	if _, err := maas_ledger_collection.InsertOne(*m.ctx, entry); err != nil {
+		loggers.ErrorLog.Printf("Encountered an error recording a ledger entry: %s. Entry: %+v\n", err, *entry)
+	}
+}
+
+// Entry 0 of a new user's ledger. It's written even for an empty balance, so a rebuild can tell a
+// user with no opening entry from one whose entry went missing
+func (m *MongoDBUserRepository) openingBalance(user *models.User, change models.BalanceChange) {
+	reason := change.Reason
+	if reason == "" {
+		reason = "opening balance"
+	}
+	m.appendLedger(&models.LedgerEntry{
+		UserId:    user.ID.Hex(),
+		Seq:       0,
+		Kind:      models.LedgerAdjustment,
+		Amount:    user.TokensRemaining,
+		Balance:   user.TokensRemaining,
+		Actor:     change.Actor,
+		Reason:    reason,
+		RequestId: change.RequestId,
+	})
+}
+
+// Newest first. When before is set the page starts with the entry after it
+func (m *MongoDBUserRepository) LedgerByUser(userId string, before string, limit int) ([]models.LedgerEntry, error) {
+	database := m.client.Database("maas")
+	maas_ledger_collection := database.Collection("maas_ledger")
+
+	filter := bson.M{"user_id": userId}
+	if before != "" {
+		beforeId, err := primitive.ObjectIDFromHex(before)
+		if err != nil {
+			return nil, err
+		}
+		filter["_id"] = bson.M{"$lt": beforeId}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(limit))
+
+	cursor, err := maas_ledger_collection.Find(*m.ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []models.LedgerEntry{}
+	if err := cursor.All(*m.ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Adds up the user's ledger and stores the total as their tokens_remaining. Only the entries up to the
+// user's ledger_seq are counted, and only when none of them are missing, otherwise it's a
+// LedgerIncompleteError. Gives up with a BalanceChangedError rather than overwrite a change made
+// while the ledger was being added up, which the ledger_seq would have moved on for
+func (m *MongoDBUserRepository) RebuildBalance(userId string) (*models.User, error) {
+	database := m.client.Database("maas")
+	maas_users_collection := database.Collection("maas_users")
+
+	user, err := m.User(userId)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, &error_types.UserNotFoundError{}
+		}
+		return nil, err
+	}
+
+	total, found, err := m.sumLedger(userId, 0, user.LedgerSeq)
+	if err != nil {
+		return nil, err
+	}
+	if found != user.LedgerSeq+1 {
+		return nil, &error_types.LedgerIncompleteError{UserId: userId, Expected: user.LedgerSeq + 1, Found: found}
+	}
+
+	filter := bson.M{"_id": user.ID, "ledger_seq": ledgerSeqFilter(user.LedgerSeq)}
+	update := bson.M{"$set": bson.M{"tokens_remaining": total}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated models.User
+
+	err = maas_users_collection.FindOneAndUpdate(*m.ctx, filter, update, opts).Decode(&updated)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, &error_types.BalanceChangedError{UserId: userId}
+		}
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// Gives every user whose ledger doesn't start with an opening balance one, for whatever their entries
+// since don't account for. Users from before the ledger kept a seq have none, so this has to have run
+// before their balance can be rebuilt. Users with later entries missing are left for another run, and
+// returns how many were given one
+func (m *MongoDBUserRepository) BackfillOpeningBalances() (int, error) {
+	database := m.client.Database("maas")
+	maas_users_collection := database.Collection("maas_users")
+	maas_ledger_collection := database.Collection("maas_ledger")
+
+	opts := options.Find().SetProjection(bson.M{"tokens_remaining": 1, "ledger_seq": 1})
+	cursor, err := maas_users_collection.Find(*m.ctx, bson.M{}, opts)
+	if err != nil {
+		return 0, err
+	}
+	var users []models.User
+	if err := cursor.All(*m.ctx, &users); err != nil {
+		return 0, err
+	}
+
+	backfilled := 0
+	for _, user := range users {
+		userId := user.ID.Hex()
+		opening := maas_ledger_collection.FindOne(*m.ctx, bson.M{"user_id": userId, "seq": 0})
+		if opening.Err() == nil {
+			continue
+		}
+		if !errors.Is(opening.Err(), mongo.ErrNoDocuments) {
+			return backfilled, opening.Err()
+		}
+
+		// The balance and the seq come from the same document, so the entries up to that seq are
+		// exactly the changes already in that balance
+		total, found, err := m.sumLedger(userId, 1, user.LedgerSeq)
+		if err != nil {
+			return backfilled, err
+		}
+		if found != user.LedgerSeq {
+			loggers.ErrorLog.Printf("Not backfilling an opening balance for user %s: the ledger has %d of its %d entries\n", userId, found, user.LedgerSeq)
+			continue
+		}
+		entry := &models.LedgerEntry{
+			ID:        primitive.NewObjectID(),
+			UserId:    userId,
+			Seq:       0,
+			Kind:      models.LedgerAdjustment,
+			Amount:    user.TokensRemaining - total,
+			Balance:   user.TokensRemaining - total,
+			Actor:     models.SystemActor,
+			Reason:    "opening balance backfill",
+			CreatedAt: time.Now().UTC(),
+		}
+		if _, err := maas_ledger_collection.InsertOne(*m.ctx, entry); err != nil {
+			// Another instance backfilled it first
+			if mongo.IsDuplicateKeyError(err) {
+				continue
+			}
+			return backfilled, err
+		}
+		backfilled++
+	}
+	return backfilled, nil
+}
+
+// The total and the number of the user's entries with a seq from first to last
+func (m *MongoDBUserRepository) sumLedger(userId string, first int, last int) (int, int, error) {
+	database := m.client.Database("maas")
+	maas_ledger_collection := database.Collection("maas_ledger")
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": userId, "seq": bson.M{"$gte": first, "$lte": last}}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": "$amount"}, "count": bson.M{"$sum": 1}}}},
+	}
+	cursor, err := maas_ledger_collection.Aggregate(*m.ctx, pipeline)
+	if err != nil {
+		return 0, 0, err
+	}
+	var totals []struct {
+		Total int `bson:"total"`
+		Count int `bson:"count"`
+	}
+	if err := cursor.All(*m.ctx, &totals); err != nil {
+		return 0, 0, err
+	}
+	if len(totals) == 0 {
+		return 0, 0, nil
+	}
+	return totals[0].Total, totals[0].Count, nil
+}
+
+// Users from before the ledger kept a seq have no ledger_seq until their balance next changes
+func ledgerSeqFilter(seq int) interface{} {
+	if seq == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+	return seq
+}
+
+// Lets a user's ledger be paged through without scanning the whole collection, and makes sure no two
+// of a user's entries share a seq
+func (m *MongoDBUserRepository) EnsureIndexes() error {
+	database := m.client.Database("maas")
+	maas_ledger_collection := database.Collection("maas_ledger")
+
+	_, err := maas_ledger_collection.Indexes().CreateMany(*m.ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "_id", Value: -1}}},
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "seq", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"seq": bson.M{"$exists": true}}),
+		},
+	})
+	return err
+}
@@ -0,0 +1,89 @@
+package user_db_test
+
+import (
+	"testing"
+	"time"
+
+	error_types "maas/error-types"
+	"maas/models"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRebuildBalance_AddsUpEveryEntryUpToTheLedgerSeq(t *testing.T) {
+	id := newUser(t, 5)
+	assert.Nil(t, repository.EnsureIndexes())
+	held := reservation(2, time.Now().Add(time.Minute))
+	_, err := repository.ReserveTokens(id, held)
+	assert.Nil(t, err)
+	assert.Nil(t, repository.CommitReservation(id, held, 1))
+	_, err = repository.CreditTokens(id, 10, "order-1", models.BalanceChange{Reason: "purchase"})
+	assert.Nil(t, err)
+	// Tokens that went missing without an entry, which the rebuild puts back
+	_, err = usersCollection.UpdateOne(ctx, bson.M{"_id": objectId(id)}, bson.M{"$set": bson.M{"tokens_remaining": 1}})
+	assert.Nil(t, err)
+
+	user, err := repository.RebuildBalance(id)
+	assert.Nil(t, err)
+	assert.Equal(t, 14, user.TokensRemaining)
+	assert.Equal(t, 3, user.LedgerSeq)
+}
+
+func TestRebuildBalance_WhenAnEntryIsMissing_RaisesLedgerIncomplete(t *testing.T) {
+	id := newUser(t, 5)
+	_, err := repository.ReserveTokens(id, reservation(2, time.Now().Add(time.Minute)))
+	assert.Nil(t, err)
+	_, err = database.Collection(ledgerCollectionName).DeleteOne(ctx, bson.M{"user_id": id, "seq": 1})
+	assert.Nil(t, err)
+
+	_, err = repository.RebuildBalance(id)
+	assert.IsType(t, &error_types.LedgerIncompleteError{}, err)
+	assert.Equal(t, 3, tokensOf(t, id))
+}
+
+func TestSetTokens_ToTheSameBalance_WritesNoEntry(t *testing.T) {
+	id := newUser(t, 5)
+
+	user, err := repository.SetTokens(id, 5, models.BalanceChange{Actor: models.SystemActor})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, user.LedgerSeq)
+	user, err = repository.SetTokens(id, 8, models.BalanceChange{Actor: models.SystemActor})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, user.LedgerSeq)
+
+	entries, err := repository.LedgerByUser(id, "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, 3, entries[0].Amount)
+}
+
+func TestBackfillOpeningBalances_LetsUsersFromBeforeTheLedgerSeqBeRebuilt(t *testing.T) {
+	cleanup()
+	assert.Nil(t, repository.EnsureIndexes())
+	// Written the way users were before they had a ledger_seq, with an entry that had no seq
+	legacyId := primitive.NewObjectID()
+	_, err := usersCollection.InsertOne(ctx, bson.M{"_id": legacyId, "user_id": "Old Timer", "tokens_remaining": 7, "auth_key": "Old-Password"})
+	assert.Nil(t, err)
+	_, err = database.Collection(ledgerCollectionName).InsertOne(ctx, bson.M{"user_id": legacyId.Hex(), "amount": 100})
+	assert.Nil(t, err)
+	_, err = repository.ReserveTokens(legacyId.Hex(), reservation(2, time.Now().Add(time.Minute)))
+	assert.Nil(t, err)
+
+	backfilled, err := repository.BackfillOpeningBalances()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, backfilled)
+	backfilled, err = repository.BackfillOpeningBalances()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, backfilled)
+
+	user, err := repository.RebuildBalance(legacyId.Hex())
+	assert.Nil(t, err)
+	assert.Equal(t, 5, user.TokensRemaining)
+}
+
+func objectId(id string) primitive.ObjectID {
+	hexId, _ := primitive.ObjectIDFromHex(id)
+	return hexId
+}
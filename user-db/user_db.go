@@ -7,6 +7,7 @@ import (
 	"maas/loggers"
 	meme_service "maas/meme-service"
 	"os"
+	"time"
 
 	auth_service "maas/auth-service"
 	error_types "maas/error-types"
@@ -35,14 +36,19 @@ func NewMongoDBUserRepository(client *mongo.Client, ctx *context.Context) *Mongo
 	return &MongoDBUserRepository{client: client, ctx: ctx}
 }
 
-func (m *MongoDBUserRepository) NewUser(user models.User) (interface{}, error) {
+// The user's starting tokens go in the ledger as an adjustment, so their balance can be rebuilt from it
+func (m *MongoDBUserRepository) NewUser(user models.User, change models.BalanceChange) (interface{}, error) {
 	database := m.client.Database("maas")
 	maas_users_collection := database.Collection("maas_users")
 
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
 	insertResult, err := maas_users_collection.InsertOne(*m.ctx, user)
 	if err != nil {
 		return nil, err
 	}
+	m.openingBalance(&user, change)
 	return insertResult.InsertedID, nil
 }
 
@@ -68,6 +74,8 @@ func (m *MongoDBUserRepository) UserByAuthHeader(auth string) (*models.User, err
 	return &user, nil
 }
 
+// Updates everything but the user's tokens, which only change through the methods that record it in
+// the ledger
 func (m *MongoDBUserRepository) UpdateUser(id string, user *models.User) error {
 	database := m.client.Database("maas")
 	maas_users_collection := database.Collection("maas_users")
@@ -75,10 +83,17 @@ func (m *MongoDBUserRepository) UpdateUser(id string, user *models.User) error {
 	if err != nil {
 		return err
 	}
-	_, err = maas_users_collection.ReplaceOne(
+	_, err = maas_users_collection.UpdateOne(
 		*m.ctx,
 		bson.M{"_id": hexId},
-		user,
+		bson.M{"$set": bson.M{
+			"user_id":         user.UserId,
+			"auth_key":        user.AuthKey,
+			"is_admin":        user.IsAdmin,
+			"plan":            user.Plan,
+			"plan_expires_at": user.PlanExpiresAt,
+			"safe_mode":       user.SafeMode,
+		}},
 	)
 	if err != nil {
 		return err
@@ -86,6 +101,281 @@ func (m *MongoDBUserRepository) UpdateUser(id string, user *models.User) error {
 	return nil
 }
 
+// Sets the user's balance to exactly tokens and records the difference as an adjustment. Only updates
+// users whose balance is different, so setting the same balance again doesn't use up a ledger seq
+func (m *MongoDBUserRepository) SetTokens(id string, tokens int, change models.BalanceChange) (*models.User, error) {
+	database := m.client.Database("maas")
+	maas_users_collection := database.Collection("maas_users")
+	hexId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"_id": hexId, "tokens_remaining": bson.M{"$ne": tokens}}
+	update := bson.M{
+		"$set": bson.M{"tokens_remaining": tokens},
+		"$inc": bson.M{"ledger_seq": 1},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+
+	var before models.User
+
+	err = maas_users_collection.FindOneAndUpdate(*m.ctx, filter, update, opts).Decode(&before)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+		unchanged, lookupErr := m.User(id)
+		if lookupErr != nil {
+			if errors.Is(lookupErr, mongo.ErrNoDocuments) {
+				return nil, &error_types.UserNotFoundError{}
+			}
+			return nil, lookupErr
+		}
+		return unchanged, nil
+	}
+	after := before
+	after.TokensRemaining = tokens
+	after.LedgerSeq = before.LedgerSeq + 1
+	m.appendLedger(&models.LedgerEntry{
+		UserId:    id,
+		Seq:       after.LedgerSeq,
+		Kind:      models.LedgerAdjustment,
+		Amount:    tokens - before.TokensRemaining,
+		Balance:   tokens,
+		Actor:     change.Actor,
+		Reason:    change.Reason,
+		RequestId: change.RequestId,
+	})
+	return &after, nil
+}
+
+// How many of a user's most recent credit keys are kept to spot retries. A retry would have to come
+// after this many newer credits to the same user to be applied twice
+const creditKeysKept = 1000
+
+// Adds amount tokens and remembers idempotencyKey in the same update, which only matches while the key
+// isn't already there, so a retried credit can't be applied twice
+func (m *MongoDBUserRepository) CreditTokens(id string, amount int, idempotencyKey string, change models.BalanceChange) (*models.User, error) {
+	database := m.client.Database("maas")
+	maas_users_collection := database.Collection("maas_users")
+	hexId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, &error_types.UserNotFoundError{}
+	}
+
+	filter := bson.M{"_id": hexId, "credit_keys": bson.M{"$ne": idempotencyKey}}
+	update := bson.M{
+		"$inc":  bson.M{"tokens_remaining": amount, "ledger_seq": 1},
+		"$push": bson.M{"credit_keys": bson.M{"$each": []string{idempotencyKey}, "$slice": -creditKeysKept}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user models.User
+
+	err = maas_users_collection.FindOneAndUpdate(*m.ctx, filter, update, opts).Decode(&user)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+		if _, lookupErr := m.User(id); lookupErr != nil {
+			if errors.Is(lookupErr, mongo.ErrNoDocuments) {
+				return nil, &error_types.UserNotFoundError{}
+			}
+			return nil, lookupErr
+		}
+		return nil, &error_types.DuplicateCreditError{Key: idempotencyKey}
+	}
+	m.appendLedger(&models.LedgerEntry{
+		UserId:         id,
+		Seq:            user.LedgerSeq,
+		Kind:           models.LedgerCredit,
+		Amount:         amount,
+		Balance:        user.TokensRemaining,
+		Actor:          change.Actor,
+		Reason:         change.Reason,
+		RequestId:      change.RequestId,
+		Reference:      change.Reference,
+		IdempotencyKey: idempotencyKey,
+	})
+	return &user, nil
+}
+
+// Only takes the tokens when the user has enough left, in a single update that also records the
+// reservation, so two requests can't spend the same tokens
+func (m *MongoDBUserRepository) ReserveTokens(id string, reservation *models.TokenReservation) (*models.User, error) {
+	hexId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	user, err := m.reserve(bson.M{"_id": hexId}, reservation)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, &error_types.InsufficientTokensError{Needed: reservation.Amount}
+	}
+	return user, err
+}
+
+// Authenticates and reserves in the same update, so the meme hot path is one round-trip. Only when
+// nothing matched does it look the key up again, to tell an unknown key from a user who can't pay
+func (m *MongoDBUserRepository) ReserveTokensByAuth(auth string, reservation *models.TokenReservation) (*models.User, error) {
+	if auth == "" {
+		return nil, &error_types.NoAuthHeaderError{}
+	}
+	user, err := m.reserve(bson.M{"auth_key": auth}, reservation)
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return user, err
+	}
+	if _, lookupErr := m.UserByAuthHeader(auth); lookupErr != nil {
+		if _, ok := lookupErr.(*error_types.UnableToLocateDocumentError); ok {
+			return nil, &error_types.AuthUserNotFoundError{}
+		}
+		return nil, lookupErr
+	}
+	return nil, &error_types.InsufficientTokensError{Needed: reservation.Amount}
+}
+
+func (m *MongoDBUserRepository) reserve(filter bson.M, reservation *models.TokenReservation) (*models.User, error) {
+	database := m.client.Database("maas")
+	maas_users_collection := database.Collection("maas_users")
+
+	filter["tokens_remaining"] = bson.M{"$gte": reservation.Amount}
+	update := bson.M{
+		"$inc":  bson.M{"tokens_remaining": -reservation.Amount, "ledger_seq": 1},
+		"$push": bson.M{"reservations": reservation},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user models.User
+
+	err := maas_users_collection.FindOneAndUpdate(*m.ctx, filter, update, opts).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	m.appendLedger(&models.LedgerEntry{
+		UserId:    user.ID.Hex(),
+		Seq:       user.LedgerSeq,
+		Kind:      models.LedgerSpend,
+		Amount:    -reservation.Amount,
+		Balance:   user.TokensRemaining,
+		Actor:     user.ID.Hex(),
+		Reason:    reservation.Reason,
+		RequestId: reservation.RequestId,
+	})
+	return &user, nil
+}
+
+func (m *MongoDBUserRepository) CommitReservation(userId string, reservation *models.TokenReservation, spent int) error {
+	return m.settle(userId, reservation, reservation.Amount-spent, userId)
+}
+
+func (m *MongoDBUserRepository) ReleaseReservation(userId string, reservation *models.TokenReservation) error {
+	return m.settle(userId, reservation, reservation.Amount, userId)
+}
+
+// Removes the reservation and gives refund tokens back in the same update. Whichever of a commit,
+// a release or the stale reservation sweep gets there first is the only one that matches
+func (m *MongoDBUserRepository) settle(userId string, reservation *models.TokenReservation, refund int, actor string) error {
+	database := m.client.Database("maas")
+	maas_users_collection := database.Collection("maas_users")
+	hexId, err := primitive.ObjectIDFromHex(userId)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{"_id": hexId, "reservations.id": reservation.ID}
+	inc := bson.M{"tokens_remaining": refund}
+	if refund != 0 {
+		inc["ledger_seq"] = 1
+	}
+	update := bson.M{
+		"$pull": bson.M{"reservations": bson.M{"id": reservation.ID}},
+		"$inc":  inc,
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user models.User
+
+	err = maas_users_collection.FindOneAndUpdate(*m.ctx, filter, update, opts).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return &error_types.ReservationNotFoundError{ID: reservation.ID}
+		}
+		return err
+	}
+	if refund != 0 {
+		m.appendLedger(&models.LedgerEntry{
+			UserId:    userId,
+			Seq:       user.LedgerSeq,
+			Kind:      models.LedgerRefund,
+			Amount:    refund,
+			Balance:   user.TokensRemaining,
+			Actor:     actor,
+			Reason:    reservation.Reason,
+			RequestId: reservation.RequestId,
+		})
+	}
+	return nil
+}
+
+// Only matches while the reservation is still held, so one the sweep has already released stays released
+func (m *MongoDBUserRepository) ExtendReservation(userId string, reservation *models.TokenReservation) error {
+	database := m.client.Database("maas")
+	maas_users_collection := database.Collection("maas_users")
+	hexId, err := primitive.ObjectIDFromHex(userId)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{"_id": hexId, "reservations.id": reservation.ID}
+	update := bson.M{"$set": bson.M{"reservations.$.expires_at": reservation.ExpiresAt}}
+	result, err := maas_users_collection.UpdateOne(*m.ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return &error_types.ReservationNotFoundError{ID: reservation.ID}
+	}
+	return nil
+}
+
+// Releases every reservation that expired before now. Another sweep or a late commit can get to
+// one first, which isn't an error, it just isn't counted
+func (m *MongoDBUserRepository) ReleaseExpiredReservations(now time.Time) (int, error) {
+	database := m.client.Database("maas")
+	maas_users_collection := database.Collection("maas_users")
+
+	filter := bson.M{"reservations.expires_at": bson.M{"$lte": now}}
+	opts := options.Find().SetProjection(bson.M{"reservations": 1})
+	cursor, err := maas_users_collection.Find(*m.ctx, filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	var users []models.User
+	if err := cursor.All(*m.ctx, &users); err != nil {
+		return 0, err
+	}
+
+	released := 0
+	for _, user := range users {
+		for _, reservation := range user.Reservations {
+			if !reservation.Expired(now) {
+				continue
+			}
+			expired := reservation
+			expired.Reason = "expired " + reservation.Reason
+			err := m.settle(user.ID.Hex(), &expired, reservation.Amount, models.SystemActor)
+			if _, ok := err.(*error_types.ReservationNotFoundError); ok {
+				continue
+			}
+			if err != nil {
+				return released, err
+			}
+			released++
+		}
+	}
+	return released, nil
+}
+
 func (m *MongoDBUserRepository) ResetDb() ([]interface{}, error) {
 	// ensure local environment
 	if os.Getenv("ENV_NAME") != "local" {
@@ -102,12 +392,23 @@ func (m *MongoDBUserRepository) ResetDb() ([]interface{}, error) {
 	if err := maas_users.Drop(*m.ctx); err != nil {
 		return nil, err
 	}
+	if err := database.Collection("maas_ledger").Drop(*m.ctx); err != nil {
+		return nil, err
+	}
+	if err := m.EnsureIndexes(); err != nil {
+		return nil, err
+	}
 
 	// Insert new data
 	insertResult, err := maas_users.InsertMany(*m.ctx, models.DefaultUsers)
 	if err != nil {
 		return nil, err
 	}
+	for i, inserted := range models.DefaultUsers {
+		user := inserted.(models.User)
+		user.ID, _ = insertResult.InsertedIDs[i].(primitive.ObjectID)
+		m.openingBalance(&user, models.BalanceChange{Actor: models.SystemActor, Reason: "reset"})
+	}
 
 	// Return data to caller
 	return insertResult.InsertedIDs, nil
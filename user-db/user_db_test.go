@@ -5,14 +5,17 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	error_types "maas/error-types"
 	"maas/models"
 	user_db "maas/user-db"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/strikesecurity/strikememongo"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
@@ -20,7 +23,8 @@ import (
 )
 
 const (
-	usersCollectionName = "maas_users"
+	usersCollectionName  = "maas_users"
+	ledgerCollectionName = "maas_ledger"
 )
 
 var (
@@ -95,6 +99,7 @@ func createCollections() {
 
 func cleanup() {
 	usersCollection.DeleteMany(ctx, bson.M{})
+	database.Collection(ledgerCollectionName).DeleteMany(ctx, bson.M{})
 }
 
 func loadDefaultData() {
@@ -112,3 +117,165 @@ func TestAllUsersDebug_ReturnsAllUsers(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 3, len(usersActual))
 }
+
+// Starts each test with an empty database and a single user holding tokens
+func newUser(t *testing.T, tokens int) string {
+	cleanup()
+	inserted, err := repository.NewUser(
+		models.User{UserId: "Tess Tokens", TokensRemaining: tokens, AuthKey: "Tess-Password"},
+		models.BalanceChange{Actor: models.SystemActor},
+	)
+	assert.Nil(t, err)
+	return inserted.(primitive.ObjectID).Hex()
+}
+
+func reservation(amount int, expiresAt time.Time) *models.TokenReservation {
+	return &models.TokenReservation{
+		ID:        primitive.NewObjectID().Hex(),
+		Amount:    amount,
+		Reason:    "meme",
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+}
+
+func TestReserveTokens_WhenBalanceIsTooLow_TakesNothing(t *testing.T) {
+	id := newUser(t, 2)
+
+	_, err := repository.ReserveTokens(id, reservation(3, time.Now().Add(time.Minute)))
+	assert.IsType(t, &error_types.InsufficientTokensError{}, err)
+	_, err = repository.ReserveTokensByAuth("Tess-Password", reservation(3, time.Now().Add(time.Minute)))
+	assert.IsType(t, &error_types.InsufficientTokensError{}, err)
+
+	user, err := repository.User(id)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, user.TokensRemaining)
+	assert.Empty(t, user.Reservations)
+	assert.Equal(t, 0, user.LedgerSeq)
+}
+
+func TestReserveTokens_WhenBalanceIsExactlyEnough_TakesItAll(t *testing.T) {
+	id := newUser(t, 2)
+
+	user, err := repository.ReserveTokensByAuth("Tess-Password", reservation(2, time.Now().Add(time.Minute)))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, user.TokensRemaining)
+	assert.Len(t, user.Reservations, 1)
+
+	_, err = repository.ReserveTokens(id, reservation(1, time.Now().Add(time.Minute)))
+	assert.IsType(t, &error_types.InsufficientTokensError{}, err)
+}
+
+func TestReserveTokensByAuth_WhenKeyIsUnknown_RaisesAuthUserNotFound(t *testing.T) {
+	newUser(t, 2)
+
+	_, err := repository.ReserveTokensByAuth("Nobody-Password", reservation(1, time.Now().Add(time.Minute)))
+	assert.IsType(t, &error_types.AuthUserNotFoundError{}, err)
+}
+
+func tokensOf(t *testing.T, id string) int {
+	user, err := repository.User(id)
+	assert.Nil(t, err)
+	return user.TokensRemaining
+}
+
+func TestCommitReservation_OnlyTheFirstSettlementCounts(t *testing.T) {
+	id := newUser(t, 5)
+	held := reservation(2, time.Now().Add(time.Minute))
+	_, err := repository.ReserveTokens(id, held)
+	assert.Nil(t, err)
+
+	assert.Nil(t, repository.CommitReservation(id, held, 1))
+	assert.Equal(t, 4, tokensOf(t, id))
+
+	assert.IsType(t, &error_types.ReservationNotFoundError{}, repository.CommitReservation(id, held, 1))
+	assert.IsType(t, &error_types.ReservationNotFoundError{}, repository.ReleaseReservation(id, held))
+	assert.Equal(t, 4, tokensOf(t, id))
+}
+
+func TestReleaseReservation_Twice_OnlyRefundsOnce(t *testing.T) {
+	id := newUser(t, 5)
+	held := reservation(2, time.Now().Add(time.Minute))
+	_, err := repository.ReserveTokens(id, held)
+	assert.Nil(t, err)
+
+	assert.Nil(t, repository.ReleaseReservation(id, held))
+	assert.IsType(t, &error_types.ReservationNotFoundError{}, repository.ReleaseReservation(id, held))
+	assert.Equal(t, 5, tokensOf(t, id))
+}
+
+func TestReleaseExpiredReservations_RacingACommit_SettlesItOnce(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		id := newUser(t, 5)
+		held := reservation(1, time.Now().Add(-time.Minute))
+		_, err := repository.ReserveTokens(id, held)
+		assert.Nil(t, err)
+
+		var wg sync.WaitGroup
+		var commitErr, sweepErr error
+		released := 0
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			commitErr = repository.CommitReservation(id, held, 1)
+		}()
+		go func() {
+			defer wg.Done()
+			released, sweepErr = repository.ReleaseExpiredReservations(time.Now().UTC())
+		}()
+		wg.Wait()
+
+		assert.Nil(t, sweepErr)
+		user, err := repository.User(id)
+		assert.Nil(t, err)
+		assert.Empty(t, user.Reservations)
+		if commitErr == nil {
+			assert.Equal(t, 0, released)
+			assert.Equal(t, 4, user.TokensRemaining)
+		} else {
+			assert.IsType(t, &error_types.ReservationNotFoundError{}, commitErr)
+			assert.Equal(t, 1, released)
+			assert.Equal(t, 5, user.TokensRemaining)
+		}
+	}
+}
+
+func TestExtendReservation_OnlyWhileItIsHeld(t *testing.T) {
+	id := newUser(t, 5)
+	held := reservation(1, time.Now().Add(-time.Minute))
+	_, err := repository.ReserveTokens(id, held)
+	assert.Nil(t, err)
+
+	held.ExpiresAt = time.Now().Add(time.Hour)
+	assert.Nil(t, repository.ExtendReservation(id, held))
+	released, err := repository.ReleaseExpiredReservations(time.Now().UTC())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, released)
+
+	assert.Nil(t, repository.ReleaseReservation(id, held))
+	assert.IsType(t, &error_types.ReservationNotFoundError{}, repository.ExtendReservation(id, held))
+}
+
+func TestCreditTokens_WithADuplicateKey_CreditsOnce(t *testing.T) {
+	id := newUser(t, 5)
+	change := models.BalanceChange{Actor: "service:purchasing", Reason: "purchase", Reference: "order-1"}
+
+	user, err := repository.CreditTokens(id, 10, "order-1", change)
+	assert.Nil(t, err)
+	assert.Equal(t, 15, user.TokensRemaining)
+
+	_, err = repository.CreditTokens(id, 10, "order-1", change)
+	assert.IsType(t, &error_types.DuplicateCreditError{}, err)
+	assert.Equal(t, 15, tokensOf(t, id))
+
+	user, err = repository.CreditTokens(id, 10, "order-2", change)
+	assert.Nil(t, err)
+	assert.Equal(t, 25, user.TokensRemaining)
+}
+
+func TestCreditTokens_WhenUserIsMissing_RaisesUserNotFound(t *testing.T) {
+	newUser(t, 5)
+
+	_, err := repository.CreditTokens(primitive.NewObjectID().Hex(), 10, "order-1", models.BalanceChange{})
+	assert.IsType(t, &error_types.UserNotFoundError{}, err)
+}
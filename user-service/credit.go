@@ -0,0 +1,89 @@
+package user_service
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	error_types "maas/error-types"
+	"maas/loggers"
+	"maas/models"
+	request_ids "maas/request-ids"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CreditResponse struct {
+	UserId          string `json:"user_id"`
+	Credited        int    `json:"credited"`
+	TokensRemaining int    `json:"tokens_remaining"`
+	Reference       string `json:"reference"`
+}
+
+// POSTs tokens a user has bought onto their balance. Meant for the purchasing team, who call it with a
+// service key, though admins can too. Every credit needs an Idempotency-Key, and a key that's already
+// been credited gets a 409 instead of the tokens a second time, so a retried call is always safe
+func (s *UserService) CreditTokens(ginContext *gin.Context) {
+	actor, err := s.requireServiceOrAdmin(ginContext)
+	if err != nil {
+		return
+	}
+	idempotencyKey, ok := request_ids.IdempotencyKey(ginContext)
+	if idempotencyKey == "" || !ok {
+		ginContext.IndentedJSON(http.StatusBadRequest, fmt.Sprintf("An Idempotency-Key of up to %d characters is needed", request_ids.MaxIdempotencyKeyLength))
+		return
+	}
+	amount, err := strconv.Atoi(ginContext.PostForm("amount"))
+	if err != nil || amount < 1 {
+		ginContext.IndentedJSON(http.StatusBadRequest, "amount must be a positive int")
+		return
+	}
+	// The purchase the tokens are for, in the purchasing team's terms
+	reference := ginContext.PostForm("reference")
+	if reference == "" {
+		ginContext.IndentedJSON(http.StatusBadRequest, "reference is needed")
+		return
+	}
+
+	id := ginContext.Param("id")
+	change := models.BalanceChange{
+		Actor:     actor,
+		Reason:    "purchase",
+		RequestId: request_ids.Of(ginContext),
+		Reference: reference,
+	}
+	user, err := s.Repo.CreditTokens(id, amount, idempotencyKey, change)
+	if err != nil {
+		switch err.(type) {
+		default:
+			loggers.ErrorLog.Printf("Encountered error crediting user: %s%v", id, err)
+			ginContext.IndentedJSON(http.StatusInternalServerError, "There was an error, please try again later")
+		case *error_types.UserNotFoundError:
+			ginContext.IndentedJSON(http.StatusNotFound, "Unable to find that user")
+		case *error_types.DuplicateCreditError:
+			ginContext.IndentedJSON(http.StatusConflict, "Tokens have already been credited for that Idempotency-Key")
+		}
+		return
+	}
+	loggers.InfoLog.Printf("Credited user %s %d tokens for %s\n", id, amount, reference)
+	ginContext.IndentedJSON(http.StatusOK, &CreditResponse{
+		UserId:          id,
+		Credited:        amount,
+		TokensRemaining: user.TokensRemaining,
+		Reference:       reference,
+	})
+}
+
+// Lets through a service key or an admin, and says who they are for the ledger: service:<name> for a
+// service and the object ID hex for an admin
+func (s *UserService) requireServiceOrAdmin(ginContext *gin.Context) (string, error) {
+	authHeader := ginContext.Request.Header.Get("auth")
+	if name, ok := s.Auth.Service(authHeader); ok {
+		return "service:" + name, nil
+	}
+	err := s.requireAdmin(ginContext)
+	if err != nil {
+		return "", err
+	}
+	return s.balanceChange(ginContext, "").Actor, nil
+}
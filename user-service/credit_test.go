@@ -0,0 +1,134 @@
+package user_service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	auth_service "maas/auth-service"
+	error_types "maas/error-types"
+	"maas/models"
+	request_ids "maas/request-ids"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// Credits the mock's users, turning away keys it's already seen
+type CreditingUserRepository struct {
+	MockUserRepository
+	keys    map[string]bool
+	changes []models.BalanceChange
+}
+
+func (m *CreditingUserRepository) CreditTokens(id string, amount int, idempotencyKey string, change models.BalanceChange) (*models.User, error) {
+	if m.keys == nil {
+		m.keys = map[string]bool{}
+	}
+	if m.keys[idempotencyKey] {
+		return nil, &error_types.DuplicateCreditError{Key: idempotencyKey}
+	}
+	user, err := m.MockUserRepository.CreditTokens(id, amount, idempotencyKey, change)
+	if err != nil {
+		return nil, err
+	}
+	m.keys[idempotencyKey] = true
+	m.changes = append(m.changes, change)
+	return user, nil
+}
+
+func creditRouter(service *UserService) *gin.Engine {
+	router := testRouter(*service)
+	router.POST("/users/:id/tokens/credit", service.CreditTokens)
+	return router
+}
+
+func creditService(repo UserRepository) *UserService {
+	auth := *auth_service.NewAuthService(&MockUserRepository{}).
+		WithServiceKeys(map[string]string{"purchasing": "PURCHASING"})
+	return NewUserService(repo, auth)
+}
+
+func performCredit(r http.Handler, id string, authHeader string, idempotencyKey string, form map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/users/%s/tokens/credit", id), nil)
+	req.Header.Set("auth", authHeader)
+	if idempotencyKey != "" {
+		req.Header.Set(request_ids.IdempotencyKeyHeader, idempotencyKey)
+	}
+	req.ParseForm()
+	for key, value := range form {
+		req.PostForm.Set(key, value)
+	}
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	return recorder
+}
+
+var purchase = map[string]string{"amount": "25", "reference": "order-1234"}
+
+func TestCreditTokens_WhenAdminCredits_AddsToBalance(t *testing.T) {
+	repo := &CreditingUserRepository{}
+	recorder := performCredit(creditRouter(creditService(repo)), defaultIDString, "ADMIN", "key-1", purchase)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response CreditResponse
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, 25, response.Credited)
+	assert.Equal(t, defaultUser.TokensRemaining+25, response.TokensRemaining)
+	assert.Equal(t, "order-1234", response.Reference)
+	assert.Equal(t, adminIDString, repo.changes[0].Actor)
+	assert.Equal(t, "purchase", repo.changes[0].Reason)
+	assert.Equal(t, "order-1234", repo.changes[0].Reference)
+}
+
+func TestCreditTokens_WithServiceKey_CreditsAsTheService(t *testing.T) {
+	repo := &CreditingUserRepository{}
+	recorder := performCredit(creditRouter(creditService(repo)), defaultIDString, "PURCHASING", "key-1", purchase)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "service:purchasing", repo.changes[0].Actor)
+}
+
+func TestCreditTokens_WhenKeyIsReused_RaisesConflict(t *testing.T) {
+	repo := &CreditingUserRepository{}
+	router := creditRouter(creditService(repo))
+	performCredit(router, defaultIDString, "PURCHASING", "key-1", purchase)
+	recorder := performCredit(router, defaultIDString, "PURCHASING", "key-1", purchase)
+
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Len(t, repo.changes, 1)
+}
+
+func TestCreditTokens_WithoutIdempotencyKey_RaisesBadRequest(t *testing.T) {
+	repo := &CreditingUserRepository{}
+	recorder := performCredit(creditRouter(creditService(repo)), defaultIDString, "PURCHASING", "", purchase)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Empty(t, repo.changes)
+}
+
+func TestCreditTokens_WhenNotAdminOrService_RaisesForbidden(t *testing.T) {
+	repo := &CreditingUserRepository{}
+	recorder := performCredit(creditRouter(creditService(repo)), defaultIDString, "DEFAULT", "key-1", purchase)
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Empty(t, repo.changes)
+}
+
+func TestCreditTokens_WhenAmountIsNotPositive_RaisesBadRequest(t *testing.T) {
+	repo := &CreditingUserRepository{}
+	form := map[string]string{"amount": "-5", "reference": "order-1234"}
+	recorder := performCredit(creditRouter(creditService(repo)), defaultIDString, "PURCHASING", "key-1", form)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Empty(t, repo.changes)
+}
+
+func TestCreditTokens_WhenUserIsMissing_RaisesNotFound(t *testing.T) {
+	repo := &CreditingUserRepository{}
+	recorder := performCredit(creditRouter(creditService(repo)), "missing", "PURCHASING", "key-1", purchase)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
@@ -0,0 +1,195 @@
+package user_service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	error_types "maas/error-types"
+	"maas/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Hands out entries pages newest first, and remembers what it was asked for
+type MockLedger struct {
+	entries    []models.LedgerEntry
+	before     string
+	limit      int
+	rebuildErr error
+}
+
+func (m *MockLedger) LedgerByUser(userId string, before string, limit int) ([]models.LedgerEntry, error) {
+	m.before, m.limit = before, limit
+	page := []models.LedgerEntry{}
+	for _, entry := range m.entries {
+		if len(page) < limit && entry.UserId == userId {
+			page = append(page, entry)
+		}
+	}
+	return page, nil
+}
+
+func (m *MockLedger) RebuildBalance(userId string) (*models.User, error) {
+	if m.rebuildErr != nil {
+		return nil, m.rebuildErr
+	}
+	rebuilt := *defaultUser
+	rebuilt.TokensRemaining = 0
+	for _, entry := range m.entries {
+		rebuilt.TokensRemaining += entry.Amount
+	}
+	return &rebuilt, nil
+}
+
+func defaultLedger() *MockLedger {
+	return &MockLedger{entries: []models.LedgerEntry{
+		{ID: primitive.NewObjectID(), UserId: defaultIDString, Kind: models.LedgerSpend, Amount: -1, Balance: 999},
+		{ID: primitive.NewObjectID(), UserId: defaultIDString, Kind: models.LedgerAdjustment, Amount: 1000, Balance: 1000},
+	}}
+}
+
+func ledgerRouter(service *UserService) *gin.Engine {
+	router := testRouter(*service)
+	router.GET("/users/:id/ledger", service.LedgerByUser)
+	router.POST("/users/:id/ledger/rebuild", service.RebuildBalance)
+	return router
+}
+
+func TestLedgerByUser_WhenAUserAsksForThemselves_ReturnsTheirEntries(t *testing.T) {
+	ledger := defaultLedger()
+	service := NewUserService(&MockUserRepository{}, authService).WithLedger(ledger)
+	recorder := performRequest(ledgerRouter(service), "GET", fmt.Sprintf("/users/%s/ledger", defaultIDString), "DEFAULT")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var page LedgerPage
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &page))
+	assert.Len(t, page.Entries, 2)
+	assert.Equal(t, models.LedgerSpend, page.Entries[0].Kind)
+	assert.Empty(t, page.Next)
+	assert.Equal(t, DefaultLedgerLimit, ledger.limit)
+}
+
+func TestLedgerByUser_WhenThereAreMorePages_SaysWhereTheNextStarts(t *testing.T) {
+	ledger := defaultLedger()
+	service := NewUserService(&MockUserRepository{}, authService).WithLedger(ledger)
+	before := primitive.NewObjectID().Hex()
+	path := fmt.Sprintf("/users/%s/ledger?limit=1&before=%s", defaultIDString, before)
+	recorder := performRequest(ledgerRouter(service), "GET", path, "ADMIN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var page LedgerPage
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &page))
+	assert.Len(t, page.Entries, 1)
+	assert.Equal(t, ledger.entries[0].ID.Hex(), page.Next)
+	assert.Equal(t, before, ledger.before)
+}
+
+func TestLedgerByUser_WithBadPaging_RaisesBadRequest(t *testing.T) {
+	service := NewUserService(&MockUserRepository{}, authService).WithLedger(defaultLedger())
+	for _, query := range []string{"limit=0", "limit=lots", fmt.Sprintf("limit=%d", MaxLedgerLimit+1), "before=yesterday"} {
+		path := fmt.Sprintf("/users/%s/ledger?%s", defaultIDString, query)
+		recorder := performRequest(ledgerRouter(service), "GET", path, "DEFAULT")
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, query)
+	}
+}
+
+func TestLedgerByUser_WhenAUserAsksForAnotherUser_RaisesForbidden(t *testing.T) {
+	service := NewUserService(&MockUserRepository{}, authService).WithLedger(defaultLedger())
+	recorder := performRequest(ledgerRouter(service), "GET", fmt.Sprintf("/users/%s/ledger", otherIDString), "DEFAULT")
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestLedgerByUser_WithoutLedger_RaisesNotFound(t *testing.T) {
+	service := NewUserService(&MockUserRepository{}, authService)
+	recorder := performRequest(ledgerRouter(service), "GET", fmt.Sprintf("/users/%s/ledger", defaultIDString), "ADMIN")
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestRebuildBalance_WhenAdmin_SetsTokensFromTheLedger(t *testing.T) {
+	service := NewUserService(&MockUserRepository{}, authService).WithLedger(defaultLedger())
+	recorder := performRequest(ledgerRouter(service), "POST", fmt.Sprintf("/users/%s/ledger/rebuild", defaultIDString), "ADMIN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var user models.User
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &user))
+	assert.Equal(t, 999, user.TokensRemaining)
+}
+
+func TestRebuildBalance_WhenBalanceChangesMeanwhile_RaisesConflict(t *testing.T) {
+	ledger := &MockLedger{rebuildErr: &error_types.BalanceChangedError{UserId: defaultIDString}}
+	service := NewUserService(&MockUserRepository{}, authService).WithLedger(ledger)
+	recorder := performRequest(ledgerRouter(service), "POST", fmt.Sprintf("/users/%s/ledger/rebuild", defaultIDString), "ADMIN")
+
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+}
+
+func TestRebuildBalance_WhenLedgerIsMissingEntries_RaisesConflict(t *testing.T) {
+	ledger := &MockLedger{rebuildErr: &error_types.LedgerIncompleteError{UserId: defaultIDString, Expected: 3, Found: 2}}
+	service := NewUserService(&MockUserRepository{}, authService).WithLedger(ledger)
+	recorder := performRequest(ledgerRouter(service), "POST", fmt.Sprintf("/users/%s/ledger/rebuild", defaultIDString), "ADMIN")
+
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "missing entries")
+}
+
+func TestRebuildBalance_WhenNotAdmin_RaisesForbidden(t *testing.T) {
+	service := NewUserService(&MockUserRepository{}, authService).WithLedger(defaultLedger())
+	recorder := performRequest(ledgerRouter(service), "POST", fmt.Sprintf("/users/%s/ledger/rebuild", defaultIDString), "DEFAULT")
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestUpdateUser_WhenTokensChange_RecordsAnAdjustmentByTheAdmin(t *testing.T) {
+	repo := &RecordingUserRepository{}
+	newUser := map[string]string{
+		"user_id":          "test_user_id",
+		"auth_key":         "DEFAULT",
+		"is_admin":         "false",
+		"tokens_remaining": "10",
+		"reason":           "goodwill for the outage",
+	}
+	service := NewUserService(repo, authService)
+	recorder := performRequestWithForm(testRouter(*service), "PATCH", fmt.Sprintf("/users/%s", defaultIDString), "ADMIN", newUser)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, 10, *repo.tokens)
+	assert.Equal(t, []models.BalanceChange{{Actor: adminIDString, Reason: "goodwill for the outage"}}, repo.changes)
+}
+
+func TestUpdateUser_WhenTokensStayTheSame_LeavesTheLedgerAlone(t *testing.T) {
+	repo := &RecordingUserRepository{}
+	newUser := map[string]string{
+		"user_id":          "test_user_id",
+		"auth_key":         "DEFAULT",
+		"is_admin":         "false",
+		"tokens_remaining": "1000",
+	}
+	service := NewUserService(repo, authService)
+	recorder := performRequestWithForm(testRouter(*service), "PATCH", fmt.Sprintf("/users/%s", defaultIDString), "ADMIN", newUser)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotNil(t, repo.updated)
+	assert.Nil(t, repo.tokens)
+	assert.Empty(t, repo.changes)
+}
+
+func TestAddUser_RecordsTheOpeningBalanceAsTheAdmin(t *testing.T) {
+	repo := &RecordingUserRepository{}
+	newUser := map[string]string{
+		"user_id":          "test_user_id",
+		"auth_key":         "AVAILABLE",
+		"is_admin":         "false",
+		"tokens_remaining": "10",
+	}
+	service := NewUserService(repo, authService)
+	recorder := performRequestWithForm(testRouter(*service), "POST", "/users", "ADMIN", newUser)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, []models.BalanceChange{{Actor: adminIDString, Reason: "opening balance"}}, repo.changes)
+}
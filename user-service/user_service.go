@@ -6,11 +6,14 @@ import (
 	"maas/loggers"
 	"net/http"
 	"strconv"
+	"time"
 
 	error_types "maas/error-types"
 	"maas/models"
+	request_ids "maas/request-ids"
 
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type UserRepository interface {
@@ -18,13 +21,64 @@ type UserRepository interface {
 	Ping() error
 	AllUsers() ([]models.User, error)
 	User(id string) (*models.User, error)
-	NewUser(user models.User) (interface{}, error)
+	// Records the user's starting tokens in the ledger as well
+	NewUser(user models.User, change models.BalanceChange) (interface{}, error)
+	// Updates everything but the user's tokens
 	UpdateUser(id string, user *models.User) error
+	// Sets the user's tokens to exactly tokens and records the difference in the ledger. Returns a
+	// UserNotFoundError when there's no such user
+	SetTokens(id string, tokens int, change models.BalanceChange) (*models.User, error)
+	// Adds amount tokens and records the credit in the ledger, once per idempotencyKey. Returns a
+	// DuplicateCreditError for a key that's already been used, and a UserNotFoundError when there's no
+	// such user
+	CreditTokens(id string, amount int, idempotencyKey string, change models.BalanceChange) (*models.User, error)
+}
+
+// Where the history of memes each user has made is kept
+type MemeHistoryRepository interface {
+	// Newest first, at most limit of them. When before is set the page starts with the meme after it
+	MemesByUser(userId string, before string, limit int) ([]models.MemeRecord, error)
+}
+
+const (
+	DefaultMemesLimit = 50
+	MaxMemesLimit     = 200
+)
+
+type MemesPage struct {
+	Memes []models.MemeRecord `json:"memes"`
+	// Pass as before to get the next page. Empty on the last one
+	Next string `json:"next,omitempty"`
+}
+
+const (
+	DefaultLedgerLimit = 50
+	MaxLedgerLimit     = 200
+)
+
+type LedgerPage struct {
+	Entries []models.LedgerEntry `json:"entries"`
+	// Pass as before to get the next page. Empty on the last one
+	Next string `json:"next,omitempty"`
+}
+
+// Where every change to a user's tokens is kept
+type LedgerRepository interface {
+	// Newest first, at most limit of them. When before is set the page starts with the entry after it
+	LedgerByUser(userId string, before string, limit int) ([]models.LedgerEntry, error)
+	// Works out the user's tokens from their ledger and stores them. Returns a UserNotFoundError when
+	// there's no such user, a BalanceChangedError when their tokens changed in the meantime and a
+	// LedgerIncompleteError when entries are missing
+	RebuildBalance(userId string) (*models.User, error)
 }
 
 type UserService struct {
 	Repo UserRepository
 	Auth auth_service.AuthService
+	// Optional. Without it GET /users/:id/memes has nothing to return
+	Memes MemeHistoryRepository
+	// Optional. Without it GET /users/:id/ledger has nothing to return
+	Ledger LedgerRepository
 }
 
 func NewUserService(repo UserRepository, auth auth_service.AuthService) *UserService {
@@ -34,6 +88,16 @@ func NewUserService(repo UserRepository, auth auth_service.AuthService) *UserSer
 	}
 }
 
+func (s *UserService) WithMemeHistory(memes MemeHistoryRepository) *UserService {
+	s.Memes = memes
+	return s
+}
+
+func (s *UserService) WithLedger(ledger LedgerRepository) *UserService {
+	s.Ledger = ledger
+	return s
+}
+
 func (s *UserService) Ping(ginContext *gin.Context) {
 	// Send a ping to confirm a successful connection
 	if err := s.Repo.Ping(); err != nil {
@@ -95,6 +159,117 @@ func (s *UserService) UserById(ginContext *gin.Context) {
 	ginContext.IndentedJSON(http.StatusOK, user)
 }
 
+// GETs the memes a user has made, newest first, a page at a time. Needs to be either the requesting
+// user getting their own history or an admin. limit (at most MaxMemesLimit) sets the page size, and
+// before takes the next value from the previous page
+func (s *UserService) MemesByUser(ginContext *gin.Context) {
+	err := s.requireCallerOrAdmin(ginContext)
+	if err != nil {
+		return
+	}
+	if s.Memes == nil {
+		ginContext.IndentedJSON(http.StatusNotFound, "meme history is not available")
+		return
+	}
+
+	before, limit, err := pageParams(ginContext, DefaultMemesLimit, MaxMemesLimit, "meme")
+	if err != nil {
+		return
+	}
+
+	memes, err := s.Memes.MemesByUser(ginContext.Param("id"), before, limit)
+	if err != nil {
+		loggers.ErrorLog.Printf("Error getting memes:\n%s", err.Error())
+		ginContext.IndentedJSON(http.StatusInternalServerError, "error getting memes")
+		return
+	}
+	page := &MemesPage{Memes: memes}
+	if len(memes) == limit {
+		page.Next = memes[len(memes)-1].ID.Hex()
+	}
+	ginContext.IndentedJSON(http.StatusOK, page)
+}
+
+// GETs the changes to a user's tokens, newest first, a page at a time. Needs to be either the
+// requesting user getting their own ledger or an admin. limit (at most MaxLedgerLimit) sets the page
+// size, and before takes the next value from the previous page
+func (s *UserService) LedgerByUser(ginContext *gin.Context) {
+	err := s.requireCallerOrAdmin(ginContext)
+	if err != nil {
+		return
+	}
+	if s.Ledger == nil {
+		ginContext.IndentedJSON(http.StatusNotFound, "ledger is not available")
+		return
+	}
+
+	before, limit, err := pageParams(ginContext, DefaultLedgerLimit, MaxLedgerLimit, "ledger entry")
+	if err != nil {
+		return
+	}
+
+	entries, err := s.Ledger.LedgerByUser(ginContext.Param("id"), before, limit)
+	if err != nil {
+		loggers.ErrorLog.Printf("Error getting ledger:\n%s", err.Error())
+		ginContext.IndentedJSON(http.StatusInternalServerError, "error getting ledger")
+		return
+	}
+	page := &LedgerPage{Entries: entries}
+	if len(entries) == limit {
+		page.Next = entries[len(entries)-1].ID.Hex()
+	}
+	ginContext.IndentedJSON(http.StatusOK, page)
+}
+
+// The before and limit query params of a paged GET, answering 400 when either is bad. before has to
+// be the id of one of the things being paged through, a what
+func pageParams(ginContext *gin.Context, defaultLimit int, maxLimit int, what string) (string, int, error) {
+	limit := defaultLimit
+	if limitValue := ginContext.Query("limit"); limitValue != "" {
+		parsed, err := strconv.Atoi(limitValue)
+		if err != nil || parsed < 1 || parsed > maxLimit {
+			ginContext.IndentedJSON(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxLimit))
+			return "", 0, fmt.Errorf("bad limit: %s", limitValue)
+		}
+		limit = parsed
+	}
+	before := ginContext.Query("before")
+	if before != "" && !primitive.IsValidObjectID(before) {
+		ginContext.IndentedJSON(http.StatusBadRequest, fmt.Sprintf("before must be a %s id", what))
+		return "", 0, fmt.Errorf("bad before: %s", before)
+	}
+	return before, limit, nil
+}
+
+// POST to set a user's tokens to what their ledger adds up to. Only an admin can do this
+func (s *UserService) RebuildBalance(ginContext *gin.Context) {
+	err := s.requireAdmin(ginContext)
+	if err != nil {
+		return
+	}
+	if s.Ledger == nil {
+		ginContext.IndentedJSON(http.StatusNotFound, "ledger is not available")
+		return
+	}
+
+	user, err := s.Ledger.RebuildBalance(ginContext.Param("id"))
+	if err != nil {
+		switch err.(type) {
+		default:
+			loggers.ErrorLog.Printf("Error rebuilding balance:\n%s", err.Error())
+			ginContext.IndentedJSON(http.StatusInternalServerError, "error rebuilding balance")
+		case *error_types.UserNotFoundError:
+			ginContext.IndentedJSON(http.StatusNotFound, "Unable to find that user")
+		case *error_types.BalanceChangedError:
+			ginContext.IndentedJSON(http.StatusConflict, "The balance changed while it was being rebuilt, try again")
+		case *error_types.LedgerIncompleteError:
+			ginContext.IndentedJSON(http.StatusConflict, "The ledger is missing entries, so the balance can't be rebuilt from it")
+		}
+		return
+	}
+	ginContext.IndentedJSON(http.StatusOK, user)
+}
+
 // GETs all users, requires requesting user to be admin
 func (s *UserService) AllUsers(ginContext *gin.Context) {
 	err := s.requireAdmin(ginContext)
@@ -129,7 +304,8 @@ func (s *UserService) NewUser(ginContext *gin.Context) {
 		return
 	}
 
-	result, err := s.Repo.NewUser(*user)
+	change := s.balanceChange(ginContext, "opening balance")
+	result, err := s.Repo.NewUser(*user, change)
 	if err != nil {
 		loggers.ErrorLog.Printf("Error encountered creating user: %s", err)
 		ginContext.IndentedJSON(http.StatusBadRequest, "Encountered error creating new user")
@@ -148,7 +324,7 @@ func (s *UserService) UpdateUser(ginContext *gin.Context) {
 	}
 
 	// Confirming user exists, feels like this could be combined with the update
-	_, err = s.Repo.User(id)
+	existingUser, err := s.Repo.User(id)
 	if err != nil {
 		loggers.ErrorLog.Printf("Encountered error getting user: %s%v", id, err)
 		ginContext.IndentedJSON(http.StatusNotFound, "Unable to find that user")
@@ -160,15 +336,45 @@ func (s *UserService) UpdateUser(ginContext *gin.Context) {
 	if err != nil {
 		return
 	}
+	// Leaving the plan or safe mode out of the form leaves them as they were
+	if _, ok := ginContext.GetPostForm("plan"); !ok {
+		newUser.Plan = existingUser.Plan
+		newUser.PlanExpiresAt = existingUser.PlanExpiresAt
+	}
+	if _, ok := ginContext.GetPostForm("safe_mode"); !ok {
+		newUser.SafeMode = existingUser.SafeMode
+	}
 
 	err = s.Repo.UpdateUser(id, newUser)
 	if err != nil {
 		ginContext.IndentedJSON(http.StatusInternalServerError, "There was an error, please try again later")
 		return
 	}
+	// Changing the balance goes in the ledger as an adjustment by this admin, with the optional reason
+	if newUser.TokensRemaining != existingUser.TokensRemaining {
+		reason := ginContext.PostForm("reason")
+		if reason == "" {
+			reason = "set by admin"
+		}
+		_, err = s.Repo.SetTokens(id, newUser.TokensRemaining, s.balanceChange(ginContext, reason))
+		if err != nil {
+			loggers.ErrorLog.Printf("Encountered error setting tokens for user: %s%v", id, err)
+			ginContext.IndentedJSON(http.StatusInternalServerError, "There was an error, please try again later")
+			return
+		}
+	}
 	ginContext.IndentedJSON(http.StatusOK, "successfully updated user")
 }
 
+// Who's making a change to a user's balance, for the ledger
+func (s *UserService) balanceChange(ginContext *gin.Context, reason string) models.BalanceChange {
+	change := models.BalanceChange{Reason: reason, RequestId: request_ids.Of(ginContext)}
+	if caller, err := s.Auth.Repo.UserByAuthHeader(ginContext.Request.Header.Get("auth")); err == nil {
+		change.Actor = caller.ID.Hex()
+	}
+	return change
+}
+
 // Auth related helpers
 func (s *UserService) userFromGinContext(ginContext *gin.Context) (*models.User, error) {
 	tokens, err := strconv.Atoi(ginContext.PostForm("tokens_remaining"))
@@ -184,15 +390,58 @@ func (s *UserService) userFromGinContext(ginContext *gin.Context) (*models.User,
 		return nil, err
 	}
 
+	plan, expiresAt, err := planFromGinContext(ginContext)
+	if err != nil {
+		return nil, err
+	}
+	safeMode := false
+	if safeModeValue := ginContext.PostForm("safe_mode"); safeModeValue != "" {
+		safeMode, err = strconv.ParseBool(safeModeValue)
+		if err != nil {
+			loggers.ErrorLog.Printf("Error encountered creating user: %s", err)
+			ginContext.IndentedJSON(http.StatusBadRequest, "safe_mode must be a bool")
+			return nil, err
+		}
+	}
+
 	user := &models.User{
 		UserId:          ginContext.PostForm("user_id"),
 		TokensRemaining: tokens,
 		AuthKey:         ginContext.PostForm("auth_key"),
 		IsAdmin:         isAdmin,
+		Plan:            plan,
+		PlanExpiresAt:   expiresAt,
+		SafeMode:        safeMode,
 	}
 	return user, nil
 }
 
+// Reads the optional plan and plan_expires_at fields. No plan means free, no expiry means never
+func planFromGinContext(ginContext *gin.Context) (models.Plan, *time.Time, error) {
+	var plan models.Plan
+	if planName := ginContext.PostForm("plan"); planName != "" {
+		parsed, err := models.ParsePlan(planName)
+		if err != nil {
+			loggers.ErrorLog.Printf("Error encountered creating user: %s", err)
+			ginContext.IndentedJSON(http.StatusBadRequest, "plan must be free, standard or ai-premium")
+			return "", nil, err
+		}
+		plan = parsed
+	}
+	expiresValue := ginContext.PostForm("plan_expires_at")
+	if expiresValue == "" {
+		return plan, nil, nil
+	}
+	expiresAt, err := time.Parse(time.RFC3339, expiresValue)
+	if err != nil {
+		loggers.ErrorLog.Printf("Error encountered creating user: %s", err)
+		ginContext.IndentedJSON(http.StatusBadRequest, "plan_expires_at must be an RFC 3339 time")
+		return "", nil, err
+	}
+	expiresAt = expiresAt.UTC()
+	return plan, &expiresAt, nil
+}
+
 func (s *UserService) ensureAuthKeyIsNew(user models.User, ginContext *gin.Context) error {
 	userResult, err := s.Auth.Repo.UserByAuthHeader(user.AuthKey)
 	if err != nil {
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	error_types "maas/error-types"
 	"maas/models"
@@ -102,12 +103,32 @@ func (m *MockUserRepository) UserByAuthHeader(auth string) (*models.User, error)
 	}
 }
 
-func (m *MockUserRepository) NewUser(user models.User) (interface{}, error) {
+func (m *MockUserRepository) NewUser(user models.User, change models.BalanceChange) (interface{}, error) {
 	return "1", nil
 }
 
 func (m *MockUserRepository) UpdateUser(id string, user *models.User) error { return nil }
 
+func (m *MockUserRepository) CreditTokens(id string, amount int, idempotencyKey string, change models.BalanceChange) (*models.User, error) {
+	user, err := m.User(id)
+	if err != nil {
+		return nil, &error_types.UserNotFoundError{}
+	}
+	credited := *user
+	credited.TokensRemaining += amount
+	return &credited, nil
+}
+
+func (m *MockUserRepository) SetTokens(id string, tokens int, change models.BalanceChange) (*models.User, error) {
+	user, err := m.User(id)
+	if err != nil {
+		return nil, err
+	}
+	updated := *user
+	updated.TokensRemaining = tokens
+	return &updated, nil
+}
+
 // AllErrorsMockUserRepository: Always returns an error
 type AllErrorsMockUserRepository struct {
 	err error
@@ -129,12 +150,20 @@ func (m *AllErrorsMockUserRepository) AllUsers() ([]models.User, error) {
 func (m *AllErrorsMockUserRepository) User(id string) (*models.User, error) {
 	return nil, errors.New("test")
 }
-func (m *AllErrorsMockUserRepository) NewUser(user models.User) (interface{}, error) {
+func (m *AllErrorsMockUserRepository) NewUser(user models.User, change models.BalanceChange) (interface{}, error) {
 	panic("Working on it")
 }
 
 func (m *AllErrorsMockUserRepository) UpdateUser(id string, user *models.User) error { return m.err }
 
+func (m *AllErrorsMockUserRepository) CreditTokens(id string, amount int, idempotencyKey string, change models.BalanceChange) (*models.User, error) {
+	return nil, m.err
+}
+
+func (m *AllErrorsMockUserRepository) SetTokens(id string, tokens int, change models.BalanceChange) (*models.User, error) {
+	return nil, m.err
+}
+
 // Test utility functions
 func TestMain(m *testing.M) {
 	loggers.SilentInit()
@@ -529,3 +558,304 @@ func TestUpdateUser_WhenUserIdNotInDB_RaisesNotFound(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, recorder.Code)
 	assert.Equal(t, expectedBody, recorder.Body.String())
 }
+
+// Has two memes for every user, and remembers the paging it was asked for
+type MockMemeHistory struct {
+	err    error
+	memes  []models.MemeRecord
+	before string
+	limit  int
+}
+
+func (m *MockMemeHistory) MemesByUser(userId string, before string, limit int) ([]models.MemeRecord, error) {
+	m.before = before
+	m.limit = limit
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.memes = []models.MemeRecord{
+		{ID: primitive.NewObjectID(), UserId: userId, Provider: "meme_maker", Cost: 1},
+		{ID: primitive.NewObjectID(), UserId: userId, Provider: "meme_maker", Cost: 1},
+	}
+	if len(m.memes) > limit {
+		m.memes = m.memes[:limit]
+	}
+	return m.memes, nil
+}
+
+func memesRouter(service *UserService) *gin.Engine {
+	router := testRouter(*service)
+	router.GET("/users/:id/memes", service.MemesByUser)
+	return router
+}
+
+func TestMemesByUser_WhenAUserAsksForThemselves_ReturnsTheirMemes(t *testing.T) {
+	history := &MockMemeHistory{}
+	service := NewUserService(&MockUserRepository{}, authService).WithMemeHistory(history)
+	recorder := performRequest(memesRouter(service), "GET", fmt.Sprintf("/users/%s/memes", defaultIDString), "DEFAULT")
+
+	var response MemesPage
+	err := json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, 2, len(response.Memes))
+	assert.Equal(t, defaultIDString, response.Memes[0].UserId)
+	assert.Empty(t, response.Next)
+	assert.Equal(t, DefaultMemesLimit, history.limit)
+	assert.Empty(t, history.before)
+}
+
+func TestMemesByUser_WhenThereAreMorePages_SaysWhereTheNextStarts(t *testing.T) {
+	history := &MockMemeHistory{}
+	service := NewUserService(&MockUserRepository{}, authService).WithMemeHistory(history)
+	before := primitive.NewObjectID().Hex()
+	path := fmt.Sprintf("/users/%s/memes?limit=1&before=%s", defaultIDString, before)
+	recorder := performRequest(memesRouter(service), "GET", path, "ADMIN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response MemesPage
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Len(t, response.Memes, 1)
+	assert.Equal(t, history.memes[0].ID.Hex(), response.Next)
+	assert.Equal(t, before, history.before)
+	assert.Equal(t, 1, history.limit)
+}
+
+func TestMemesByUser_WithBadPaging_RaisesBadRequest(t *testing.T) {
+	service := NewUserService(&MockUserRepository{}, authService).WithMemeHistory(&MockMemeHistory{})
+	for _, query := range []string{"limit=0", "limit=lots", fmt.Sprintf("limit=%d", MaxMemesLimit+1), "before=yesterday"} {
+		path := fmt.Sprintf("/users/%s/memes?%s", defaultIDString, query)
+		recorder := performRequest(memesRouter(service), "GET", path, "DEFAULT")
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, query)
+	}
+}
+
+func TestMemesByUser_WhenAdminAsksForAUser_ReturnsTheirMemes(t *testing.T) {
+	service := NewUserService(&MockUserRepository{}, authService).WithMemeHistory(&MockMemeHistory{})
+	recorder := performRequest(memesRouter(service), "GET", fmt.Sprintf("/users/%s/memes", otherIDString), "ADMIN")
+
+	var response MemesPage
+	err := json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, otherIDString, response.Memes[0].UserId)
+}
+
+func TestMemesByUser_WhenAUserAsksForAnotherUser_RaisesForbidden(t *testing.T) {
+	service := NewUserService(&MockUserRepository{}, authService).WithMemeHistory(&MockMemeHistory{})
+	recorder := performRequest(memesRouter(service), "GET", fmt.Sprintf("/users/%s/memes", otherIDString), "DEFAULT")
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, "\"forbidden\"", recorder.Body.String())
+}
+
+func TestMemesByUser_WhenAuthHeaderIsNotGiven_RaisesUnauthorized(t *testing.T) {
+	service := NewUserService(&MockUserRepository{}, authService).WithMemeHistory(&MockMemeHistory{})
+	recorder := performRequest(memesRouter(service), "GET", fmt.Sprintf("/users/%s/memes", defaultIDString), "")
+
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestMemesByUser_WhenHistoryErrors_RaisesInternalServerError(t *testing.T) {
+	service := NewUserService(&MockUserRepository{}, authService).WithMemeHistory(&MockMemeHistory{err: errors.New("test")})
+	recorder := performRequest(memesRouter(service), "GET", fmt.Sprintf("/users/%s/memes", defaultIDString), "ADMIN")
+
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Equal(t, "\"error getting memes\"", recorder.Body.String())
+}
+
+func TestMemesByUser_WithoutHistory_RaisesNotFound(t *testing.T) {
+	service := NewUserService(&MockUserRepository{}, authService)
+	recorder := performRequest(memesRouter(service), "GET", fmt.Sprintf("/users/%s/memes", defaultIDString), "ADMIN")
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+// Remembers the users it was asked to create or update, and the balance changes. Users in users are
+// returned ahead of the mock's own
+type RecordingUserRepository struct {
+	MockUserRepository
+	users   map[string]*models.User
+	created *models.User
+	updated *models.User
+	tokens  *int
+	changes []models.BalanceChange
+}
+
+func (m *RecordingUserRepository) User(id string) (*models.User, error) {
+	if user, ok := m.users[id]; ok {
+		return user, nil
+	}
+	return m.MockUserRepository.User(id)
+}
+
+func (m *RecordingUserRepository) NewUser(user models.User, change models.BalanceChange) (interface{}, error) {
+	m.created = &user
+	m.changes = append(m.changes, change)
+	return "1", nil
+}
+
+func (m *RecordingUserRepository) SetTokens(id string, tokens int, change models.BalanceChange) (*models.User, error) {
+	m.tokens = &tokens
+	m.changes = append(m.changes, change)
+	return m.MockUserRepository.SetTokens(id, tokens, change)
+}
+
+func (m *RecordingUserRepository) UpdateUser(id string, user *models.User) error {
+	m.updated = user
+	return nil
+}
+
+func TestAddUser_WhenAdminGivesAPlan_CreatesUserOnThatPlan(t *testing.T) {
+	newUser := map[string]string{
+		"user_id":          "test_user_id",
+		"auth_key":         "AVAILABLE",
+		"is_admin":         "false",
+		"tokens_remaining": "10",
+		"plan":             "ai-premium",
+		"plan_expires_at":  "2030-01-02T03:04:05Z",
+	}
+	repo := &RecordingUserRepository{}
+	service := NewUserService(repo, authService)
+	recorder := performRequestWithForm(testRouter(*service), "POST", "/users", "ADMIN", newUser)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, models.PlanAIPremium, repo.created.Plan)
+	assert.Equal(t, "2030-01-02T03:04:05Z", repo.created.PlanExpiresAt.Format(time.RFC3339))
+}
+
+func TestAddUser_WhenPlanIsUnknown_RaisesBadRequest(t *testing.T) {
+	newUser := map[string]string{
+		"user_id":          "test_user_id",
+		"auth_key":         "AVAILABLE",
+		"is_admin":         "false",
+		"tokens_remaining": "10",
+		"plan":             "platinum",
+	}
+	repo := &RecordingUserRepository{}
+	service := NewUserService(repo, authService)
+	recorder := performRequestWithForm(testRouter(*service), "POST", "/users", "ADMIN", newUser)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "\"plan must be free, standard or ai-premium\"", recorder.Body.String())
+	assert.Nil(t, repo.created)
+}
+
+func TestUpdateUser_WhenPlanExpiryIsNotATime_RaisesBadRequest(t *testing.T) {
+	newUser := map[string]string{
+		"user_id":          "test_user_id",
+		"auth_key":         "DEFAULT",
+		"is_admin":         "false",
+		"tokens_remaining": "10",
+		"plan":             "standard",
+		"plan_expires_at":  "next tuesday",
+	}
+	repo := &RecordingUserRepository{}
+	service := NewUserService(repo, authService)
+	recorder := performRequestWithForm(testRouter(*service), "PATCH", fmt.Sprintf("/users/%s", defaultIDString), "ADMIN", newUser)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "\"plan_expires_at must be an RFC 3339 time\"", recorder.Body.String())
+	assert.Nil(t, repo.updated)
+}
+
+func TestUpdateUser_WhenPlanIsLeftOut_KeepsTheExistingPlan(t *testing.T) {
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	planUser := *otherUser
+	planUser.Plan, planUser.PlanExpiresAt = models.PlanStandard, &expires
+	repo := &RecordingUserRepository{}
+	repo.users = map[string]*models.User{otherIDString: &planUser}
+	newUser := map[string]string{
+		"user_id":          "test_user_id",
+		"auth_key":         "DEFAULT",
+		"is_admin":         "false",
+		"tokens_remaining": "10",
+	}
+	service := NewUserService(repo, authService)
+	recorder := performRequestWithForm(testRouter(*service), "PATCH", fmt.Sprintf("/users/%s", otherIDString), "ADMIN", newUser)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, models.PlanStandard, repo.updated.Plan)
+	assert.Equal(t, &expires, repo.updated.PlanExpiresAt)
+}
+
+func TestUpdateUser_WhenPlanIsGiven_ReplacesThePlan(t *testing.T) {
+	newUser := map[string]string{
+		"user_id":          "test_user_id",
+		"auth_key":         "DEFAULT",
+		"is_admin":         "false",
+		"tokens_remaining": "10",
+		"plan":             "ai-premium",
+	}
+	repo := &RecordingUserRepository{}
+	service := NewUserService(repo, authService)
+	recorder := performRequestWithForm(testRouter(*service), "PATCH", fmt.Sprintf("/users/%s", defaultIDString), "ADMIN", newUser)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, models.PlanAIPremium, repo.updated.Plan)
+	assert.Nil(t, repo.updated.PlanExpiresAt)
+}
+
+func TestUserByID_WhenUserIsOnAPlan_ReturnsThePlan(t *testing.T) {
+	planUser := *otherUser
+	planUser.Plan = models.PlanAIPremium
+	repo := &RecordingUserRepository{}
+	repo.users = map[string]*models.User{otherIDString: &planUser}
+	service := NewUserService(repo, authService)
+	recorder := performRequest(testRouter(*service), "GET", fmt.Sprintf("/users/%s", otherIDString), "ADMIN")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"Plan": "ai-premium"`)
+}
+
+func TestAddUser_WhenSafeModeIsGiven_CreatesUserInSafeMode(t *testing.T) {
+	newUser := map[string]string{
+		"user_id":          "test_user_id",
+		"auth_key":         "AVAILABLE",
+		"is_admin":         "false",
+		"tokens_remaining": "10",
+		"safe_mode":        "true",
+	}
+	repo := &RecordingUserRepository{}
+	service := NewUserService(repo, authService)
+	recorder := performRequestWithForm(testRouter(*service), "POST", "/users", "ADMIN", newUser)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, repo.created.SafeMode)
+}
+
+func TestAddUser_WhenSafeModeIsNotABool_RaisesBadRequest(t *testing.T) {
+	newUser := map[string]string{
+		"user_id":          "test_user_id",
+		"auth_key":         "AVAILABLE",
+		"is_admin":         "false",
+		"tokens_remaining": "10",
+		"safe_mode":        "sometimes",
+	}
+	repo := &RecordingUserRepository{}
+	service := NewUserService(repo, authService)
+	recorder := performRequestWithForm(testRouter(*service), "POST", "/users", "ADMIN", newUser)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "\"safe_mode must be a bool\"", recorder.Body.String())
+}
+
+func TestUpdateUser_WhenSafeModeIsLeftOut_KeepsTheExistingSetting(t *testing.T) {
+	safeUser := *otherUser
+	safeUser.SafeMode = true
+	repo := &RecordingUserRepository{}
+	repo.users = map[string]*models.User{otherIDString: &safeUser}
+	newUser := map[string]string{
+		"user_id":          "test_user_id",
+		"auth_key":         "DEFAULT",
+		"is_admin":         "false",
+		"tokens_remaining": "10",
+	}
+	service := NewUserService(repo, authService)
+	recorder := performRequestWithForm(testRouter(*service), "PATCH", fmt.Sprintf("/users/%s", otherIDString), "ADMIN", newUser)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, repo.updated.SafeMode)
+}